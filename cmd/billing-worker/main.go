@@ -9,6 +9,8 @@ import (
 	"tranche/internal/billing"
 	"tranche/internal/config"
 	"tranche/internal/db"
+	"tranche/internal/export"
+	"tranche/internal/export/stripe"
 	"tranche/internal/logging"
 	"tranche/internal/observability"
 )
@@ -30,11 +32,29 @@ func main() {
 		return db.Ready(c, sqlDB)
 	})
 
-	engine := billing.NewEngine(queries, logger, metrics, billing.Config{
-		Period:         cfg.BillingPeriod,
-		RateCentsPerGB: cfg.BillingRateCentsPerGB,
-		DiscountRate:   cfg.BillingDiscountRate,
-	})
+	billingCfg, err := billing.ConfigFrom(cfg)
+	if err != nil {
+		logger.Fatalf("configuring billing: %v", err)
+	}
+	engine := billing.NewEngine(queries, logger, metrics, billingCfg)
+
+	var syncer *export.Syncer
+	switch cfg.Export.Processor {
+	case "":
+	case "stripe":
+		if cfg.Export.StripeAPIKey == "" {
+			logger.Fatalf("EXPORT_PROCESSOR=stripe requires STRIPE_API_KEY")
+		}
+		exporter := stripe.NewClient(cfg.Export.StripeAPIKey, stripe.WithEndpoint(cfg.Export.StripeEndpoint))
+		syncer = export.NewSyncer(queries, exporter, logger, export.Config{
+			BatchSize:   int(cfg.Export.BatchSize),
+			MaxAttempts: int(cfg.Export.MaxAttempts),
+			RetryBase:   cfg.Export.RetryBase,
+			RetryMax:    cfg.Export.RetryMax,
+		})
+	default:
+		logger.Fatalf("unknown EXPORT_PROCESSOR %q", cfg.Export.Processor)
+	}
 
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
@@ -49,6 +69,11 @@ func main() {
 				metrics.RecordBillingRun(time.Since(start), 0, err)
 				logger.Error("billing run error", "error", err)
 			}
+			if syncer != nil {
+				if err := syncer.RunOnce(ctx, time.Now()); err != nil {
+					logger.Error("invoice export error", "error", err)
+				}
+			}
 		}
 	}
 }
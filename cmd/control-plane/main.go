@@ -8,11 +8,14 @@ import (
 	"syscall"
 	"time"
 
+	"tranche/internal/billing"
 	"tranche/internal/config"
 	"tranche/internal/db"
 	"tranche/internal/httpapi"
+	"tranche/internal/invoicerender"
 	"tranche/internal/logging"
 	"tranche/internal/observability"
+	"tranche/internal/usagehealth"
 )
 
 func main() {
@@ -33,7 +36,18 @@ func main() {
 		return db.Ready(c, sqlDB)
 	})
 
-	api := httpapi.NewServer(logger, sqlDB, queries, cfg.ControlPlaneAdminToken)
+	usage := usagehealth.NewChecker(queries, cfg.UsageWindow, cfg.UsageHealth)
+	docs, err := invoicerender.New(cfg.Invoice)
+	if err != nil {
+		logger.Fatalf("configuring invoice rendering: %v", err)
+	}
+	billingCfg, err := billing.ConfigFrom(cfg)
+	if err != nil {
+		logger.Fatalf("configuring billing: %v", err)
+	}
+	api := httpapi.NewServer(logger, sqlDB, queries, cfg.ControlPlaneAdminToken, usage).
+		WithInvoiceRenderer(docs).
+		WithBilling(billing.NewEngine(queries, logger, nil, billingCfg))
 
 	srv := &http.Server{
 		Addr:              cfg.HTTPAddr,
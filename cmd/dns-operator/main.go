@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
@@ -11,6 +13,7 @@ import (
 	"tranche/internal/db"
 	"tranche/internal/dns"
 	"tranche/internal/logging"
+	"tranche/internal/monitor"
 	"tranche/internal/observability"
 	"tranche/internal/routing"
 )
@@ -21,31 +24,22 @@ func main() {
 	cfg := config.Load()
 	logger := logging.New("dns-operator")
 
+	flags := flag.NewFlagSet("dns-operator", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", cfg.DNSDryRun, "compute and log DNS changes without applying them (env DNS_DRY_RUN)")
+	_ = flags.Parse(os.Args[1:])
+
+	if flags.Arg(0) == "plan" {
+		code := runPlan(ctx, cfg, logger, flags.Args()[1:])
+		cancel()
+		os.Exit(code)
+	}
+
 	sqlDB, queries, err := db.Open(ctx, cfg.PGDSN)
 	if err != nil {
 		logger.Fatalf("opening db: %v", err)
 	}
 
-	planner := routing.NewPlanner(queries)
-	var (
-		dnsProv      dns.Provider = dns.NewNoopProvider(logger)
-		providerInit bool
-	)
-	if cfg.AWSRegion != "" {
-		awsCfg := dns.Route53ProviderConfig{
-			Region:          cfg.AWSRegion,
-			AccessKeyID:     cfg.AWSAccessKey,
-			SecretAccessKey: cfg.AWSSecretKey,
-			SessionToken:    cfg.AWSSession,
-		}
-		prov, err := dns.NewRoute53Provider(ctx, logger, awsCfg)
-		if err != nil {
-			logger.Printf("failed to init Route53 provider, falling back to noop: %v", err)
-		} else {
-			dnsProv = prov
-			providerInit = true
-		}
-	}
+	dnsProv, providerInit := newDNSProvider(ctx, cfg, logger)
 
 	metrics := observability.NewMetrics("dns_operator")
 	readyCheck := func(c context.Context) error {
@@ -60,46 +54,21 @@ func main() {
 
 	observability.Start(ctx, cfg.MetricsAddr, logger, metrics.Registry, readyCheck)
 
-	reconcile := func() {
-		servicesCtx, servicesCancel := context.WithTimeout(ctx, 5*time.Second)
-		services, err := queries.GetActiveServices(servicesCtx)
-		servicesCancel()
-		if err != nil {
-			logger.Printf("GetActiveServices: %v", err)
-			return
-		}
-		for _, s := range services {
-			weightsCtx, weightsCancel := context.WithTimeout(ctx, 5*time.Second)
-			weights, err := planner.DesiredRouting(weightsCtx, s.ID)
-			weightsCancel()
-			if err != nil {
-				logger.Printf("DesiredRouting(service=%d): %v", s.ID, err)
-				continue
-			}
-			domainsCtx, domainsCancel := context.WithTimeout(ctx, 5*time.Second)
-			domains, err := queries.GetServiceDomains(domainsCtx, s.ID)
-			domainsCancel()
-			if err != nil {
-				logger.Printf("GetServiceDomains(service=%d): %v", s.ID, err)
-				continue
-			}
-			for _, dom := range domains {
-				setWeightsCtx, setWeightsCancel := context.WithTimeout(ctx, 5*time.Second)
-				if err := dnsProv.SetWeights(setWeightsCtx, dom.Name, weights.Primary, weights.Backup); err != nil {
-					metrics.RecordDNSChange(dom.Name, "route53", err)
-					logger.Error("route53 weight update failed", "domain", dom.Name, "error", err)
-				} else {
-					metrics.RecordDNSChange(dom.Name, "route53", nil)
-					logger.Info("route53 weights updated", "domain", dom.Name, "primary_weight", weights.Primary, "backup_weight", weights.Backup)
-				}
-				setWeightsCancel()
-			}
-		}
+	op := &operator{
+		queries: queries,
+		planner: newPlanner(queries),
+		dns:     dnsProv,
+		metrics: metrics,
+		log:     logger,
+		dryRun:  *dryRun,
+	}
+	if op.dryRun {
+		logger.Println("dry-run enabled: DNS changes will be logged but not applied")
 	}
 
 	ticker := time.NewTicker(15 * time.Second)
 
-	reconcile()
+	op.reconcile(ctx)
 
 	for {
 		select {
@@ -109,40 +78,33 @@ func main() {
 			_ = sqlDB.Close()
 			return
 		case <-ticker.C:
-			servicesCtx, servicesCancel := context.WithTimeout(ctx, 5*time.Second)
-			services, err := queries.GetActiveServices(servicesCtx)
-			servicesCancel()
-			if err != nil {
-				logger.Printf("GetActiveServices: %v", err)
-				continue
-			}
-			for _, s := range services {
-				weightsCtx, weightsCancel := context.WithTimeout(ctx, 5*time.Second)
-				weights, err := planner.DesiredRouting(weightsCtx, s.ID)
-				weightsCancel()
-				if err != nil {
-					logger.Printf("DesiredRouting(service=%d): %v", s.ID, err)
-					continue
-				}
-				domainsCtx, domainsCancel := context.WithTimeout(ctx, 5*time.Second)
-				domains, err := queries.GetServiceDomains(domainsCtx, s.ID)
-				domainsCancel()
-				if err != nil {
-					logger.Printf("GetServiceDomains(service=%d): %v", s.ID, err)
-					continue
-				}
-				for _, dom := range domains {
-					setWeightsCtx, setWeightsCancel := context.WithTimeout(ctx, 5*time.Second)
-					if err := dnsProv.SetWeights(setWeightsCtx, dom.Name, weights.Primary, weights.Backup); err != nil {
-						metrics.RecordDNSChange(dom.Name, "route53", err)
-						logger.Error("route53 weight update failed", "domain", dom.Name, "error", err)
-					} else {
-						metrics.RecordDNSChange(dom.Name, "route53", nil)
-						logger.Info("route53 weights updated", "domain", dom.Name, "primary_weight", weights.Primary, "backup_weight", weights.Backup)
-					}
-					setWeightsCancel()
-				}
-			}
+			op.reconcile(ctx)
 		}
 	}
 }
+
+// newDNSProvider returns the Route53 provider when AWS is configured and the noop logger otherwise.
+// The boolean reports whether the Route53 provider initialized successfully.
+func newDNSProvider(ctx context.Context, cfg config.Config, logger *logging.Logger) (dns.Provider, bool) {
+	if cfg.AWSRegion == "" {
+		return dns.NewNoopProvider(logger), false
+	}
+	awsCfg := dns.Route53ProviderConfig{
+		Region:          cfg.AWSRegion,
+		AccessKeyID:     cfg.AWSAccessKey,
+		SecretAccessKey: cfg.AWSSecretKey,
+		SessionToken:    cfg.AWSSession,
+	}
+	prov, err := dns.NewRoute53Provider(ctx, logger, awsCfg)
+	if err != nil {
+		logger.Printf("failed to init Route53 provider, falling back to noop: %v", err)
+		return dns.NewNoopProvider(logger), false
+	}
+	return prov, true
+}
+
+// newPlanner wires probe availability into the routing planner so TTLs can be lowered
+// before a storm is declared. Services without recent probe samples count as healthy.
+func newPlanner(queries *db.Queries) *routing.Planner {
+	return routing.NewPlanner(queries).WithMetrics(monitor.NewPostgresMetricsWithDefault(queries, 1))
+}
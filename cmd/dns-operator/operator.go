@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/dns"
+	"tranche/internal/logging"
+	"tranche/internal/observability"
+	"tranche/internal/routing"
+)
+
+type operator struct {
+	queries *db.Queries
+	planner *routing.Planner
+	dns     dns.Provider
+	metrics *observability.Metrics
+	log     *logging.Logger
+	dryRun  bool
+}
+
+type desiredRecord struct {
+	serviceID int64
+	domain    string
+	strategy  string
+	phase     routing.Phase
+	state     dns.RecordState
+}
+
+// desiredRecords computes the target weights and TTL for every domain of every active service.
+// Failures scoped to a single service are returned alongside the records that could be computed.
+func (o *operator) desiredRecords(ctx context.Context) ([]desiredRecord, []error, error) {
+	servicesCtx, servicesCancel := context.WithTimeout(ctx, 5*time.Second)
+	services, err := o.queries.GetActiveServices(servicesCtx)
+	servicesCancel()
+	if err != nil {
+		return nil, nil, fmt.Errorf("GetActiveServices: %w", err)
+	}
+
+	var (
+		records []desiredRecord
+		errs    []error
+	)
+	for _, s := range services {
+		weightsCtx, weightsCancel := context.WithTimeout(ctx, 5*time.Second)
+		decision, err := o.planner.Decide(weightsCtx, s.ID)
+		weightsCancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Decide(service=%d): %w", s.ID, err))
+			continue
+		}
+		domainsCtx, domainsCancel := context.WithTimeout(ctx, 5*time.Second)
+		domains, err := o.queries.GetServiceDomains(domainsCtx, s.ID)
+		domainsCancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("GetServiceDomains(service=%d): %w", s.ID, err))
+			continue
+		}
+		for _, dom := range domains {
+			rec := desiredRecord{
+				serviceID: s.ID,
+				domain:    dom.Name,
+				strategy:  dom.RoutingStrategy,
+				phase:     decision.Phase,
+				state:     dns.RecordState{TTL: decision.TTL},
+			}
+			if rec.strategy == dns.StrategyFailover {
+				rec.state.Failover = &dns.FailoverState{PrimaryHealthy: decision.Weights.Primary > 0}
+			} else {
+				rec.state.PrimaryWeight = decision.Weights.Primary
+				rec.state.BackupWeight = decision.Weights.Backup
+			}
+			records = append(records, rec)
+		}
+	}
+	return records, errs, nil
+}
+
+func (o *operator) reconcile(ctx context.Context) {
+	records, errs, err := o.desiredRecords(ctx)
+	if err != nil {
+		o.log.Printf("%v", err)
+		return
+	}
+	for _, err := range errs {
+		o.log.Printf("%v", err)
+	}
+	var weighted []desiredRecord
+	for _, rec := range records {
+		if o.dryRun {
+			o.reportDryRun(ctx, rec)
+			continue
+		}
+		if rec.strategy == dns.StrategyFailover {
+			o.applyFailover(ctx, rec)
+			continue
+		}
+		weighted = append(weighted, rec)
+	}
+	o.applyWeights(ctx, weighted)
+}
+
+// applyWeights submits every weighted change in one batch so the provider can apply domains
+// sharing a hosted zone together.
+func (o *operator) applyWeights(ctx context.Context, records []desiredRecord) {
+	if len(records) == 0 {
+		return
+	}
+	changes := make([]dns.WeightChange, 0, len(records))
+	for _, rec := range records {
+		changes = append(changes, dns.WeightChange{
+			Domain:        rec.domain,
+			PrimaryWeight: rec.state.PrimaryWeight,
+			BackupWeight:  rec.state.BackupWeight,
+			TTL:           rec.state.TTL,
+		})
+	}
+	batchCtx, batchCancel := context.WithTimeout(ctx, 30*time.Second)
+	batchErr := o.dns.SetWeightsBatch(batchCtx, changes)
+	batchCancel()
+	for _, rec := range records {
+		if err := dns.DomainError(batchErr, rec.domain); err != nil {
+			o.metrics.RecordDNSChange(rec.domain, "route53", err)
+			o.log.Error("route53 weight update failed", "domain", rec.domain, "error", err)
+			continue
+		}
+		o.metrics.RecordDNSChange(rec.domain, "route53", nil)
+		o.log.Info("route53 weights updated", "domain", rec.domain, "phase", rec.phase, "primary_weight", rec.state.PrimaryWeight, "backup_weight", rec.state.BackupWeight, "ttl", rec.state.TTL)
+		o.recordWeights(ctx, rec, rec.state.PrimaryWeight, rec.state.BackupWeight)
+	}
+}
+
+func (o *operator) applyFailover(ctx context.Context, rec desiredRecord) {
+	prov, ok := o.dns.(dns.FailoverProvider)
+	if !ok {
+		err := fmt.Errorf("dns provider does not support %s routing", dns.StrategyFailover)
+		o.metrics.RecordDNSChange(rec.domain, "route53", err)
+		o.log.Error("route53 failover update failed", "domain", rec.domain, "error", err)
+		return
+	}
+	failoverCtx, failoverCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer failoverCancel()
+	healthy := rec.state.Failover.PrimaryHealthy
+	if err := prov.SetFailover(failoverCtx, rec.domain, healthy, rec.state.TTL); err != nil {
+		o.metrics.RecordDNSChange(rec.domain, "route53", err)
+		o.log.Error("route53 failover update failed", "domain", rec.domain, "error", err)
+		return
+	}
+	o.metrics.RecordDNSChange(rec.domain, "route53", nil)
+	o.log.Info("route53 failover updated", "domain", rec.domain, "phase", rec.phase, "primary_healthy", healthy, "ttl", rec.state.TTL)
+	if healthy {
+		o.recordWeights(ctx, rec, 100, 0)
+	} else {
+		o.recordWeights(ctx, rec, 0, 100)
+	}
+}
+
+// recordWeights adds the weights just applied to a domain to the history storm discounts
+// are priced from. Failover domains count as all primary or all backup. The noop provider
+// moves no traffic, so nothing is recorded for it.
+func (o *operator) recordWeights(ctx context.Context, rec desiredRecord, primary, backup int) {
+	if _, noop := o.dns.(*dns.NoopProvider); noop {
+		return
+	}
+	recordCtx, recordCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer recordCancel()
+	if _, err := o.queries.InsertDNSWeightChangeIfChanged(recordCtx, db.InsertDNSWeightChangeIfChangedParams{
+		ServiceID:     rec.serviceID,
+		Domain:        rec.domain,
+		PrimaryWeight: int32(primary),
+		BackupWeight:  int32(backup),
+	}); err != nil {
+		o.log.Error("recording applied weights failed", "domain", rec.domain, "error", err)
+	}
+}
+
+// reportDryRun logs what reconcile would change for a domain without touching DNS.
+func (o *operator) reportDryRun(ctx context.Context, rec desiredRecord) {
+	if _, ok := o.dns.(dns.Reader); !ok {
+		o.log.Info("dry-run: would set records", "domain", rec.domain, "strategy", rec.strategy, "phase", rec.phase, "desired", rec.state)
+		return
+	}
+	diff := o.diff(ctx, rec)
+	switch {
+	case diff.Error != "":
+		o.log.Error("dry-run: reading live records failed", "domain", rec.domain, "error", diff.Error)
+	case diff.Changed():
+		o.log.Info("dry-run: would update records", "domain", rec.domain, "strategy", rec.strategy, "phase", rec.phase,
+			"current", diff.Current, "desired", rec.state)
+	default:
+		o.log.Debug("dry-run: weights already in desired state", "domain", rec.domain)
+	}
+}
+
+// plan diffs the desired state of every domain against the live records.
+func (o *operator) plan(ctx context.Context) (dns.Plan, []error, error) {
+	records, errs, err := o.desiredRecords(ctx)
+	if err != nil {
+		return dns.Plan{}, nil, err
+	}
+	plan := dns.Plan{Diffs: make([]dns.RecordDiff, 0, len(records))}
+	for _, rec := range records {
+		plan.Diffs = append(plan.Diffs, o.diff(ctx, rec))
+	}
+	return plan, errs, nil
+}
+
+// diff reads the live state of a domain through the provider's reader for its strategy.
+func (o *operator) diff(ctx context.Context, rec desiredRecord) dns.RecordDiff {
+	diff := dns.RecordDiff{ServiceID: rec.serviceID, Domain: rec.domain, Desired: rec.state}
+	readCtx, readCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer readCancel()
+	var (
+		current dns.RecordState
+		err     error
+	)
+	if rec.strategy == dns.StrategyFailover {
+		reader, ok := o.dns.(dns.FailoverReader)
+		if !ok {
+			diff.Error = fmt.Sprintf("dns provider cannot read %s records", dns.StrategyFailover)
+			return diff
+		}
+		current, err = reader.CurrentFailover(readCtx, rec.domain)
+	} else {
+		reader, ok := o.dns.(dns.Reader)
+		if !ok {
+			diff.Error = "dns provider cannot read weighted records"
+			return diff
+		}
+		current, err = reader.CurrentWeights(readCtx, rec.domain)
+	}
+	if err != nil {
+		diff.Error = err.Error()
+		return diff
+	}
+	diff.Current = &current
+	return diff
+}
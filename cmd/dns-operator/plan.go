@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"tranche/internal/config"
+	"tranche/internal/db"
+	"tranche/internal/dns"
+	"tranche/internal/logging"
+)
+
+// Exit codes for the plan subcommand, modelled on `terraform plan -detailed-exitcode`.
+const (
+	planExitClean = 0
+	planExitError = 1
+	planExitDrift = 2
+)
+
+// runPlan computes the desired DNS state once, diffs it against the live records and
+// prints the result without calling ChangeResourceRecordSets.
+func runPlan(ctx context.Context, cfg config.Config, logger *logging.Logger, args []string) int {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	format := flags.String("format", "text", "output format: text or json")
+	_ = flags.Parse(args)
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %q (want text or json)\n", *format)
+		return planExitError
+	}
+
+	sqlDB, queries, err := db.Open(ctx, cfg.PGDSN)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening db: %v\n", err)
+		return planExitError
+	}
+	defer sqlDB.Close()
+
+	prov, _ := newDNSProvider(ctx, cfg, logger)
+	if _, ok := prov.(dns.Reader); !ok {
+		fmt.Fprintln(os.Stderr, "plan requires a DNS provider that can read live records; set AWS_REGION and credentials")
+		return planExitError
+	}
+
+	op := &operator{queries: queries, planner: newPlanner(queries), dns: prov, log: logger, dryRun: true}
+	plan, errs, err := op.plan(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "computing plan: %v\n", err)
+		return planExitError
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+
+	if *format == "json" {
+		err = dns.WritePlanJSON(os.Stdout, plan)
+	} else {
+		err = dns.WritePlanText(os.Stdout, plan)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "writing plan: %v\n", err)
+		return planExitError
+	}
+
+	switch {
+	case len(errs) > 0 || plan.Summary().Errored > 0:
+		return planExitError
+	case plan.HasDrift():
+		return planExitDrift
+	default:
+		return planExitClean
+	}
+}
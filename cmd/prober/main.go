@@ -12,6 +12,7 @@ import (
 	"tranche/internal/logging"
 	"tranche/internal/monitor"
 	"tranche/internal/observability"
+	"tranche/internal/prewarm"
 	"tranche/internal/storm"
 )
 
@@ -44,6 +45,16 @@ func main() {
 
 	go probeSched.Run(ctx)
 
+	if cfg.Prewarm.Enabled {
+		warmer, err := prewarm.NewWarmer(queries, cfg.Prewarm, logger)
+		if err != nil {
+			logger.Fatalf("configuring prewarm: %v", err)
+		}
+		warmer.WithMetrics(metrics)
+		stormEng.WithListener(warmer)
+		go warmer.Run(ctx)
+	}
+
 	ticker := time.NewTicker(10 * time.Second)
 
 	for {
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"tranche/internal/config"
+	"tranche/internal/db"
+	"tranche/internal/logging"
+	"tranche/internal/usageingestor"
+)
+
+// runBackfill ingests a historical range through the API providers and prints which
+// windows were filled. Re-running the same command resumes an interrupted backfill.
+func runBackfill(ctx context.Context, cfg config.Config, logger *logging.Logger, args []string) int {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	from := flags.String("from", "", "start of the range, RFC3339 (required)")
+	to := flags.String("to", "", "end of the range, RFC3339, no later than the last complete window (required)")
+	services := flags.String("services", "", "comma-separated service IDs (default: all active services)")
+	chunk := flags.Duration("chunk", 24*time.Hour, "range fetched per provider call; a multiple of USAGE_WINDOW")
+	pause := flags.Duration("pause", 2*time.Second, "wait between chunks to stay within provider rate limits")
+	restart := flags.Bool("restart", false, "discard saved progress and start from -from again")
+	format := flags.String("format", "text", "output format: text or json")
+	_ = flags.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %q (want text or json)\n", *format)
+		return 1
+	}
+	if cfg.UsageMode != "api" {
+		fmt.Fprintln(os.Stderr, "backfill fetches from the usage APIs; with USAGE_MODE=logs point USAGE_LOG_SOURCE at the older files instead")
+		return 1
+	}
+	start, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -from %q: %v\n", *from, err)
+		return 1
+	}
+	// The end is part of the job key, so it has to be given explicitly for a re-run of the
+	// same command to resume the job rather than start a new one.
+	end, err := time.Parse(time.RFC3339, *to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -to %q: %v\n", *to, err)
+		return 1
+	}
+	if lastComplete := time.Now().Truncate(cfg.UsageWindow); end.After(lastComplete) {
+		fmt.Fprintf(os.Stderr, "-to %s is after the last complete window, which ends %s\n", end.Format(time.RFC3339), lastComplete.Format(time.RFC3339))
+		return 1
+	}
+	serviceIDs, err := parseServiceIDs(*services)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -services: %v\n", err)
+		return 1
+	}
+
+	selector, err := newSelector(ctx, cfg, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configuring usage providers: %v\n", err)
+		return 1
+	}
+	if len(selector.Providers()) == 0 {
+		fmt.Fprintln(os.Stderr, "no usage providers configured")
+		return 1
+	}
+
+	sqlDB, queries, err := db.Open(ctx, cfg.PGDSN)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening db: %v\n", err)
+		return 1
+	}
+	defer sqlDB.Close()
+
+	engine := usageingestor.NewEngine(queries, selector, logger, cfg.UsageWindow, cfg.UsageLookback)
+	backfill, err := usageingestor.NewBackfill(engine, queries, logger, usageingestor.BackfillOptions{
+		Start:      start,
+		End:        end,
+		ServiceIDs: serviceIDs,
+		Chunk:      *chunk,
+		Pause:      *pause,
+		Restart:    *restart,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	report, runErr := backfill.Run(ctx)
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = writeBackfillText(os.Stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "writing report: %v\n", err)
+		return 1
+	}
+	if runErr != nil {
+		fmt.Fprintf(os.Stderr, "backfill stopped: %v\nre-run the same command to resume from %s\n", runErr, report.Cursor.Format(time.RFC3339))
+		return 1
+	}
+	return 0
+}
+
+func writeBackfillText(w io.Writer, r *usageingestor.BackfillReport) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Backfill %s\n", r.JobKey)
+	fmt.Fprintf(&b, "Range: %s - %s", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339))
+	if r.ResumedFrom != nil {
+		fmt.Fprintf(&b, " (resumed from %s)", r.ResumedFrom.Format(time.RFC3339))
+	}
+	b.WriteString("\n")
+	if r.Complete {
+		b.WriteString("Status: complete\n")
+	} else {
+		fmt.Fprintf(&b, "Status: incomplete, cursor at %s\n", r.Cursor.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "Windows: %d filled, %d already present, %d without usage\n", r.Filled, r.Present, r.Empty)
+
+	for _, svc := range r.Services {
+		fmt.Fprintf(&b, "\nservice %d: %d present, %d empty\n", svc.ServiceID, svc.Present, svc.Empty)
+		for _, span := range svc.Filled {
+			fmt.Fprintf(&b, "  + filled %s - %s\n", span.Start.Format(time.RFC3339), span.End.Format(time.RFC3339))
+		}
+	}
+	ids := make([]int64, 0, len(r.Unmeasured))
+	for id := range r.Unmeasured {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		fmt.Fprintf(&b, "\nservice %d: not measured: %s\n", id, r.Unmeasured[id])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func parseServiceIDs(val string) ([]int64, error) {
+	var ids []int64
+	for _, part := range strings.Split(val, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("service id %q: %w", part, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -2,16 +2,29 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awscfg "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"tranche/internal/cdn"
 	cf "tranche/internal/cdn/cloudflare"
+	"tranche/internal/cdn/cloudfront"
+	"tranche/internal/cdn/fastly"
 	"tranche/internal/config"
 	"tranche/internal/db"
 	"tranche/internal/logging"
 	"tranche/internal/observability"
+	"tranche/internal/usagehealth"
 	"tranche/internal/usageingestor"
+	"tranche/internal/usagelogs"
 )
 
 func main() {
@@ -20,9 +33,15 @@ func main() {
 	cfg := config.Load()
 	logger := logging.New("usage-ingestor")
 
-	provider := cf.NewClient(cfg.CloudflareAccountID, cfg.CloudflareAPIToken)
-	if cfg.CloudflareAccountID == "" || cfg.CloudflareAPIToken == "" {
-		logger.Fatal("CLOUDFLARE_ACCOUNT_ID and CLOUDFLARE_API_TOKEN must be set")
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		code := runBackfill(ctx, cfg, logger, os.Args[2:])
+		stop()
+		os.Exit(code)
+	}
+
+	selector, err := newSelector(ctx, cfg, logger)
+	if err != nil {
+		logger.Fatalf("configuring usage providers: %v", err)
 	}
 
 	sqlDB, queries, err := db.Open(ctx, cfg.PGDSN)
@@ -36,20 +55,147 @@ func main() {
 		return db.Ready(c, sqlDB)
 	})
 
-	engine := usageingestor.NewEngine(queries, provider, logger, cfg.UsageWindow, cfg.UsageLookback)
+	var runOnce func(context.Context) error
+	switch cfg.UsageMode {
+	case "api":
+		if len(selector.Providers()) == 0 {
+			logger.Fatal("no usage providers configured; set CLOUDFLARE_ACCOUNT_ID and CLOUDFLARE_API_TOKEN, FASTLY_API_TOKEN or CLOUDFRONT_DISTRIBUTION_CONFIG")
+		}
+		engine := usageingestor.NewEngine(queries, selector, logger, cfg.UsageWindow, cfg.UsageLookback)
+		runOnce = func(c context.Context) error { return engine.RunOnce(c, time.Now()) }
+		logger.Printf("usage ingestor starting with window %s lookback %s", cfg.UsageWindow, cfg.UsageLookback)
+	case "logs":
+		engine, err := newLogEngine(ctx, cfg, queries, selector, logger)
+		if err != nil {
+			logger.Fatalf("configuring log ingestion: %v", err)
+		}
+		runOnce = engine.RunOnce
+		logger.Printf("usage ingestor reading %s logs from %s with window %s", cfg.UsageLogFormat, cfg.UsageLogSource, cfg.UsageWindow)
+	default:
+		logger.Fatalf("unknown USAGE_MODE %q (want api or logs)", cfg.UsageMode)
+	}
+
+	checker := usagehealth.NewChecker(queries, cfg.UsageWindow, cfg.UsageHealth)
 
 	ticker := time.NewTicker(cfg.UsageTick)
 	defer ticker.Stop()
 
-	logger.Printf("usage ingestor starting with window %s lookback %s", cfg.UsageWindow, cfg.UsageLookback)
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if err := engine.RunOnce(ctx, time.Now()); err != nil {
+			if err := runOnce(ctx); err != nil {
 				logger.Error("usage ingestion error", "error", err)
 			}
+			if err := checkCoverage(ctx, checker, metrics, logger); err != nil {
+				logger.Error("usage coverage check error", "error", err)
+			}
+		}
+	}
+}
+
+// checkCoverage publishes every active service's usage coverage and logs the unhealthy ones.
+func checkCoverage(ctx context.Context, checker *usagehealth.Checker, metrics *observability.Metrics, logger *logging.Logger) error {
+	now := time.Now()
+	coverages, err := checker.Check(ctx, now)
+	if err != nil {
+		return err
+	}
+	metrics.ResetUsageCoverage()
+	for _, cov := range coverages {
+		metrics.SetUsageCoverage(cov.ServiceID, cov.MissingWindows, len(cov.LateWindows), time.Duration(cov.StalenessSeconds)*time.Second, cov.Drop != nil)
+		if !cov.Healthy() {
+			logger.Info("usage coverage degraded", "service_id", cov.ServiceID, "missing_windows", cov.MissingWindows, "gaps", len(cov.Gaps), "late_windows", len(cov.LateWindows), "drop", cov.Drop != nil)
+		}
+	}
+	return nil
+}
+
+// newLogEngine wires log-based ingestion. The CDN defaults to the log format's own CDN.
+func newLogEngine(ctx context.Context, cfg config.Config, queries *db.Queries, selector *cdn.Selector, logger *logging.Logger) (*usageingestor.LogEngine, error) {
+	var client usagelogs.S3API
+	if strings.HasPrefix(cfg.UsageLogSource, "s3://") {
+		awsCfg, err := loadAWSConfig(ctx, cfg, cfg.AWSRegion)
+		if err != nil {
+			return nil, err
+		}
+		client = s3.NewFromConfig(awsCfg)
+	}
+	source, err := usagelogs.OpenSource(cfg.UsageLogSource, client)
+	if err != nil {
+		return nil, err
+	}
+	cdnName := cfg.UsageLogCDN
+	if cdnName == "" && cfg.UsageLogFormat != usagelogs.FormatW3C {
+		cdnName = cfg.UsageLogFormat
+	}
+	return usageingestor.NewLogEngine(queries, selector, source, cfg.UsageLogFormat, cdnName, cfg.UsageWindow, logger)
+}
+
+// loadAWSConfig loads the shared AWS credentials for a region, preferring static keys.
+func loadAWSConfig(ctx context.Context, cfg config.Config, region string) (aws.Config, error) {
+	loadOpts := []func(*awscfg.LoadOptions) error{awscfg.WithRegion(region)}
+	if cfg.AWSAccessKey != "" && cfg.AWSSecretKey != "" {
+		loadOpts = append(loadOpts, awscfg.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.AWSAccessKey, cfg.AWSSecretKey, cfg.AWSSession)))
+	}
+	awsCfg, err := awscfg.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("load aws config: %w", err)
+	}
+	return awsCfg, nil
+}
+
+// newSelector registers every usage provider with credentials configured.
+func newSelector(ctx context.Context, cfg config.Config, logger *logging.Logger) (*cdn.Selector, error) {
+	var providers []cdn.Provider
+	if cfg.CloudflareAccountID != "" && cfg.CloudflareAPIToken != "" {
+		var opts []cf.ClientOption
+		if cfg.Cloudflare.CountryBreakdown {
+			opts = append(opts, cf.WithCountryBreakdown())
+		}
+		zoneConfig, err := cf.ParseZoneConfig(cfg.Cloudflare)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Cloudflare.DailyZoneRollups && len(zoneConfig) > 0 {
+			zones := make(map[string]string, len(zoneConfig))
+			for host, zone := range zoneConfig {
+				zones[host] = zone.ZoneID
+			}
+			opts = append(opts, cf.WithZones(zones))
+		}
+		providers = append(providers, cf.NewClient(cfg.CloudflareAccountID, cfg.CloudflareAPIToken, opts...))
+	}
+	if cfg.Cloudflare.APIToken != "" && cfg.Cloudflare.ZoneConfigJSON != "" {
+		zones, err := cf.NewProvider(cfg.Cloudflare)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, zones)
+	}
+	if cfg.Fastly.APIToken != "" {
+		fastlyProvider, err := fastly.NewProvider(cfg.Fastly)
+		if err != nil {
+			return nil, err
 		}
+		providers = append(providers, fastlyProvider)
 	}
+	if cfg.CloudFront.DistributionConfigJSON != "" {
+		awsCfg, err := loadAWSConfig(ctx, cfg, cloudfront.MetricsRegion)
+		if err != nil {
+			return nil, err
+		}
+		cloudfrontProvider, err := cloudfront.NewProvider(cfg.CloudFront, awsCfg)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, cloudfrontProvider)
+	}
+	return cdn.NewSelector(cdn.SelectorConfig{
+		DefaultProvider:   cfg.CDNDefaultProvider,
+		CustomerOverrides: cfg.CDNCustomerProviders,
+		ServiceOverrides:  cfg.CDNServiceProviders,
+		Providers:         providers,
+	})
 }
@@ -3,23 +3,118 @@ package billing
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"math"
 	"sort"
+	"strings"
 	"time"
 
+	"tranche/internal/config"
 	"tranche/internal/db"
+	"tranche/internal/money"
 	"tranche/internal/observability"
+	"tranche/internal/sla"
 )
 
 type Logger interface {
 	Printf(string, ...any)
 }
 
+// store is what a billing run reads and writes, inside the run's transaction.
+type store interface {
+	LockUnbilledUsageSnapshots(ctx context.Context, windowEnd time.Time) ([]db.LockUnbilledUsageSnapshotsRow, error)
+	LockUnsettledUsageRevisions(ctx context.Context) ([]db.LockUnsettledUsageRevisionsRow, error)
+	GetBilledUsageForWindow(ctx context.Context, arg db.GetBilledUsageForWindowParams) (db.GetBilledUsageForWindowRow, error)
+	GetUsagePricingForWindow(ctx context.Context, arg db.GetUsagePricingForWindowParams) (db.GetUsagePricingForWindowRow, error)
+	ListBilledStormDiscountsForWindow(ctx context.Context, arg db.ListBilledStormDiscountsForWindowParams) ([]db.ListBilledStormDiscountsForWindowRow, error)
+	GetStormEventsForWindow(ctx context.Context, arg db.GetStormEventsForWindowParams) ([]db.StormEvent, error)
+	ListStormCoverageFactorsForService(ctx context.Context, serviceID int64) ([]db.ListStormCoverageFactorsForServiceRow, error)
+	ListDNSWeightChangesForWindow(ctx context.Context, arg db.ListDNSWeightChangesForWindowParams) ([]db.ListDNSWeightChangesForWindowRow, error)
+	GetCustomerBillingSettings(ctx context.Context, id int64) (db.GetCustomerBillingSettingsRow, error)
+	ListCustomerPlans(ctx context.Context, customerID int64) ([]db.CustomerPlan, error)
+	GetPricingPlan(ctx context.Context, id int64) (db.PricingPlan, error)
+	GetCustomerBilledBytes(ctx context.Context, arg db.GetCustomerBilledBytesParams) (int64, error)
+	GetInvoiceForPeriod(ctx context.Context, arg db.GetInvoiceForPeriodParams) (db.Invoice, error)
+	InsertDraftInvoice(ctx context.Context, arg db.InsertDraftInvoiceParams) (db.Invoice, error)
+	InsertInvoiceLineItem(ctx context.Context, arg db.InsertInvoiceLineItemParams) (db.InvoiceLineItem, error)
+	SetInvoiceAmounts(ctx context.Context, arg db.SetInvoiceAmountsParams) (int64, error)
+	MarkUsageSnapshotInvoiced(ctx context.Context, arg db.MarkUsageSnapshotInvoicedParams) error
+	SettleUsageRevision(ctx context.Context, arg db.SettleUsageRevisionParams) error
+	ListDueDraftInvoices(ctx context.Context, periodEnd time.Time) ([]db.Invoice, error)
+	ListInvoiceLineItems(ctx context.Context, invoiceID int64) ([]db.InvoiceLineItem, error)
+	UpdateInvoiceLineItemCents(ctx context.Context, arg db.UpdateInvoiceLineItemCentsParams) error
+	ListInvoiceServiceCharges(ctx context.Context, invoiceID int64) ([]db.ListInvoiceServiceChargesRow, error)
+	GetSLADefinition(ctx context.Context, id int64) (db.SlaDefinition, error)
+	GetServiceDowntime(ctx context.Context, arg db.GetServiceDowntimeParams) (db.GetServiceDowntimeRow, error)
+	InsertSLAResult(ctx context.Context, arg db.InsertSLAResultParams) (db.SlaResult, error)
+	FinalizeInvoice(ctx context.Context, id int64) (db.Invoice, error)
+}
+
 type Config struct {
-	Period         time.Duration
 	RateCentsPerGB int64
 	DiscountRate   float64
+	// RequestRateCentsPerMillion prices requests on top of bytes; zero leaves them free.
+	RequestRateCentsPerMillion int64
+	// RegionRatesCentsPerGB replaces RateCentsPerGB for bytes attributed to a region.
+	// Bytes outside the snapshot's regional breakdown are billed at RateCentsPerGB.
+	// Customers on a pricing plan are billed at the plan's tier rates wherever the
+	// traffic was served.
+	RegionRatesCentsPerGB map[string]int64
+	// FinalizeDelay is how long after a billing period ends its draft invoice is finalized,
+	// leaving time for late usage to land on it.
+	FinalizeDelay time.Duration
+	// Rounding turns exact invoice amounts into cents. Charges are kept to the millionth of
+	// a cent until then.
+	Rounding money.RoundingMode
+	// BytesPerGB is the size of the GB that per-GB rates and plan tiers are quoted in:
+	// BytesPerGiB (the default) or BytesPerGB.
+	BytesPerGB int64
+	// Currency is what customers without a pricing plan are invoiced in. Rates are in the
+	// currency's minor unit.
+	Currency string
+}
+
+// Byte units per-GB rates can be quoted in.
+const (
+	BytesPerGiB int64 = 1 << 30
+	BytesPerGB  int64 = 1_000_000_000
+)
+
+// BytesPerUnit reads a byte unit name, gib or gb.
+func BytesPerUnit(unit string) (int64, error) {
+	switch strings.ToLower(strings.TrimSpace(unit)) {
+	case "gib":
+		return BytesPerGiB, nil
+	case "gb":
+		return BytesPerGB, nil
+	}
+	return 0, fmt.Errorf("unknown byte unit %q (want gib or gb)", unit)
+}
+
+// ConfigFrom builds the engine configuration from the service configuration, shared by the
+// billing worker and the control plane's previews so both price usage alike.
+func ConfigFrom(cfg config.Config) (Config, error) {
+	rounding, err := money.ParseRoundingMode(cfg.BillingRounding)
+	if err != nil {
+		return Config{}, fmt.Errorf("BILLING_ROUNDING: %w", err)
+	}
+	bytesPerGB, err := BytesPerUnit(cfg.BillingByteUnit)
+	if err != nil {
+		return Config{}, fmt.Errorf("BILLING_BYTE_UNIT: %w", err)
+	}
+	if !money.ValidCurrency(cfg.BillingCurrency) {
+		return Config{}, fmt.Errorf("BILLING_CURRENCY %q is not a three-letter currency code", cfg.BillingCurrency)
+	}
+	return Config{
+		RateCentsPerGB:             cfg.BillingRateCentsPerGB,
+		DiscountRate:               cfg.BillingDiscountRate,
+		RequestRateCentsPerMillion: cfg.BillingRequestRate,
+		RegionRatesCentsPerGB:      cfg.BillingRegionRates,
+		FinalizeDelay:              cfg.BillingFinalizeDelay,
+		Rounding:                   rounding,
+		BytesPerGB:                 bytesPerGB,
+		Currency:                   cfg.BillingCurrency,
+	}, nil
 }
 
 type Engine struct {
@@ -29,258 +124,884 @@ type Engine struct {
 	m   *observability.Metrics
 }
 
-type coverageQuerier interface {
-	GetMaxCoverageFactorForService(context.Context, int64) (float64, error)
-}
-
 func NewEngine(dbx *db.Queries, log Logger, m *observability.Metrics, cfg Config) *Engine {
-	if cfg.Period <= 0 {
-		cfg.Period = 24 * time.Hour
-	}
 	if cfg.RateCentsPerGB <= 0 {
 		cfg.RateCentsPerGB = 12
 	}
 	if cfg.DiscountRate < 0 {
 		cfg.DiscountRate = 0
 	}
+	if cfg.RequestRateCentsPerMillion < 0 {
+		cfg.RequestRateCentsPerMillion = 0
+	}
+	if cfg.FinalizeDelay < 0 {
+		cfg.FinalizeDelay = 0
+	}
+	if cfg.BytesPerGB <= 0 {
+		cfg.BytesPerGB = BytesPerGiB
+	}
+	if cfg.Currency == "" {
+		cfg.Currency = "usd"
+	}
 	return &Engine{db: dbx, log: log, cfg: cfg, m: m}
 }
 
+// RunOnce bills every unbilled usage snapshot and unsettled revision onto each customer's
+// draft invoice for the billing period they fall in, then finalizes drafts whose period
+// closed more than FinalizeDelay ago. Snapshots are picked up however old their window is,
+// so backfilled and late usage is billed too.
 func (e *Engine) RunOnce(ctx context.Context, now time.Time) error {
-	since := now.Add(-e.cfg.Period)
-
 	qtx, tx, err := e.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("begin invoice transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	snapshots, err := qtx.LockUnbilledUsageSnapshots(ctx, db.LockUnbilledUsageSnapshotsParams{
-		WindowEnd:   now,
-		WindowStart: since,
-	})
+	report, err := e.runIn(ctx, qtx, now)
 	if err != nil {
-		return fmt.Errorf("list unbilled snapshots: %w", err)
+		return err
 	}
-	if len(snapshots) == 0 {
+	if report.drafts == 0 && report.settled == 0 && report.finalized == 0 {
 		e.log.Printf("billing run at %s: no usage in window", now.Format(time.RFC3339))
 		return nil
 	}
 
-	coverageCache := make(map[int64]float64)
-	invoices := make(map[int64]*invoiceBuild)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit invoice batch: %w", err)
+	}
 
-	for _, snap := range snapshots {
-		storms, err := qtx.GetStormEventsForWindow(ctx, db.GetStormEventsForWindowParams{
-			ServiceID:   snap.ServiceID,
-			WindowEnd:   snap.WindowEnd,
-			WindowStart: sql.NullTime{Time: snap.WindowStart, Valid: true},
-		})
+	for _, msg := range report.logs {
+		e.log.Printf("%s", msg)
+	}
+
+	if e.m != nil {
+		e.m.RecordBillingRun(time.Since(now), report.drafts, nil)
+	}
+
+	return nil
+}
+
+// runReport is what one billing run changed, with a log line per invoice.
+type runReport struct {
+	drafts    int
+	settled   int
+	finalized int
+	logs      []string
+}
+
+// runIn does RunOnce's work against q, leaving the transaction to the caller.
+func (e *Engine) runIn(ctx context.Context, q store, now time.Time) (runReport, error) {
+	snapshots, err := q.LockUnbilledUsageSnapshots(ctx, now)
+	if err != nil {
+		return runReport{}, fmt.Errorf("list unbilled snapshots: %w", err)
+	}
+	revisions, err := q.LockUnsettledUsageRevisions(ctx)
+	if err != nil {
+		return runReport{}, fmt.Errorf("list unsettled usage revisions: %w", err)
+	}
+
+	r := e.newRun(q, now, q.GetInvoiceForPeriod)
+	if err := r.bill(ctx, snapshots, revisions); err != nil {
+		return runReport{}, err
+	}
+	for _, id := range r.settleOnly {
+		if err := q.SettleUsageRevision(ctx, db.SettleUsageRevisionParams{ID: id}); err != nil {
+			return runReport{}, fmt.Errorf("settle usage revision %d: %w", id, err)
+		}
+	}
+
+	order := r.ordered()
+	report := runReport{drafts: len(order), settled: len(r.settleOnly), logs: make([]string, 0, len(order))}
+	for _, inv := range order {
+		invoice, err := e.persistDraft(ctx, q, inv)
 		if err != nil {
-			return fmt.Errorf("storms for service %d: %w", snap.ServiceID, err)
+			return runReport{}, err
 		}
-		maxCoverage, err := e.maxCoverageFactor(ctx, qtx, coverageCache, snap.ServiceID)
+		report.logs = append(report.logs, fmt.Sprintf("updated draft invoice %d for customer %d (line_items=%d total_cents=%d)", invoice.ID, invoice.CustomerID, len(inv.items), invoice.TotalCents))
+	}
+
+	finalized, err := e.finalizeDue(ctx, q, r.plans, now)
+	if err != nil {
+		return runReport{}, err
+	}
+	report.finalized = len(finalized)
+	for _, invoice := range finalized {
+		report.logs = append(report.logs, fmt.Sprintf("finalized invoice %d for customer %d (period %s to %s, total_cents=%d)", invoice.ID, invoice.CustomerID, invoice.PeriodStart.Format(time.RFC3339), invoice.PeriodEnd.Format(time.RFC3339), invoice.TotalCents))
+	}
+	return report, nil
+}
+
+// run prices one batch of usage onto draft invoices in memory. It only reads from the
+// database; RunOnce persists what it built and Preview reports it.
+type run struct {
+	e   *Engine
+	q   store
+	now time.Time
+	// invoiceForPeriod looks up a customer's invoice for a period, locking it when the run
+	// will be persisted.
+	invoiceForPeriod func(context.Context, db.GetInvoiceForPeriodParams) (db.Invoice, error)
+	// coverage caches each service's coverage factor per storm kind.
+	coverage map[int64]map[string]float64
+	cal      *calendar
+	plans    *planState
+	drafts   map[draftKey]*invoiceBuild
+	// target, when set, is the one draft everything in the run is billed on, whatever
+	// period it falls in. Regenerating a voided invoice bills onto its replacement this way.
+	target *invoiceBuild
+	// settleOnly lists revisions that changed nothing billable; they are settled without a
+	// line item.
+	settleOnly []int64
+}
+
+func (e *Engine) newRun(q store, now time.Time, invoiceForPeriod func(context.Context, db.GetInvoiceForPeriodParams) (db.Invoice, error)) *run {
+	cal := newCalendar(e.log)
+	return &run{
+		e:                e,
+		q:                q,
+		now:              now,
+		invoiceForPeriod: invoiceForPeriod,
+		coverage:         make(map[int64]map[string]float64),
+		cal:              cal,
+		plans:            newPlanState(cal),
+		drafts:           make(map[draftKey]*invoiceBuild),
+	}
+}
+
+// bill prices snapshots and revisions and adds their line items to the run's drafts.
+func (r *run) bill(ctx context.Context, snapshots []db.LockUnbilledUsageSnapshotsRow, revisions []db.LockUnsettledUsageRevisionsRow) error {
+	for _, snap := range snapshots {
+		p, err := r.currentRates(ctx, snap.CustomerID, snap.WindowStart, snap.PrimaryBytes+snap.BackupBytes)
 		if err != nil {
 			return err
 		}
-		coverage := coverageRatio(snap.WindowStart, snap.WindowEnd, storms) * maxCoverage
-		if coverage > maxCoverage {
-			coverage = maxCoverage
+		charge, err := r.price(ctx, snap.ServiceID, snap.WindowStart, snap.WindowEnd, p, usage{
+			primaryBytes:    snap.PrimaryBytes,
+			backupBytes:     snap.BackupBytes,
+			primaryRequests: snap.PrimaryRequests,
+			backupRequests:  snap.BackupRequests,
+			regions:         snap.Regions,
+		})
+		if err != nil {
+			return err
 		}
 
-		lineSubtotal := e.chargeForBytes(snap.PrimaryBytes) + e.chargeForBytes(snap.BackupBytes)
-		backupCharge := e.chargeForBytes(snap.BackupBytes)
-		discount := int64(math.Round(float64(backupCharge) * e.cfg.DiscountRate * coverage))
-		if discount > lineSubtotal {
-			discount = lineSubtotal
+		inv, err := r.draftFor(ctx, snap.CustomerID, snap.WindowStart, charge.currency)
+		if err != nil {
+			return err
 		}
-		lineTotal := lineSubtotal - discount
+		inv.add(lineItem{
+			Kind:            lineKindUsage,
+			ServiceID:       snap.ServiceID,
+			WindowStart:     snap.WindowStart,
+			WindowEnd:       snap.WindowEnd,
+			PrimaryBytes:    snap.PrimaryBytes,
+			BackupBytes:     snap.BackupBytes,
+			PrimaryRequests: snap.PrimaryRequests,
+			BackupRequests:  snap.BackupRequests,
+			CoverageFactor:  charge.coverage,
+			Amount:          charge.subtotal,
+			Discount:        charge.discount,
+			Storms:          charge.storms,
+			Pricing:         p,
+		})
+		inv.snapshotIDs = append(inv.snapshotIDs, snap.ID)
+	}
 
-		inv := invoices[snap.CustomerID]
-		if inv == nil {
-			inv = &invoiceBuild{
-				customerID:  snap.CustomerID,
-				periodStart: snap.WindowStart,
-				periodEnd:   snap.WindowEnd,
-			}
-			invoices[snap.CustomerID] = inv
+	// Revisions of already-invoiced windows are billed as the difference between the
+	// latest revision and everything invoiced for that window so far, priced at the rates
+	// the window was first billed at. Only the newest revision of a snapshot counts; older
+	// unsettled ones are settled alongside it.
+	for _, group := range latestRevisions(revisions) {
+		rev := group.latest
+		billed, err := r.q.GetBilledUsageForWindow(ctx, db.GetBilledUsageForWindowParams{
+			ServiceID:   rev.ServiceID,
+			WindowStart: rev.WindowStart,
+			WindowEnd:   rev.WindowEnd,
+		})
+		if err != nil {
+			return fmt.Errorf("billed usage for service %d window %s: %w", rev.ServiceID, rev.WindowStart.Format(time.RFC3339), err)
 		}
-		if snap.WindowStart.Before(inv.periodStart) {
-			inv.periodStart = snap.WindowStart
+		billedStorms, err := r.q.ListBilledStormDiscountsForWindow(ctx, db.ListBilledStormDiscountsForWindowParams{
+			ServiceID:   rev.ServiceID,
+			WindowStart: rev.WindowStart,
+			WindowEnd:   rev.WindowEnd,
+		})
+		if err != nil {
+			return fmt.Errorf("billed storm discounts for service %d window %s: %w", rev.ServiceID, rev.WindowStart.Format(time.RFC3339), err)
 		}
-		if snap.WindowEnd.After(inv.periodEnd) {
-			inv.periodEnd = snap.WindowEnd
+		p, err := r.revisionRates(ctx, rev, billed)
+		if errors.Is(err, errCurrencyChanged) {
+			// Needs a manual credit and rebill; retried every run until then.
+			r.e.log.Printf("usage revision %d left unsettled: %v", rev.ID, err)
+			continue
 		}
-
-		inv.subtotal += lineSubtotal
-		inv.discount += discount
-		inv.total += lineTotal
-		inv.snapshotIDs = append(inv.snapshotIDs, snap.ID)
-		inv.items = append(inv.items, lineItem{
-			ServiceID:      snap.ServiceID,
-			WindowStart:    snap.WindowStart,
-			WindowEnd:      snap.WindowEnd,
-			PrimaryBytes:   snap.PrimaryBytes,
-			BackupBytes:    snap.BackupBytes,
-			CoverageFactor: coverage,
-			AmountCents:    lineSubtotal,
-			DiscountCents:  discount,
+		if err != nil {
+			return err
+		}
+		charge, err := r.price(ctx, rev.ServiceID, rev.WindowStart, rev.WindowEnd, p, usage{
+			primaryBytes:    rev.PrimaryBytes,
+			backupBytes:     rev.BackupBytes,
+			primaryRequests: rev.PrimaryRequests,
+			backupRequests:  rev.BackupRequests,
+			regions:         rev.Regions,
 		})
+		if err != nil {
+			return err
+		}
+		item := lineItem{
+			Kind:             lineKindAdjustment,
+			AdjustsInvoiceID: rev.InvoiceID,
+			ServiceID:        rev.ServiceID,
+			WindowStart:      rev.WindowStart,
+			WindowEnd:        rev.WindowEnd,
+			PrimaryBytes:     rev.PrimaryBytes - billed.PrimaryBytes,
+			BackupBytes:      rev.BackupBytes - billed.BackupBytes,
+			PrimaryRequests:  rev.PrimaryRequests - billed.PrimaryRequests,
+			BackupRequests:   rev.BackupRequests - billed.BackupRequests,
+			CoverageFactor:   charge.coverage,
+			Amount:           charge.subtotal - money.Amount(billed.AmountMicros),
+			Discount:         charge.discount - money.Amount(billed.DiscountMicros),
+			Storms:           adjustStorms(charge.storms, billedStorms),
+			Pricing:          p,
+		}
+		if item.PrimaryBytes == 0 && item.BackupBytes == 0 && item.PrimaryRequests == 0 && item.BackupRequests == 0 &&
+			item.Amount == 0 && item.Discount == 0 {
+			r.settleOnly = append(r.settleOnly, group.ids...)
+			continue
+		}
+		inv, err := r.draftFor(ctx, rev.CustomerID, rev.WindowStart, charge.currency)
+		if err != nil {
+			return err
+		}
+		inv.add(item)
+		inv.revisionIDs = append(inv.revisionIDs, group.ids...)
+	}
+	return nil
+}
+
+// ordered returns the run's drafts by customer and period, with each draft's line items
+// sorted by kind and window.
+func (r *run) ordered() []*invoiceBuild {
+	order := make([]*invoiceBuild, 0, len(r.drafts))
+	for _, inv := range r.drafts {
+		inv.sortItems()
+		order = append(order, inv)
 	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i].invoice, order[j].invoice
+		if a.CustomerID != b.CustomerID {
+			return a.CustomerID < b.CustomerID
+		}
+		if !a.PeriodStart.Equal(b.PeriodStart) {
+			return a.PeriodStart.Before(b.PeriodStart)
+		}
+		return a.Currency < b.Currency
+	})
+	return order
+}
 
-	logs := make([]string, 0, len(invoices))
+type draftKey struct {
+	customerID  int64
+	periodStart time.Time
+	currency    string
+}
 
-	for _, inv := range invoices {
-		sort.Slice(inv.items, func(i, j int) bool {
-			return inv.items[i].WindowStart.Before(inv.items[j].WindowStart)
-		})
-		invoice, err := qtx.InsertInvoice(ctx, db.InsertInvoiceParams{
-			CustomerID:    inv.customerID,
-			PeriodStart:   inv.periodStart,
-			PeriodEnd:     inv.periodEnd,
-			SubtotalCents: inv.subtotal,
-			DiscountCents: inv.discount,
-			TotalCents:    inv.total,
+// draftFor returns the draft invoice that usage from windowStart is billed on: the draft
+// in currency for the window's billing period, or a new one while that period has not yet
+// been finalized. Usage arriving after its period was finalized lands on the current
+// period's draft instead, and usage for a current period whose invoice was already
+// finalized or paid lands on the next period's. A run with a target bills everything on it.
+func (r *run) draftFor(ctx context.Context, customerID int64, windowStart time.Time, currency string) (*invoiceBuild, error) {
+	if r.target != nil {
+		if currency != r.target.invoice.Currency {
+			return nil, fmt.Errorf("%w: customer %d's usage is now priced in %s, not the invoice's %s", ErrNotVoidable, customerID, currency, r.target.invoice.Currency)
+		}
+		return r.target, nil
+	}
+	start, end, err := r.cal.periodFor(ctx, r.q, customerID, windowStart)
+	if err != nil {
+		return nil, err
+	}
+	key := draftKey{customerID, start, currency}
+	if inv, ok := r.drafts[key]; ok {
+		return inv, nil
+	}
+	existing, err := r.invoiceForPeriod(ctx, db.GetInvoiceForPeriodParams{CustomerID: customerID, PeriodStart: start, Currency: currency})
+	switch {
+	case err == nil && existing.Status == invoiceStatusDraft:
+		inv := &invoiceBuild{invoice: existing}
+		r.drafts[key] = inv
+		return inv, nil
+	case errors.Is(err, sql.ErrNoRows) && r.now.Before(end.Add(r.e.cfg.FinalizeDelay)):
+		inv := &invoiceBuild{invoice: db.Invoice{CustomerID: customerID, PeriodStart: start, PeriodEnd: end, Currency: currency}}
+		r.drafts[key] = inv
+		return inv, nil
+	case err != nil && !errors.Is(err, sql.ErrNoRows):
+		return nil, fmt.Errorf("invoice for customer %d period %s: %w", customerID, start.Format(time.RFC3339), err)
+	}
+
+	currentStart, _, err := r.cal.periodFor(ctx, r.q, customerID, r.now)
+	if err != nil {
+		return nil, err
+	}
+	if !start.Before(currentStart) {
+		// Closed early; failing here would hold up every other customer's billing.
+		return r.draftFor(ctx, customerID, end, currency)
+	}
+	return r.draftFor(ctx, customerID, r.now, currency)
+}
+
+// persistDraft creates the draft if it is new and adds the run's line items and amounts to
+// it, returning the draft with its new totals.
+func (e *Engine) persistDraft(ctx context.Context, q store, inv *invoiceBuild) (db.Invoice, error) {
+	invoice := inv.invoice
+	if invoice.ID == 0 {
+		var err error
+		invoice, err = q.InsertDraftInvoice(ctx, db.InsertDraftInvoiceParams{
+			CustomerID:        invoice.CustomerID,
+			PeriodStart:       invoice.PeriodStart,
+			PeriodEnd:         invoice.PeriodEnd,
+			Currency:          invoice.Currency,
+			ReplacesInvoiceID: invoice.ReplacesInvoiceID,
 		})
 		if err != nil {
-			return fmt.Errorf("insert invoice: %w", err)
-		}
-		for _, item := range inv.items {
-			_, err := qtx.InsertInvoiceLineItem(ctx, db.InsertInvoiceLineItemParams{
-				InvoiceID:      invoice.ID,
-				ServiceID:      item.ServiceID,
-				WindowStart:    item.WindowStart,
-				WindowEnd:      item.WindowEnd,
-				PrimaryBytes:   item.PrimaryBytes,
-				BackupBytes:    item.BackupBytes,
-				CoverageFactor: item.CoverageFactor,
-				AmountCents:    item.AmountCents,
-				DiscountCents:  item.DiscountCents,
-			})
+			return db.Invoice{}, fmt.Errorf("insert draft invoice: %w", err)
+		}
+	}
+	for _, item := range inv.items {
+		if err := e.insertLineItem(ctx, q, invoice.ID, item); err != nil {
+			return db.Invoice{}, err
+		}
+	}
+	subtotal := money.Amount(invoice.SubtotalMicros) + inv.subtotal
+	discount := money.Amount(invoice.DiscountMicros) + inv.discount
+	if err := e.setAmounts(ctx, q, &invoice, subtotal, discount); err != nil {
+		return db.Invoice{}, err
+	}
+	for _, snapID := range inv.snapshotIDs {
+		if err := q.MarkUsageSnapshotInvoiced(ctx, db.MarkUsageSnapshotInvoicedParams{
+			InvoiceID: sql.NullInt64{Int64: invoice.ID, Valid: true},
+			ID:        snapID,
+		}); err != nil {
+			return db.Invoice{}, fmt.Errorf("mark snapshot %d invoiced: %w", snapID, err)
+		}
+	}
+	for _, revID := range inv.revisionIDs {
+		if err := q.SettleUsageRevision(ctx, db.SettleUsageRevisionParams{
+			ID:        revID,
+			InvoiceID: sql.NullInt64{Int64: invoice.ID, Valid: true},
+		}); err != nil {
+			return db.Invoice{}, fmt.Errorf("settle usage revision %d: %w", revID, err)
+		}
+	}
+	return invoice, nil
+}
+
+// finalizeDue finalizes drafts whose period ended at least FinalizeDelay before now.
+func (e *Engine) finalizeDue(ctx context.Context, q store, plans *planState, now time.Time) ([]db.Invoice, error) {
+	due, err := q.ListDueDraftInvoices(ctx, now.Add(-e.cfg.FinalizeDelay))
+	if err != nil {
+		return nil, fmt.Errorf("list due draft invoices: %w", err)
+	}
+	meter := sla.NewMeter(q)
+	definitions := make(map[int64]db.SlaDefinition)
+	finalized := make([]db.Invoice, 0, len(due))
+	for _, invoice := range due {
+		done, err := e.finalize(ctx, q, plans, meter, definitions, invoice)
+		if err != nil {
+			return nil, err
+		}
+		finalized = append(finalized, done)
+	}
+	return finalized, nil
+}
+
+// finalize closes a draft. If the plan in effect at the end of the period carries an SLA,
+// each billed service is first credited for the period's measured availability. A customer
+// whose plan has a minimum commit above what is then left of the invoice's total in the
+// plan's currency is billed the shortfall, so credits never take an invoice below the
+// commit. Finally the line items' cents are settled so they add up to the totals.
+// definitions caches SLA definitions across invoices.
+func (e *Engine) finalize(ctx context.Context, q store, plans *planState, meter *sla.Meter, definitions map[int64]db.SlaDefinition, invoice db.Invoice) (db.Invoice, error) {
+	plan, err := plans.planAt(ctx, q, invoice.CustomerID, invoice.PeriodEnd.Add(-time.Nanosecond))
+	if err != nil {
+		return db.Invoice{}, err
+	}
+	if plan != nil && plan.SlaDefinitionID.Valid {
+		def, ok := definitions[plan.SlaDefinitionID.Int64]
+		if !ok {
+			def, err = q.GetSLADefinition(ctx, plan.SlaDefinitionID.Int64)
 			if err != nil {
-				return fmt.Errorf("insert line item: %w", err)
+				return db.Invoice{}, fmt.Errorf("load sla definition %d: %w", plan.SlaDefinitionID.Int64, err)
 			}
+			definitions[def.ID] = def
+		}
+		if err := e.creditSLA(ctx, q, meter, &invoice, def); err != nil {
+			return db.Invoice{}, err
+		}
+	}
+	net := money.Amount(invoice.SubtotalMicros - invoice.DiscountMicros)
+	if plan != nil && plan.Currency == invoice.Currency && money.FromCents(plan.MinimumMonthlyCents) > net {
+		shortfall := money.FromCents(plan.MinimumMonthlyCents) - net
+		if err := e.insertLineItem(ctx, q, invoice.ID, lineItem{
+			Kind:        lineKindMinimumCommit,
+			WindowStart: invoice.PeriodStart,
+			WindowEnd:   invoice.PeriodEnd,
+			Amount:      shortfall,
+		}); err != nil {
+			return db.Invoice{}, err
 		}
-		for _, snapID := range inv.snapshotIDs {
-			if err := qtx.MarkUsageSnapshotInvoiced(ctx, db.MarkUsageSnapshotInvoicedParams{
-				InvoiceID: sql.NullInt64{Int64: invoice.ID, Valid: true},
-				ID:        snapID,
+		if err := e.setAmounts(ctx, q, &invoice, money.Amount(invoice.SubtotalMicros)+shortfall, money.Amount(invoice.DiscountMicros)); err != nil {
+			return db.Invoice{}, err
+		}
+	}
+	if err := settleLineItemCents(ctx, q, invoice); err != nil {
+		return db.Invoice{}, err
+	}
+	done, err := q.FinalizeInvoice(ctx, invoice.ID)
+	if err != nil {
+		return db.Invoice{}, fmt.Errorf("finalize invoice %d: %w", invoice.ID, err)
+	}
+	return done, nil
+}
+
+// creditSLA measures each service billed on the invoice over its period and records the
+// result. Services that missed the SLA get an sla_credit line item worth their tier's share
+// of the service's net usage charges.
+func (e *Engine) creditSLA(ctx context.Context, q store, meter *sla.Meter, invoice *db.Invoice, def db.SlaDefinition) error {
+	charges, err := q.ListInvoiceServiceCharges(ctx, invoice.ID)
+	if err != nil {
+		return fmt.Errorf("list invoice %d service charges: %w", invoice.ID, err)
+	}
+	for _, c := range charges {
+		from := invoice.PeriodStart
+		if c.ServiceCreatedAt.After(from) {
+			from = c.ServiceCreatedAt
+		}
+		a, err := meter.Measure(ctx, c.ServiceID, from, invoice.PeriodEnd)
+		if err != nil {
+			return err
+		}
+		percent := sla.CreditPercent(def.Tiers, a.AvailabilityPercent)
+		credit := sla.CreditCents(money.Amount(c.NetMicros).Round(e.cfg.Rounding), percent)
+		if credit > 0 {
+			if err := e.insertLineItem(ctx, q, invoice.ID, lineItem{
+				Kind:        lineKindSLACredit,
+				ServiceID:   c.ServiceID,
+				WindowStart: invoice.PeriodStart,
+				WindowEnd:   invoice.PeriodEnd,
+				Amount:      -money.FromCents(credit),
 			}); err != nil {
-				return fmt.Errorf("mark snapshot %d invoiced: %w", snapID, err)
+				return err
+			}
+			if err := e.setAmounts(ctx, q, invoice, money.Amount(invoice.SubtotalMicros)-money.FromCents(credit), money.Amount(invoice.DiscountMicros)); err != nil {
+				return err
 			}
 		}
-		logs = append(logs, fmt.Sprintf("generated invoice %d for customer %d (line_items=%d total_cents=%d)", invoice.ID, invoice.CustomerID, len(inv.items), invoice.TotalCents))
+		if _, err := q.InsertSLAResult(ctx, db.InsertSLAResultParams{
+			InvoiceID:           invoice.ID,
+			ServiceID:           c.ServiceID,
+			SlaDefinitionID:     def.ID,
+			PeriodStart:         invoice.PeriodStart,
+			PeriodEnd:           invoice.PeriodEnd,
+			AvailabilityPercent: a.AvailabilityPercent,
+			DownMinutes:         a.DownMinutes,
+			TotalMinutes:        a.TotalMinutes,
+			CreditPercent:       percent,
+			CreditCents:         credit,
+		}); err != nil {
+			return fmt.Errorf("record sla result for invoice %d service %d: %w", invoice.ID, c.ServiceID, err)
+		}
 	}
+	return nil
+}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("commit invoice batch: %w", err)
+// insertLineItem stores an item with its exact amounts and their cents rounded on their own.
+// Until the invoice is finalized, those cents need not add up to its totals.
+func (e *Engine) insertLineItem(ctx context.Context, q store, invoiceID int64, item lineItem) error {
+	_, err := q.InsertInvoiceLineItem(ctx, db.InsertInvoiceLineItemParams{
+		InvoiceID:        invoiceID,
+		ServiceID:        sql.NullInt64{Int64: item.ServiceID, Valid: item.Kind != lineKindMinimumCommit},
+		WindowStart:      item.WindowStart,
+		WindowEnd:        item.WindowEnd,
+		PrimaryBytes:     item.PrimaryBytes,
+		BackupBytes:      item.BackupBytes,
+		CoverageFactor:   item.CoverageFactor,
+		AmountCents:      item.Amount.Round(e.cfg.Rounding),
+		DiscountCents:    item.Discount.Round(e.cfg.Rounding),
+		Kind:             item.Kind,
+		AdjustsInvoiceID: item.AdjustsInvoiceID,
+		PrimaryRequests:  item.PrimaryRequests,
+		BackupRequests:   item.BackupRequests,
+		AmountMicros:     int64(item.Amount),
+		DiscountMicros:   int64(item.Discount),
+		StormBreakdown:   item.Storms,
+		Pricing:          db.LinePricing(item.Pricing),
+	})
+	if err != nil {
+		return fmt.Errorf("insert line item: %w", err)
 	}
+	return nil
+}
 
-	for _, msg := range logs {
-		e.log.Printf(msg)
+// setAmounts stores a draft's exact subtotal and discount and updates invoice to match. The
+// subtotal and discount are each rounded to cents and the total is their difference, so the
+// invoice always adds up as shown.
+func (e *Engine) setAmounts(ctx context.Context, q store, invoice *db.Invoice, subtotal, discount money.Amount) error {
+	subtotalCents, discountCents, totalCents := e.round(subtotal, discount)
+	n, err := q.SetInvoiceAmounts(ctx, db.SetInvoiceAmountsParams{
+		ID:             invoice.ID,
+		SubtotalMicros: int64(subtotal),
+		DiscountMicros: int64(discount),
+		SubtotalCents:  subtotalCents,
+		DiscountCents:  discountCents,
+		TotalCents:     totalCents,
+	})
+	if err != nil {
+		return fmt.Errorf("update invoice %d amounts: %w", invoice.ID, err)
 	}
-
-	if e.m != nil {
-		e.m.RecordBillingRun(time.Since(now), len(invoices), nil)
+	if n == 0 {
+		return fmt.Errorf("invoice %d is no longer a draft", invoice.ID)
 	}
+	invoice.SubtotalMicros, invoice.DiscountMicros = int64(subtotal), int64(discount)
+	invoice.SubtotalCents, invoice.DiscountCents, invoice.TotalCents = subtotalCents, discountCents, totalCents
+	return nil
+}
+
+// round returns an invoice's subtotal, discount and total in cents.
+func (e *Engine) round(subtotal, discount money.Amount) (int64, int64, int64) {
+	subtotalCents, discountCents := subtotal.Round(e.cfg.Rounding), discount.Round(e.cfg.Rounding)
+	return subtotalCents, discountCents, subtotalCents - discountCents
+}
 
+// settleLineItemCents spreads the invoice's subtotal and discount cents over its line items
+// by largest remainder, so the items shown add up to the invoice's totals.
+func settleLineItemCents(ctx context.Context, q store, invoice db.Invoice) error {
+	items, err := q.ListInvoiceLineItems(ctx, invoice.ID)
+	if err != nil {
+		return fmt.Errorf("list invoice %d line items: %w", invoice.ID, err)
+	}
+	amounts := make([]money.Amount, len(items))
+	discounts := make([]money.Amount, len(items))
+	for i, item := range items {
+		amounts[i], discounts[i] = money.Amount(item.AmountMicros), money.Amount(item.DiscountMicros)
+	}
+	amountCents := money.Allocate(invoice.SubtotalCents, amounts)
+	discountCents := money.Allocate(invoice.DiscountCents, discounts)
+	for i, item := range items {
+		if item.AmountCents == amountCents[i] && item.DiscountCents == discountCents[i] {
+			continue
+		}
+		if err := q.UpdateInvoiceLineItemCents(ctx, db.UpdateInvoiceLineItemCentsParams{
+			ID:            item.ID,
+			AmountCents:   amountCents[i],
+			DiscountCents: discountCents[i],
+		}); err != nil {
+			return fmt.Errorf("update line item %d cents: %w", item.ID, err)
+		}
+	}
 	return nil
 }
 
-func (e *Engine) maxCoverageFactor(ctx context.Context, q coverageQuerier, cache map[int64]float64, serviceID int64) (float64, error) {
-	if v, ok := cache[serviceID]; ok {
-		return v, nil
+type charge struct {
+	subtotal money.Amount
+	discount money.Amount
+	coverage float64
+	currency string
+	storms   db.StormBreakdown
+}
+
+// usage is one window of traffic as stored on a snapshot or revision.
+type usage struct {
+	primaryBytes    int64
+	backupBytes     int64
+	primaryRequests int64
+	backupRequests  int64
+	regions         db.UsageRegions
+}
+
+// rates are the prices a window of usage is billed at, as recorded on its line items.
+type rates db.LinePricing
+
+// globalRates are the configured rates, for customers without a pricing plan.
+func (e *Engine) globalRates() rates {
+	return rates{
+		Currency:                   e.cfg.Currency,
+		BytesPerGB:                 e.cfg.BytesPerGB,
+		RequestRateCentsPerMillion: e.cfg.RequestRateCentsPerMillion,
+		DiscountRate:               e.cfg.DiscountRate,
+		RateCentsPerGB:             e.cfg.RateCentsPerGB,
+		RegionRatesCentsPerGB:      e.cfg.RegionRatesCentsPerGB,
+		Valid:                      true,
+	}
+}
+
+// planRates are a plan's rates for a window that starts offset bytes into the customer's
+// volume for the billing period.
+func (e *Engine) planRates(plan *db.PricingPlan, offset int64) rates {
+	return rates{
+		Currency:                   plan.Currency,
+		BytesPerGB:                 e.cfg.BytesPerGB,
+		RequestRateCentsPerMillion: e.cfg.RequestRateCentsPerMillion,
+		DiscountRate:               plan.StormDiscountRate,
+		PlanID:                     plan.ID,
+		PrimaryRateCentsPerGB:      plan.PrimaryRateCentsPerGb,
+		BackupRateCentsPerGB:       plan.BackupRateCentsPerGb,
+		Tiers:                      plan.Tiers,
+		VolumeOffsetBytes:          offset,
+		Valid:                      true,
 	}
-	factor, err := q.GetMaxCoverageFactorForService(ctx, serviceID)
+}
+
+// currentRates returns the rates a window is billed at the first time: those of the
+// customer's pricing plan in effect at the window start, placed after the period's volume
+// so far, or the global rates for customers without one. A plan customer's bytes are added
+// to that volume.
+func (r *run) currentRates(ctx context.Context, customerID int64, windowStart time.Time, bytes int64) (rates, error) {
+	plan, err := r.plans.planAt(ctx, r.q, customerID, windowStart)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			cache[serviceID] = 1
-			return 1, nil
-		}
-		return 0, fmt.Errorf("coverage factor for service %d: %w", serviceID, err)
+		return rates{}, err
 	}
-	cache[serviceID] = factor
-	return factor, nil
+	if plan == nil {
+		return r.e.globalRates(), nil
+	}
+	offset, err := r.plans.addVolume(ctx, r.q, customerID, windowStart, plan.Currency, bytes)
+	if err != nil {
+		return rates{}, err
+	}
+	return r.e.planRates(plan, offset), nil
 }
 
-func (e *Engine) chargeForBytes(bytes int64) int64 {
-	if bytes <= 0 {
-		return 0
+// errCurrencyChanged marks a revision whose window was billed in another currency than its
+// current rates, which its adjustment could not be priced against.
+var errCurrencyChanged = errors.New("currency changed since the window was billed")
+
+// revisionRates returns the rates a revision is billed at: those its window was first
+// billed at, so a rate, plan or currency change since does not show up as an adjustment.
+// Windows billed before line items recorded their pricing fall back to the current rates,
+// placed where the window's billed bytes end the period's volume so far, unless those are
+// in another currency than the window's invoice. Either way only the change in bytes is
+// added to the customer's volume, since the billed bytes are already part of it.
+func (r *run) revisionRates(ctx context.Context, rev db.LockUnsettledUsageRevisionsRow, billed db.GetBilledUsageForWindowRow) (rates, error) {
+	original, err := r.q.GetUsagePricingForWindow(ctx, db.GetUsagePricingForWindowParams{
+		ServiceID:   rev.ServiceID,
+		WindowStart: rev.WindowStart,
+		WindowEnd:   rev.WindowEnd,
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return rates{}, fmt.Errorf("pricing for service %d window %s: %w", rev.ServiceID, rev.WindowStart.Format(time.RFC3339), err)
+	}
+	billedBytes := billed.PrimaryBytes + billed.BackupBytes
+	delta := rev.PrimaryBytes + rev.BackupBytes - billedBytes
+	if original.Pricing.Valid {
+		p := rates(original.Pricing)
+		if p.PlanID != 0 {
+			if _, err := r.plans.addVolume(ctx, r.q, rev.CustomerID, rev.WindowStart, p.Currency, delta); err != nil {
+				return rates{}, err
+			}
+		}
+		return p, nil
+	}
+	plan, err := r.plans.planAt(ctx, r.q, rev.CustomerID, rev.WindowStart)
+	if err != nil {
+		return rates{}, err
+	}
+	currency := r.e.cfg.Currency
+	if plan != nil {
+		currency = plan.Currency
+	}
+	if original.Currency != "" && original.Currency != currency {
+		return rates{}, fmt.Errorf("%w: service %d window %s was billed in %s and is now priced in %s", errCurrencyChanged, rev.ServiceID, rev.WindowStart.Format(time.RFC3339), original.Currency, currency)
+	}
+	if plan == nil {
+		return r.e.globalRates(), nil
 	}
-	gb := float64(bytes) / (1024 * 1024 * 1024)
-	return int64(math.Round(gb * float64(e.cfg.RateCentsPerGB)))
+	offset, err := r.plans.addVolume(ctx, r.q, rev.CustomerID, rev.WindowStart, plan.Currency, delta)
+	if err != nil {
+		return rates{}, err
+	}
+	return r.e.planRates(plan, max(offset-billedBytes, 0)), nil
 }
 
-func coverageRatio(windowStart, windowEnd time.Time, storms []db.StormEvent) float64 {
-	duration := windowEnd.Sub(windowStart).Seconds()
-	if duration <= 0 {
-		return 0
+// price computes the charge for a window of usage at p. Backup traffic is discounted for
+// each storm by the share of it the storm moved to the backup CDN, times the coverage
+// factor of the storm's kind.
+func (r *run) price(ctx context.Context, serviceID int64, windowStart, windowEnd time.Time, p rates, u usage) (charge, error) {
+	q := r.q
+	storms, err := q.GetStormEventsForWindow(ctx, db.GetStormEventsForWindowParams{
+		ServiceID:   serviceID,
+		WindowEnd:   windowEnd,
+		WindowStart: sql.NullTime{Time: windowStart, Valid: true},
+	})
+	if err != nil {
+		return charge{}, fmt.Errorf("storms for service %d: %w", serviceID, err)
 	}
-	intervals := make([]timeRange, 0, len(storms))
-	for _, storm := range storms {
-		start := storm.StartedAt
-		if start.Before(windowStart) {
-			start = windowStart
+	var shares db.StormBreakdown
+	if len(storms) > 0 {
+		factors, err := r.coverageFactors(ctx, serviceID)
+		if err != nil {
+			return charge{}, err
 		}
-		end := windowEnd
-		if storm.EndedAt.Valid && storm.EndedAt.Time.Before(end) {
-			end = storm.EndedAt.Time
+		weights, err := q.ListDNSWeightChangesForWindow(ctx, db.ListDNSWeightChangesForWindowParams{
+			ServiceID:   serviceID,
+			WindowStart: windowStart,
+			WindowEnd:   windowEnd,
+		})
+		if err != nil {
+			return charge{}, fmt.Errorf("dns weights for service %d: %w", serviceID, err)
+		}
+		shares = stormShares(windowStart, windowEnd, storms, weights, factors)
+	}
+
+	var primaryCharge, backupCharge money.Amount
+	if p.PlanID != 0 {
+		primaryCharge, backupCharge = planBytesCharge(p, u.primaryBytes, u.backupBytes)
+		primaryCharge += p.chargeForRequests(u.primaryRequests)
+		backupCharge += p.chargeForRequests(u.backupRequests)
+	} else {
+		primaryRegions := make(map[string]int64, len(u.regions))
+		backupRegions := make(map[string]int64, len(u.regions))
+		for region, r := range u.regions {
+			primaryRegions[region] = r.PrimaryBytes
+			backupRegions[region] = r.BackupBytes
 		}
-		if end.Before(start) {
+		primaryCharge = p.chargeForTraffic(u.primaryBytes, u.primaryRequests, primaryRegions)
+		backupCharge = p.chargeForTraffic(u.backupBytes, u.backupRequests, backupRegions)
+	}
+	subtotal := primaryCharge + backupCharge
+	discount, coverage := discountStorms(shares, backupCharge, subtotal, p.DiscountRate)
+	return charge{subtotal: subtotal, discount: discount, coverage: coverage, currency: p.Currency, storms: shares}, nil
+}
+
+type revisionGroup struct {
+	latest db.LockUnsettledUsageRevisionsRow
+	ids    []int64
+}
+
+// latestRevisions groups unsettled revisions by snapshot, keeping the newest of each.
+// Rows arrive ordered by snapshot and revision ID.
+func latestRevisions(rows []db.LockUnsettledUsageRevisionsRow) []revisionGroup {
+	var groups []revisionGroup
+	for _, row := range rows {
+		if n := len(groups); n > 0 && groups[n-1].latest.SnapshotID == row.SnapshotID {
+			groups[n-1].latest = row
+			groups[n-1].ids = append(groups[n-1].ids, row.ID)
 			continue
 		}
-		intervals = append(intervals, timeRange{start: start, end: end})
+		groups = append(groups, revisionGroup{latest: row, ids: []int64{row.ID}})
 	}
-	if len(intervals) == 0 {
-		return 0
+	return groups
+}
+
+// chargeForTraffic prices one CDN path's bytes and requests. Bytes attributed to a region
+// with its own rate are billed at that rate; the rest, including regional bytes exceeding
+// the total, fall back to RateCentsPerGB.
+func (p rates) chargeForTraffic(bytes, requests int64, regionBytes map[string]int64) money.Amount {
+	total := p.chargeForRequests(requests)
+	regions := make([]string, 0, len(regionBytes))
+	for region := range regionBytes {
+		regions = append(regions, region)
 	}
-	sort.Slice(intervals, func(i, j int) bool {
-		return intervals[i].start.Before(intervals[j].start)
-	})
-	merged := intervals[:1]
-	for _, iv := range intervals[1:] {
-		last := &merged[len(merged)-1]
-		if iv.start.After(last.end) {
-			merged = append(merged, iv)
+	sort.Strings(regions)
+	for _, region := range regions {
+		rate, ok := p.RegionRatesCentsPerGB[strings.ToUpper(region)]
+		b := regionBytes[region]
+		if !ok || b <= 0 || bytes <= 0 {
 			continue
 		}
-		if iv.end.After(last.end) {
-			last.end = iv.end
+		if b > bytes {
+			b = bytes
 		}
+		total += p.chargeForBytes(b, rate)
+		bytes -= b
 	}
-	covered := 0.0
-	for _, iv := range merged {
-		covered += iv.end.Sub(iv.start).Seconds()
-	}
-	if covered > duration {
-		covered = duration
+	return total + p.chargeForBytes(bytes, p.RateCentsPerGB)
+}
+
+func (p rates) chargeForRequests(requests int64) money.Amount {
+	if requests <= 0 {
+		return 0
 	}
-	return covered / duration
+	return money.Rate(requests, p.RequestRateCentsPerMillion, 1_000_000)
 }
 
-type timeRange struct {
-	start time.Time
-	end   time.Time
+func (p rates) chargeForBytes(bytes, rateCentsPerGB int64) money.Amount {
+	if bytes <= 0 {
+		return 0
+	}
+	return money.Rate(bytes, rateCentsPerGB, p.BytesPerGB)
 }
 
+// invoiceBuild collects one run's additions to a draft invoice. invoice has a zero ID until
+// a new draft is inserted.
 type invoiceBuild struct {
-	customerID  int64
-	periodStart time.Time
-	periodEnd   time.Time
-	subtotal    int64
-	discount    int64
-	total       int64
+	invoice     db.Invoice
+	subtotal    money.Amount
+	discount    money.Amount
 	snapshotIDs []int64
+	revisionIDs []int64
 	items       []lineItem
 }
 
+func (inv *invoiceBuild) add(item lineItem) {
+	inv.subtotal += item.Amount
+	inv.discount += item.Discount
+	inv.items = append(inv.items, item)
+}
+
+// sortItems orders the line items by kind and window.
+func (inv *invoiceBuild) sortItems() {
+	sort.Slice(inv.items, func(i, j int) bool {
+		a, b := inv.items[i], inv.items[j]
+		if a.Kind != b.Kind {
+			return lineKindOrder[a.Kind] < lineKindOrder[b.Kind]
+		}
+		return a.WindowStart.Before(b.WindowStart)
+	})
+}
+
+// Line item kinds: usage bills a window for the first time, adjustment bills a later
+// revision of an already-invoiced window, sla_credit refunds part of a service's charges
+// for missing its SLA and minimum_commit bills a billing period's shortfall against the
+// customer's plan minimum.
+const (
+	lineKindUsage         = "usage"
+	lineKindAdjustment    = "adjustment"
+	lineKindSLACredit     = "sla_credit"
+	lineKindMinimumCommit = "minimum_commit"
+)
+
+// Invoice statuses. Usage can still be added to a draft. Drafts become finalized once
+// their period closes, after which they can only be voided or marked paid.
+const (
+	invoiceStatusDraft     = "draft"
+	invoiceStatusFinalized = "finalized"
+	invoiceStatusVoid      = "void"
+)
+
+// lineKindOrder is the order line item kinds appear in on an invoice.
+var lineKindOrder = map[string]int{
+	lineKindUsage:         0,
+	lineKindAdjustment:    1,
+	lineKindSLACredit:     2,
+	lineKindMinimumCommit: 3,
+}
+
 type lineItem struct {
-	ServiceID      int64
-	WindowStart    time.Time
-	WindowEnd      time.Time
-	PrimaryBytes   int64
-	BackupBytes    int64
-	CoverageFactor float64
-	AmountCents    int64
-	DiscountCents  int64
+	Kind             string
+	AdjustsInvoiceID sql.NullInt64
+	ServiceID        int64
+	WindowStart      time.Time
+	WindowEnd        time.Time
+	PrimaryBytes     int64
+	BackupBytes      int64
+	PrimaryRequests  int64
+	BackupRequests   int64
+	CoverageFactor   float64
+	Amount           money.Amount
+	Discount         money.Amount
+	// Storms breaks Discount down by the storms that earned it.
+	Storms db.StormBreakdown
+	// Pricing is what usage and adjustments were priced at; other kinds have none.
+	Pricing rates
 }
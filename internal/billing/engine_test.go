@@ -0,0 +1,787 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"testing"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/money"
+)
+
+func TestChargeForTraffic(t *testing.T) {
+	p := NewEngine(nil, nil, nil, Config{
+		RateCentsPerGB:             10,
+		RequestRateCentsPerMillion: 40,
+		RegionRatesCentsPerGB:      map[string]int64{"US": 5, "BR": 30},
+		BytesPerGB:                 BytesPerGB,
+	}).globalRates()
+	const gb = BytesPerGB
+	tests := []struct {
+		name     string
+		bytes    int64
+		requests int64
+		regions  map[string]int64
+		want     money.Amount
+	}{
+		{name: "no breakdown", bytes: 2 * gb, want: money.FromCents(20)},
+		{name: "regional rate", bytes: 2 * gb, regions: map[string]int64{"US": gb}, want: money.FromCents(15)},
+		{name: "two regions", bytes: 3 * gb, regions: map[string]int64{"US": gb, "BR": gb}, want: money.FromCents(45)},
+		{name: "region without a rate", bytes: 2 * gb, regions: map[string]int64{"DE": gb}, want: money.FromCents(20)},
+		{name: "region code case", bytes: gb, regions: map[string]int64{"us": gb}, want: money.FromCents(5)},
+		{name: "breakdown exceeds total", bytes: 2 * gb, regions: map[string]int64{"US": 3 * gb}, want: money.FromCents(10)},
+		{name: "requests", bytes: gb, requests: 500_000, want: money.FromCents(30)},
+		{name: "partial gb", bytes: gb / 4, want: money.FromCents(10) / 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.chargeForTraffic(tt.bytes, tt.requests, tt.regions); got != tt.want {
+				t.Fatalf("expected %d micros, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestChargeForRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     int64
+		requests int64
+		want     money.Amount
+	}{
+		{name: "free", rate: 0, requests: 1_000_000, want: 0},
+		{name: "one million", rate: 40, requests: 1_000_000, want: money.FromCents(40)},
+		{name: "fraction of a cent", rate: 40, requests: 1, want: money.FromCents(40) / 1_000_000},
+		{name: "no requests", rate: 40, requests: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewEngine(nil, nil, nil, Config{RequestRateCentsPerMillion: tt.rate}).globalRates()
+			if got := p.chargeForRequests(tt.requests); got != tt.want {
+				t.Fatalf("expected %d micros, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+// fakeStore keeps billing's tables in memory, answering queries the way the SQL does.
+type fakeStore struct {
+	customers map[int64]db.GetCustomerBillingSettingsRow
+	// services maps each service to its customer.
+	services        map[int64]int64
+	snapshots       []db.LockUnbilledUsageSnapshotsRow
+	snapshotInvoice map[int64]int64
+	revisions       []db.LockUnsettledUsageRevisionsRow
+	settled         map[int64]sql.NullInt64
+	storms          []db.StormEvent
+	factors         map[int64][]db.ListStormCoverageFactorsForServiceRow
+	// weights are every weight change applied, per service.
+	weights map[int64][]fakeWeightChange
+	// domains are the names each service routes now.
+	domains      map[int64]map[string]bool
+	plans        map[int64][]db.CustomerPlan
+	pricingPlans map[int64]db.PricingPlan
+	invoices     []db.Invoice
+	lineItems    []db.InvoiceLineItem
+	slas         map[int64]db.SlaDefinition
+	downtime     map[int64]db.GetServiceDowntimeRow
+	slaResults   []db.InsertSLAResultParams
+}
+
+type fakeWeightChange struct {
+	domain                      string
+	primaryWeight, backupWeight int32
+	appliedAt                   time.Time
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		customers:       make(map[int64]db.GetCustomerBillingSettingsRow),
+		services:        make(map[int64]int64),
+		snapshotInvoice: make(map[int64]int64),
+		settled:         make(map[int64]sql.NullInt64),
+		factors:         make(map[int64][]db.ListStormCoverageFactorsForServiceRow),
+		weights:         make(map[int64][]fakeWeightChange),
+		domains:         make(map[int64]map[string]bool),
+		plans:           make(map[int64][]db.CustomerPlan),
+		pricingPlans:    make(map[int64]db.PricingPlan),
+		slas:            make(map[int64]db.SlaDefinition),
+		downtime:        make(map[int64]db.GetServiceDowntimeRow),
+	}
+}
+
+// addSnapshot records an unbilled snapshot for a service of the customer.
+func (f *fakeStore) addSnapshot(customerID, serviceID int64, start, end time.Time, primaryBytes, backupBytes int64) int64 {
+	if _, ok := f.customers[customerID]; !ok {
+		f.customers[customerID] = db.GetCustomerBillingSettingsRow{BillingTimezone: "UTC", BillingAnchorDay: 1}
+	}
+	f.services[serviceID] = customerID
+	id := int64(len(f.snapshots) + 1)
+	f.snapshots = append(f.snapshots, db.LockUnbilledUsageSnapshotsRow{
+		ID:           id,
+		ServiceID:    serviceID,
+		CustomerID:   customerID,
+		WindowStart:  start,
+		WindowEnd:    end,
+		PrimaryBytes: primaryBytes,
+		BackupBytes:  backupBytes,
+	})
+	return id
+}
+
+// addRevision records new totals for an invoiced snapshot.
+func (f *fakeStore) addRevision(snapshotID, primaryBytes, backupBytes int64) int64 {
+	snap := f.snapshots[snapshotID-1]
+	id := int64(len(f.revisions) + 1)
+	f.revisions = append(f.revisions, db.LockUnsettledUsageRevisionsRow{
+		ID:           id,
+		SnapshotID:   snapshotID,
+		ServiceID:    snap.ServiceID,
+		CustomerID:   snap.CustomerID,
+		WindowStart:  snap.WindowStart,
+		WindowEnd:    snap.WindowEnd,
+		PrimaryBytes: primaryBytes,
+		BackupBytes:  backupBytes,
+		InvoiceID:    sql.NullInt64{Int64: f.snapshotInvoice[snapshotID], Valid: true},
+	})
+	return id
+}
+
+func (f *fakeStore) invoice(id int64) *db.Invoice {
+	for i := range f.invoices {
+		if f.invoices[i].ID == id {
+			return &f.invoices[i]
+		}
+	}
+	return nil
+}
+
+// itemsOn returns the line items of an invoice in insertion order.
+func (f *fakeStore) itemsOn(invoiceID int64) []db.InvoiceLineItem {
+	var items []db.InvoiceLineItem
+	for _, item := range f.lineItems {
+		if item.InvoiceID == invoiceID {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (f *fakeStore) billedItems(match func(db.InvoiceLineItem) bool) []db.InvoiceLineItem {
+	var items []db.InvoiceLineItem
+	for _, item := range f.lineItems {
+		if inv := f.invoice(item.InvoiceID); inv != nil && inv.Status != invoiceStatusVoid && match(item) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (f *fakeStore) LockUnbilledUsageSnapshots(ctx context.Context, windowEnd time.Time) ([]db.LockUnbilledUsageSnapshotsRow, error) {
+	var out []db.LockUnbilledUsageSnapshotsRow
+	for _, snap := range f.snapshots {
+		if _, billed := f.snapshotInvoice[snap.ID]; !billed && !snap.WindowEnd.After(windowEnd) {
+			out = append(out, snap)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].WindowStart.Before(out[j].WindowStart) })
+	return out, nil
+}
+
+func (f *fakeStore) LockUnsettledUsageRevisions(ctx context.Context) ([]db.LockUnsettledUsageRevisionsRow, error) {
+	var out []db.LockUnsettledUsageRevisionsRow
+	for _, rev := range f.revisions {
+		if _, ok := f.settled[rev.ID]; !ok {
+			out = append(out, rev)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].SnapshotID < out[j].SnapshotID })
+	return out, nil
+}
+
+func (f *fakeStore) GetBilledUsageForWindow(ctx context.Context, arg db.GetBilledUsageForWindowParams) (db.GetBilledUsageForWindowRow, error) {
+	var row db.GetBilledUsageForWindowRow
+	for _, item := range f.billedItems(func(item db.InvoiceLineItem) bool {
+		return item.ServiceID.Int64 == arg.ServiceID && item.WindowStart.Equal(arg.WindowStart) && item.WindowEnd.Equal(arg.WindowEnd)
+	}) {
+		row.PrimaryBytes += item.PrimaryBytes
+		row.BackupBytes += item.BackupBytes
+		row.PrimaryRequests += item.PrimaryRequests
+		row.BackupRequests += item.BackupRequests
+		row.AmountMicros += item.AmountMicros
+		row.DiscountMicros += item.DiscountMicros
+	}
+	return row, nil
+}
+
+func (f *fakeStore) GetUsagePricingForWindow(ctx context.Context, arg db.GetUsagePricingForWindowParams) (db.GetUsagePricingForWindowRow, error) {
+	items := f.billedItems(func(item db.InvoiceLineItem) bool {
+		return item.Kind == lineKindUsage && item.ServiceID.Int64 == arg.ServiceID && item.WindowStart.Equal(arg.WindowStart) && item.WindowEnd.Equal(arg.WindowEnd)
+	})
+	if len(items) == 0 {
+		return db.GetUsagePricingForWindowRow{}, sql.ErrNoRows
+	}
+	item := items[len(items)-1]
+	return db.GetUsagePricingForWindowRow{Pricing: item.Pricing, Currency: f.invoice(item.InvoiceID).Currency}, nil
+}
+
+func (f *fakeStore) ListBilledStormDiscountsForWindow(ctx context.Context, arg db.ListBilledStormDiscountsForWindowParams) ([]db.ListBilledStormDiscountsForWindowRow, error) {
+	byStorm := make(map[int64]*db.ListBilledStormDiscountsForWindowRow)
+	for _, item := range f.billedItems(func(item db.InvoiceLineItem) bool {
+		return item.ServiceID.Int64 == arg.ServiceID && item.WindowStart.Equal(arg.WindowStart) && item.WindowEnd.Equal(arg.WindowEnd)
+	}) {
+		for _, share := range item.StormBreakdown {
+			row, ok := byStorm[share.StormEventID]
+			if !ok {
+				row = &db.ListBilledStormDiscountsForWindowRow{StormEventID: share.StormEventID, Kind: share.Kind}
+				byStorm[share.StormEventID] = row
+			}
+			row.DiscountMicros += share.DiscountMicros
+		}
+	}
+	out := []db.ListBilledStormDiscountsForWindowRow{}
+	for _, row := range byStorm {
+		out = append(out, *row)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StormEventID < out[j].StormEventID })
+	return out, nil
+}
+
+func (f *fakeStore) GetStormEventsForWindow(ctx context.Context, arg db.GetStormEventsForWindowParams) ([]db.StormEvent, error) {
+	out := []db.StormEvent{}
+	for _, s := range f.storms {
+		if s.ServiceID == arg.ServiceID && s.StartedAt.Before(arg.WindowEnd) && (!s.EndedAt.Valid || s.EndedAt.Time.After(arg.WindowStart.Time)) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeStore) ListStormCoverageFactorsForService(ctx context.Context, serviceID int64) ([]db.ListStormCoverageFactorsForServiceRow, error) {
+	return f.factors[serviceID], nil
+}
+
+func (f *fakeStore) ListDNSWeightChangesForWindow(ctx context.Context, arg db.ListDNSWeightChangesForWindowParams) ([]db.ListDNSWeightChangesForWindowRow, error) {
+	inForce := make(map[string]fakeWeightChange)
+	var during []db.ListDNSWeightChangesForWindowRow
+	for _, c := range f.weights[arg.ServiceID] {
+		if !f.domains[arg.ServiceID][c.domain] {
+			continue
+		}
+		switch {
+		case !c.appliedAt.After(arg.WindowStart):
+			if prev, ok := inForce[c.domain]; !ok || !c.appliedAt.Before(prev.appliedAt) {
+				inForce[c.domain] = c
+			}
+		case c.appliedAt.Before(arg.WindowEnd):
+			during = append(during, db.ListDNSWeightChangesForWindowRow{Domain: c.domain, PrimaryWeight: c.primaryWeight, BackupWeight: c.backupWeight, AppliedAt: c.appliedAt})
+		}
+	}
+	out := []db.ListDNSWeightChangesForWindowRow{}
+	for _, c := range inForce {
+		out = append(out, db.ListDNSWeightChangesForWindowRow{Domain: c.domain, PrimaryWeight: c.primaryWeight, BackupWeight: c.backupWeight, AppliedAt: c.appliedAt})
+	}
+	out = append(out, during...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if !out[i].AppliedAt.Equal(out[j].AppliedAt) {
+			return out[i].AppliedAt.Before(out[j].AppliedAt)
+		}
+		return out[i].Domain < out[j].Domain
+	})
+	return out, nil
+}
+
+func (f *fakeStore) GetCustomerBillingSettings(ctx context.Context, id int64) (db.GetCustomerBillingSettingsRow, error) {
+	row, ok := f.customers[id]
+	if !ok {
+		return db.GetCustomerBillingSettingsRow{}, sql.ErrNoRows
+	}
+	return row, nil
+}
+
+func (f *fakeStore) ListCustomerPlans(ctx context.Context, customerID int64) ([]db.CustomerPlan, error) {
+	return f.plans[customerID], nil
+}
+
+func (f *fakeStore) GetPricingPlan(ctx context.Context, id int64) (db.PricingPlan, error) {
+	plan, ok := f.pricingPlans[id]
+	if !ok {
+		return db.PricingPlan{}, sql.ErrNoRows
+	}
+	return plan, nil
+}
+
+func (f *fakeStore) GetCustomerBilledBytes(ctx context.Context, arg db.GetCustomerBilledBytesParams) (int64, error) {
+	var bytes int64
+	for _, item := range f.billedItems(func(item db.InvoiceLineItem) bool {
+		return (item.Kind == lineKindUsage || item.Kind == lineKindAdjustment) &&
+			!item.WindowStart.Before(arg.PeriodStart) && item.WindowStart.Before(arg.PeriodEnd)
+	}) {
+		if inv := f.invoice(item.InvoiceID); inv.CustomerID == arg.CustomerID && inv.Currency == arg.Currency {
+			bytes += item.PrimaryBytes + item.BackupBytes
+		}
+	}
+	return bytes, nil
+}
+
+func (f *fakeStore) GetInvoiceForPeriod(ctx context.Context, arg db.GetInvoiceForPeriodParams) (db.Invoice, error) {
+	for i := len(f.invoices) - 1; i >= 0; i-- {
+		inv := f.invoices[i]
+		if inv.CustomerID == arg.CustomerID && inv.PeriodStart.Equal(arg.PeriodStart) && inv.Currency == arg.Currency && inv.Status != invoiceStatusVoid {
+			return inv, nil
+		}
+	}
+	return db.Invoice{}, sql.ErrNoRows
+}
+
+func (f *fakeStore) InsertDraftInvoice(ctx context.Context, arg db.InsertDraftInvoiceParams) (db.Invoice, error) {
+	inv := db.Invoice{
+		ID:                int64(len(f.invoices) + 1),
+		CustomerID:        arg.CustomerID,
+		PeriodStart:       arg.PeriodStart,
+		PeriodEnd:         arg.PeriodEnd,
+		Currency:          arg.Currency,
+		ReplacesInvoiceID: arg.ReplacesInvoiceID,
+		Status:            invoiceStatusDraft,
+		ExportStatus:      "pending",
+	}
+	f.invoices = append(f.invoices, inv)
+	return inv, nil
+}
+
+func (f *fakeStore) InsertInvoiceLineItem(ctx context.Context, arg db.InsertInvoiceLineItemParams) (db.InvoiceLineItem, error) {
+	item := db.InvoiceLineItem{
+		ID:               int64(len(f.lineItems) + 1),
+		InvoiceID:        arg.InvoiceID,
+		ServiceID:        arg.ServiceID,
+		WindowStart:      arg.WindowStart,
+		WindowEnd:        arg.WindowEnd,
+		PrimaryBytes:     arg.PrimaryBytes,
+		BackupBytes:      arg.BackupBytes,
+		CoverageFactor:   arg.CoverageFactor,
+		AmountCents:      arg.AmountCents,
+		DiscountCents:    arg.DiscountCents,
+		Kind:             arg.Kind,
+		AdjustsInvoiceID: arg.AdjustsInvoiceID,
+		PrimaryRequests:  arg.PrimaryRequests,
+		BackupRequests:   arg.BackupRequests,
+		AmountMicros:     arg.AmountMicros,
+		DiscountMicros:   arg.DiscountMicros,
+		StormBreakdown:   arg.StormBreakdown,
+		Pricing:          arg.Pricing,
+	}
+	f.lineItems = append(f.lineItems, item)
+	return item, nil
+}
+
+func (f *fakeStore) SetInvoiceAmounts(ctx context.Context, arg db.SetInvoiceAmountsParams) (int64, error) {
+	inv := f.invoice(arg.ID)
+	if inv == nil || inv.Status != invoiceStatusDraft {
+		return 0, nil
+	}
+	inv.SubtotalMicros, inv.DiscountMicros = arg.SubtotalMicros, arg.DiscountMicros
+	inv.SubtotalCents, inv.DiscountCents, inv.TotalCents = arg.SubtotalCents, arg.DiscountCents, arg.TotalCents
+	return 1, nil
+}
+
+func (f *fakeStore) MarkUsageSnapshotInvoiced(ctx context.Context, arg db.MarkUsageSnapshotInvoicedParams) error {
+	f.snapshotInvoice[arg.ID] = arg.InvoiceID.Int64
+	return nil
+}
+
+func (f *fakeStore) SettleUsageRevision(ctx context.Context, arg db.SettleUsageRevisionParams) error {
+	f.settled[arg.ID] = arg.InvoiceID
+	return nil
+}
+
+func (f *fakeStore) ListDueDraftInvoices(ctx context.Context, periodEnd time.Time) ([]db.Invoice, error) {
+	var out []db.Invoice
+	for _, inv := range f.invoices {
+		if inv.Status == invoiceStatusDraft && !inv.PeriodEnd.After(periodEnd) {
+			out = append(out, inv)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeStore) ListInvoiceLineItems(ctx context.Context, invoiceID int64) ([]db.InvoiceLineItem, error) {
+	return f.itemsOn(invoiceID), nil
+}
+
+func (f *fakeStore) UpdateInvoiceLineItemCents(ctx context.Context, arg db.UpdateInvoiceLineItemCentsParams) error {
+	item := &f.lineItems[arg.ID-1]
+	item.AmountCents, item.DiscountCents = arg.AmountCents, arg.DiscountCents
+	return nil
+}
+
+func (f *fakeStore) ListInvoiceServiceCharges(ctx context.Context, invoiceID int64) ([]db.ListInvoiceServiceChargesRow, error) {
+	net := make(map[int64]int64)
+	for _, item := range f.itemsOn(invoiceID) {
+		if item.Kind == lineKindUsage || item.Kind == lineKindAdjustment {
+			net[item.ServiceID.Int64] += item.AmountMicros - item.DiscountMicros
+		}
+	}
+	out := []db.ListInvoiceServiceChargesRow{}
+	for id, micros := range net {
+		out = append(out, db.ListInvoiceServiceChargesRow{ServiceID: id, NetMicros: micros})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ServiceID < out[j].ServiceID })
+	return out, nil
+}
+
+func (f *fakeStore) GetSLADefinition(ctx context.Context, id int64) (db.SlaDefinition, error) {
+	def, ok := f.slas[id]
+	if !ok {
+		return db.SlaDefinition{}, sql.ErrNoRows
+	}
+	return def, nil
+}
+
+func (f *fakeStore) GetServiceDowntime(ctx context.Context, arg db.GetServiceDowntimeParams) (db.GetServiceDowntimeRow, error) {
+	return f.downtime[arg.ServiceID], nil
+}
+
+func (f *fakeStore) InsertSLAResult(ctx context.Context, arg db.InsertSLAResultParams) (db.SlaResult, error) {
+	f.slaResults = append(f.slaResults, arg)
+	return db.SlaResult{InvoiceID: arg.InvoiceID, ServiceID: arg.ServiceID, CreditCents: arg.CreditCents}, nil
+}
+
+func (f *fakeStore) FinalizeInvoice(ctx context.Context, id int64) (db.Invoice, error) {
+	inv := f.invoice(id)
+	if inv == nil || inv.Status != invoiceStatusDraft {
+		return db.Invoice{}, sql.ErrNoRows
+	}
+	inv.Status = invoiceStatusFinalized
+	return *inv, nil
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...any) {}
+
+func newTestEngine(cfg Config) *Engine {
+	if cfg.BytesPerGB == 0 {
+		cfg.BytesPerGB = BytesPerGB
+	}
+	return NewEngine(nil, discardLogger{}, nil, cfg)
+}
+
+func TestRunBillsBackfilledWindows(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	f := newFakeStore()
+	recent := f.addSnapshot(1, 10, now.Add(-2*time.Hour), now.Add(-time.Hour), BytesPerGB, 0)
+	backfilled := f.addSnapshot(1, 10, now.Add(-72*time.Hour), now.Add(-71*time.Hour), 2*BytesPerGB, 0)
+	f.addSnapshot(1, 10, now, now.Add(time.Hour), BytesPerGB, 0)
+
+	e := newTestEngine(Config{RateCentsPerGB: 10, FinalizeDelay: 72 * time.Hour})
+	report, err := e.runIn(context.Background(), f, now)
+	if err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if report.drafts != 1 {
+		t.Fatalf("expected one draft, got %+v", report)
+	}
+	for _, id := range []int64{recent, backfilled} {
+		if _, ok := f.snapshotInvoice[id]; !ok {
+			t.Fatalf("snapshot %d was not billed", id)
+		}
+	}
+	if _, ok := f.snapshotInvoice[3]; ok {
+		t.Fatalf("snapshot of a window that has not ended was billed")
+	}
+	inv := f.invoices[0]
+	if inv.TotalCents != 30 || len(f.itemsOn(inv.ID)) != 2 {
+		t.Fatalf("expected both windows on a 30 cent draft, got %+v with %d items", inv, len(f.itemsOn(inv.ID)))
+	}
+}
+
+func TestRunBillsBackfillForFinalizedPeriodOnCurrentDraft(t *testing.T) {
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	f := newFakeStore()
+	f.addSnapshot(1, 10, time.Date(2024, 2, 27, 10, 0, 0, 0, time.UTC), time.Date(2024, 2, 27, 11, 0, 0, 0, time.UTC), BytesPerGB, 0)
+	f.invoices = append(f.invoices, db.Invoice{
+		ID:          1,
+		CustomerID:  1,
+		PeriodStart: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		PeriodEnd:   time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		Currency:    "usd",
+		Status:      invoiceStatusFinalized,
+	})
+
+	e := newTestEngine(Config{RateCentsPerGB: 10})
+	if _, err := e.runIn(context.Background(), f, now); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if len(f.invoices) != 2 {
+		t.Fatalf("expected a new draft, got %+v", f.invoices)
+	}
+	draft := f.invoices[1]
+	if !draft.PeriodStart.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) || draft.Status != invoiceStatusDraft || draft.TotalCents != 10 {
+		t.Fatalf("expected the late window on March's draft, got %+v", draft)
+	}
+	if f.snapshotInvoice[1] != draft.ID {
+		t.Fatalf("expected the snapshot billed on invoice %d, got %d", draft.ID, f.snapshotInvoice[1])
+	}
+}
+
+func TestRunBillsUsageForClosedCurrentPeriodOnNextDraft(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	window := time.Date(2024, 3, 9, 10, 0, 0, 0, time.UTC)
+	f := newFakeStore()
+	// Customer 1's March invoice was finalized before the period ended.
+	closed := f.addSnapshot(1, 10, window, window.Add(time.Hour), BytesPerGB, 0)
+	f.invoices = append(f.invoices, db.Invoice{
+		ID:          1,
+		CustomerID:  1,
+		PeriodStart: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		PeriodEnd:   time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		Currency:    "usd",
+		Status:      invoiceStatusFinalized,
+	})
+	open := f.addSnapshot(2, 20, window, window.Add(time.Hour), 2*BytesPerGB, 0)
+
+	e := newTestEngine(Config{RateCentsPerGB: 10})
+	if _, err := e.runIn(context.Background(), f, now); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if len(f.invoices) != 3 {
+		t.Fatalf("expected two new drafts, got %+v", f.invoices)
+	}
+	for _, tc := range []struct {
+		snapshotID  int64
+		customerID  int64
+		periodStart time.Time
+		totalCents  int64
+	}{
+		{closed, 1, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), 10},
+		{open, 2, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), 20},
+	} {
+		inv := f.invoice(f.snapshotInvoice[tc.snapshotID])
+		if inv == nil || inv.CustomerID != tc.customerID || !inv.PeriodStart.Equal(tc.periodStart) || inv.Status != invoiceStatusDraft || inv.TotalCents != tc.totalCents {
+			t.Fatalf("expected snapshot %d on a %d cent draft for customer %d starting %s, got %+v", tc.snapshotID, tc.totalCents, tc.customerID, tc.periodStart, inv)
+		}
+	}
+	if f.invoices[0].TotalCents != 0 || len(f.itemsOn(1)) != 0 {
+		t.Fatalf("expected the finalized invoice to be untouched, got %+v", f.invoices[0])
+	}
+}
+
+func TestRevisionPricedAtOriginalRates(t *testing.T) {
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	f := newFakeStore()
+	snap := f.addSnapshot(1, 10, start, start.Add(time.Hour), BytesPerGB, 0)
+	if _, err := newTestEngine(Config{RateCentsPerGB: 10}).runIn(context.Background(), f, start.Add(2*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if p := f.lineItems[0].Pricing; !p.Valid || p.RateCentsPerGB != 10 || p.Currency != "usd" {
+		t.Fatalf("expected the usage line to record its rates, got %+v", p)
+	}
+
+	// The rate doubles before the window is revised to twice the bytes: only the extra GB
+	// is billed, at the rate the window was first billed at.
+	f.addRevision(snap, 2*BytesPerGB, 0)
+	if _, err := newTestEngine(Config{RateCentsPerGB: 20}).runIn(context.Background(), f, start.Add(3*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	adj := f.lineItems[1]
+	if adj.Kind != lineKindAdjustment || adj.AmountMicros != int64(money.FromCents(10)) || adj.PrimaryBytes != BytesPerGB {
+		t.Fatalf("expected a 10 cent adjustment for one GB, got %+v", adj)
+	}
+	if adj.Pricing.RateCentsPerGB != 10 {
+		t.Fatalf("expected the adjustment to carry the original rates, got %+v", adj.Pricing)
+	}
+}
+
+func TestRevisionIgnoresPlanChangeSinceBilling(t *testing.T) {
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	f := newFakeStore()
+	snap := f.addSnapshot(1, 10, start, start.Add(time.Hour), BytesPerGB, 0)
+	f.pricingPlans[7] = db.PricingPlan{ID: 7, PrimaryRateCentsPerGb: 10, BackupRateCentsPerGb: 10, Currency: "usd"}
+	f.plans[1] = []db.CustomerPlan{{CustomerID: 1, PlanID: 7, EffectiveFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	e := newTestEngine(Config{RequestRateCentsPerMillion: 100})
+	if _, err := e.runIn(context.Background(), f, start.Add(2*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+
+	// The plan's rate is raised, then the window is revised with a million more requests
+	// and the same bytes: the adjustment bills the requests and nothing for the bytes.
+	plan := f.pricingPlans[7]
+	plan.PrimaryRateCentsPerGb = 50
+	f.pricingPlans[7] = plan
+	rev := f.addRevision(snap, BytesPerGB, 0)
+	f.revisions[rev-1].PrimaryRequests = 1_000_000
+	if _, err := e.runIn(context.Background(), f, start.Add(3*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if len(f.lineItems) != 2 {
+		t.Fatalf("expected one adjustment, got %+v", f.lineItems)
+	}
+	if adj := f.lineItems[1]; adj.AmountMicros != int64(money.FromCents(100)) || adj.PrimaryBytes != 0 || adj.Pricing.PlanID != 7 {
+		t.Fatalf("expected a 100 cent adjustment for the requests alone, got %+v", adj)
+	}
+}
+
+func TestRevisionOfLegacyLineUsesCurrentRates(t *testing.T) {
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	f := newFakeStore()
+	snap := f.addSnapshot(1, 10, start, start.Add(time.Hour), BytesPerGB, 0)
+	if _, err := newTestEngine(Config{RateCentsPerGB: 10}).runIn(context.Background(), f, start.Add(2*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	f.lineItems[0].Pricing = db.LinePricing{}
+
+	f.addRevision(snap, 2*BytesPerGB, 0)
+	if _, err := newTestEngine(Config{RateCentsPerGB: 20}).runIn(context.Background(), f, start.Add(3*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if adj := f.lineItems[1]; adj.AmountMicros != int64(money.FromCents(30)) || !adj.Pricing.Valid {
+		t.Fatalf("expected the legacy window repriced at 20 cents less the 10 billed, got %+v", adj)
+	}
+}
+
+func TestRevisionKeepsOriginalCurrency(t *testing.T) {
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	f := newFakeStore()
+	snap := f.addSnapshot(1, 10, start, start.Add(time.Hour), BytesPerGB, 0)
+	f.pricingPlans[7] = db.PricingPlan{ID: 7, PrimaryRateCentsPerGb: 10, Currency: "usd"}
+	f.plans[1] = []db.CustomerPlan{{CustomerID: 1, PlanID: 7, EffectiveFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	e := newTestEngine(Config{})
+	if _, err := e.runIn(context.Background(), f, start.Add(2*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+
+	// The plan is switched to euros before the window is revised.
+	plan := f.pricingPlans[7]
+	plan.Currency = "eur"
+	f.pricingPlans[7] = plan
+	f.addRevision(snap, 2*BytesPerGB, 0)
+	if _, err := e.runIn(context.Background(), f, start.Add(3*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if len(f.invoices) != 1 {
+		t.Fatalf("expected the adjustment on the usd draft, got %+v", f.invoices)
+	}
+	if adj := f.lineItems[1]; adj.AmountMicros != int64(money.FromCents(10)) || adj.Pricing.Currency != "usd" {
+		t.Fatalf("expected a 10 cent usd adjustment, got %+v", adj)
+	}
+}
+
+func TestLegacyRevisionInAnotherCurrencyIsLeftUnsettled(t *testing.T) {
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	f := newFakeStore()
+	snap := f.addSnapshot(1, 10, start, start.Add(time.Hour), BytesPerGB, 0)
+	e := newTestEngine(Config{RateCentsPerGB: 10})
+	if _, err := e.runIn(context.Background(), f, start.Add(2*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	f.lineItems[0].Pricing = db.LinePricing{}
+
+	// Without recorded pricing the revision would be priced on the customer's new euro
+	// plan and subtracted from what was billed in dollars.
+	f.pricingPlans[7] = db.PricingPlan{ID: 7, PrimaryRateCentsPerGb: 10, Currency: "eur"}
+	f.plans[1] = []db.CustomerPlan{{CustomerID: 1, PlanID: 7, EffectiveFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	rev := f.addRevision(snap, 2*BytesPerGB, 0)
+	if _, err := e.runIn(context.Background(), f, start.Add(3*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if len(f.lineItems) != 1 || len(f.invoices) != 1 {
+		t.Fatalf("expected no adjustment, got %+v", f.lineItems)
+	}
+	if _, ok := f.settled[rev]; ok {
+		t.Fatalf("expected revision %d to stay unsettled", rev)
+	}
+}
+
+func TestPlanVolumeIsCountedPerCurrency(t *testing.T) {
+	f := newFakeStore()
+	f.pricingPlans[1] = db.PricingPlan{ID: 1, PrimaryRateCentsPerGb: 10, Currency: "usd"}
+	f.pricingPlans[2] = db.PricingPlan{
+		ID:                    2,
+		PrimaryRateCentsPerGb: 10,
+		Tiers:                 db.PlanTiers{{FromGB: 1, PrimaryRateCentsPerGB: 1}},
+		Currency:              "eur",
+	}
+	f.plans[1] = []db.CustomerPlan{
+		{CustomerID: 1, PlanID: 1, EffectiveFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{CustomerID: 1, PlanID: 2, EffectiveFrom: time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)},
+	}
+	f.addSnapshot(1, 10, time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 10, 1, 0, 0, 0, time.UTC), 2*BytesPerGB, 0)
+	f.addSnapshot(1, 10, time.Date(2024, 3, 20, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 20, 1, 0, 0, 0, time.UTC), BytesPerGB, 0)
+	if _, err := newTestEngine(Config{}).runIn(context.Background(), f, time.Date(2024, 3, 21, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	for _, inv := range f.invoices {
+		if inv.Currency == "eur" && inv.TotalCents != 10 {
+			t.Fatalf("expected the first euro GB at the base rate, got %+v", inv)
+		}
+	}
+	if len(f.invoices) != 2 {
+		t.Fatalf("expected one invoice per currency, got %+v", f.invoices)
+	}
+}
+
+func TestFinalizeCreditsSLABeforeMinimumCommit(t *testing.T) {
+	tests := []struct {
+		name string
+		// usageGB are billed at 10 cents a GB against a 500 cent commit.
+		usageGB     int64
+		downMinutes int64
+		wantCredit  int64
+		wantCommit  int64
+		wantTotal   int64
+	}{
+		// 99.76% available earns 10% of the 100 cent usage; the commit tops the rest up.
+		{name: "under the commit", usageGB: 10, downMinutes: 100, wantCredit: 10, wantCommit: 410, wantTotal: 500},
+		// 97.6% available earns 50% of 600 cents, which would leave the invoice at 300.
+		{name: "credit takes usage below the commit", usageGB: 60, downMinutes: 1000, wantCredit: 300, wantCommit: 200, wantTotal: 500},
+		{name: "credit leaves usage above the commit", usageGB: 120, downMinutes: 100, wantCredit: 120, wantTotal: 1080},
+		{name: "sla met", usageGB: 60, wantTotal: 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeStore()
+			f.slas[3] = db.SlaDefinition{ID: 3, Tiers: db.SLATiers{{BelowPercent: 99.9, CreditPercent: 10}, {BelowPercent: 99, CreditPercent: 50}}}
+			f.pricingPlans[1] = db.PricingPlan{
+				ID:                    1,
+				PrimaryRateCentsPerGb: 10,
+				MinimumMonthlyCents:   500,
+				SlaDefinitionID:       sql.NullInt64{Int64: 3, Valid: true},
+				Currency:              "usd",
+			}
+			f.plans[1] = []db.CustomerPlan{{CustomerID: 1, PlanID: 1, EffectiveFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}}
+			f.downtime[10] = db.GetServiceDowntimeRow{DownMinutes: tt.downMinutes}
+			f.addSnapshot(1, 10, time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 5, 1, 0, 0, 0, time.UTC), tt.usageGB*BytesPerGB, 0)
+			e := newTestEngine(Config{})
+			if _, err := e.runIn(context.Background(), f, time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC)); err != nil {
+				t.Fatalf("runIn: %v", err)
+			}
+			if _, err := e.runIn(context.Background(), f, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+				t.Fatalf("runIn: %v", err)
+			}
+
+			inv := f.invoices[0]
+			if inv.Status != invoiceStatusFinalized || inv.TotalCents != tt.wantTotal {
+				t.Fatalf("expected a finalized invoice of %d cents, got %+v", tt.wantTotal, inv)
+			}
+			var credit, commit int64
+			var kinds []string
+			for _, item := range f.itemsOn(inv.ID) {
+				kinds = append(kinds, item.Kind)
+				switch item.Kind {
+				case lineKindSLACredit:
+					credit -= item.AmountCents
+				case lineKindMinimumCommit:
+					commit += item.AmountCents
+				}
+			}
+			if credit != tt.wantCredit || commit != tt.wantCommit {
+				t.Fatalf("expected a %d cent credit and %d cent commit, got %d and %d (%v)", tt.wantCredit, tt.wantCommit, credit, commit, kinds)
+			}
+			if len(f.slaResults) != 1 || f.slaResults[0].CreditCents != tt.wantCredit {
+				t.Fatalf("expected one sla result crediting %d cents, got %+v", tt.wantCredit, f.slaResults)
+			}
+		})
+	}
+}
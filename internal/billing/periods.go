@@ -0,0 +1,58 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// calendar caches customers' billing settings for the duration of one billing run.
+type calendar struct {
+	log      Logger
+	settings map[int64]periodSettings
+}
+
+type periodSettings struct {
+	loc       *time.Location
+	anchorDay int
+}
+
+func newCalendar(log Logger) *calendar {
+	return &calendar{log: log, settings: make(map[int64]periodSettings)}
+}
+
+// periodFor returns the customer's billing period containing t as UTC instants.
+func (c *calendar) periodFor(ctx context.Context, q store, customerID int64, t time.Time) (time.Time, time.Time, error) {
+	s, ok := c.settings[customerID]
+	if !ok {
+		row, err := q.GetCustomerBillingSettings(ctx, customerID)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("billing settings for customer %d: %w", customerID, err)
+		}
+		loc, err := time.LoadLocation(row.BillingTimezone)
+		if err != nil {
+			// A bad zone must not hold up everyone else's billing.
+			c.log.Printf("customer %d billing timezone %q: %v; using UTC", customerID, row.BillingTimezone, err)
+			loc = time.UTC
+		}
+		s = periodSettings{loc: loc, anchorDay: int(row.BillingAnchorDay)}
+		c.settings[customerID] = s
+	}
+	start, end := Period(t, s.loc, s.anchorDay)
+	return start, end, nil
+}
+
+// Period returns the month-long period containing t that starts at midnight on
+// anchorDay in loc. Anchor days stop at 28 so every month has one.
+func Period(t time.Time, loc *time.Location, anchorDay int) (time.Time, time.Time) {
+	if anchorDay < 1 || anchorDay > 28 {
+		anchorDay = 1
+	}
+	local := t.In(loc)
+	start := time.Date(local.Year(), local.Month(), anchorDay, 0, 0, 0, 0, loc)
+	if start.After(local) {
+		start = time.Date(local.Year(), local.Month()-1, anchorDay, 0, 0, 0, 0, loc)
+	}
+	end := time.Date(start.Year(), start.Month()+1, anchorDay, 0, 0, 0, 0, loc)
+	return start.UTC(), end.UTC()
+}
@@ -0,0 +1,116 @@
+package billing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tranche/internal/db"
+)
+
+func TestPeriod(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("load zone: %v", err)
+	}
+	utc := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name      string
+		t         time.Time
+		loc       *time.Location
+		anchorDay int
+		start     time.Time
+		end       time.Time
+	}{
+		{"anchor 1 mid month", utc(2024, 3, 15, 12, 0), time.UTC, 1, utc(2024, 3, 1, 0, 0), utc(2024, 4, 1, 0, 0)},
+		{"anchor 1 last instant of January", utc(2024, 1, 31, 23, 59).Add(59*time.Second + 999999999), time.UTC, 1, utc(2024, 1, 1, 0, 0), utc(2024, 2, 1, 0, 0)},
+		{"anchor 1 exactly on the boundary", utc(2024, 2, 1, 0, 0), time.UTC, 1, utc(2024, 2, 1, 0, 0), utc(2024, 3, 1, 0, 0)},
+		{"anchor 15 January into February", utc(2024, 2, 3, 0, 0), time.UTC, 15, utc(2024, 1, 15, 0, 0), utc(2024, 2, 15, 0, 0)},
+		{"anchor 15 exactly on the boundary", utc(2024, 2, 15, 0, 0), time.UTC, 15, utc(2024, 2, 15, 0, 0), utc(2024, 3, 15, 0, 0)},
+		{"anchor 28 before the anchor", utc(2024, 2, 10, 0, 0), time.UTC, 28, utc(2024, 1, 28, 0, 0), utc(2024, 2, 28, 0, 0)},
+		{"anchor 28 leap day", utc(2024, 2, 29, 8, 0), time.UTC, 28, utc(2024, 2, 28, 0, 0), utc(2024, 3, 28, 0, 0)},
+		{"anchor 28 across the year", utc(2025, 1, 5, 0, 0), time.UTC, 28, utc(2024, 12, 28, 0, 0), utc(2025, 1, 28, 0, 0)},
+		{"out of range anchor falls back to 1", utc(2024, 3, 15, 0, 0), time.UTC, 31, utc(2024, 3, 1, 0, 0), utc(2024, 4, 1, 0, 0)},
+		// Clocks go forward on 10 March 2024, so the period ends an hour earlier in UTC
+		// than it starts.
+		{"spring forward inside the period", utc(2024, 3, 15, 0, 0), newYork, 1, utc(2024, 3, 1, 5, 0), utc(2024, 4, 1, 4, 0)},
+		{"spring forward on the anchor day", utc(2024, 3, 20, 0, 0), newYork, 10, utc(2024, 3, 10, 5, 0), utc(2024, 4, 10, 4, 0)},
+		{"local day before the anchor", utc(2024, 3, 10, 4, 30), newYork, 10, utc(2024, 2, 10, 5, 0), utc(2024, 3, 10, 5, 0)},
+		{"fall back inside the period", utc(2024, 11, 20, 0, 0), newYork, 1, utc(2024, 11, 1, 4, 0), utc(2024, 12, 1, 5, 0)},
+		{"local boundary in a zone", utc(2024, 11, 1, 4, 0), newYork, 1, utc(2024, 11, 1, 4, 0), utc(2024, 12, 1, 5, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := Period(tt.t, tt.loc, tt.anchorDay)
+			if !start.Equal(tt.start) || !end.Equal(tt.end) {
+				t.Fatalf("got %s to %s, want %s to %s", start, end, tt.start, tt.end)
+			}
+			if start.Location() != time.UTC || end.Location() != time.UTC {
+				t.Fatalf("expected UTC instants, got %s and %s", start.Location(), end.Location())
+			}
+		})
+	}
+}
+
+func TestCalendarFallsBackToUTCForUnknownZone(t *testing.T) {
+	f := newFakeStore()
+	f.customers[1] = db.GetCustomerBillingSettingsRow{BillingTimezone: "Mars/Olympus_Mons", BillingAnchorDay: 5}
+	start, end, err := newCalendar(discardLogger{}).periodFor(context.Background(), f, 1, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("periodFor: %v", err)
+	}
+	if !start.Equal(time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC)) || !end.Equal(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the UTC period, got %s to %s", start, end)
+	}
+}
+
+func TestLateUsageMovesToCurrentDraftOnceFinalized(t *testing.T) {
+	f := newFakeStore()
+	hour := func(day, h int) time.Time { return time.Date(2024, 2, day, h, 0, 0, 0, time.UTC) }
+	f.addSnapshot(1, 10, hour(20, 0), hour(20, 1), BytesPerGB, 0)
+	e := newTestEngine(Config{RateCentsPerGB: 10, FinalizeDelay: 48 * time.Hour})
+
+	// Inside the finalize delay, late February usage still lands on February's draft.
+	f.addSnapshot(1, 10, hour(29, 23), hour(29, 24), BytesPerGB, 0)
+	report, err := e.runIn(context.Background(), f, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if report.finalized != 0 || len(f.invoices) != 1 || f.invoices[0].TotalCents != 20 {
+		t.Fatalf("expected one open 20 cent February draft, got %+v", f.invoices)
+	}
+
+	// The delay has passed: February is finalized as it stands.
+	report, err = e.runIn(context.Background(), f, time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if report.finalized != 1 || f.invoices[0].Status != invoiceStatusFinalized {
+		t.Fatalf("expected February to be finalized, got %+v", f.invoices[0])
+	}
+
+	// Usage for February arriving afterwards is billed on March's draft.
+	late := f.addSnapshot(1, 10, hour(28, 0), hour(28, 1), 3*BytesPerGB, 0)
+	if _, err := e.runIn(context.Background(), f, time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if len(f.invoices) != 2 {
+		t.Fatalf("expected a March draft, got %+v", f.invoices)
+	}
+	february, march := f.invoices[0], f.invoices[1]
+	if february.TotalCents != 20 || len(f.itemsOn(february.ID)) != 2 {
+		t.Fatalf("expected the finalized invoice to be untouched, got %+v", february)
+	}
+	if !march.PeriodStart.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) || march.Status != invoiceStatusDraft || march.TotalCents != 30 {
+		t.Fatalf("expected the late usage on a 30 cent March draft, got %+v", march)
+	}
+	if f.snapshotInvoice[late] != march.ID {
+		t.Fatalf("expected snapshot %d on invoice %d, got %d", late, march.ID, f.snapshotInvoice[late])
+	}
+	items := f.itemsOn(march.ID)
+	if len(items) != 1 || !items[0].WindowStart.Equal(hour(28, 0)) {
+		t.Fatalf("expected the line item to keep its February window, got %+v", items)
+	}
+}
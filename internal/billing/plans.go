@@ -0,0 +1,134 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/money"
+)
+
+// planState caches customers' plan assignments and tracks each customer's volume per billing
+// period for the duration of one billing run.
+type planState struct {
+	cal         *calendar
+	assignments map[int64][]db.CustomerPlan
+	plans       map[int64]*db.PricingPlan
+	volume      map[volumeKey]int64
+}
+
+type volumeKey struct {
+	customerID int64
+	period     time.Time
+	currency   string
+}
+
+func newPlanState(cal *calendar) *planState {
+	return &planState{
+		cal:         cal,
+		assignments: make(map[int64][]db.CustomerPlan),
+		plans:       make(map[int64]*db.PricingPlan),
+		volume:      make(map[volumeKey]int64),
+	}
+}
+
+// planAt returns the plan assigned to the customer at t, or nil when the customer has none.
+func (s *planState) planAt(ctx context.Context, q store, customerID int64, t time.Time) (*db.PricingPlan, error) {
+	assignments, ok := s.assignments[customerID]
+	if !ok {
+		var err error
+		assignments, err = q.ListCustomerPlans(ctx, customerID)
+		if err != nil {
+			return nil, fmt.Errorf("plans for customer %d: %w", customerID, err)
+		}
+		s.assignments[customerID] = assignments
+	}
+	var current *db.CustomerPlan
+	for i := range assignments {
+		if assignments[i].EffectiveFrom.After(t) {
+			break
+		}
+		current = &assignments[i]
+	}
+	if current == nil {
+		return nil, nil
+	}
+	if plan, ok := s.plans[current.PlanID]; ok {
+		return plan, nil
+	}
+	plan, err := q.GetPricingPlan(ctx, current.PlanID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("pricing plan %d for customer %d not found", current.PlanID, customerID)
+		}
+		return nil, fmt.Errorf("pricing plan %d: %w", current.PlanID, err)
+	}
+	s.plans[current.PlanID] = &plan
+	return &plan, nil
+}
+
+// addVolume records bytes against the customer's volume in currency for the billing period
+// containing t and returns the volume billed before them: what earlier invoices in that
+// currency covered plus what this run has priced so far. Volume priced in another currency
+// never moves a plan's tiers.
+func (s *planState) addVolume(ctx context.Context, q store, customerID int64, t time.Time, currency string, bytes int64) (int64, error) {
+	start, end, err := s.cal.periodFor(ctx, q, customerID, t)
+	if err != nil {
+		return 0, err
+	}
+	key := volumeKey{customerID: customerID, period: start, currency: currency}
+	offset, ok := s.volume[key]
+	if !ok {
+		offset, err = q.GetCustomerBilledBytes(ctx, db.GetCustomerBilledBytesParams{
+			CustomerID:  customerID,
+			Currency:    currency,
+			PeriodStart: start,
+			PeriodEnd:   end,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("period volume for customer %d: %w", customerID, err)
+		}
+	}
+	s.volume[key] = offset + bytes
+	return offset, nil
+}
+
+// planBytesCharge prices a window's bytes on a plan. The window occupies
+// [offset, offset+primary+backup) of the customer's volume for the billing period, where
+// offset is p.VolumeOffsetBytes; the share of that range falling into each tier is billed
+// at the tier's rates, and volume below the first tier at the plan's base rates. Tier
+// boundaries are whole GBs of p.BytesPerGB bytes.
+func planBytesCharge(p rates, primaryBytes, backupBytes int64) (money.Amount, money.Amount) {
+	total := primaryBytes + backupBytes
+	if total <= 0 {
+		return 0, 0
+	}
+	tiers := append([]db.PlanTier{{
+		PrimaryRateCentsPerGB: p.PrimaryRateCentsPerGB,
+		BackupRateCentsPerGB:  p.BackupRateCentsPerGB,
+	}}, p.Tiers...)
+	sort.SliceStable(tiers, func(i, j int) bool { return tiers[i].FromGB < tiers[j].FromGB })
+
+	var primary, backup money.Amount
+	bytesPerGB := p.BytesPerGB
+	start, end := p.VolumeOffsetBytes, p.VolumeOffsetBytes+total
+	for i, tier := range tiers {
+		from := tier.FromGB * bytesPerGB
+		to := int64(math.MaxInt64)
+		if i+1 < len(tiers) {
+			to = tiers[i+1].FromGB * bytesPerGB
+		}
+		overlap := min(end, to) - max(start, from)
+		if overlap <= 0 {
+			continue
+		}
+		primary += money.Rate(primaryBytes, tier.PrimaryRateCentsPerGB, bytesPerGB).Share(overlap, total)
+		backup += money.Rate(backupBytes, tier.BackupRateCentsPerGB, bytesPerGB).Share(overlap, total)
+	}
+	return primary, backup
+}
@@ -0,0 +1,230 @@
+package billing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/money"
+)
+
+func TestPlanBytesCharge(t *testing.T) {
+	const gb = BytesPerGB
+	tiers := db.PlanTiers{
+		{FromGB: 2, PrimaryRateCentsPerGB: 5, BackupRateCentsPerGB: 10},
+		{FromGB: 4, PrimaryRateCentsPerGB: 2, BackupRateCentsPerGB: 4},
+	}
+	reversed := db.PlanTiers{tiers[1], tiers[0]}
+	tests := []struct {
+		name        string
+		tiers       db.PlanTiers
+		offset      int64
+		primary     int64
+		backup      int64
+		wantPrimary money.Amount
+		wantBackup  money.Amount
+	}{
+		{name: "below the first tier", tiers: tiers, primary: gb, backup: gb, wantPrimary: money.FromCents(10), wantBackup: money.FromCents(20)},
+		{name: "starts on a tier boundary", tiers: tiers, offset: 2 * gb, primary: gb, wantPrimary: money.FromCents(5)},
+		{name: "ends on a tier boundary", tiers: tiers, offset: gb, primary: gb, wantPrimary: money.FromCents(10)},
+		{name: "overlaps one boundary", tiers: tiers, offset: gb, primary: gb, backup: gb, wantPrimary: money.FromCents(15) / 2, wantBackup: money.FromCents(15)},
+		{name: "overlaps two boundaries", tiers: tiers, offset: gb, primary: 4 * gb, wantPrimary: money.FromCents(22)},
+		{name: "inside the top tier", tiers: tiers, offset: 10 * gb, primary: gb, backup: gb, wantPrimary: money.FromCents(2), wantBackup: money.FromCents(4)},
+		{name: "tiers out of order", tiers: reversed, offset: gb, primary: gb, backup: gb, wantPrimary: money.FromCents(15) / 2, wantBackup: money.FromCents(15)},
+		{name: "no tiers", offset: 100 * gb, primary: gb, wantPrimary: money.FromCents(10)},
+		{name: "no bytes", tiers: tiers, offset: gb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := rates{
+				BytesPerGB:            gb,
+				PlanID:                1,
+				PrimaryRateCentsPerGB: 10,
+				BackupRateCentsPerGB:  20,
+				Tiers:                 tt.tiers,
+				VolumeOffsetBytes:     tt.offset,
+			}
+			primary, backup := planBytesCharge(p, tt.primary, tt.backup)
+			if primary != tt.wantPrimary || backup != tt.wantBackup {
+				t.Fatalf("got %d and %d micros, want %d and %d", primary, backup, tt.wantPrimary, tt.wantBackup)
+			}
+		})
+	}
+}
+
+func TestPlanAt(t *testing.T) {
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	f := newFakeStore()
+	f.pricingPlans[1] = db.PricingPlan{ID: 1, Name: "starter"}
+	f.pricingPlans[2] = db.PricingPlan{ID: 2, Name: "growth"}
+	f.plans[1] = []db.CustomerPlan{
+		{CustomerID: 1, PlanID: 1, EffectiveFrom: jan},
+		{CustomerID: 1, PlanID: 2, EffectiveFrom: feb},
+	}
+	f.plans[2] = []db.CustomerPlan{{CustomerID: 2, PlanID: 9, EffectiveFrom: jan}}
+
+	tests := []struct {
+		name     string
+		customer int64
+		t        time.Time
+		want     int64
+		wantErr  bool
+	}{
+		{name: "before any plan", customer: 1, t: jan.Add(-time.Nanosecond)},
+		{name: "on the first plan's start", customer: 1, t: jan, want: 1},
+		{name: "between plans", customer: 1, t: feb.Add(-time.Nanosecond), want: 1},
+		{name: "on the next plan's start", customer: 1, t: feb, want: 2},
+		{name: "customer without plans", customer: 3, t: feb},
+		{name: "plan that does not exist", customer: 2, t: feb, wantErr: true},
+	}
+	plans := newPlanState(newCalendar(discardLogger{}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := plans.planAt(context.Background(), f, tt.customer, tt.t)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got plan %+v", plan)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("planAt: %v", err)
+			}
+			var got int64
+			if plan != nil {
+				got = plan.ID
+			}
+			if got != tt.want {
+				t.Fatalf("got plan %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// tieredCustomer puts customer 1 on a plan billing 10 cents per GB for their first 2 GB
+// of a period and 5 cents after that, with two 1 GB windows already on February's draft.
+func tieredCustomer(t *testing.T) (*fakeStore, *Engine, int64, int64) {
+	t.Helper()
+	f := newFakeStore()
+	f.pricingPlans[1] = db.PricingPlan{
+		ID:                    1,
+		PrimaryRateCentsPerGb: 10,
+		BackupRateCentsPerGb:  10,
+		Tiers:                 db.PlanTiers{{FromGB: 2, PrimaryRateCentsPerGB: 5, BackupRateCentsPerGB: 5}},
+		Currency:              "usd",
+	}
+	f.plans[1] = []db.CustomerPlan{{CustomerID: 1, PlanID: 1, EffectiveFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	first := f.addSnapshot(1, 10, time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 5, 1, 0, 0, 0, time.UTC), BytesPerGB, 0)
+	second := f.addSnapshot(1, 10, time.Date(2024, 2, 6, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 6, 1, 0, 0, 0, time.UTC), BytesPerGB, 0)
+	e := newTestEngine(Config{})
+	if _, err := e.runIn(context.Background(), f, time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	if f.invoices[0].TotalCents != 20 {
+		t.Fatalf("expected both windows in the first tier, got %+v", f.invoices[0])
+	}
+	return f, e, first, second
+}
+
+func TestPlanRevisionPricedAtOriginalOffset(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy bool
+		revise func(first, second int64) (int64, int64)
+		// want is the adjustment in cents.
+		want int64
+	}{
+		// The first window grows by half a GB but still ends inside the first tier.
+		{name: "stays in its tier", revise: func(first, _ int64) (int64, int64) { return first, BytesPerGB * 3 / 2 }, want: 5},
+		// The second window doubles and its new GB is in the second tier.
+		{name: "crosses into the next tier", revise: func(_, second int64) (int64, int64) { return second, 2 * BytesPerGB }, want: 5},
+		// Without recorded pricing the window is taken to end the period's volume so far,
+		// which is exact for the latest window.
+		{name: "legacy line", legacy: true, revise: func(_, second int64) (int64, int64) { return second, 2 * BytesPerGB }, want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, e, first, second := tieredCustomer(t)
+			if tt.legacy {
+				for i := range f.lineItems {
+					f.lineItems[i].Pricing = db.LinePricing{}
+				}
+			}
+			snap, bytes := tt.revise(first, second)
+			f.addRevision(snap, bytes, 0)
+			run := e.newRun(f, time.Date(2024, 2, 11, 0, 0, 0, 0, time.UTC), f.GetInvoiceForPeriod)
+			revisions, _ := f.LockUnsettledUsageRevisions(context.Background())
+			if err := run.bill(context.Background(), nil, revisions); err != nil {
+				t.Fatalf("bill: %v", err)
+			}
+			inv := run.drafts[draftKey{1, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), "usd"}]
+			if inv == nil || len(inv.items) != 1 {
+				t.Fatalf("expected one adjustment, got %+v", inv)
+			}
+			if got := inv.items[0].Amount; got != money.FromCents(tt.want) {
+				t.Fatalf("got %d micros, want %d", got, money.FromCents(tt.want))
+			}
+			// The window's billed bytes are already in the volume; only the change is added.
+			key := volumeKey{customerID: 1, period: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), currency: "usd"}
+			if got, want := run.plans.volume[key], bytes+BytesPerGB; got != want {
+				t.Fatalf("expected the period volume to be %d bytes, got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestFinalizeBillsMinimumCommitShortfall(t *testing.T) {
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		plans     []db.CustomerPlan
+		usageGB   int64
+		wantCents int64
+		wantTotal int64
+	}{
+		{name: "below the commit", plans: []db.CustomerPlan{{PlanID: 1, EffectiveFrom: jan}}, usageGB: 1, wantCents: 490, wantTotal: 500},
+		{name: "above the commit", plans: []db.CustomerPlan{{PlanID: 1, EffectiveFrom: jan}}, usageGB: 60, wantTotal: 600},
+		{name: "no plan", usageGB: 1, wantTotal: 10},
+		// The plan at the end of the period bills in another currency, so its commit does
+		// not apply to the usd invoice.
+		{name: "plan in another currency at period end", plans: []db.CustomerPlan{
+			{PlanID: 1, EffectiveFrom: jan},
+			{PlanID: 2, EffectiveFrom: time.Date(2024, 2, 20, 0, 0, 0, 0, time.UTC)},
+		}, usageGB: 1, wantTotal: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeStore()
+			f.pricingPlans[1] = db.PricingPlan{ID: 1, PrimaryRateCentsPerGb: 10, MinimumMonthlyCents: 500, Currency: "usd"}
+			f.pricingPlans[2] = db.PricingPlan{ID: 2, PrimaryRateCentsPerGb: 10, MinimumMonthlyCents: 900, Currency: "eur"}
+			f.plans[1] = tt.plans
+			f.addSnapshot(1, 10, time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 5, 1, 0, 0, 0, time.UTC), tt.usageGB*BytesPerGB, 0)
+			e := newTestEngine(Config{RateCentsPerGB: 10})
+			if _, err := e.runIn(context.Background(), f, time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC)); err != nil {
+				t.Fatalf("runIn: %v", err)
+			}
+			report, err := e.runIn(context.Background(), f, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+			if err != nil {
+				t.Fatalf("runIn: %v", err)
+			}
+			inv := f.invoices[0]
+			if report.finalized != 1 || inv.Status != invoiceStatusFinalized || inv.TotalCents != tt.wantTotal {
+				t.Fatalf("expected a finalized invoice of %d cents, got %+v", tt.wantTotal, inv)
+			}
+			var commit []db.InvoiceLineItem
+			for _, item := range f.itemsOn(inv.ID) {
+				if item.Kind == lineKindMinimumCommit {
+					commit = append(commit, item)
+				}
+			}
+			switch {
+			case tt.wantCents == 0 && len(commit) != 0:
+				t.Fatalf("expected no minimum commit, got %+v", commit)
+			case tt.wantCents != 0 && (len(commit) != 1 || commit[0].AmountCents != tt.wantCents || commit[0].ServiceID.Valid):
+				t.Fatalf("expected a %d cent minimum commit, got %+v", tt.wantCents, commit)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/money"
+)
+
+// Preview is where a customer's draft invoices would stand if billing ran now.
+type Preview struct {
+	CustomerID int64            `json:"customer_id"`
+	AsOf       time.Time        `json:"as_of"`
+	Invoices   []PreviewInvoice `json:"invoices"`
+}
+
+// PreviewInvoice is one draft after the usage not yet billed on it. The amounts include what
+// the draft already holds; LineItems lists only what the next run would add. InvoiceID is
+// zero when the run would open the draft. DiscountCents is the storm discount accrued so far.
+type PreviewInvoice struct {
+	InvoiceID     int64             `json:"invoice_id,omitempty"`
+	PeriodStart   time.Time         `json:"period_start"`
+	PeriodEnd     time.Time         `json:"period_end"`
+	Currency      string            `json:"currency"`
+	LineItems     []PreviewLineItem `json:"line_items"`
+	SubtotalCents int64             `json:"subtotal_cents"`
+	DiscountCents int64             `json:"discount_cents"`
+	TotalCents    int64             `json:"total_cents"`
+	// ProjectedTotalCents extrapolates the total to the end of the period at the rate so
+	// far, raised to the plan's minimum commit. SLA credits are not projected.
+	ProjectedTotalCents int64 `json:"projected_total_cents"`
+}
+
+type PreviewLineItem struct {
+	Kind             string            `json:"kind"`
+	ServiceID        int64             `json:"service_id"`
+	AdjustsInvoiceID *int64            `json:"adjusts_invoice_id,omitempty"`
+	WindowStart      time.Time         `json:"window_start"`
+	WindowEnd        time.Time         `json:"window_end"`
+	PrimaryBytes     int64             `json:"primary_bytes"`
+	BackupBytes      int64             `json:"backup_bytes"`
+	PrimaryRequests  int64             `json:"primary_requests"`
+	BackupRequests   int64             `json:"backup_requests"`
+	CoverageFactor   float64           `json:"coverage_factor"`
+	AmountMicros     int64             `json:"amount_micros"`
+	DiscountMicros   int64             `json:"discount_micros"`
+	StormBreakdown   db.StormBreakdown `json:"storm_breakdown"`
+}
+
+// Preview prices the customer's unbilled usage and unsettled revisions the way RunOnce
+// would, in a read-only transaction, and reports the drafts they would land on. The
+// current period's draft is always included.
+func (e *Engine) Preview(ctx context.Context, customerID int64, now time.Time) (Preview, error) {
+	qtx, tx, err := e.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return Preview{}, fmt.Errorf("begin preview transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	snapshotRows, err := qtx.ListUnbilledUsageSnapshotsForCustomer(ctx, db.ListUnbilledUsageSnapshotsForCustomerParams{
+		CustomerID: customerID,
+		WindowEnd:  now,
+	})
+	if err != nil {
+		return Preview{}, fmt.Errorf("list unbilled snapshots: %w", err)
+	}
+	snapshots := make([]db.LockUnbilledUsageSnapshotsRow, len(snapshotRows))
+	for i, row := range snapshotRows {
+		snapshots[i] = db.LockUnbilledUsageSnapshotsRow(row)
+	}
+	revisionRows, err := qtx.ListUnsettledUsageRevisionsForCustomer(ctx, customerID)
+	if err != nil {
+		return Preview{}, fmt.Errorf("list unsettled usage revisions: %w", err)
+	}
+	revisions := make([]db.LockUnsettledUsageRevisionsRow, len(revisionRows))
+	for i, row := range revisionRows {
+		revisions[i] = db.LockUnsettledUsageRevisionsRow(row)
+	}
+
+	r := e.newRun(qtx, now, func(ctx context.Context, arg db.GetInvoiceForPeriodParams) (db.Invoice, error) {
+		return qtx.GetInvoiceForPeriodNoLock(ctx, db.GetInvoiceForPeriodNoLockParams(arg))
+	})
+	if err := r.bill(ctx, snapshots, revisions); err != nil {
+		return Preview{}, err
+	}
+	plan, err := r.plans.planAt(ctx, qtx, customerID, now)
+	if err != nil {
+		return Preview{}, err
+	}
+	currency := e.cfg.Currency
+	if plan != nil {
+		currency = plan.Currency
+	}
+	if _, err := r.draftFor(ctx, customerID, now, currency); err != nil {
+		return Preview{}, err
+	}
+
+	p := Preview{CustomerID: customerID, AsOf: now, Invoices: []PreviewInvoice{}}
+	for _, inv := range r.ordered() {
+		subtotal := money.Amount(inv.invoice.SubtotalMicros) + inv.subtotal
+		discount := money.Amount(inv.invoice.DiscountMicros) + inv.discount
+		out := PreviewInvoice{
+			InvoiceID:   inv.invoice.ID,
+			PeriodStart: inv.invoice.PeriodStart,
+			PeriodEnd:   inv.invoice.PeriodEnd,
+			Currency:    inv.invoice.Currency,
+			LineItems:   make([]PreviewLineItem, 0, len(inv.items)),
+		}
+		out.SubtotalCents, out.DiscountCents, out.TotalCents = e.round(subtotal, discount)
+		for _, item := range inv.items {
+			out.LineItems = append(out.LineItems, previewLineItem(item))
+		}
+		out.ProjectedTotalCents, err = r.project(ctx, inv.invoice, subtotal-discount)
+		if err != nil {
+			return Preview{}, err
+		}
+		p.Invoices = append(p.Invoices, out)
+	}
+	return p, nil
+}
+
+// project extrapolates an invoice's net amount over its whole period from the part of the
+// period elapsed by the run, then raises it to the minimum commit of the plan in effect at
+// the end of the period.
+func (r *run) project(ctx context.Context, invoice db.Invoice, net money.Amount) (int64, error) {
+	projected := net
+	period := invoice.PeriodEnd.Sub(invoice.PeriodStart)
+	elapsed := r.now.Sub(invoice.PeriodStart)
+	if seconds := int64(elapsed / time.Second); seconds > 0 && elapsed < period {
+		projected = net.Share(int64(period/time.Second), seconds)
+	}
+	plan, err := r.plans.planAt(ctx, r.q, invoice.CustomerID, invoice.PeriodEnd.Add(-time.Nanosecond))
+	if err != nil {
+		return 0, err
+	}
+	if plan != nil && plan.Currency == invoice.Currency && money.FromCents(plan.MinimumMonthlyCents) > projected {
+		projected = money.FromCents(plan.MinimumMonthlyCents)
+	}
+	return projected.Round(r.e.cfg.Rounding), nil
+}
+
+func previewLineItem(item lineItem) PreviewLineItem {
+	out := PreviewLineItem{
+		Kind:            item.Kind,
+		ServiceID:       item.ServiceID,
+		WindowStart:     item.WindowStart,
+		WindowEnd:       item.WindowEnd,
+		PrimaryBytes:    item.PrimaryBytes,
+		BackupBytes:     item.BackupBytes,
+		PrimaryRequests: item.PrimaryRequests,
+		BackupRequests:  item.BackupRequests,
+		CoverageFactor:  item.CoverageFactor,
+		AmountMicros:    int64(item.Amount),
+		DiscountMicros:  int64(item.Discount),
+		StormBreakdown:  item.Storms,
+	}
+	if item.AdjustsInvoiceID.Valid {
+		id := item.AdjustsInvoiceID.Int64
+		out.AdjustsInvoiceID = &id
+	}
+	if out.StormBreakdown == nil {
+		out.StormBreakdown = db.StormBreakdown{}
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/money"
+)
+
+// stormShares splits a window's backup traffic among the storms that moved it there, as
+// recorded by the DNS weights the dns-operator applied. The backup share of a service's
+// traffic at any moment is the mean over its domains of backup/(primary+backup); domains
+// with both weights zero split evenly. Before any weights were recorded, all traffic counts
+// as moved, so a storm's share is its share of the window's time. Traffic is taken to flow
+// evenly over the window, and storms that overlap split the traffic moved meanwhile
+// equally. Each storm is paired with its kind's coverage factor; kinds without a storm
+// policy count 1.
+func stormShares(windowStart, windowEnd time.Time, storms []db.StormEvent, weights []db.ListDNSWeightChangesForWindowRow, factors map[string]float64) db.StormBreakdown {
+	if len(storms) == 0 || !windowEnd.After(windowStart) {
+		return nil
+	}
+	clip := func(t time.Time) time.Time {
+		switch {
+		case t.Before(windowStart):
+			return windowStart
+		case t.After(windowEnd):
+			return windowEnd
+		}
+		return t
+	}
+	cuts := []time.Time{windowStart, windowEnd}
+	for _, storm := range storms {
+		cuts = append(cuts, clip(storm.StartedAt))
+		if storm.EndedAt.Valid {
+			cuts = append(cuts, clip(storm.EndedAt.Time))
+		}
+	}
+	for _, w := range weights {
+		cuts = append(cuts, clip(w.AppliedAt))
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i].Before(cuts[j]) })
+
+	inForce := make(map[string]float64)
+	next := 0
+	moved := make([]float64, len(storms))
+	var total float64
+	for i := 0; i+1 < len(cuts); i++ {
+		from, to := cuts[i], cuts[i+1]
+		if !to.After(from) {
+			continue
+		}
+		for ; next < len(weights) && !weights[next].AppliedAt.After(from); next++ {
+			w := weights[next]
+			share := 0.5
+			if sum := w.PrimaryWeight + w.BackupWeight; sum > 0 {
+				share = float64(w.BackupWeight) / float64(sum)
+			}
+			inForce[w.Domain] = share
+		}
+		backup := to.Sub(from).Seconds() * meanShare(inForce)
+		total += backup
+		var active []int
+		for k, storm := range storms {
+			if !storm.StartedAt.After(from) && (!storm.EndedAt.Valid || storm.EndedAt.Time.After(from)) {
+				active = append(active, k)
+			}
+		}
+		for _, k := range active {
+			moved[k] += backup / float64(len(active))
+		}
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	var out db.StormBreakdown
+	for k, storm := range storms {
+		if moved[k] <= 0 {
+			continue
+		}
+		factor, ok := factors[storm.Kind]
+		if !ok {
+			factor = 1
+		}
+		out = append(out, db.StormShare{
+			StormEventID:   storm.ID,
+			Kind:           storm.Kind,
+			Share:          moved[k] / total,
+			CoverageFactor: factor,
+		})
+	}
+	return out
+}
+
+// meanShare averages the backup share of the domains with weights in force; with none
+// recorded all traffic counts as movable.
+func meanShare(shares map[string]float64) float64 {
+	if len(shares) == 0 {
+		return 1
+	}
+	var sum float64
+	for _, s := range shares {
+		sum += s
+	}
+	return sum / float64(len(shares))
+}
+
+// discountStorms prices each storm's discount on the backup charge at rate times its share
+// and coverage factor, filling in the breakdown. It returns the total discount and the
+// window's effective coverage. A total above limit is scaled down to it, storm by storm.
+func discountStorms(shares db.StormBreakdown, backupCharge, limit money.Amount, rate float64) (money.Amount, float64) {
+	var total money.Amount
+	var coverage float64
+	for i, s := range shares {
+		d := backupCharge.MulFloat(rate * s.Share * s.CoverageFactor)
+		shares[i].DiscountMicros = int64(d)
+		total += d
+		coverage += s.Share * s.CoverageFactor
+	}
+	if total <= limit || len(shares) == 0 {
+		return total, coverage
+	}
+	var scaled money.Amount
+	for i := range shares {
+		if i == len(shares)-1 {
+			shares[i].DiscountMicros = int64(limit - scaled)
+			break
+		}
+		d := money.Amount(shares[i].DiscountMicros).Share(int64(limit), int64(total))
+		shares[i].DiscountMicros = int64(d)
+		scaled += d
+	}
+	return limit, coverage
+}
+
+// adjustStorms turns a revision's storm breakdown into its adjustment's: each storm's
+// discount less what was billed for it on the window before. Storms billed before that no
+// longer move the window's traffic are credited back with a zero share.
+func adjustStorms(current db.StormBreakdown, billed []db.ListBilledStormDiscountsForWindowRow) db.StormBreakdown {
+	prior := make(map[int64]db.ListBilledStormDiscountsForWindowRow, len(billed))
+	for _, b := range billed {
+		prior[b.StormEventID] = b
+	}
+	out := make(db.StormBreakdown, 0, len(current)+len(billed))
+	for _, s := range current {
+		s.DiscountMicros -= prior[s.StormEventID].DiscountMicros
+		delete(prior, s.StormEventID)
+		out = append(out, s)
+	}
+	for _, b := range billed {
+		if _, ok := prior[b.StormEventID]; ok && b.DiscountMicros != 0 {
+			out = append(out, db.StormShare{StormEventID: b.StormEventID, Kind: b.Kind, DiscountMicros: -b.DiscountMicros})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StormEventID < out[j].StormEventID })
+	return out
+}
+
+// coverageFactors returns the coverage factor of each storm kind with a policy on the
+// service, cached for the run.
+func (r *run) coverageFactors(ctx context.Context, serviceID int64) (map[string]float64, error) {
+	if factors, ok := r.coverage[serviceID]; ok {
+		return factors, nil
+	}
+	rows, err := r.q.ListStormCoverageFactorsForService(ctx, serviceID)
+	if err != nil {
+		return nil, fmt.Errorf("coverage factors for service %d: %w", serviceID, err)
+	}
+	factors := make(map[string]float64, len(rows))
+	for _, row := range rows {
+		factors[row.Kind] = row.MaxCoverageFactor
+	}
+	r.coverage[serviceID] = factors
+	return factors, nil
+}
@@ -0,0 +1,208 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/money"
+)
+
+func TestStormShares(t *testing.T) {
+	start := time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return start.Add(time.Duration(min) * time.Minute) }
+	storm := func(id int64, kind string, from, to int) db.StormEvent {
+		s := db.StormEvent{ID: id, ServiceID: 10, Kind: kind, StartedAt: at(from)}
+		if to >= 0 {
+			s.EndedAt = sql.NullTime{Time: at(to), Valid: true}
+		}
+		return s
+	}
+	weight := func(domain string, primary, backup int32, min int) db.ListDNSWeightChangesForWindowRow {
+		return db.ListDNSWeightChangesForWindowRow{Domain: domain, PrimaryWeight: primary, BackupWeight: backup, AppliedAt: at(min)}
+	}
+	factors := map[string]float64{"latency": 1.5}
+
+	tests := []struct {
+		name    string
+		storms  []db.StormEvent
+		weights []db.ListDNSWeightChangesForWindowRow
+		// want maps storm IDs to their share of the window's backup traffic.
+		want map[int64]float64
+	}{
+		// Only the storm moved traffic, so all of the window's backup traffic is its.
+		{
+			name:    "partial failover at 50/50",
+			storms:  []db.StormEvent{storm(1, "latency", 30, -1)},
+			weights: []db.ListDNSWeightChangesForWindowRow{weight("a", 100, 0, -10), weight("b", 100, 0, -10), weight("a", 50, 50, 30)},
+			want:    map[int64]float64{1: 1},
+		},
+		// A quarter of the traffic was on the backup before the storm and half during it.
+		{
+			name:    "partial failover at 50/50 over a standing split",
+			storms:  []db.StormEvent{storm(1, "latency", 30, -1)},
+			weights: []db.ListDNSWeightChangesForWindowRow{weight("a", 75, 25, -10), weight("a", 50, 50, 30)},
+			want:    map[int64]float64{1: 2.0 / 3},
+		},
+		// Storm 1 has 15 minutes alone and half of 15 shared; storm 2 half of 15 shared and
+		// 30 alone.
+		{
+			name:    "overlapping storms of different kinds",
+			storms:  []db.StormEvent{storm(1, "latency", -5, 30), storm(2, "errors", 15, -1)},
+			weights: []db.ListDNSWeightChangesForWindowRow{weight("a", 0, 100, -10)},
+			want:    map[int64]float64{1: 0.375, 2: 0.625},
+		},
+		// Without weights all traffic counts as moved, so the share is the storm's time.
+		{
+			name:   "no weight history",
+			storms: []db.StormEvent{storm(1, "latency", 15, 45)},
+			want:   map[int64]float64{1: 0.5},
+		},
+		{
+			name:    "both weights zero split evenly",
+			storms:  []db.StormEvent{storm(1, "latency", 0, 30)},
+			weights: []db.ListDNSWeightChangesForWindowRow{weight("a", 0, 0, -10)},
+			want:    map[int64]float64{1: 0.5},
+		},
+		{
+			name:    "storm the DNS never acted on",
+			storms:  []db.StormEvent{storm(1, "latency", 0, -1)},
+			weights: []db.ListDNSWeightChangesForWindowRow{weight("a", 100, 0, -10)},
+		},
+		{
+			name:    "no storms",
+			weights: []db.ListDNSWeightChangesForWindowRow{weight("a", 0, 100, -10)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stormShares(start, at(60), tt.storms, tt.weights, factors)
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %d storms, got %+v", len(tt.want), got)
+			}
+			for _, s := range got {
+				want, ok := tt.want[s.StormEventID]
+				if !ok || math.Abs(s.Share-want) > 1e-9 {
+					t.Fatalf("storm %d: got share %v, want %v", s.StormEventID, s.Share, want)
+				}
+				wantFactor := 1.0
+				if s.Kind == "latency" {
+					wantFactor = 1.5
+				}
+				if s.CoverageFactor != wantFactor {
+					t.Fatalf("storm %d: got coverage factor %v, want %v", s.StormEventID, s.CoverageFactor, wantFactor)
+				}
+			}
+		})
+	}
+}
+
+func TestDiscountStorms(t *testing.T) {
+	shares := func() db.StormBreakdown {
+		return db.StormBreakdown{
+			{StormEventID: 1, Kind: "latency", Share: 0.5, CoverageFactor: 1.5},
+			{StormEventID: 2, Kind: "errors", Share: 0.5, CoverageFactor: 1},
+		}
+	}
+	tests := []struct {
+		name         string
+		shares       db.StormBreakdown
+		limit        money.Amount
+		wantTotal    money.Amount
+		wantCoverage float64
+		// wantStorms is each storm's discount in cents.
+		wantStorms []int64
+	}{
+		{name: "below the limit", shares: shares(), limit: money.FromCents(1000), wantTotal: money.FromCents(250), wantCoverage: 1.25, wantStorms: []int64{150, 100}},
+		// 250 cents of discounts scaled down to the 200 cent subtotal, storm by storm.
+		{name: "capped at the subtotal", shares: shares(), limit: money.FromCents(200), wantTotal: money.FromCents(200), wantCoverage: 1.25, wantStorms: []int64{120, 80}},
+		{name: "no storms", limit: money.FromCents(200)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, coverage := discountStorms(tt.shares, money.FromCents(1000), tt.limit, 0.2)
+			if total != tt.wantTotal || math.Abs(coverage-tt.wantCoverage) > 1e-9 {
+				t.Fatalf("got %d micros at coverage %v, want %d at %v", total, coverage, tt.wantTotal, tt.wantCoverage)
+			}
+			var sum money.Amount
+			for i, s := range tt.shares {
+				if s.DiscountMicros != int64(money.FromCents(tt.wantStorms[i])) {
+					t.Fatalf("storm %d: got %d micros, want %d cents", s.StormEventID, s.DiscountMicros, tt.wantStorms[i])
+				}
+				sum += money.Amount(s.DiscountMicros)
+			}
+			if sum != total {
+				t.Fatalf("storm discounts add up to %d micros, total is %d", sum, total)
+			}
+		})
+	}
+}
+
+func TestAdjustStorms(t *testing.T) {
+	tests := []struct {
+		name    string
+		current db.StormBreakdown
+		billed  []db.ListBilledStormDiscountsForWindowRow
+		want    db.StormBreakdown
+	}{
+		{
+			name:    "unchanged storm nets to zero",
+			current: db.StormBreakdown{{StormEventID: 1, Kind: "latency", Share: 1, CoverageFactor: 1, DiscountMicros: 100}},
+			billed:  []db.ListBilledStormDiscountsForWindowRow{{StormEventID: 1, Kind: "latency", DiscountMicros: 100}},
+			want:    db.StormBreakdown{{StormEventID: 1, Kind: "latency", Share: 1, CoverageFactor: 1}},
+		},
+		{
+			name:    "storm that disappeared is credited",
+			current: db.StormBreakdown{{StormEventID: 2, Kind: "errors", Share: 1, CoverageFactor: 1, DiscountMicros: 50}},
+			billed:  []db.ListBilledStormDiscountsForWindowRow{{StormEventID: 1, Kind: "latency", DiscountMicros: 80}},
+			want: db.StormBreakdown{
+				{StormEventID: 1, Kind: "latency", DiscountMicros: -80},
+				{StormEventID: 2, Kind: "errors", Share: 1, CoverageFactor: 1, DiscountMicros: 50},
+			},
+		},
+		{
+			name:   "storm that disappeared without a discount",
+			billed: []db.ListBilledStormDiscountsForWindowRow{{StormEventID: 1, Kind: "latency"}},
+			want:   db.StormBreakdown{},
+		},
+		{
+			name:    "new storm",
+			current: db.StormBreakdown{{StormEventID: 3, Kind: "latency", Share: 1, CoverageFactor: 1, DiscountMicros: 40}},
+			want:    db.StormBreakdown{{StormEventID: 3, Kind: "latency", Share: 1, CoverageFactor: 1, DiscountMicros: 40}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := adjustStorms(tt.current, tt.billed); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStormSharesIgnoreRemovedDomains(t *testing.T) {
+	f := newFakeStore()
+	start := time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC)
+	f.addSnapshot(1, 10, start, start.Add(time.Hour), 0, BytesPerGB)
+	f.storms = []db.StormEvent{{ID: 1, ServiceID: 10, Kind: "latency", StartedAt: start.Add(30 * time.Minute)}}
+	// The service failed www over for the storm. legacy was fully on the backup all along,
+	// but has since been removed from the service.
+	f.domains[10] = map[string]bool{"www": true}
+	f.weights[10] = []fakeWeightChange{
+		{domain: "www", primaryWeight: 100, appliedAt: start.Add(-time.Hour)},
+		{domain: "legacy", backupWeight: 100, appliedAt: start.Add(-time.Hour)},
+		{domain: "www", backupWeight: 100, appliedAt: start.Add(30 * time.Minute)},
+	}
+	e := newTestEngine(Config{RateCentsPerGB: 10, DiscountRate: 0.5})
+	if _, err := e.runIn(context.Background(), f, start.Add(2*time.Hour)); err != nil {
+		t.Fatalf("runIn: %v", err)
+	}
+	items := f.itemsOn(f.invoices[0].ID)
+	if len(items) != 1 || len(items[0].StormBreakdown) != 1 || items[0].StormBreakdown[0].Share != 1 || items[0].DiscountCents != 5 {
+		t.Fatalf("expected the storm to have moved all backup traffic for a 5 cent discount, got %+v", items)
+	}
+}
@@ -0,0 +1,245 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/sla"
+)
+
+var (
+	// ErrInvoiceNotFound is returned when voiding an invoice that does not exist.
+	ErrInvoiceNotFound = errors.New("invoice not found")
+	// ErrNotVoidable is returned when an invoice cannot be voided and regenerated as it
+	// stands; the error says why.
+	ErrNotVoidable = errors.New("invoice cannot be voided")
+)
+
+// Regeneration is the outcome of voiding an invoice: the audit record, the voided invoice,
+// its replacement with the replacement's line items, and how the totals changed. A dry run
+// reports the same without keeping any of it, so its IDs are not reserved.
+type Regeneration struct {
+	DryRun      bool                 `json:"dry_run"`
+	Void        db.InvoiceVoid       `json:"void"`
+	Voided      db.Invoice           `json:"voided"`
+	Replacement db.Invoice           `json:"replacement"`
+	LineItems   []db.InvoiceLineItem `json:"line_items"`
+	Diff        TotalsDiff           `json:"diff"`
+}
+
+// TotalsDiff compares the voided invoice's amounts with its replacement's, in cents.
+type TotalsDiff struct {
+	Subtotal AmountChange `json:"subtotal_cents"`
+	Discount AmountChange `json:"discount_cents"`
+	Total    AmountChange `json:"total_cents"`
+}
+
+type AmountChange struct {
+	Old   int64 `json:"old"`
+	New   int64 `json:"new"`
+	Delta int64 `json:"delta"`
+}
+
+func change(old, new int64) AmountChange {
+	return AmountChange{Old: old, New: new, Delta: new - old}
+}
+
+// Void voids a draft or finalized invoice and bills its usage again, at current pricing, on
+// a replacement invoice for the same customer, period and currency that references it. The
+// snapshots and revisions the invoice billed are released and rebilled; a window whose
+// revisions were billed on the invoice is billed once at the newest of them. The
+// replacement of a finalized invoice is finalized straight away, with the minimum commit and
+// SLA credits worked out afresh; a draft's replacement stays a draft.
+//
+// A voided finalized invoice is queued to be voided at the payment processor as well, and
+// its replacement is not exported until that has happened, so the customer is never billed
+// for both.
+//
+// Everything happens in one transaction, together with the audit record. With dryRun the
+// transaction is rolled back and the result only shows what would change.
+//
+// An invoice cannot be voided while another invoice that is not void bills later changes to
+// its windows, since those amounts were worked out against it; such invoices have to be
+// voided first, newest first.
+func (e *Engine) Void(ctx context.Context, invoiceID int64, reason string, now time.Time, dryRun bool) (Regeneration, error) {
+	qtx, tx, err := e.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Regeneration{}, fmt.Errorf("begin void transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	old, err := qtx.LockInvoice(ctx, invoiceID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Regeneration{}, ErrInvoiceNotFound
+		}
+		return Regeneration{}, fmt.Errorf("load invoice %d: %w", invoiceID, err)
+	}
+	if old.Status != invoiceStatusDraft && old.Status != invoiceStatusFinalized {
+		return Regeneration{}, fmt.Errorf("%w: invoice %d is %s; only drafts and finalized invoices can be voided", ErrNotVoidable, invoiceID, old.Status)
+	}
+	later, err := qtx.ListInvoicesBillingLaterWindowChanges(ctx, invoiceID)
+	if err != nil {
+		return Regeneration{}, fmt.Errorf("list invoices billing later changes to invoice %d: %w", invoiceID, err)
+	}
+	if len(later) > 0 {
+		ids := make([]string, len(later))
+		for i, id := range later {
+			ids[i] = strconv.FormatInt(id, 10)
+		}
+		return Regeneration{}, fmt.Errorf("%w: invoices %s bill later changes to invoice %d's windows and must be voided first", ErrNotVoidable, strings.Join(ids, ", "), invoiceID)
+	}
+
+	if _, err := qtx.VoidInvoice(ctx, invoiceID); err != nil {
+		return Regeneration{}, fmt.Errorf("void invoice %d: %w", invoiceID, err)
+	}
+	if old.Status == invoiceStatusFinalized {
+		if err := qtx.QueueInvoiceVoidExport(ctx, invoiceID); err != nil {
+			return Regeneration{}, fmt.Errorf("queue void of invoice %d at the processor: %w", invoiceID, err)
+		}
+	}
+	billedOn := sql.NullInt64{Int64: invoiceID, Valid: true}
+	revisionRows, err := qtx.ReleaseInvoiceUsageRevisions(ctx, billedOn)
+	if err != nil {
+		return Regeneration{}, fmt.Errorf("release invoice %d usage revisions: %w", invoiceID, err)
+	}
+	revisions := make([]db.LockUnsettledUsageRevisionsRow, len(revisionRows))
+	for i, row := range revisionRows {
+		revisions[i] = db.LockUnsettledUsageRevisionsRow(row)
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		if revisions[i].SnapshotID != revisions[j].SnapshotID {
+			return revisions[i].SnapshotID < revisions[j].SnapshotID
+		}
+		return revisions[i].ID < revisions[j].ID
+	})
+	snapshotRows, err := qtx.ReleaseInvoiceUsageSnapshots(ctx, billedOn)
+	if err != nil {
+		return Regeneration{}, fmt.Errorf("release invoice %d usage snapshots: %w", invoiceID, err)
+	}
+	snapshots := make([]db.LockUnbilledUsageSnapshotsRow, len(snapshotRows))
+	for i, row := range snapshotRows {
+		snapshots[i] = db.LockUnbilledUsageSnapshotsRow(row)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].WindowStart.Equal(snapshots[j].WindowStart) {
+			return snapshots[i].WindowStart.Before(snapshots[j].WindowStart)
+		}
+		return snapshots[i].ID < snapshots[j].ID
+	})
+
+	r := e.newRun(qtx, now, qtx.GetInvoiceForPeriod)
+	r.target = &invoiceBuild{invoice: db.Invoice{
+		CustomerID:        old.CustomerID,
+		PeriodStart:       old.PeriodStart,
+		PeriodEnd:         old.PeriodEnd,
+		Currency:          old.Currency,
+		ReplacesInvoiceID: billedOn,
+	}}
+	unfolded, folded := foldRevisions(snapshots, revisions)
+	if err := r.bill(ctx, snapshots, unfolded); err != nil {
+		return Regeneration{}, err
+	}
+	r.target.revisionIDs = append(r.target.revisionIDs, folded...)
+	for _, id := range r.settleOnly {
+		if err := qtx.SettleUsageRevision(ctx, db.SettleUsageRevisionParams{ID: id}); err != nil {
+			return Regeneration{}, fmt.Errorf("settle usage revision %d: %w", id, err)
+		}
+	}
+	r.target.sortItems()
+	replacement, err := e.persistDraft(ctx, qtx, r.target)
+	if err != nil {
+		return Regeneration{}, err
+	}
+	if old.Status == invoiceStatusFinalized {
+		replacement, err = e.finalize(ctx, qtx, r.plans, sla.NewMeter(qtx), make(map[int64]db.SlaDefinition), replacement)
+		if err != nil {
+			return Regeneration{}, err
+		}
+	}
+	items, err := qtx.ListInvoiceLineItems(ctx, replacement.ID)
+	if err != nil {
+		return Regeneration{}, fmt.Errorf("list invoice %d line items: %w", replacement.ID, err)
+	}
+
+	record, err := qtx.InsertInvoiceVoid(ctx, db.InsertInvoiceVoidParams{
+		InvoiceID:            invoiceID,
+		ReplacementInvoiceID: replacement.ID,
+		Reason:               reason,
+		PreviousStatus:       old.Status,
+		ReleasedSnapshots:    int32(len(snapshots)),
+		ReleasedRevisions:    int32(len(revisions)),
+		OldSubtotalCents:     old.SubtotalCents,
+		OldDiscountCents:     old.DiscountCents,
+		OldTotalCents:        old.TotalCents,
+		NewSubtotalCents:     replacement.SubtotalCents,
+		NewDiscountCents:     replacement.DiscountCents,
+		NewTotalCents:        replacement.TotalCents,
+	})
+	if err != nil {
+		return Regeneration{}, fmt.Errorf("record void of invoice %d: %w", invoiceID, err)
+	}
+
+	voided := old
+	voided.Status = invoiceStatusVoid
+	out := Regeneration{
+		DryRun:      dryRun,
+		Void:        record,
+		Voided:      voided,
+		Replacement: replacement,
+		LineItems:   items,
+		Diff: TotalsDiff{
+			Subtotal: change(old.SubtotalCents, replacement.SubtotalCents),
+			Discount: change(old.DiscountCents, replacement.DiscountCents),
+			Total:    change(old.TotalCents, replacement.TotalCents),
+		},
+	}
+	if dryRun {
+		return out, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return Regeneration{}, fmt.Errorf("commit void of invoice %d: %w", invoiceID, err)
+	}
+	e.log.Printf("voided invoice %d for customer %d (%s): replaced by %s invoice %d, total_cents %d -> %d", invoiceID, old.CustomerID, reason, replacement.Status, replacement.ID, old.TotalCents, replacement.TotalCents)
+	return out, nil
+}
+
+// foldRevisions bills windows whose snapshot and revisions were all released from the voided
+// invoice at the newest of those revisions: it overwrites the snapshots' usage with it and
+// returns the remaining revisions, to be billed as adjustments, along with the IDs of the
+// folded ones, which are settled on the replacement. Billing both would count the window
+// twice, since the rebilled snapshot is not yet on any invoice when revisions are priced.
+func foldRevisions(snapshots []db.LockUnbilledUsageSnapshotsRow, revisions []db.LockUnsettledUsageRevisionsRow) ([]db.LockUnsettledUsageRevisionsRow, []int64) {
+	released := make(map[int64]int, len(snapshots))
+	for i, snap := range snapshots {
+		released[snap.ID] = i
+	}
+	var rest []db.LockUnsettledUsageRevisionsRow
+	for _, rev := range revisions {
+		if _, ok := released[rev.SnapshotID]; !ok {
+			rest = append(rest, rev)
+		}
+	}
+	var folded []int64
+	for _, group := range latestRevisions(revisions) {
+		i, ok := released[group.latest.SnapshotID]
+		if !ok {
+			continue
+		}
+		rev := group.latest
+		snapshots[i].PrimaryBytes = rev.PrimaryBytes
+		snapshots[i].BackupBytes = rev.BackupBytes
+		snapshots[i].PrimaryRequests = rev.PrimaryRequests
+		snapshots[i].BackupRequests = rev.BackupRequests
+		snapshots[i].Regions = rev.Regions
+		folded = append(folded, group.ids...)
+	}
+	return rest, folded
+}
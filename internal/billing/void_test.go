@@ -0,0 +1,68 @@
+package billing
+
+import (
+	"reflect"
+	"testing"
+
+	"tranche/internal/db"
+)
+
+func TestFoldRevisions(t *testing.T) {
+	snapshot := func(id, bytes int64) db.LockUnbilledUsageSnapshotsRow {
+		return db.LockUnbilledUsageSnapshotsRow{ID: id, ServiceID: 10, PrimaryBytes: bytes}
+	}
+	revision := func(id, snapshotID, bytes int64) db.LockUnsettledUsageRevisionsRow {
+		return db.LockUnsettledUsageRevisionsRow{ID: id, SnapshotID: snapshotID, ServiceID: 10, PrimaryBytes: bytes}
+	}
+	tests := []struct {
+		name      string
+		snapshots []db.LockUnbilledUsageSnapshotsRow
+		revisions []db.LockUnsettledUsageRevisionsRow
+		// wantBytes is each snapshot's primary bytes once folded.
+		wantBytes  []int64
+		wantRest   []db.LockUnsettledUsageRevisionsRow
+		wantFolded []int64
+	}{
+		{
+			name:      "no revisions",
+			snapshots: []db.LockUnbilledUsageSnapshotsRow{snapshot(1, 10)},
+			wantBytes: []int64{10},
+		},
+		{
+			name:       "window folded at its newest revision",
+			snapshots:  []db.LockUnbilledUsageSnapshotsRow{snapshot(1, 10), snapshot(2, 20)},
+			revisions:  []db.LockUnsettledUsageRevisionsRow{revision(5, 1, 11), revision(6, 1, 12)},
+			wantBytes:  []int64{12, 20},
+			wantFolded: []int64{5, 6},
+		},
+		// Snapshot 3 was billed on an earlier invoice, so its revision stays an adjustment.
+		{
+			name:      "revision of a window billed elsewhere",
+			snapshots: []db.LockUnbilledUsageSnapshotsRow{snapshot(1, 10)},
+			revisions: []db.LockUnsettledUsageRevisionsRow{revision(7, 3, 30)},
+			wantBytes: []int64{10},
+			wantRest:  []db.LockUnsettledUsageRevisionsRow{revision(7, 3, 30)},
+		},
+		{
+			name:       "both kinds",
+			snapshots:  []db.LockUnbilledUsageSnapshotsRow{snapshot(1, 10), snapshot(2, 20)},
+			revisions:  []db.LockUnsettledUsageRevisionsRow{revision(5, 1, 11), revision(8, 2, 25), revision(7, 3, 30), revision(9, 3, 35)},
+			wantBytes:  []int64{11, 25},
+			wantRest:   []db.LockUnsettledUsageRevisionsRow{revision(7, 3, 30), revision(9, 3, 35)},
+			wantFolded: []int64{5, 8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rest, folded := foldRevisions(tt.snapshots, tt.revisions)
+			if !reflect.DeepEqual(rest, tt.wantRest) || !reflect.DeepEqual(folded, tt.wantFolded) {
+				t.Fatalf("got rest %+v and folded %v, want %+v and %v", rest, folded, tt.wantRest, tt.wantFolded)
+			}
+			for i, snap := range tt.snapshots {
+				if snap.PrimaryBytes != tt.wantBytes[i] {
+					t.Fatalf("snapshot %d: got %d bytes, want %d", snap.ID, snap.PrimaryBytes, tt.wantBytes[i])
+				}
+			}
+		})
+	}
+}
@@ -2,18 +2,111 @@ package cdn
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
-// WindowedUsage captures usage for a hostname within a discrete billing window.
+// WindowedUsage captures usage for a hostname within a discrete billing window. Regions is
+// an optional breakdown by region or price zone (Cloudflare reports ISO country codes); it
+// may cover only part of Bytes and Requests.
 type WindowedUsage struct {
 	Host        string
 	WindowStart time.Time
 	WindowEnd   time.Time
 	Bytes       int64
+	Requests    int64
+	Regions     map[string]RegionUsage
 }
 
-// Provider fetches usage statistics between aligned windows.
+// RegionUsage is one region's share of a WindowedUsage.
+type RegionUsage struct {
+	Bytes    int64
+	Requests int64
+}
+
+// AddRegion accumulates a region's traffic into the breakdown, allocating it on first use.
+func (u *WindowedUsage) AddRegion(region string, bytes, requests int64) {
+	if region == "" || (bytes == 0 && requests == 0) {
+		return
+	}
+	if u.Regions == nil {
+		u.Regions = make(map[string]RegionUsage)
+	}
+	r := u.Regions[region]
+	r.Bytes += bytes
+	r.Requests += requests
+	u.Regions[region] = r
+}
+
+// Provider is a named source of CDN usage. Every provider measures either hostnames
+// (HostProvider) or whole Tranche services (ServiceProvider).
 type Provider interface {
+	Name() string
+}
+
+// HostProvider fetches usage statistics per hostname between aligned windows.
+// Implementations return one entry per host and window, may be called repeatedly for the same
+// range so late data can be re-fetched, and should be safe for concurrent use.
+type HostProvider interface {
+	Provider
 	Usage(ctx context.Context, start, end time.Time, window time.Duration, hosts []string) ([]WindowedUsage, error)
 }
+
+// ServiceProvider is implemented by providers that measure whole Tranche services rather
+// than hostnames, such as CloudFront distributions mapped per service.
+type ServiceProvider interface {
+	Provider
+	ServiceUsage(ctx context.Context, start, end time.Time, window time.Duration, serviceIDs []int64) ([]ServiceUsage, error)
+}
+
+// UnmeasuredError is returned along with the usage a provider did measure when it could not
+// measure some of the hostnames or services it was asked for, such as ones its configuration
+// does not map. Their usage is unknown rather than zero, so nothing must be recorded for them.
+type UnmeasuredError struct {
+	Hosts    map[string]error
+	Services map[int64]error
+}
+
+func (e *UnmeasuredError) Error() string {
+	hosts := make([]string, 0, len(e.Hosts))
+	for host := range e.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	ids := make([]int64, 0, len(e.Services))
+	for id := range e.Services {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	parts := make([]string, 0, len(hosts)+len(ids))
+	for _, host := range hosts {
+		parts = append(parts, fmt.Sprintf("%s: %v", host, e.Hosts[host]))
+	}
+	for _, id := range ids {
+		parts = append(parts, fmt.Sprintf("service %d: %v", id, e.Services[id]))
+	}
+	return fmt.Sprintf("%d not measured: %s", len(parts), strings.Join(parts, "; "))
+}
+
+// ServiceUsage is a ServiceProvider's usage for one service and window; Host is unset.
+type ServiceUsage struct {
+	ServiceID int64
+	WindowedUsage
+}
+
+// Role identifies which of a service's CDNs usage is attributed to.
+type Role int
+
+const (
+	RolePrimary Role = iota
+	RoleBackup
+)
+
+func (r Role) String() string {
+	if r == RoleBackup {
+		return "backup"
+	}
+	return "primary"
+}
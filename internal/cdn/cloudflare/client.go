@@ -4,28 +4,81 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"tranche/internal/cdn"
 )
 
-const graphqlEndpoint = "https://api.cloudflare.com/client/v4/graphql"
+const (
+	graphqlEndpoint = "https://api.cloudflare.com/client/v4/graphql"
+	// groupLimit is the most groups Cloudflare returns for one dataset query.
+	groupLimit = 10000
+	// maxPages guards against a response that never advances the pagination cursor.
+	maxPages = 1000
+)
+
+// ErrTruncated reports that a single time bucket holds more groups than one query can
+// return, so usage for that bucket would be undercounted. Use a smaller window or disable
+// the country breakdown.
+var ErrTruncated = errors.New("cloudflare analytics response truncated")
 
 // Client queries Cloudflare's GraphQL analytics API for usage stats.
 type Client struct {
 	accountID string
 	apiToken  string
 	client    *http.Client
+	endpoint  string
+	limit     int
+	countries bool
+	zones     map[string]string
+}
+
+type ClientOption func(*Client)
+
+// WithCountryBreakdown groups usage by client country as well, filling WindowedUsage.Regions
+// with ISO country codes. It multiplies the number of groups the query returns.
+func WithCountryBreakdown() ClientOption {
+	return func(c *Client) {
+		c.countries = true
+	}
+}
+
+// WithZones maps hostnames to zone tags. Daily windows for a mapped host are read from its
+// zone's httpRequests1dGroups rollups, which retain more history than the adaptive dataset.
+// A rollup counts the whole zone, including hostnames nobody asked for, so the option is
+// only safe for zones that serve nothing but the host's service. Zones with more than one
+// requested hostname, which may belong to different services, keep the per-host adaptive
+// query.
+func WithZones(zones map[string]string) ClientOption {
+	return func(c *Client) {
+		c.zones = zones
+	}
 }
 
-func NewClient(accountID, apiToken string) *Client {
-	return &Client{
+func NewClient(accountID, apiToken string, opts ...ClientOption) *Client {
+	c := &Client{
 		accountID: accountID,
 		apiToken:  apiToken,
 		client:    http.DefaultClient,
+		endpoint:  graphqlEndpoint,
+		limit:     groupLimit,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+var _ cdn.HostProvider = (*Client)(nil)
+
+// Name reports the provider name services reference in primary_cdn/backup_cdn.
+func (c *Client) Name() string {
+	return "cloudflare"
 }
 
 type gqlRequest struct {
@@ -33,14 +86,20 @@ type gqlRequest struct {
 	Variables map[string]any `json:"variables"`
 }
 
+type gqlErrors []struct {
+	Message string `json:"message"`
+}
+
 type adaptiveResponse struct {
 	Data struct {
 		Viewer struct {
 			Accounts []struct {
 				HttpRequestsAdaptiveGroups []struct {
+					Count      int64 `json:"count"`
 					Dimensions struct {
-						DatetimeHour          time.Time `json:"datetimeHour"`
-						ClientRequestHTTPHost string    `json:"clientRequestHTTPHost"`
+						Bucket                string `json:"bucket"`
+						ClientRequestHTTPHost string `json:"clientRequestHTTPHost"`
+						ClientCountryName     string `json:"clientCountryName"`
 					} `json:"dimensions"`
 					Sum struct {
 						Bytes int64 `json:"bytes"`
@@ -49,86 +108,356 @@ type adaptiveResponse struct {
 			} `json:"accounts"`
 		} `json:"viewer"`
 	} `json:"data"`
-	Errors []struct {
-		Message string `json:"message"`
-	} `json:"errors"`
+	Errors gqlErrors `json:"errors"`
 }
 
-// Usage fetches usage grouped by hour and hostname between [start, end).
-// Cloudflare's adaptive dataset emits hourly windows, so window must be exactly 1h.
+type dailyResponse struct {
+	Data struct {
+		Viewer struct {
+			Zones []struct {
+				ZoneTag              string `json:"zoneTag"`
+				HttpRequests1dGroups []struct {
+					Dimensions struct {
+						Date string `json:"date"`
+					} `json:"dimensions"`
+					Sum struct {
+						Bytes      int64 `json:"bytes"`
+						Requests   int64 `json:"requests"`
+						CountryMap []struct {
+							ClientCountryName string `json:"clientCountryName"`
+							Bytes             int64  `json:"bytes"`
+							Requests          int64  `json:"requests"`
+						} `json:"countryMap"`
+					} `json:"sum"`
+				} `json:"httpRequests1dGroups"`
+			} `json:"zones"`
+		} `json:"viewer"`
+	} `json:"data"`
+	Errors gqlErrors `json:"errors"`
+}
+
+// Usage fetches usage per hostname and window between [start, end). The adaptive dataset is
+// queried at the coarsest granularity dividing the window (day, hour, 15, 5 or 1 minute)
+// and paginated; daily windows for the only requested host of a mapped zone use
+// httpRequests1dGroups.
 func (c *Client) Usage(ctx context.Context, start, end time.Time, window time.Duration, hosts []string) ([]cdn.WindowedUsage, error) {
-	if window != time.Hour {
-		return nil, fmt.Errorf("cloudflare only supports 1h windows; got %s", window)
+	dimension, err := adaptiveDimension(window)
+	if err != nil {
+		return nil, err
 	}
 
-	query := `query usage($accountTag: String, $from: Time!, $to: Time!, $hosts: [String!]) {
+	buckets := newUsageBuckets(start, end, window)
+	adaptiveHosts := hosts
+	if window%(24*time.Hour) == 0 && len(c.zones) > 0 {
+		adaptiveHosts, err = c.dailyUsage(ctx, start, end, hosts, buckets)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(adaptiveHosts) > 0 {
+		if err := c.adaptiveUsage(ctx, start, end, dimension, adaptiveHosts, buckets); err != nil {
+			return nil, err
+		}
+	}
+	return buckets.usages(), nil
+}
+
+// adaptiveDimension picks the adaptive dataset's time dimension for a window.
+func adaptiveDimension(window time.Duration) (string, error) {
+	switch {
+	case window <= 0:
+		return "", fmt.Errorf("window must be positive")
+	case window%(24*time.Hour) == 0:
+		return "date", nil
+	case window%time.Hour == 0:
+		return "datetimeHour", nil
+	case window%(15*time.Minute) == 0:
+		return "datetimeFifteenMinutes", nil
+	case window%(5*time.Minute) == 0:
+		return "datetimeFiveMinutes", nil
+	case window%time.Minute == 0:
+		return "datetimeMinute", nil
+	default:
+		return "", fmt.Errorf("cloudflare windows must be whole minutes; got %s", window)
+	}
+}
+
+// adaptiveUsage pages through httpRequestsAdaptiveGroups ordered by time bucket. Each page
+// asks for one group more than it counts; that extra group shows whether the page's last
+// bucket continues on the next page. If it does, the next page restarts at that bucket,
+// skipping groups already counted; otherwise it starts at the extra group's bucket. A full
+// page that never leaves its first bucket, with the bucket continuing, is truncated.
+func (c *Client) adaptiveUsage(ctx context.Context, start, end time.Time, dimension string, hosts []string, buckets *usageBuckets) error {
+	dimensions := "bucket: " + dimension + " clientRequestHTTPHost"
+	orderBy := dimension + "_ASC, clientRequestHTTPHost_ASC"
+	if c.countries {
+		dimensions += " clientCountryName"
+		orderBy += ", clientCountryName_ASC"
+	}
+	query := `query usage($accountTag: String, $from: Time!, $to: Time!, $hosts: [String!], $limit: Int!) {
   viewer {
     accounts(filter: {accountTag: $accountTag}) {
       httpRequestsAdaptiveGroups(
         filter: {datetime_geq: $from, datetime_lt: $to, clientRequestHTTPHost_in: $hosts},
-        limit: 10000,
-        orderBy: [datetimeHour_ASC]) {
-        dimensions { datetimeHour clientRequestHTTPHost }
+        limit: $limit,
+        orderBy: [` + orderBy + `]) {
+        count
+        dimensions { ` + dimensions + ` }
         sum { bytes }
       }
     }
   }
 }`
 
-	payload := gqlRequest{
-		Query: query,
-		Variables: map[string]any{
+	type groupKey struct {
+		bucket  time.Time
+		host    string
+		country string
+	}
+	from := start
+	var seen map[groupKey]bool
+	for page := 0; ; page++ {
+		if page == maxPages {
+			return fmt.Errorf("cloudflare analytics: gave up after %d pages", maxPages)
+		}
+		var decoded adaptiveResponse
+		err := c.query(ctx, gqlRequest{Query: query, Variables: map[string]any{
 			"accountTag": c.accountID,
-			"from":       start.Format(time.RFC3339),
+			"from":       from.Format(time.RFC3339),
 			"to":         end.Format(time.RFC3339),
 			"hosts":      hosts,
-		},
+			"limit":      c.limit + 1,
+		}}, &decoded, &decoded.Errors)
+		if err != nil {
+			return err
+		}
+		if len(decoded.Data.Viewer.Accounts) == 0 {
+			return fmt.Errorf("cloudflare account %s not found", c.accountID)
+		}
+		groups := decoded.Data.Viewer.Accounts[0].HttpRequestsAdaptiveGroups
+		more := len(groups) > c.limit
+		var following time.Time
+		if more {
+			following, err = parseBucket(groups[c.limit].Dimensions.Bucket)
+			if err != nil {
+				return err
+			}
+			groups = groups[:c.limit]
+		}
+
+		last := from
+		next := make(map[groupKey]bool)
+		added := 0
+		for _, group := range groups {
+			bucket, err := parseBucket(group.Dimensions.Bucket)
+			if err != nil {
+				return err
+			}
+			key := groupKey{bucket: bucket, host: group.Dimensions.ClientRequestHTTPHost, country: group.Dimensions.ClientCountryName}
+			if bucket.After(last) {
+				last = bucket
+				next = make(map[groupKey]bool)
+			}
+			next[key] = true
+			if seen[key] {
+				continue
+			}
+			added++
+			country := ""
+			if c.countries {
+				country = key.country
+			}
+			buckets.add(key.host, bucket, group.Sum.Bytes, group.Count, country)
+		}
+
+		switch {
+		case !more:
+			return nil
+		case following.After(last):
+			from, seen = following, nil
+		case added == 0:
+			return fmt.Errorf("%w: more than %d groups in the bucket starting %s", ErrTruncated, c.limit, last.Format(time.RFC3339))
+		default:
+			from, seen = last, next
+		}
+	}
+}
+
+// dailyUsage reads httpRequests1dGroups for every zone-mapped host that is the only
+// requested host in its zone and returns the other hosts, which fall back to the adaptive
+// dataset.
+func (c *Client) dailyUsage(ctx context.Context, start, end time.Time, hosts []string, buckets *usageBuckets) ([]string, error) {
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+	hostsInZone := make(map[string][]string)
+	var unmapped []string
+	for _, host := range sorted {
+		zone := c.zones[host]
+		if zone == "" {
+			unmapped = append(unmapped, host)
+			continue
+		}
+		hostsInZone[zone] = append(hostsInZone[zone], host)
+	}
+	var zoneTags []string
+	hostForZone := make(map[string]string)
+	for zone, zoneHosts := range hostsInZone {
+		if len(zoneHosts) > 1 {
+			unmapped = append(unmapped, zoneHosts...)
+			continue
+		}
+		hostForZone[zone] = zoneHosts[0]
+		zoneTags = append(zoneTags, zone)
+	}
+	sort.Strings(unmapped)
+	sort.Strings(zoneTags)
+	if len(zoneTags) == 0 {
+		return unmapped, nil
+	}
+
+	countryMap := ""
+	if c.countries {
+		countryMap = " countryMap { clientCountryName bytes requests }"
+	}
+	query := `query daily($zoneTags: [String!], $from: Date!, $to: Date!, $limit: Int!) {
+  viewer {
+    zones(filter: {zoneTag_in: $zoneTags}) {
+      zoneTag
+      httpRequests1dGroups(filter: {date_geq: $from, date_lt: $to}, limit: $limit, orderBy: [date_ASC]) {
+        dimensions { date }
+        sum { bytes requests` + countryMap + ` }
+      }
+    }
+  }
+}`
+	var decoded dailyResponse
+	err := c.query(ctx, gqlRequest{Query: query, Variables: map[string]any{
+		"zoneTags": zoneTags,
+		"from":     start.Format(time.DateOnly),
+		"to":       end.Format(time.DateOnly),
+		"limit":    c.limit + 1,
+	}}, &decoded, &decoded.Errors)
+	if err != nil {
+		return nil, err
 	}
 
+	for _, zone := range decoded.Data.Viewer.Zones {
+		host, ok := hostForZone[zone.ZoneTag]
+		if !ok {
+			continue
+		}
+		if len(zone.HttpRequests1dGroups) > c.limit {
+			return nil, fmt.Errorf("%w: zone %s has more than %d daily groups", ErrTruncated, zone.ZoneTag, c.limit)
+		}
+		for _, group := range zone.HttpRequests1dGroups {
+			day, err := parseBucket(group.Dimensions.Date)
+			if err != nil {
+				return nil, err
+			}
+			buckets.add(host, day, group.Sum.Bytes, group.Sum.Requests, "")
+			for _, country := range group.Sum.CountryMap {
+				buckets.addRegion(host, day, country.ClientCountryName, country.Bytes, country.Requests)
+			}
+		}
+	}
+	return unmapped, nil
+}
+
+// query posts a GraphQL request and decodes the response into out, surfacing GraphQL errors.
+func (c *Client) query(ctx context.Context, payload gqlRequest, out any, errs *gqlErrors) error {
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return nil, fmt.Errorf("marshal graphql payload: %w", err)
+		return fmt.Errorf("marshal graphql payload: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, graphqlEndpoint, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
 	if err != nil {
-		return nil, fmt.Errorf("build request: %w", err)
+		return fmt.Errorf("build request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+c.apiToken)
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("query cloudflare: %w", err)
+		return fmt.Errorf("query cloudflare: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("cloudflare api status %d", resp.StatusCode)
+		return fmt.Errorf("cloudflare api status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	if len(*errs) > 0 {
+		return fmt.Errorf("cloudflare graphql error: %s", (*errs)[0].Message)
 	}
+	return nil
+}
 
-	var decoded adaptiveResponse
-	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+// parseBucket reads a time dimension, which is a date for daily data and a timestamp otherwise.
+func parseBucket(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
 	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cloudflare analytics: unexpected time bucket %q", v)
+	}
+	return t, nil
+}
+
+// usageBuckets folds dataset groups into per-host windows.
+type usageBuckets struct {
+	start, end time.Time
+	window     time.Duration
+	byKey      map[string]*cdn.WindowedUsage
+}
 
-	if len(decoded.Errors) > 0 {
-		return nil, fmt.Errorf("cloudflare graphql error: %s", decoded.Errors[0].Message)
+func newUsageBuckets(start, end time.Time, window time.Duration) *usageBuckets {
+	return &usageBuckets{start: start, end: end, window: window, byKey: make(map[string]*cdn.WindowedUsage)}
+}
+
+func (b *usageBuckets) get(host string, at time.Time) *cdn.WindowedUsage {
+	ws := at.Truncate(b.window)
+	if ws.Before(b.start) || !ws.Before(b.end) {
+		return nil
 	}
-	if len(decoded.Data.Viewer.Accounts) == 0 {
-		return nil, fmt.Errorf("cloudflare account %s not found", c.accountID)
+	key := strings.ToLower(host) + "|" + ws.Format(time.RFC3339)
+	u := b.byKey[key]
+	if u == nil {
+		u = &cdn.WindowedUsage{Host: host, WindowStart: ws, WindowEnd: ws.Add(b.window)}
+		b.byKey[key] = u
+	}
+	return u
+}
+
+func (b *usageBuckets) add(host string, at time.Time, bytes, requests int64, country string) {
+	u := b.get(host, at)
+	if u == nil {
+		return
 	}
+	u.Bytes += bytes
+	u.Requests += requests
+	u.AddRegion(country, bytes, requests)
+}
 
-	usages := make([]cdn.WindowedUsage, 0, len(decoded.Data.Viewer.Accounts[0].HttpRequestsAdaptiveGroups))
-	for _, group := range decoded.Data.Viewer.Accounts[0].HttpRequestsAdaptiveGroups {
-		start := group.Dimensions.DatetimeHour.Truncate(window)
-		usages = append(usages, cdn.WindowedUsage{
-			Host:        group.Dimensions.ClientRequestHTTPHost,
-			WindowStart: start,
-			WindowEnd:   start.Add(window),
-			Bytes:       group.Sum.Bytes,
-		})
+func (b *usageBuckets) addRegion(host string, at time.Time, country string, bytes, requests int64) {
+	if u := b.get(host, at); u != nil {
+		u.AddRegion(country, bytes, requests)
 	}
+}
 
-	return usages, nil
+func (b *usageBuckets) usages() []cdn.WindowedUsage {
+	usages := make([]cdn.WindowedUsage, 0, len(b.byKey))
+	for _, u := range b.byKey {
+		usages = append(usages, *u)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if !usages[i].WindowStart.Equal(usages[j].WindowStart) {
+			return usages[i].WindowStart.Before(usages[j].WindowStart)
+		}
+		return usages[i].Host < usages[j].Host
+	})
+	return usages
 }
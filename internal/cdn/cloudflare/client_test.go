@@ -0,0 +1,305 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testGroup struct {
+	bucket  string
+	host    string
+	country string
+	bytes   int64
+	count   int64
+}
+
+func (g testGroup) JSON() string {
+	return fmt.Sprintf(`{"count":%d,"dimensions":{"bucket":%q,"clientRequestHTTPHost":%q,"clientCountryName":%q},"sum":{"bytes":%d}}`,
+		g.count, g.bucket, g.host, g.country, g.bytes)
+}
+
+func adaptiveBody(groups []testGroup) string {
+	parts := make([]string, len(groups))
+	for i, g := range groups {
+		parts[i] = g.JSON()
+	}
+	return `{"data":{"viewer":{"accounts":[{"httpRequestsAdaptiveGroups":[` + strings.Join(parts, ",") + `]}]}}}`
+}
+
+func newTestClient(t *testing.T, handler func(t *testing.T, req gqlRequest) string, opts ...ClientOption) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("unexpected authorization header %q", got)
+		}
+		var req gqlRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		fmt.Fprint(w, handler(t, req))
+	}))
+	t.Cleanup(srv.Close)
+
+	c := NewClient("acct", "token", opts...)
+	c.endpoint = srv.URL
+	return c
+}
+
+// pagedGroups serves groups at or after the request's $from, at most $limit at a time, the
+// way the adaptive dataset answers an ordered query.
+func pagedGroups(t *testing.T, req gqlRequest, groups []testGroup) string {
+	t.Helper()
+	from, err := time.Parse(time.RFC3339, req.Variables["from"].(string))
+	if err != nil {
+		t.Fatalf("parse from: %v", err)
+	}
+	limit := int(req.Variables["limit"].(float64))
+	var page []testGroup
+	for _, g := range groups {
+		bucket, _ := parseBucket(g.bucket)
+		if bucket.Before(from) || len(page) == limit {
+			continue
+		}
+		page = append(page, g)
+	}
+	return adaptiveBody(page)
+}
+
+func TestClientSumsHourlyBucketsIntoWindows(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(4 * time.Hour)
+
+	c := newTestClient(t, func(t *testing.T, req gqlRequest) string {
+		if !strings.Contains(req.Query, "bucket: datetimeHour") {
+			t.Errorf("expected the hourly dimension, got query %s", req.Query)
+		}
+		if strings.Contains(req.Query, "clientCountryName") {
+			t.Errorf("country breakdown queried without the option")
+		}
+		return adaptiveBody([]testGroup{
+			{bucket: "2024-03-01T10:00:00Z", host: "a.example.com", bytes: 100, count: 1},
+			{bucket: "2024-03-01T11:00:00Z", host: "a.example.com", bytes: 200, count: 2},
+			{bucket: "2024-03-01T12:00:00Z", host: "a.example.com", bytes: 50, count: 3},
+			{bucket: "2024-03-01T12:00:00Z", host: "b.example.com", bytes: 7, count: 4},
+		})
+	})
+
+	usages, err := c.Usage(context.Background(), start, end, 2*time.Hour, []string{"a.example.com", "b.example.com"})
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if len(usages) != 3 {
+		t.Fatalf("expected 3 windows, got %+v", usages)
+	}
+	first := usages[0]
+	if first.Host != "a.example.com" || !first.WindowStart.Equal(start) || !first.WindowEnd.Equal(start.Add(2*time.Hour)) || first.Bytes != 300 || first.Requests != 3 {
+		t.Fatalf("unexpected first window %+v", first)
+	}
+	if usages[1].Host != "a.example.com" || usages[1].Bytes != 50 || usages[2].Host != "b.example.com" || usages[2].Bytes != 7 {
+		t.Fatalf("unexpected second windows %+v", usages[1:])
+	}
+}
+
+func TestClientPaginatesAdaptiveGroups(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(15 * time.Minute)
+	groups := []testGroup{
+		{bucket: "2024-03-01T10:00:00Z", host: "a.example.com", bytes: 1, count: 1},
+		{bucket: "2024-03-01T10:00:00Z", host: "b.example.com", bytes: 10, count: 1},
+		{bucket: "2024-03-01T10:05:00Z", host: "a.example.com", bytes: 2, count: 1},
+		{bucket: "2024-03-01T10:05:00Z", host: "b.example.com", bytes: 20, count: 1},
+		{bucket: "2024-03-01T10:10:00Z", host: "a.example.com", bytes: 3, count: 1},
+	}
+
+	calls := 0
+	c := newTestClient(t, func(t *testing.T, req gqlRequest) string {
+		calls++
+		if !strings.Contains(req.Query, "bucket: datetimeFiveMinutes") {
+			t.Errorf("expected the five-minute dimension, got query %s", req.Query)
+		}
+		return pagedGroups(t, req, groups)
+	})
+	c.limit = 3
+
+	usages, err := c.Usage(context.Background(), start, end, 5*time.Minute, []string{"a.example.com", "b.example.com"})
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 pages, got %d", calls)
+	}
+	var total int64
+	for _, u := range usages {
+		total += u.Bytes
+	}
+	if len(usages) != 5 || total != 36 {
+		t.Fatalf("expected every group counted once, got %d windows totalling %d bytes: %+v", len(usages), total, usages)
+	}
+}
+
+func TestClientAcceptsBucketFillingAPage(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	for name, groups := range map[string][]testGroup{
+		"followed by another bucket": {
+			{bucket: "2024-03-01T10:00:00Z", host: "a.example.com", bytes: 1},
+			{bucket: "2024-03-01T10:00:00Z", host: "b.example.com", bytes: 2},
+			{bucket: "2024-03-01T10:05:00Z", host: "a.example.com", bytes: 4},
+			{bucket: "2024-03-01T10:05:00Z", host: "b.example.com", bytes: 8},
+		},
+		"last bucket": {
+			{bucket: "2024-03-01T10:00:00Z", host: "a.example.com", bytes: 1},
+			{bucket: "2024-03-01T10:00:00Z", host: "b.example.com", bytes: 2},
+		},
+	} {
+		c := newTestClient(t, func(t *testing.T, req gqlRequest) string {
+			return pagedGroups(t, req, groups)
+		})
+		c.limit = 2
+
+		usages, err := c.Usage(context.Background(), start, start.Add(15*time.Minute), 5*time.Minute, []string{"a.example.com", "b.example.com"})
+		if err != nil {
+			t.Fatalf("%s: Usage: %v", name, err)
+		}
+		var total, want int64
+		for _, u := range usages {
+			total += u.Bytes
+		}
+		for _, g := range groups {
+			want += g.bytes
+		}
+		if total != want {
+			t.Fatalf("%s: expected %d bytes counted once, got %d: %+v", name, want, total, usages)
+		}
+	}
+}
+
+func TestClientDetectsTruncatedBucket(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	groups := []testGroup{
+		{bucket: "2024-03-01T10:00:00Z", host: "a.example.com", bytes: 1},
+		{bucket: "2024-03-01T10:00:00Z", host: "b.example.com", bytes: 1},
+		{bucket: "2024-03-01T10:00:00Z", host: "c.example.com", bytes: 1},
+	}
+	c := newTestClient(t, func(t *testing.T, req gqlRequest) string {
+		return pagedGroups(t, req, groups)
+	})
+	c.limit = 2
+
+	_, err := c.Usage(context.Background(), start, start.Add(time.Hour), time.Hour, []string{"a.example.com", "b.example.com", "c.example.com"})
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestClientDailyWindowsUseZoneRollups(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(48 * time.Hour)
+
+	var sawDaily, sawAdaptive bool
+	c := newTestClient(t, func(t *testing.T, req gqlRequest) string {
+		if strings.Contains(req.Query, "httpRequests1dGroups") {
+			sawDaily = true
+			if req.Variables["from"] != "2024-03-01" || req.Variables["to"] != "2024-03-03" {
+				t.Errorf("unexpected daily range %v - %v", req.Variables["from"], req.Variables["to"])
+			}
+			if !strings.Contains(req.Query, "countryMap") {
+				t.Errorf("expected the country map in %s", req.Query)
+			}
+			return `{"data":{"viewer":{"zones":[{"zoneTag":"zone1","httpRequests1dGroups":[
+				{"dimensions":{"date":"2024-03-01"},"sum":{"bytes":1000,"requests":10,"countryMap":[{"clientCountryName":"DE","bytes":600,"requests":6}]}},
+				{"dimensions":{"date":"2024-03-02"},"sum":{"bytes":500,"requests":5,"countryMap":[]}}]}]}}}`
+		}
+		sawAdaptive = true
+		if !strings.Contains(req.Query, "bucket: date ") {
+			t.Errorf("expected the date dimension, got query %s", req.Query)
+		}
+		hosts, _ := req.Variables["hosts"].([]any)
+		if len(hosts) != 1 || hosts[0] != "c.example.com" {
+			t.Errorf("expected only the unmapped host in the adaptive query, got %v", hosts)
+		}
+		return adaptiveBody([]testGroup{{bucket: "2024-03-02", host: "c.example.com", country: "US", bytes: 42, count: 2}})
+	}, WithZones(map[string]string{"a.example.com": "zone1"}), WithCountryBreakdown())
+
+	usages, err := c.Usage(context.Background(), start, end, 24*time.Hour, []string{"a.example.com", "c.example.com"})
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if !sawDaily || !sawAdaptive {
+		t.Fatalf("expected both datasets to be queried (daily=%v adaptive=%v)", sawDaily, sawAdaptive)
+	}
+	if len(usages) != 3 {
+		t.Fatalf("expected 3 windows, got %+v", usages)
+	}
+	first := usages[0]
+	if first.Host != "a.example.com" || !first.WindowStart.Equal(start) || first.Bytes != 1000 || first.Requests != 10 || first.Regions["DE"].Bytes != 600 {
+		t.Fatalf("unexpected zone window %+v", first)
+	}
+	if usages[2].Host != "c.example.com" || usages[2].Bytes != 42 || usages[2].Regions["US"].Requests != 2 {
+		t.Fatalf("unexpected adaptive window %+v", usages[2])
+	}
+}
+
+// Two services' hostnames share zone1, so its rollup would bill one service for both.
+func TestClientDailyWindowsOfSharedZoneUseAdaptiveDataset(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	c := newTestClient(t, func(t *testing.T, req gqlRequest) string {
+		if strings.Contains(req.Query, "httpRequests1dGroups") {
+			zones, _ := req.Variables["zoneTags"].([]any)
+			if len(zones) != 1 || zones[0] != "zone2" {
+				t.Errorf("expected only the unshared zone in the daily query, got %v", zones)
+			}
+			return `{"data":{"viewer":{"zones":[{"zoneTag":"zone2","httpRequests1dGroups":[
+				{"dimensions":{"date":"2024-03-01"},"sum":{"bytes":300,"requests":3}}]}]}}}`
+		}
+		hosts, _ := req.Variables["hosts"].([]any)
+		if len(hosts) != 2 || hosts[0] != "a.example.com" || hosts[1] != "b.example.com" {
+			t.Errorf("expected the shared zone's hosts in the adaptive query, got %v", hosts)
+		}
+		return adaptiveBody([]testGroup{
+			{bucket: "2024-03-01", host: "a.example.com", bytes: 100, count: 1},
+			{bucket: "2024-03-01", host: "b.example.com", bytes: 200, count: 2},
+		})
+	}, WithZones(map[string]string{"a.example.com": "zone1", "b.example.com": "zone1", "d.example.com": "zone2"}))
+
+	usages, err := c.Usage(context.Background(), start, start.Add(24*time.Hour), 24*time.Hour, []string{"b.example.com", "a.example.com", "d.example.com"})
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, u := range usages {
+		got[u.Host] += u.Bytes
+	}
+	if len(got) != 3 || got["a.example.com"] != 100 || got["b.example.com"] != 200 || got["d.example.com"] != 300 {
+		t.Fatalf("expected each host's own bytes, got %v", got)
+	}
+}
+
+func TestAdaptiveDimension(t *testing.T) {
+	cases := []struct {
+		window time.Duration
+		want   string
+	}{
+		{48 * time.Hour, "date"},
+		{6 * time.Hour, "datetimeHour"},
+		{30 * time.Minute, "datetimeFifteenMinutes"},
+		{10 * time.Minute, "datetimeFiveMinutes"},
+		{2 * time.Minute, "datetimeMinute"},
+	}
+	for _, tc := range cases {
+		got, err := adaptiveDimension(tc.window)
+		if err != nil || got != tc.want {
+			t.Errorf("adaptiveDimension(%s) = %q, %v; want %q", tc.window, got, err, tc.want)
+		}
+	}
+	if _, err := adaptiveDimension(90 * time.Second); err == nil {
+		t.Errorf("expected sub-minute windows to be rejected")
+	}
+}
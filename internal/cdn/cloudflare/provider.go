@@ -4,40 +4,56 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	cflog "github.com/cloudflare/cloudflare-go"
 
 	"tranche/internal/cdn"
 	"tranche/internal/config"
-	"tranche/internal/db"
 )
 
-const providerName = "cloudflare"
+// zoneProviderName is distinct from the GraphQL client's name so both can be registered;
+// route services to it with CDN_PROVIDER_*_OVERRIDES.
+const zoneProviderName = "cloudflare-zones"
 
 type ZoneConfig struct {
 	ZoneID    string `json:"zone_id"`
 	AccountID string `json:"account_id"`
 }
 
+// Provider reads usage from the zone analytics dashboard, including the per-country
+// breakdown it returns. Zone totals cannot be split per hostname, so CLOUDFLARE_ZONE_CONFIG
+// maps hostnames to zones and each zone's usage is reported under the first of its
+// requested hostnames. Hostnames sharing a zone must
+// therefore belong to the same service.
 type Provider struct {
-	api    *cflog.API
-	zones  map[string]ZoneConfig
-	logger cdn.Logger
+	api   *cflog.API
+	zones map[string]ZoneConfig
 }
 
-var _ cdn.UsageProvider = (*Provider)(nil)
+var _ cdn.HostProvider = (*Provider)(nil)
 
-func NewProvider(cfg config.CloudflareConfig, logger cdn.Logger) (*Provider, error) {
+func NewProvider(cfg config.CloudflareConfig, opts ...cflog.Option) (*Provider, error) {
 	if cfg.APIToken == "" {
 		return nil, fmt.Errorf("cloudflare api token missing")
 	}
 
-	api, err := cflog.NewWithAPIToken(cfg.APIToken)
+	api, err := cflog.NewWithAPIToken(cfg.APIToken, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("init cloudflare client: %w", err)
 	}
 
+	zoneMap, err := ParseZoneConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{api: api, zones: zoneMap}, nil
+}
+
+// ParseZoneConfig reads the CLOUDFLARE_ZONE_CONFIG hostname-to-zone mapping, filling in the
+// default account for zones that do not name one.
+func ParseZoneConfig(cfg config.CloudflareConfig) (map[string]ZoneConfig, error) {
 	zoneMap := make(map[string]ZoneConfig)
 	if cfg.ZoneConfigJSON != "" {
 		if err := json.Unmarshal([]byte(cfg.ZoneConfigJSON), &zoneMap); err != nil {
@@ -51,49 +67,96 @@ func NewProvider(cfg config.CloudflareConfig, logger cdn.Logger) (*Provider, err
 			zoneMap[key] = zone
 		}
 	}
-
-	return &Provider{api: api, zones: zoneMap, logger: logger}, nil
+	return zoneMap, nil
 }
 
 func (p *Provider) Name() string {
-	return providerName
+	return zoneProviderName
 }
 
-func (p *Provider) FetchUsage(ctx context.Context, svc db.Service, since, until time.Time) (int64, int64, error) {
-	primaryZone, err := p.zoneForAlias(svc.PrimaryCdn)
-	if err != nil {
-		return 0, 0, err
+// Usage buckets each zone's analytics timeseries into windows between [start, end). Hosts
+// without a zone are reported in a *cdn.UnmeasuredError returned with the usage of the
+// others.
+func (p *Provider) Usage(ctx context.Context, start, end time.Time, window time.Duration, hosts []string) ([]cdn.WindowedUsage, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be positive")
 	}
-	backupZone, err := p.zoneForAlias(svc.BackupCdn)
-	if err != nil {
-		return 0, 0, err
+
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+	var zoneOrder []string
+	hostForZone := make(map[string]string)
+	unmapped := make(map[string]error)
+	for _, host := range sorted {
+		zone, ok := p.zones[host]
+		if !ok || zone.ZoneID == "" {
+			unmapped[host] = fmt.Errorf("no cloudflare zone mapped in CLOUDFLARE_ZONE_CONFIG")
+			continue
+		}
+		if _, seen := hostForZone[zone.ZoneID]; !seen {
+			hostForZone[zone.ZoneID] = host
+			zoneOrder = append(zoneOrder, zone.ZoneID)
+		}
 	}
 
-	primaryBytes, err := p.zoneBytes(ctx, primaryZone.ZoneID, since, until)
-	if err != nil {
-		return 0, 0, err
+	var usages []cdn.WindowedUsage
+	for _, zoneID := range zoneOrder {
+		buckets, err := p.zoneBuckets(ctx, zoneID, start, end, window)
+		if err != nil {
+			return nil, err
+		}
+		for _, ws := range sortedWindows(buckets) {
+			u := *buckets[ws]
+			u.Host = hostForZone[zoneID]
+			usages = append(usages, u)
+		}
 	}
-	backupBytes, err := p.zoneBytes(ctx, backupZone.ZoneID, since, until)
-	if err != nil {
-		return 0, 0, err
+	if len(unmapped) > 0 {
+		return usages, &cdn.UnmeasuredError{Hosts: unmapped}
 	}
-
-	return primaryBytes, backupBytes, nil
+	return usages, nil
 }
 
-func (p *Provider) zoneBytes(ctx context.Context, zoneID string, since, until time.Time) (int64, error) {
+func (p *Provider) zoneBuckets(ctx context.Context, zoneID string, start, end time.Time, window time.Duration) (map[time.Time]*cdn.WindowedUsage, error) {
 	continuous := true
-	resp, err := p.api.ZoneAnalyticsDashboard(ctx, zoneID, cflog.ZoneAnalyticsOptions{Since: &since, Until: &until, Continuous: &continuous})
+	resp, err := p.api.ZoneAnalyticsDashboard(ctx, zoneID, cflog.ZoneAnalyticsOptions{Since: &start, Until: &end, Continuous: &continuous})
 	if err != nil {
-		return 0, fmt.Errorf("cloudflare analytics for zone %s: %w", zoneID, err)
+		return nil, fmt.Errorf("cloudflare analytics for zone %s: %w", zoneID, err)
+	}
+
+	buckets := make(map[time.Time]*cdn.WindowedUsage)
+	for _, point := range resp.Timeseries {
+		if step := point.Until.Sub(point.Since); step > window {
+			return nil, fmt.Errorf("cloudflare analytics for zone %s: %s buckets are coarser than the %s window", zoneID, step, window)
+		}
+		ws := point.Since.UTC().Truncate(window)
+		if ws.Before(start) || !ws.Before(end) {
+			continue
+		}
+		u := buckets[ws]
+		if u == nil {
+			u = &cdn.WindowedUsage{WindowStart: ws, WindowEnd: ws.Add(window)}
+			buckets[ws] = u
+		}
+		u.Bytes += int64(point.Bandwidth.All)
+		u.Requests += int64(point.Requests.All)
+		for country, bytes := range point.Bandwidth.Country {
+			u.AddRegion(country, int64(bytes), int64(point.Requests.Country[country]))
+		}
+		for country, requests := range point.Requests.Country {
+			if _, ok := point.Bandwidth.Country[country]; !ok {
+				u.AddRegion(country, 0, int64(requests))
+			}
+		}
 	}
-	return int64(resp.Totals.Bandwidth.All), nil
+	return buckets, nil
 }
 
-func (p *Provider) zoneForAlias(alias string) (ZoneConfig, error) {
-	zone, ok := p.zones[alias]
-	if !ok || zone.ZoneID == "" {
-		return ZoneConfig{}, fmt.Errorf("zone mapping for %q not found", alias)
+func sortedWindows(buckets map[time.Time]*cdn.WindowedUsage) []time.Time {
+	windows := make([]time.Time, 0, len(buckets))
+	for ws := range buckets {
+		windows = append(windows, ws)
 	}
-	return zone, nil
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Before(windows[j]) })
+	return windows
 }
@@ -0,0 +1,118 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cflog "github.com/cloudflare/cloudflare-go"
+
+	"tranche/internal/cdn"
+	"tranche/internal/config"
+)
+
+func newZoneTestProvider(t *testing.T, handler http.HandlerFunc) *Provider {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	p, err := NewProvider(config.CloudflareConfig{
+		APIToken:       "token",
+		ZoneConfigJSON: `{"app.example.com":{"zone_id":"zone1"},"www.example.com":{"zone_id":"zone1"}}`,
+	}, cflog.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	return p
+}
+
+func timeseriesPoint(since time.Time, step time.Duration, bytes int) string {
+	return fmt.Sprintf(`{"since":%q,"until":%q,"bandwidth":{"all":%d}}`, since.Format(time.RFC3339), since.Add(step).Format(time.RFC3339), bytes)
+}
+
+func TestZoneProviderBucketsTimeseries(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(2 * time.Hour)
+
+	requests := 0
+	p := newZoneTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/zones/zone1/analytics/dashboard" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		step := 30 * time.Minute
+		fmt.Fprintf(w, `{"success":true,"errors":[],"messages":[],"result":{"totals":{},"timeseries":[%s,%s,%s]}}`,
+			timeseriesPoint(start, step, 100),
+			timeseriesPoint(start.Add(step), step, 200),
+			timeseriesPoint(start.Add(time.Hour), step, 50))
+	})
+
+	usages, err := p.Usage(context.Background(), start, end, time.Hour, []string{"www.example.com", "app.example.com", "unmapped.example.com"})
+	var unmeasured *cdn.UnmeasuredError
+	if !errors.As(err, &unmeasured) || len(unmeasured.Hosts) != 1 || unmeasured.Hosts["unmapped.example.com"] == nil {
+		t.Fatalf("expected unmapped.example.com to be reported unmeasured, got %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("expected hosts sharing a zone to be fetched once, got %d requests", requests)
+	}
+	if len(usages) != 2 {
+		t.Fatalf("expected 2 windows, got %+v", usages)
+	}
+	if usages[0].Host != "app.example.com" || usages[0].Bytes != 300 || !usages[0].WindowStart.Equal(start) {
+		t.Fatalf("unexpected first window %+v", usages[0])
+	}
+	if usages[1].Bytes != 50 || !usages[1].WindowEnd.Equal(end) {
+		t.Fatalf("unexpected second window %+v", usages[1])
+	}
+}
+
+func TestZoneProviderRejectsCoarseTimeseries(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	p := newZoneTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"success":true,"errors":[],"messages":[],"result":{"timeseries":[%s]}}`, timeseriesPoint(start, 24*time.Hour, 1))
+	})
+
+	_, err := p.Usage(context.Background(), start, start.Add(24*time.Hour), time.Hour, []string{"app.example.com"})
+	if err == nil || !strings.Contains(err.Error(), "coarser") {
+		t.Fatalf("expected coarse bucket error, got %v", err)
+	}
+}
+
+func TestZoneProviderReportsRequestsAndCountries(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	point := func(since time.Time, bytesUS, bytesDE, reqUS, reqDE int) string {
+		return fmt.Sprintf(`{"since":%q,"until":%q,`+
+			`"requests":{"all":%d,"country":{"US":%d,"DE":%d}},`+
+			`"bandwidth":{"all":%d,"country":{"US":%d,"DE":%d}}}`,
+			since.Format(time.RFC3339), since.Add(30*time.Minute).Format(time.RFC3339),
+			reqUS+reqDE, reqUS, reqDE, bytesUS+bytesDE, bytesUS, bytesDE)
+	}
+	p := newZoneTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"success":true,"errors":[],"messages":[],"result":{"timeseries":[%s,%s]}}`,
+			point(start, 100, 40, 3, 1),
+			point(start.Add(30*time.Minute), 60, 0, 2, 0))
+	})
+
+	usages, err := p.Usage(context.Background(), start, start.Add(time.Hour), time.Hour, []string{"app.example.com"})
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if len(usages) != 1 {
+		t.Fatalf("expected 1 window, got %+v", usages)
+	}
+	u := usages[0]
+	if u.Bytes != 200 || u.Requests != 6 {
+		t.Fatalf("expected 200 bytes and 6 requests, got %d/%d", u.Bytes, u.Requests)
+	}
+	if us := u.Regions["US"]; us.Bytes != 160 || us.Requests != 5 {
+		t.Fatalf("unexpected US breakdown %+v", us)
+	}
+	if de := u.Regions["DE"]; de.Bytes != 40 || de.Requests != 1 {
+		t.Fatalf("unexpected DE breakdown %+v", de)
+	}
+}
@@ -0,0 +1,224 @@
+package cloudfront
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+
+	"tranche/internal/cdn"
+	"tranche/internal/config"
+)
+
+const (
+	providerName = "cloudfront"
+	// MetricsRegion is the only region CloudFront publishes CloudWatch metrics in.
+	MetricsRegion = "us-east-1"
+	namespace     = "AWS/CloudFront"
+	// maxQueries is GetMetricData's limit on metric queries per request; each distribution
+	// needs two.
+	maxQueries = 500
+)
+
+// cloudWatchAPI captures the subset of the AWS SDK we use so it can be mocked in tests.
+type cloudWatchAPI interface {
+	GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error)
+}
+
+// Provider reads BytesDownloaded and Requests per CloudFront distribution from CloudWatch.
+// Distributions are not tied to hostnames, so CLOUDFRONT_DISTRIBUTION_CONFIG maps Tranche
+// service IDs to distribution IDs and the provider measures whole services.
+type Provider struct {
+	client        cloudWatchAPI
+	distributions map[int64]string
+}
+
+var _ cdn.ServiceProvider = (*Provider)(nil)
+
+// NewProvider builds a provider from an AWS config, which must target MetricsRegion.
+func NewProvider(cfg config.CloudFrontConfig, awsCfg aws.Config) (*Provider, error) {
+	distributions, err := parseDistributions(cfg.DistributionConfigJSON)
+	if err != nil {
+		return nil, err
+	}
+	return newProvider(cloudwatch.NewFromConfig(awsCfg), distributions), nil
+}
+
+func newProvider(client cloudWatchAPI, distributions map[int64]string) *Provider {
+	return &Provider{client: client, distributions: distributions}
+}
+
+// parseDistributions reads the service-to-distribution mapping. A distribution may only be
+// mapped to one service, otherwise its traffic would be billed twice.
+func parseDistributions(raw string) (map[int64]string, error) {
+	distributions := make(map[int64]string)
+	if raw == "" {
+		return distributions, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &distributions); err != nil {
+		return nil, fmt.Errorf("parse CLOUDFRONT_DISTRIBUTION_CONFIG: %w", err)
+	}
+	owner := make(map[string]int64, len(distributions))
+	for serviceID, dist := range distributions {
+		if dist == "" {
+			return nil, fmt.Errorf("parse CLOUDFRONT_DISTRIBUTION_CONFIG: service %d has no distribution id", serviceID)
+		}
+		if other, dup := owner[dist]; dup {
+			if other > serviceID {
+				other, serviceID = serviceID, other
+			}
+			return nil, fmt.Errorf("parse CLOUDFRONT_DISTRIBUTION_CONFIG: distribution %s mapped to services %d and %d", dist, other, serviceID)
+		}
+		owner[dist] = serviceID
+	}
+	return distributions, nil
+}
+
+func (p *Provider) Name() string {
+	return providerName
+}
+
+type target struct {
+	serviceID    int64
+	distribution string
+}
+
+// ServiceUsage sums each mapped service's distribution metrics into windows between
+// [start, end), using the window as the CloudWatch period. Services without a mapping are
+// reported in a *cdn.UnmeasuredError returned with the usage of the others.
+func (p *Provider) ServiceUsage(ctx context.Context, start, end time.Time, window time.Duration, serviceIDs []int64) ([]cdn.ServiceUsage, error) {
+	if window <= 0 || window%time.Minute != 0 {
+		return nil, fmt.Errorf("cloudfront windows must be whole minutes; got %s", window)
+	}
+
+	ids := append([]int64(nil), serviceIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var targets []target
+	unmapped := make(map[int64]error)
+	for _, id := range ids {
+		dist, ok := p.distributions[id]
+		if !ok {
+			unmapped[id] = fmt.Errorf("no cloudfront distribution mapped in CLOUDFRONT_DISTRIBUTION_CONFIG")
+			continue
+		}
+		targets = append(targets, target{serviceID: id, distribution: dist})
+	}
+
+	buckets := make(map[int64]map[time.Time]*cdn.WindowedUsage)
+	for len(targets) > 0 {
+		batch := targets
+		if len(batch) > maxQueries/2 {
+			batch = batch[:maxQueries/2]
+		}
+		targets = targets[len(batch):]
+		if err := p.fetch(ctx, start, end, window, batch, buckets); err != nil {
+			return nil, err
+		}
+	}
+
+	var usages []cdn.ServiceUsage
+	for _, id := range ids {
+		windows := make([]time.Time, 0, len(buckets[id]))
+		for ws := range buckets[id] {
+			windows = append(windows, ws)
+		}
+		sort.Slice(windows, func(i, j int) bool { return windows[i].Before(windows[j]) })
+		for _, ws := range windows {
+			usages = append(usages, cdn.ServiceUsage{ServiceID: id, WindowedUsage: *buckets[id][ws]})
+		}
+	}
+	if len(unmapped) > 0 {
+		return usages, &cdn.UnmeasuredError{Services: unmapped}
+	}
+	return usages, nil
+}
+
+// fetch pages through GetMetricData for one batch of distributions. Query IDs encode the
+// metric ("b" for bytes, "r" for requests) and the target's index in the batch.
+func (p *Provider) fetch(ctx context.Context, start, end time.Time, window time.Duration, batch []target, buckets map[int64]map[time.Time]*cdn.WindowedUsage) error {
+	period := int32(window / time.Second)
+	queries := make([]cwtypes.MetricDataQuery, 0, 2*len(batch))
+	for i, t := range batch {
+		queries = append(queries,
+			metricQuery("b"+strconv.Itoa(i), "BytesDownloaded", t.distribution, period),
+			metricQuery("r"+strconv.Itoa(i), "Requests", t.distribution, period))
+	}
+	input := &cloudwatch.GetMetricDataInput{
+		StartTime:         aws.Time(start),
+		EndTime:           aws.Time(end),
+		MetricDataQueries: queries,
+		ScanBy:            cwtypes.ScanByTimestampAscending,
+	}
+
+	for {
+		out, err := p.client.GetMetricData(ctx, input)
+		if err != nil {
+			return fmt.Errorf("cloudwatch GetMetricData: %w", err)
+		}
+		for _, res := range out.MetricDataResults {
+			id := aws.ToString(res.Id)
+			idx := -1
+			if len(id) > 1 {
+				idx, _ = strconv.Atoi(id[1:])
+			}
+			if idx < 0 || idx >= len(batch) {
+				return fmt.Errorf("cloudwatch returned unexpected query id %q", id)
+			}
+			if res.StatusCode == cwtypes.StatusCodeInternalError || res.StatusCode == cwtypes.StatusCodeForbidden {
+				return fmt.Errorf("cloudwatch metrics for distribution %s: %s", batch[idx].distribution, res.StatusCode)
+			}
+			if len(res.Timestamps) != len(res.Values) {
+				return fmt.Errorf("cloudwatch metrics for distribution %s: %d timestamps for %d values", batch[idx].distribution, len(res.Timestamps), len(res.Values))
+			}
+			for i, ts := range res.Timestamps {
+				ws := ts.UTC().Truncate(window)
+				if ws.Before(start) || !ws.Before(end) {
+					continue
+				}
+				serviceID := batch[idx].serviceID
+				if buckets[serviceID] == nil {
+					buckets[serviceID] = make(map[time.Time]*cdn.WindowedUsage)
+				}
+				u := buckets[serviceID][ws]
+				if u == nil {
+					u = &cdn.WindowedUsage{WindowStart: ws, WindowEnd: ws.Add(window)}
+					buckets[serviceID][ws] = u
+				}
+				if id[0] == 'b' {
+					u.Bytes += int64(res.Values[i])
+				} else {
+					u.Requests += int64(res.Values[i])
+				}
+			}
+		}
+		if out.NextToken == nil {
+			return nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+func metricQuery(id, metric, distribution string, period int32) cwtypes.MetricDataQuery {
+	return cwtypes.MetricDataQuery{
+		Id: aws.String(id),
+		MetricStat: &cwtypes.MetricStat{
+			Metric: &cwtypes.Metric{
+				Namespace:  aws.String(namespace),
+				MetricName: aws.String(metric),
+				Dimensions: []cwtypes.Dimension{
+					{Name: aws.String("DistributionId"), Value: aws.String(distribution)},
+					{Name: aws.String("Region"), Value: aws.String("Global")},
+				},
+			},
+			Period: aws.Int32(period),
+			Stat:   aws.String("Sum"),
+		},
+		ReturnData: aws.Bool(true),
+	}
+}
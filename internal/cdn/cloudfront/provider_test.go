@@ -0,0 +1,134 @@
+package cloudfront
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+
+	"tranche/internal/cdn"
+)
+
+type mockCloudWatchClient struct {
+	getMetricDataFn func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error)
+}
+
+func (m *mockCloudWatchClient) GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+	return m.getMetricDataFn(ctx, params, optFns...)
+}
+
+func result(id string, values map[time.Time]float64) cwtypes.MetricDataResult {
+	res := cwtypes.MetricDataResult{Id: aws.String(id), StatusCode: cwtypes.StatusCodeComplete}
+	for ts, v := range values {
+		res.Timestamps = append(res.Timestamps, ts)
+		res.Values = append(res.Values, v)
+	}
+	return res
+}
+
+func TestServiceUsageSumsDistributionMetrics(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(2 * time.Hour)
+
+	calls := 0
+	mock := &mockCloudWatchClient{}
+	mock.getMetricDataFn = func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+		calls++
+		if len(params.MetricDataQueries) != 4 {
+			t.Fatalf("expected 4 queries for 2 distributions, got %d", len(params.MetricDataQueries))
+		}
+		q := params.MetricDataQueries[0]
+		if aws.ToString(q.Id) != "b0" || aws.ToString(q.MetricStat.Metric.MetricName) != "BytesDownloaded" ||
+			aws.ToString(q.MetricStat.Metric.Dimensions[0].Value) != "EDIST12" || aws.ToInt32(q.MetricStat.Period) != 3600 ||
+			aws.ToString(q.MetricStat.Stat) != "Sum" {
+			t.Fatalf("unexpected first query %+v", q.MetricStat)
+		}
+		if aws.ToString(params.MetricDataQueries[1].MetricStat.Metric.MetricName) != "Requests" {
+			t.Fatalf("expected the requests query second")
+		}
+		if calls == 1 {
+			if params.NextToken != nil {
+				t.Fatalf("unexpected token on first call")
+			}
+			return &cloudwatch.GetMetricDataOutput{
+				MetricDataResults: []cwtypes.MetricDataResult{
+					result("b0", map[time.Time]float64{start: 1000}),
+					result("r0", map[time.Time]float64{start: 10}),
+					result("b1", map[time.Time]float64{start.Add(time.Hour): 70}),
+				},
+				NextToken: aws.String("page2"),
+			}, nil
+		}
+		if aws.ToString(params.NextToken) != "page2" {
+			t.Fatalf("expected the second page token, got %v", params.NextToken)
+		}
+		return &cloudwatch.GetMetricDataOutput{
+			MetricDataResults: []cwtypes.MetricDataResult{
+				result("b0", map[time.Time]float64{start.Add(time.Hour): 500, end: 999}),
+				result("r0", map[time.Time]float64{start.Add(time.Hour): 5}),
+				result("r1", map[time.Time]float64{start.Add(time.Hour): 7}),
+			},
+		}, nil
+	}
+
+	p := newProvider(mock, map[int64]string{12: "EDIST12", 15: "EDIST15"})
+	usages, err := p.ServiceUsage(context.Background(), start, end, time.Hour, []int64{15, 12, 99})
+	var unmeasured *cdn.UnmeasuredError
+	if !errors.As(err, &unmeasured) {
+		t.Fatalf("expected the unmapped service to be reported unmeasured, got %v", err)
+	}
+	if len(unmeasured.Services) != 1 || unmeasured.Services[99] == nil {
+		t.Fatalf("expected only service 99 unmeasured, got %v", unmeasured.Services)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 pages, got %d", calls)
+	}
+	if len(usages) != 3 {
+		t.Fatalf("expected 3 windows, got %+v", usages)
+	}
+	first := usages[0]
+	if first.ServiceID != 12 || !first.WindowStart.Equal(start) || !first.WindowEnd.Equal(start.Add(time.Hour)) || first.Bytes != 1000 || first.Requests != 10 {
+		t.Fatalf("unexpected first window %+v", first)
+	}
+	if usages[1].ServiceID != 12 || usages[1].Bytes != 500 || usages[1].Requests != 5 {
+		t.Fatalf("unexpected second window %+v", usages[1])
+	}
+	if usages[2].ServiceID != 15 || usages[2].Bytes != 70 || usages[2].Requests != 7 {
+		t.Fatalf("unexpected third window %+v", usages[2])
+	}
+}
+
+func TestServiceUsageFailsOnForbiddenMetrics(t *testing.T) {
+	mock := &mockCloudWatchClient{}
+	mock.getMetricDataFn = func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+		return &cloudwatch.GetMetricDataOutput{
+			MetricDataResults: []cwtypes.MetricDataResult{{Id: aws.String("b0"), StatusCode: cwtypes.StatusCodeForbidden}},
+		}, nil
+	}
+	p := newProvider(mock, map[int64]string{12: "EDIST12"})
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	if _, err := p.ServiceUsage(context.Background(), start, start.Add(time.Hour), time.Hour, []int64{12}); err == nil || !strings.Contains(err.Error(), "EDIST12") {
+		t.Fatalf("expected a forbidden error naming the distribution, got %v", err)
+	}
+	if _, err := p.ServiceUsage(context.Background(), start, start.Add(time.Hour), 90*time.Second, []int64{12}); err == nil {
+		t.Fatalf("expected sub-minute windows to be rejected")
+	}
+}
+
+func TestParseDistributions(t *testing.T) {
+	got, err := parseDistributions(`{"12":"EDIST12","15":"EDIST15"}`)
+	if err != nil || got[12] != "EDIST12" || got[15] != "EDIST15" {
+		t.Fatalf("unexpected mapping %v, %v", got, err)
+	}
+	if _, err := parseDistributions(`{"12":"EDIST","15":"EDIST"}`); err == nil || !strings.Contains(err.Error(), "services 12 and 15") {
+		t.Fatalf("expected a shared distribution to be rejected, got %v", err)
+	}
+	if _, err := parseDistributions(`{"web":"EDIST"}`); err == nil {
+		t.Fatalf("expected non-numeric service ids to be rejected")
+	}
+}
@@ -0,0 +1,198 @@
+package fastly
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"tranche/internal/cdn"
+	"tranche/internal/config"
+)
+
+const (
+	providerName   = "fastly"
+	defaultBaseURL = "https://api.fastly.com"
+)
+
+// Provider reads bandwidth and request counts from Fastly's historical stats API. FASTLY_SERVICE_CONFIG maps
+// hostnames to Fastly service IDs. Stats are per Fastly service, so each service's bytes are
+// reported under the first of its requested hostnames; hostnames sharing a Fastly service
+// must therefore belong to the same Tranche service.
+type Provider struct {
+	apiToken string
+	services map[string]string
+	baseURL  string
+	client   *http.Client
+}
+
+var _ cdn.HostProvider = (*Provider)(nil)
+
+func NewProvider(cfg config.FastlyConfig) (*Provider, error) {
+	if cfg.APIToken == "" {
+		return nil, fmt.Errorf("fastly api token missing")
+	}
+
+	services, err := parseServices(cfg.ServiceConfigJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{
+		apiToken: cfg.APIToken,
+		services: services,
+		baseURL:  defaultBaseURL,
+		client:   http.DefaultClient,
+	}, nil
+}
+
+// parseServices reads the hostname-to-Fastly-service mapping. FASTLY_SERVICE_CONFIG used to
+// be keyed by Tranche service ID; such keys are refused rather than left to match no host.
+func parseServices(raw string) (map[string]string, error) {
+	services := make(map[string]string)
+	if raw == "" {
+		return services, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &services); err != nil {
+		return nil, fmt.Errorf("parse FASTLY_SERVICE_CONFIG: %w", err)
+	}
+	for key, fastlyID := range services {
+		if _, err := strconv.ParseInt(key, 10, 64); err == nil {
+			return nil, fmt.Errorf("parse FASTLY_SERVICE_CONFIG: key %q is a Tranche service ID; keys are now the hostnames served by each Fastly service, e.g. {\"app.example.com\":%q}", key, fastlyID)
+		}
+		if fastlyID == "" {
+			return nil, fmt.Errorf("parse FASTLY_SERVICE_CONFIG: host %s has no Fastly service id", key)
+		}
+	}
+	return services, nil
+}
+
+func (p *Provider) Name() string {
+	return providerName
+}
+
+// Usage buckets Fastly bandwidth and requests into windows between [start, end). The stats granularity
+// (minute, hour or day) is the coarsest one that evenly divides the window. Hosts without a
+// mapping are reported in a *cdn.UnmeasuredError returned with the usage of the others.
+func (p *Provider) Usage(ctx context.Context, start, end time.Time, window time.Duration, hosts []string) ([]cdn.WindowedUsage, error) {
+	by, err := granularity(window)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+	var serviceOrder []string
+	hostForService := make(map[string]string)
+	unmapped := make(map[string]error)
+	for _, host := range sorted {
+		fastlyID, ok := p.services[host]
+		if !ok {
+			unmapped[host] = fmt.Errorf("no fastly service mapped in FASTLY_SERVICE_CONFIG")
+			continue
+		}
+		if _, seen := hostForService[fastlyID]; !seen {
+			hostForService[fastlyID] = host
+			serviceOrder = append(serviceOrder, fastlyID)
+		}
+	}
+
+	var usages []cdn.WindowedUsage
+	for _, fastlyID := range serviceOrder {
+		buckets, err := p.serviceStats(ctx, fastlyID, start, end, window, by)
+		if err != nil {
+			return nil, err
+		}
+		windows := make([]time.Time, 0, len(buckets))
+		for ws := range buckets {
+			windows = append(windows, ws)
+		}
+		sort.Slice(windows, func(i, j int) bool { return windows[i].Before(windows[j]) })
+		for _, ws := range windows {
+			u := *buckets[ws]
+			u.Host = hostForService[fastlyID]
+			usages = append(usages, u)
+		}
+	}
+	if len(unmapped) > 0 {
+		return usages, &cdn.UnmeasuredError{Hosts: unmapped}
+	}
+	return usages, nil
+}
+
+func granularity(window time.Duration) (string, error) {
+	switch {
+	case window <= 0:
+		return "", fmt.Errorf("window must be positive")
+	case window%(24*time.Hour) == 0:
+		return "day", nil
+	case window%time.Hour == 0:
+		return "hour", nil
+	case window%time.Minute == 0:
+		return "minute", nil
+	default:
+		return "", fmt.Errorf("fastly windows must be whole minutes; got %s", window)
+	}
+}
+
+type statsResponse struct {
+	Status string `json:"status"`
+	Msg    string `json:"msg"`
+	Data   []struct {
+		StartTime int64 `json:"start_time"`
+		Bandwidth int64 `json:"bandwidth"`
+		Requests  int64 `json:"requests"`
+	} `json:"data"`
+}
+
+func (p *Provider) serviceStats(ctx context.Context, fastlyID string, start, end time.Time, window time.Duration, by string) (map[time.Time]*cdn.WindowedUsage, error) {
+	q := url.Values{}
+	q.Set("from", strconv.FormatInt(start.Unix(), 10))
+	q.Set("to", strconv.FormatInt(end.Unix(), 10))
+	q.Set("by", by)
+	endpoint := fmt.Sprintf("%s/stats/service/%s?%s", p.baseURL, url.PathEscape(fastlyID), q.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Fastly-Key", p.apiToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("query fastly stats for service %s: %w", fastlyID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fastly stats api status %d for service %s", resp.StatusCode, fastlyID)
+	}
+
+	var decoded statsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if decoded.Status != "success" {
+		return nil, fmt.Errorf("fastly stats error for service %s: %s", fastlyID, decoded.Msg)
+	}
+
+	buckets := make(map[time.Time]*cdn.WindowedUsage)
+	for _, bucket := range decoded.Data {
+		ws := time.Unix(bucket.StartTime, 0).UTC().Truncate(window)
+		if ws.Before(start) || !ws.Before(end) {
+			continue
+		}
+		u := buckets[ws]
+		if u == nil {
+			u = &cdn.WindowedUsage{WindowStart: ws, WindowEnd: ws.Add(window)}
+			buckets[ws] = u
+		}
+		u.Bytes += bucket.Bandwidth
+		u.Requests += bucket.Requests
+	}
+	return buckets, nil
+}
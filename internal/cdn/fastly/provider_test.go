@@ -0,0 +1,153 @@
+package fastly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tranche/internal/cdn"
+	"tranche/internal/config"
+)
+
+func newTestProvider(t *testing.T, handler http.HandlerFunc) *Provider {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	p, err := NewProvider(config.FastlyConfig{
+		APIToken:          "token",
+		ServiceConfigJSON: `{"app.example.com":"SU1Z0isxPaozGVKXdv0eY","www.example.com":"SU1Z0isxPaozGVKXdv0eY"}`,
+	})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	p.baseURL = srv.URL
+	p.client = srv.Client()
+	return p
+}
+
+func TestUsageBucketsBandwidthPerWindow(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(2 * time.Hour)
+
+	requests := 0
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/stats/service/SU1Z0isxPaozGVKXdv0eY" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Fastly-Key"); got != "token" {
+			t.Errorf("expected Fastly-Key header, got %q", got)
+		}
+		q := r.URL.Query()
+		if q.Get("from") != fmt.Sprint(start.Unix()) || q.Get("to") != fmt.Sprint(end.Unix()) || q.Get("by") != "hour" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		fmt.Fprintf(w, `{"status":"success","msg":null,"data":[
+			{"start_time":%d,"bandwidth":1000,"requests":10},
+			{"start_time":%d,"bandwidth":500,"requests":5},
+			{"start_time":%d,"bandwidth":9999,"requests":1}
+		]}`, start.Unix(), start.Add(time.Hour).Unix(), end.Unix())
+	})
+
+	usages, err := p.Usage(context.Background(), start, end, time.Hour, []string{"www.example.com", "app.example.com", "unmapped.example.com"})
+	var unmeasured *cdn.UnmeasuredError
+	if !errors.As(err, &unmeasured) || len(unmeasured.Hosts) != 1 || unmeasured.Hosts["unmapped.example.com"] == nil {
+		t.Fatalf("expected unmapped.example.com to be reported unmeasured, got %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("expected hosts sharing a Fastly service to be fetched once, got %d requests", requests)
+	}
+	if len(usages) != 2 {
+		t.Fatalf("expected 2 windows, got %d: %+v", len(usages), usages)
+	}
+	for i, want := range []struct{ bytes, requests int64 }{{1000, 10}, {500, 5}} {
+		u := usages[i]
+		if u.Host != "app.example.com" {
+			t.Fatalf("expected usage under app.example.com, got %s", u.Host)
+		}
+		if !u.WindowStart.Equal(start.Add(time.Duration(i)*time.Hour)) || !u.WindowEnd.Equal(u.WindowStart.Add(time.Hour)) {
+			t.Fatalf("unexpected window %s-%s", u.WindowStart, u.WindowEnd)
+		}
+		if u.Bytes != want.bytes || u.Requests != want.requests {
+			t.Fatalf("window %d: expected %d bytes/%d requests, got %d/%d", i, want.bytes, want.requests, u.Bytes, u.Requests)
+		}
+	}
+}
+
+func TestUsageGranularityFollowsWindow(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		window time.Duration
+		want   string
+	}{
+		{window: 15 * time.Minute, want: "minute"},
+		{window: time.Hour, want: "hour"},
+		{window: 24 * time.Hour, want: "day"},
+	}
+	for _, tc := range cases {
+		p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+			if by := r.URL.Query().Get("by"); by != tc.want {
+				t.Errorf("window %s: expected by=%s, got %q", tc.window, tc.want, by)
+			}
+			fmt.Fprint(w, `{"status":"success","data":[]}`)
+		})
+		if _, err := p.Usage(context.Background(), start, start.Add(tc.window), tc.window, []string{"app.example.com"}); err != nil {
+			t.Fatalf("window %s: %v", tc.window, err)
+		}
+	}
+}
+
+func TestNewProviderRejectsServiceIDKeys(t *testing.T) {
+	_, err := NewProvider(config.FastlyConfig{APIToken: "token", ServiceConfigJSON: `{"12":"SU1Z0isxPaozGVKXdv0eY"}`})
+	if err == nil || !strings.Contains(err.Error(), "hostnames") {
+		t.Fatalf("expected service ID keys to be refused, got %v", err)
+	}
+	if _, err := NewProvider(config.FastlyConfig{APIToken: "token", ServiceConfigJSON: `{"app.example.com":""}`}); err == nil {
+		t.Fatalf("expected a host without a Fastly service to be refused")
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name    string
+		window  time.Duration
+		handler http.HandlerFunc
+		want    string
+	}{
+		{
+			name:    "sub-minute window",
+			window:  30 * time.Second,
+			handler: func(w http.ResponseWriter, r *http.Request) { t.Errorf("unexpected request") },
+			want:    "whole minutes",
+		},
+		{
+			name:    "http error",
+			window:  time.Hour,
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusUnauthorized) },
+			want:    "status 401",
+		},
+		{
+			name:   "api error",
+			window: time.Hour,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"status":"error","msg":"bad range"}`)
+			},
+			want: "bad range",
+		},
+	}
+
+	for _, tc := range cases {
+		p := newTestProvider(t, tc.handler)
+		_, err := p.Usage(context.Background(), start, start.Add(time.Hour), tc.window, []string{"app.example.com"})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
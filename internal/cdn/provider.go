@@ -1,20 +1,12 @@
 package cdn
 
 import (
-	"context"
 	"fmt"
-	"time"
+	"sort"
 
 	"tranche/internal/db"
 )
 
-// UsageProvider exposes CDN-specific primitives such as usage gathering.
-// Implementations should be stateless and safe for concurrent use.
-type UsageProvider interface {
-	Name() string
-	FetchUsage(ctx context.Context, svc db.Service, since, until time.Time) (primaryBytes, backupBytes int64, err error)
-}
-
 type Logger interface {
 	Printf(string, ...any)
 }
@@ -23,18 +15,18 @@ type SelectorConfig struct {
 	DefaultProvider   string
 	CustomerOverrides map[int64]string
 	ServiceOverrides  map[int64]string
-	Providers         []UsageProvider
+	Providers         []Provider
 }
 
 type Selector struct {
-	providers         map[string]UsageProvider
+	providers         map[string]Provider
 	defaultProvider   string
 	customerOverrides map[int64]string
 	serviceOverrides  map[int64]string
 }
 
 func NewSelector(cfg SelectorConfig) (*Selector, error) {
-	providers := make(map[string]UsageProvider)
+	providers := make(map[string]Provider)
 	for _, p := range cfg.Providers {
 		if p == nil {
 			continue
@@ -43,6 +35,9 @@ func NewSelector(cfg SelectorConfig) (*Selector, error) {
 		if name == "" {
 			return nil, fmt.Errorf("provider with empty name")
 		}
+		if _, dup := providers[name]; dup {
+			return nil, fmt.Errorf("provider %q registered twice", name)
+		}
 		providers[name] = p
 	}
 
@@ -54,7 +49,42 @@ func NewSelector(cfg SelectorConfig) (*Selector, error) {
 	}, nil
 }
 
-func (s *Selector) ProviderForService(svc db.Service) (UsageProvider, error) {
+// Providers returns the registered provider names.
+func (s *Selector) Providers() []string {
+	names := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ProviderForService resolves the provider measuring a service's primary CDN.
+func (s *Selector) ProviderForService(svc db.Service) (Provider, error) {
+	return s.ProviderFor(svc, RolePrimary)
+}
+
+// ProviderFor resolves the provider measuring one of a service's CDNs. The primary CDN honours
+// service and customer overrides, then falls back to the default provider; the backup CDN
+// is looked up by name only.
+func (s *Selector) ProviderFor(svc db.Service, role Role) (Provider, error) {
+	name := s.NameFor(svc, role)
+	if name == "" {
+		return nil, fmt.Errorf("no %s provider configured for service %d", role, svc.ID)
+	}
+	p, ok := s.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%s provider %q not registered", role, name)
+	}
+	return p, nil
+}
+
+// NameFor returns the provider name ProviderFor would resolve, without requiring it to be
+// registered.
+func (s *Selector) NameFor(svc db.Service, role Role) string {
+	if role == RoleBackup {
+		return svc.BackupCdn
+	}
 	name := svc.PrimaryCdn
 	if override, ok := s.customerOverrides[svc.CustomerID]; ok {
 		name = override
@@ -65,12 +95,5 @@ func (s *Selector) ProviderForService(svc db.Service) (UsageProvider, error) {
 	if name == "" {
 		name = s.defaultProvider
 	}
-	if name == "" {
-		return nil, fmt.Errorf("no provider configured for service %d", svc.ID)
-	}
-	p, ok := s.providers[name]
-	if !ok {
-		return nil, fmt.Errorf("provider %q not registered", name)
-	}
-	return p, nil
+	return name
 }
@@ -12,8 +12,8 @@ type fakeProvider struct{ name string }
 
 func (f fakeProvider) Name() string { return f.name }
 
-func (fakeProvider) FetchUsage(ctx context.Context, svc db.Service, since, until time.Time) (int64, int64, error) {
-	return 0, 0, nil
+func (fakeProvider) Usage(ctx context.Context, start, end time.Time, window time.Duration, hosts []string) ([]WindowedUsage, error) {
+	return nil, nil
 }
 
 func TestSelectorPrecedence(t *testing.T) {
@@ -21,7 +21,7 @@ func TestSelectorPrecedence(t *testing.T) {
 		DefaultProvider:   "default",
 		CustomerOverrides: map[int64]string{1: "customer"},
 		ServiceOverrides:  map[int64]string{2: "service"},
-		Providers: []UsageProvider{
+		Providers: []Provider{
 			fakeProvider{name: "default"},
 			fakeProvider{name: "customer"},
 			fakeProvider{name: "service"},
@@ -53,3 +53,32 @@ func TestSelectorPrecedence(t *testing.T) {
 		}
 	}
 }
+
+func TestSelectorBackupIgnoresOverrides(t *testing.T) {
+	selector, err := NewSelector(SelectorConfig{
+		DefaultProvider:  "default",
+		ServiceOverrides: map[int64]string{2: "service"},
+		Providers:        []Provider{fakeProvider{name: "default"}, fakeProvider{name: "service"}, fakeProvider{name: "fastly"}},
+	})
+	if err != nil {
+		t.Fatalf("selector init: %v", err)
+	}
+
+	prov, err := selector.ProviderFor(db.Service{ID: 2, PrimaryCdn: "cloudflare", BackupCdn: "fastly"}, RoleBackup)
+	if err != nil {
+		t.Fatalf("backup provider: %v", err)
+	}
+	if prov.Name() != "fastly" {
+		t.Fatalf("expected fastly got %s", prov.Name())
+	}
+
+	if _, err := selector.ProviderFor(db.Service{ID: 3, PrimaryCdn: "cloudflare", BackupCdn: "akamai"}, RoleBackup); err == nil {
+		t.Fatalf("expected error for unregistered backup provider")
+	}
+}
+
+func TestSelectorRejectsDuplicateNames(t *testing.T) {
+	if _, err := NewSelector(SelectorConfig{Providers: []Provider{fakeProvider{name: "a"}, fakeProvider{name: "a"}}}); err == nil {
+		t.Fatalf("expected duplicate provider names to be rejected")
+	}
+}
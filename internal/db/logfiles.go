@@ -0,0 +1,56 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// LogFileWindow is what one log file added to one service's usage window.
+type LogFileWindow struct {
+	ServiceID       int64     `json:"service_id"`
+	WindowStart     time.Time `json:"window_start"`
+	WindowEnd       time.Time `json:"window_end"`
+	PrimaryBytes    int64     `json:"primary_bytes,omitempty"`
+	BackupBytes     int64     `json:"backup_bytes,omitempty"`
+	PrimaryRequests int64     `json:"primary_requests,omitempty"`
+	BackupRequests  int64     `json:"backup_requests,omitempty"`
+}
+
+// LogFileUsage is the usage JSONB column of usage_log_files. It is empty for files
+// processed before the column existed.
+type LogFileUsage []LogFileWindow
+
+// Value encodes the windows as a JSON array; a nil slice is stored as [].
+func (u LogFileUsage) Value() (driver.Value, error) {
+	if u == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]LogFileWindow(u))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (u *LogFileUsage) Scan(src any) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*u = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("scan log file usage: unsupported type %T", src)
+	}
+	usage := LogFileUsage{}
+	if err := json.Unmarshal(raw, &usage); err != nil {
+		return fmt.Errorf("scan log file usage: %w", err)
+	}
+	*u = usage
+	return nil
+}
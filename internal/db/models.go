@@ -10,9 +10,20 @@ import (
 )
 
 type Customer struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"created_at"`
+	ID                 int64          `json:"id"`
+	Name               string         `json:"name"`
+	CreatedAt          time.Time      `json:"created_at"`
+	BillingTimezone    string         `json:"billing_timezone"`
+	BillingAnchorDay   int16          `json:"billing_anchor_day"`
+	ExternalCustomerID sql.NullString `json:"external_customer_id"`
+}
+
+type CustomerPlan struct {
+	ID            int64     `json:"id"`
+	CustomerID    int64     `json:"customer_id"`
+	PlanID        int64     `json:"plan_id"`
+	EffectiveFrom time.Time `json:"effective_from"`
+	CreatedAt     time.Time `json:"created_at"`
 }
 
 type CustomerToken struct {
@@ -24,29 +35,97 @@ type CustomerToken struct {
 	RevokedAt  sql.NullTime `json:"revoked_at"`
 }
 
-type Invoice struct {
+type DnsWeightChange struct {
 	ID            int64     `json:"id"`
-	CustomerID    int64     `json:"customer_id"`
-	PeriodStart   time.Time `json:"period_start"`
-	PeriodEnd     time.Time `json:"period_end"`
-	SubtotalCents int64     `json:"subtotal_cents"`
-	DiscountCents int64     `json:"discount_cents"`
-	TotalCents    int64     `json:"total_cents"`
-	CreatedAt     time.Time `json:"created_at"`
+	ServiceID     int64     `json:"service_id"`
+	Domain        string    `json:"domain"`
+	PrimaryWeight int32     `json:"primary_weight"`
+	BackupWeight  int32     `json:"backup_weight"`
+	AppliedAt     time.Time `json:"applied_at"`
+}
+
+type Invoice struct {
+	ID                  int64          `json:"id"`
+	CustomerID          int64          `json:"customer_id"`
+	PeriodStart         time.Time      `json:"period_start"`
+	PeriodEnd           time.Time      `json:"period_end"`
+	SubtotalCents       int64          `json:"subtotal_cents"`
+	DiscountCents       int64          `json:"discount_cents"`
+	TotalCents          int64          `json:"total_cents"`
+	CreatedAt           time.Time      `json:"created_at"`
+	Status              string         `json:"status"`
+	FinalizedAt         sql.NullTime   `json:"finalized_at"`
+	PaidAt              sql.NullTime   `json:"paid_at"`
+	ExportStatus        string         `json:"export_status"`
+	ExternalID          sql.NullString `json:"external_id"`
+	ExportAttempts      int32          `json:"export_attempts"`
+	ExportError         sql.NullString `json:"export_error"`
+	ExportNextAttemptAt sql.NullTime   `json:"export_next_attempt_at"`
+	ExportedAt          sql.NullTime   `json:"exported_at"`
+	Currency            string         `json:"currency"`
+	SubtotalMicros      int64          `json:"subtotal_micros"`
+	DiscountMicros      int64          `json:"discount_micros"`
+	ReplacesInvoiceID   sql.NullInt64  `json:"replaces_invoice_id"`
 }
 
 type InvoiceLineItem struct {
-	ID             int64     `json:"id"`
-	InvoiceID      int64     `json:"invoice_id"`
-	ServiceID      int64     `json:"service_id"`
-	WindowStart    time.Time `json:"window_start"`
-	WindowEnd      time.Time `json:"window_end"`
-	PrimaryBytes   int64     `json:"primary_bytes"`
-	BackupBytes    int64     `json:"backup_bytes"`
-	CoverageFactor float64   `json:"coverage_factor"`
-	AmountCents    int64     `json:"amount_cents"`
-	DiscountCents  int64     `json:"discount_cents"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID               int64          `json:"id"`
+	InvoiceID        int64          `json:"invoice_id"`
+	ServiceID        sql.NullInt64  `json:"service_id"`
+	WindowStart      time.Time      `json:"window_start"`
+	WindowEnd        time.Time      `json:"window_end"`
+	PrimaryBytes     int64          `json:"primary_bytes"`
+	BackupBytes      int64          `json:"backup_bytes"`
+	CoverageFactor   float64        `json:"coverage_factor"`
+	AmountCents      int64          `json:"amount_cents"`
+	DiscountCents    int64          `json:"discount_cents"`
+	CreatedAt        time.Time      `json:"created_at"`
+	Kind             string         `json:"kind"`
+	AdjustsInvoiceID sql.NullInt64  `json:"adjusts_invoice_id"`
+	PrimaryRequests  int64          `json:"primary_requests"`
+	BackupRequests   int64          `json:"backup_requests"`
+	AmountMicros     int64          `json:"amount_micros"`
+	DiscountMicros   int64          `json:"discount_micros"`
+	StormBreakdown   StormBreakdown `json:"storm_breakdown"`
+	Pricing          LinePricing    `json:"pricing"`
+}
+
+type InvoiceLineItemExport struct {
+	LineItemID int64     `json:"line_item_id"`
+	InvoiceID  int64     `json:"invoice_id"`
+	ExternalID string    `json:"external_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type InvoiceVoid struct {
+	ID                   int64     `json:"id"`
+	InvoiceID            int64     `json:"invoice_id"`
+	ReplacementInvoiceID int64     `json:"replacement_invoice_id"`
+	Reason               string    `json:"reason"`
+	PreviousStatus       string    `json:"previous_status"`
+	ReleasedSnapshots    int32     `json:"released_snapshots"`
+	ReleasedRevisions    int32     `json:"released_revisions"`
+	OldSubtotalCents     int64     `json:"old_subtotal_cents"`
+	OldDiscountCents     int64     `json:"old_discount_cents"`
+	OldTotalCents        int64     `json:"old_total_cents"`
+	NewSubtotalCents     int64     `json:"new_subtotal_cents"`
+	NewDiscountCents     int64     `json:"new_discount_cents"`
+	NewTotalCents        int64     `json:"new_total_cents"`
+	CreatedAt            time.Time `json:"created_at"`
+}
+
+type PricingPlan struct {
+	ID                    int64         `json:"id"`
+	Name                  string        `json:"name"`
+	PrimaryRateCentsPerGb int64         `json:"primary_rate_cents_per_gb"`
+	BackupRateCentsPerGb  int64         `json:"backup_rate_cents_per_gb"`
+	Tiers                 PlanTiers     `json:"tiers"`
+	MinimumMonthlyCents   int64         `json:"minimum_monthly_cents"`
+	StormDiscountRate     float64       `json:"storm_discount_rate"`
+	CreatedAt             time.Time     `json:"created_at"`
+	UpdatedAt             time.Time     `json:"updated_at"`
+	SlaDefinitionID       sql.NullInt64 `json:"sla_definition_id"`
+	Currency              string        `json:"currency"`
 }
 
 type ProbeSample struct {
@@ -68,11 +147,50 @@ type Service struct {
 	DeletedAt  sql.NullTime `json:"deleted_at"`
 }
 
+type ServiceDnsSetting struct {
+	ServiceID       int64     `json:"service_id"`
+	TtlSeconds      int32     `json:"ttl_seconds"`
+	StormTtlSeconds int32     `json:"storm_ttl_seconds"`
+	PrestormMargin  float64   `json:"prestorm_margin"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
 type ServiceDomain struct {
-	ID        int64     `json:"id"`
+	ID              int64     `json:"id"`
+	ServiceID       int64     `json:"service_id"`
+	Name            string    `json:"name"`
+	CreatedAt       time.Time `json:"created_at"`
+	RoutingStrategy string    `json:"routing_strategy"`
+}
+
+type ServicePathHit struct {
 	ServiceID int64     `json:"service_id"`
+	Day       time.Time `json:"day"`
+	Path      string    `json:"path"`
+	Hits      int64     `json:"hits"`
+}
+
+type SlaDefinition struct {
+	ID        int64     `json:"id"`
 	Name      string    `json:"name"`
+	Tiers     SLATiers  `json:"tiers"`
 	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SlaResult struct {
+	ID                  int64     `json:"id"`
+	InvoiceID           int64     `json:"invoice_id"`
+	ServiceID           int64     `json:"service_id"`
+	SlaDefinitionID     int64     `json:"sla_definition_id"`
+	PeriodStart         time.Time `json:"period_start"`
+	PeriodEnd           time.Time `json:"period_end"`
+	AvailabilityPercent float64   `json:"availability_percent"`
+	DownMinutes         int64     `json:"down_minutes"`
+	TotalMinutes        int64     `json:"total_minutes"`
+	CreditPercent       float64   `json:"credit_percent"`
+	CreditCents         int64     `json:"credit_cents"`
+	CreatedAt           time.Time `json:"created_at"`
 }
 
 type StormEvent struct {
@@ -94,13 +212,62 @@ type StormPolicy struct {
 	CreatedAt         time.Time `json:"created_at"`
 }
 
+type UsageBackfill struct {
+	JobKey      string       `json:"job_key"`
+	RangeStart  time.Time    `json:"range_start"`
+	RangeEnd    time.Time    `json:"range_end"`
+	Services    string       `json:"services"`
+	CursorAt    time.Time    `json:"cursor_at"`
+	Filled      int64        `json:"filled"`
+	Present     int64        `json:"present"`
+	Empty       int64        `json:"empty"`
+	StartedAt   time.Time    `json:"started_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	CompletedAt sql.NullTime `json:"completed_at"`
+}
+
+type UsageIngestCoverage struct {
+	ServiceID      int64     `json:"service_id"`
+	CoveredFrom    time.Time `json:"covered_from"`
+	CoveredThrough time.Time `json:"covered_through"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+type UsageLogFile struct {
+	Source      string       `json:"source"`
+	ObjectKey   string       `json:"object_key"`
+	SizeBytes   int64        `json:"size_bytes"`
+	Etag        string       `json:"etag"`
+	Records     int64        `json:"records"`
+	Skipped     int64        `json:"skipped"`
+	ProcessedAt time.Time    `json:"processed_at"`
+	Usage       LogFileUsage `json:"usage"`
+}
+
+type UsageRevision struct {
+	ID              int64         `json:"id"`
+	SnapshotID      int64         `json:"snapshot_id"`
+	PrimaryBytes    int64         `json:"primary_bytes"`
+	BackupBytes     int64         `json:"backup_bytes"`
+	CreatedAt       time.Time     `json:"created_at"`
+	SettledAt       sql.NullTime  `json:"settled_at"`
+	InvoiceID       sql.NullInt64 `json:"invoice_id"`
+	PrimaryRequests int64         `json:"primary_requests"`
+	BackupRequests  int64         `json:"backup_requests"`
+	Regions         UsageRegions  `json:"regions"`
+}
+
 type UsageSnapshot struct {
-	ID           int64         `json:"id"`
-	ServiceID    int64         `json:"service_id"`
-	WindowStart  time.Time     `json:"window_start"`
-	WindowEnd    time.Time     `json:"window_end"`
-	PrimaryBytes int64         `json:"primary_bytes"`
-	BackupBytes  int64         `json:"backup_bytes"`
-	CreatedAt    time.Time     `json:"created_at"`
-	InvoiceID    sql.NullInt64 `json:"invoice_id"`
+	ID              int64         `json:"id"`
+	ServiceID       int64         `json:"service_id"`
+	WindowStart     time.Time     `json:"window_start"`
+	WindowEnd       time.Time     `json:"window_end"`
+	PrimaryBytes    int64         `json:"primary_bytes"`
+	BackupBytes     int64         `json:"backup_bytes"`
+	CreatedAt       time.Time     `json:"created_at"`
+	InvoiceID       sql.NullInt64 `json:"invoice_id"`
+	PrimaryRequests int64         `json:"primary_requests"`
+	BackupRequests  int64         `json:"backup_requests"`
+	Regions         UsageRegions  `json:"regions"`
+	FirstSeenAt     time.Time     `json:"first_seen_at"`
 }
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// PlanTier lowers a pricing plan's rates for a customer's monthly volume beyond FromGB.
+type PlanTier struct {
+	FromGB                int64 `json:"from_gb"`
+	PrimaryRateCentsPerGB int64 `json:"primary_rate_cents_per_gb"`
+	BackupRateCentsPerGB  int64 `json:"backup_rate_cents_per_gb"`
+}
+
+// PlanTiers is the tiers JSONB column of pricing_plans, ordered by FromGB.
+type PlanTiers []PlanTier
+
+// Value encodes the tiers as a JSON array; a nil slice is stored as [].
+func (t PlanTiers) Value() (driver.Value, error) {
+	if t == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]PlanTier(t))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (t *PlanTiers) Scan(src any) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("scan plan tiers: unsupported type %T", src)
+	}
+	tiers := PlanTiers{}
+	if err := json.Unmarshal(raw, &tiers); err != nil {
+		return fmt.Errorf("scan plan tiers: %w", err)
+	}
+	*t = tiers
+	return nil
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// LinePricing is the pricing JSONB column of invoice_line_items: the rates a window of usage
+// was priced at. A customer without a plan is priced at the global RateCentsPerGB and
+// RegionRatesCentsPerGB; one with a plan at the plan's base rates and Tiers, starting
+// VolumeOffsetBytes into their volume for the billing period. Valid is false for line items
+// billed before pricing was recorded.
+type LinePricing struct {
+	Currency                   string           `json:"currency"`
+	BytesPerGB                 int64            `json:"bytes_per_gb"`
+	RequestRateCentsPerMillion int64            `json:"request_rate_cents_per_million"`
+	DiscountRate               float64          `json:"discount_rate"`
+	RateCentsPerGB             int64            `json:"rate_cents_per_gb,omitempty"`
+	RegionRatesCentsPerGB      map[string]int64 `json:"region_rates_cents_per_gb,omitempty"`
+	PlanID                     int64            `json:"plan_id,omitempty"`
+	PrimaryRateCentsPerGB      int64            `json:"primary_rate_cents_per_gb,omitempty"`
+	BackupRateCentsPerGB       int64            `json:"backup_rate_cents_per_gb,omitempty"`
+	Tiers                      PlanTiers        `json:"tiers,omitempty"`
+	VolumeOffsetBytes          int64            `json:"volume_offset_bytes,omitempty"`
+	Valid                      bool             `json:"-"`
+}
+
+// Value encodes the pricing as a JSON object, or NULL when it is not valid.
+func (p LinePricing) Value() (driver.Value, error) {
+	if !p.Valid {
+		return nil, nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// MarshalJSON encodes pricing that is not valid as null.
+func (p LinePricing) MarshalJSON() ([]byte, error) {
+	if !p.Valid {
+		return []byte("null"), nil
+	}
+	type linePricing LinePricing
+	return json.Marshal(linePricing(p))
+}
+
+func (p *LinePricing) Scan(src any) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*p = LinePricing{}
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("scan line pricing: unsupported type %T", src)
+	}
+	pricing := LinePricing{}
+	if err := json.Unmarshal(raw, &pricing); err != nil {
+		return fmt.Errorf("scan line pricing: %w", err)
+	}
+	pricing.Valid = true
+	*p = pricing
+	return nil
+}
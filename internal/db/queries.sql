@@ -17,7 +17,7 @@ FROM customer_tokens
 WHERE token_hash = $1
   AND revoked_at IS NULL;
 -- name: GetUsageSnapshotForWindow :one
-SELECT id, service_id, window_start, window_end, primary_bytes, backup_bytes, created_at, invoice_id
+SELECT id, service_id, window_start, window_end, primary_bytes, backup_bytes, created_at, invoice_id, primary_requests, backup_requests, regions, first_seen_at
 FROM usage_snapshots
 WHERE service_id = $1
   AND window_start = $2
@@ -64,8 +64,15 @@ FROM service_domains
 ORDER BY service_id, id;
 
 -- name: InsertServiceDomain :one
-INSERT INTO service_domains (service_id, name)
-VALUES ($1, $2)
+INSERT INTO service_domains (service_id, name, routing_strategy)
+VALUES ($1, $2, $3)
+RETURNING *;
+
+-- name: UpdateServiceDomainStrategy :one
+UPDATE service_domains
+SET routing_strategy = $3
+WHERE id = $1
+  AND service_id = $2
 RETURNING *;
 
 -- name: DeleteServiceDomain :one
@@ -156,7 +163,10 @@ SELECT
     us.window_start,
     us.window_end,
     us.primary_bytes,
-    us.backup_bytes
+    us.backup_bytes,
+    us.primary_requests,
+    us.backup_requests,
+    us.regions
 FROM usage_snapshots us
 JOIN services s ON s.id = us.service_id
 WHERE us.invoice_id IS NULL
@@ -172,12 +182,14 @@ SELECT
     us.window_start,
     us.window_end,
     us.primary_bytes,
-    us.backup_bytes
+    us.backup_bytes,
+    us.primary_requests,
+    us.backup_requests,
+    us.regions
 FROM usage_snapshots us
 JOIN services s ON s.id = us.service_id
 WHERE us.invoice_id IS NULL
   AND us.window_end <= sqlc.arg(window_end)
-  AND us.window_end > sqlc.arg(window_start)
 ORDER BY us.window_start
 FOR UPDATE SKIP LOCKED;
 
@@ -189,15 +201,18 @@ WHERE service_id = sqlc.arg(service_id)
   AND (ended_at IS NULL OR ended_at > sqlc.arg(window_start))
 ORDER BY started_at;
 
--- name: GetMaxCoverageFactorForService :one
-SELECT COALESCE(MAX(max_coverage_factor), 1.0)::double precision AS max_coverage_factor
+-- name: ListStormCoverageFactorsForService :many
+-- The largest coverage factor among a service's storm policies of each kind.
+SELECT kind, MAX(max_coverage_factor)::double precision AS max_coverage_factor
 FROM storm_policies
-WHERE service_id = $1;
+WHERE service_id = $1
+GROUP BY kind
+ORDER BY kind;
 
--- name: InsertInvoice :one
-INSERT INTO invoices (customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents)
-VALUES ($1, $2, $3, $4, $5, $6)
-RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at;
+-- name: InsertDraftInvoice :one
+INSERT INTO invoices (customer_id, period_start, period_end, currency, replaces_invoice_id, subtotal_cents, discount_cents, total_cents, status)
+VALUES ($1, $2, $3, $4, $5, 0, 0, 0, 'draft')
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id;
 
 -- name: InsertInvoiceLineItem :one
 INSERT INTO invoice_line_items (
@@ -209,9 +224,17 @@ INSERT INTO invoice_line_items (
     backup_bytes,
     coverage_factor,
     amount_cents,
-    discount_cents
-) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-RETURNING id, invoice_id, service_id, window_start, window_end, primary_bytes, backup_bytes, coverage_factor, amount_cents, discount_cents, created_at;
+    discount_cents,
+    kind,
+    adjusts_invoice_id,
+    primary_requests,
+    backup_requests,
+    amount_micros,
+    discount_micros,
+    storm_breakdown,
+    pricing
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+RETURNING id, invoice_id, service_id, window_start, window_end, primary_bytes, backup_bytes, coverage_factor, amount_cents, discount_cents, created_at, kind, adjusts_invoice_id, primary_requests, backup_requests, amount_micros, discount_micros, storm_breakdown, pricing;
 
 -- name: MarkUsageSnapshotInvoiced :exec
 UPDATE usage_snapshots
@@ -237,10 +260,880 @@ INSERT INTO usage_snapshots (
         window_start,
         window_end,
         primary_bytes,
-        backup_bytes)
-VALUES ($1, $2, $3, $4, $5)
+        backup_bytes,
+        primary_requests,
+        backup_requests,
+        regions)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 ON CONFLICT (service_id, window_start, window_end)
 DO UPDATE SET
         primary_bytes = EXCLUDED.primary_bytes,
         backup_bytes = EXCLUDED.backup_bytes,
-        created_at = NOW();
+        primary_requests = EXCLUDED.primary_requests,
+        backup_requests = EXCLUDED.backup_requests,
+        regions = EXCLUDED.regions,
+        created_at = NOW()
+WHERE usage_snapshots.invoice_id IS NULL;
+
+-- name: InsertUsageRevisionIfChanged :execrows
+INSERT INTO usage_revisions (snapshot_id, primary_bytes, backup_bytes, primary_requests, backup_requests, regions)
+SELECT us.id, sqlc.arg(primary_bytes), sqlc.arg(backup_bytes), sqlc.arg(primary_requests)::BIGINT, sqlc.arg(backup_requests)::BIGINT, sqlc.arg(regions)::JSONB
+FROM usage_snapshots us
+LEFT JOIN LATERAL (
+    SELECT ur.primary_bytes, ur.backup_bytes, ur.primary_requests, ur.backup_requests, ur.regions
+    FROM usage_revisions ur
+    WHERE ur.snapshot_id = us.id
+    ORDER BY ur.id DESC
+    LIMIT 1
+) latest ON TRUE
+WHERE us.service_id = sqlc.arg(service_id)
+  AND us.window_start = sqlc.arg(window_start)
+  AND us.window_end = sqlc.arg(window_end)
+  AND us.invoice_id IS NOT NULL
+  AND (COALESCE(latest.primary_bytes, us.primary_bytes),
+       COALESCE(latest.backup_bytes, us.backup_bytes),
+       COALESCE(latest.primary_requests, us.primary_requests),
+       COALESCE(latest.backup_requests, us.backup_requests),
+       COALESCE(latest.regions, us.regions))
+      IS DISTINCT FROM (sqlc.arg(primary_bytes)::BIGINT, sqlc.arg(backup_bytes)::BIGINT, sqlc.arg(primary_requests)::BIGINT, sqlc.arg(backup_requests)::BIGINT, sqlc.arg(regions)::JSONB);
+
+-- name: LockUnsettledUsageRevisions :many
+SELECT
+    ur.id,
+    ur.snapshot_id,
+    us.service_id,
+    s.customer_id,
+    us.window_start,
+    us.window_end,
+    ur.primary_bytes,
+    ur.backup_bytes,
+    ur.primary_requests,
+    ur.backup_requests,
+    ur.regions,
+    us.invoice_id
+FROM usage_revisions ur
+JOIN usage_snapshots us ON us.id = ur.snapshot_id
+JOIN services s ON s.id = us.service_id
+WHERE ur.settled_at IS NULL
+ORDER BY ur.snapshot_id, ur.id
+FOR UPDATE OF ur SKIP LOCKED;
+
+-- name: GetBilledUsageForWindow :one
+SELECT
+    COALESCE(SUM(li.primary_bytes), 0)::BIGINT AS primary_bytes,
+    COALESCE(SUM(li.backup_bytes), 0)::BIGINT AS backup_bytes,
+    COALESCE(SUM(li.primary_requests), 0)::BIGINT AS primary_requests,
+    COALESCE(SUM(li.backup_requests), 0)::BIGINT AS backup_requests,
+    COALESCE(SUM(li.amount_micros), 0)::BIGINT AS amount_micros,
+    COALESCE(SUM(li.discount_micros), 0)::BIGINT AS discount_micros
+FROM invoice_line_items li
+JOIN invoices i ON i.id = li.invoice_id
+WHERE li.service_id = $1
+  AND li.window_start = $2
+  AND li.window_end = $3
+  AND i.status <> 'void';
+
+-- name: GetUsagePricingForWindow :one
+-- How a window was first billed: the pricing of its usage line item on an invoice that
+-- has not been voided, and that invoice's currency.
+SELECT li.pricing, i.currency
+FROM invoice_line_items li
+JOIN invoices i ON i.id = li.invoice_id
+WHERE li.service_id = $1
+  AND li.window_start = $2
+  AND li.window_end = $3
+  AND li.kind = 'usage'
+  AND i.status <> 'void'
+ORDER BY li.id DESC
+LIMIT 1;
+
+-- name: SettleUsageRevision :exec
+UPDATE usage_revisions
+SET settled_at = NOW(),
+    invoice_id = $2
+WHERE id = $1;
+
+-- name: GetServiceDNSSettings :one
+SELECT service_id, ttl_seconds, storm_ttl_seconds, prestorm_margin, updated_at
+FROM service_dns_settings
+WHERE service_id = $1;
+
+-- name: UpsertServiceDNSSettings :one
+INSERT INTO service_dns_settings (
+        service_id,
+        ttl_seconds,
+        storm_ttl_seconds,
+        prestorm_margin)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (service_id)
+DO UPDATE SET
+        ttl_seconds = EXCLUDED.ttl_seconds,
+        storm_ttl_seconds = EXCLUDED.storm_ttl_seconds,
+        prestorm_margin = EXCLUDED.prestorm_margin,
+        updated_at = NOW()
+RETURNING service_id, ttl_seconds, storm_ttl_seconds, prestorm_margin, updated_at;
+
+-- name: DeleteServiceDNSSettings :one
+DELETE FROM service_dns_settings
+WHERE service_id = $1
+RETURNING service_id, ttl_seconds, storm_ttl_seconds, prestorm_margin, updated_at;
+
+-- name: GetUsageLogFile :one
+SELECT source, object_key, size_bytes, etag, records, skipped, processed_at, usage
+FROM usage_log_files
+WHERE source = $1 AND object_key = $2;
+
+-- name: LockUsageLogFile :one
+-- Locks a processed file's row while a new version of it replaces its counts.
+SELECT source, object_key, size_bytes, etag, records, skipped, processed_at, usage
+FROM usage_log_files
+WHERE source = $1 AND object_key = $2
+FOR UPDATE;
+
+-- name: InsertUsageLogFile :execrows
+INSERT INTO usage_log_files (source, object_key, size_bytes, etag, records, skipped, usage)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (source, object_key) DO NOTHING;
+
+-- name: UpdateUsageLogFile :exec
+-- Records a new version of an already processed file.
+UPDATE usage_log_files
+SET size_bytes = $3,
+    etag = $4,
+    records = $5,
+    skipped = $6,
+    usage = $7,
+    processed_at = NOW()
+WHERE source = $1 AND object_key = $2;
+
+-- name: AddUsageSnapshotBytes :execrows
+INSERT INTO usage_snapshots (
+        service_id,
+        window_start,
+        window_end,
+        primary_bytes,
+        backup_bytes,
+        primary_requests,
+        backup_requests)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (service_id, window_start, window_end)
+DO UPDATE SET
+        primary_bytes = usage_snapshots.primary_bytes + EXCLUDED.primary_bytes,
+        backup_bytes = usage_snapshots.backup_bytes + EXCLUDED.backup_bytes,
+        primary_requests = usage_snapshots.primary_requests + EXCLUDED.primary_requests,
+        backup_requests = usage_snapshots.backup_requests + EXCLUDED.backup_requests,
+        created_at = NOW()
+WHERE usage_snapshots.invoice_id IS NULL;
+
+-- name: AddUsageRevisionBytes :exec
+INSERT INTO usage_revisions (snapshot_id, primary_bytes, backup_bytes, primary_requests, backup_requests, regions)
+SELECT us.id,
+       COALESCE(latest.primary_bytes, us.primary_bytes) + sqlc.arg(primary_bytes)::BIGINT,
+       COALESCE(latest.backup_bytes, us.backup_bytes) + sqlc.arg(backup_bytes)::BIGINT,
+       COALESCE(latest.primary_requests, us.primary_requests) + sqlc.arg(primary_requests)::BIGINT,
+       COALESCE(latest.backup_requests, us.backup_requests) + sqlc.arg(backup_requests)::BIGINT,
+       COALESCE(latest.regions, us.regions)
+FROM usage_snapshots us
+LEFT JOIN LATERAL (
+    SELECT ur.primary_bytes, ur.backup_bytes, ur.primary_requests, ur.backup_requests, ur.regions
+    FROM usage_revisions ur
+    WHERE ur.snapshot_id = us.id
+    ORDER BY ur.id DESC
+    LIMIT 1
+) latest ON TRUE
+WHERE us.service_id = sqlc.arg(service_id)
+  AND us.window_start = sqlc.arg(window_start)
+  AND us.window_end = sqlc.arg(window_end)
+  AND us.invoice_id IS NOT NULL;
+
+-- name: ListUsageSnapshotWindows :many
+SELECT service_id, window_start
+FROM usage_snapshots
+WHERE window_start >= sqlc.arg(range_start)
+  AND window_start < sqlc.arg(range_end)
+ORDER BY service_id, window_start;
+
+-- name: StartUsageBackfill :one
+INSERT INTO usage_backfills (job_key, range_start, range_end, services, cursor_at)
+VALUES ($1, $2, $3, $4, $2)
+ON CONFLICT (job_key) DO UPDATE SET updated_at = NOW()
+RETURNING job_key, range_start, range_end, services, cursor_at, filled, present, empty, started_at, updated_at, completed_at;
+
+-- name: ResetUsageBackfill :exec
+UPDATE usage_backfills
+SET cursor_at = range_start,
+    filled = 0,
+    present = 0,
+    empty = 0,
+    started_at = NOW(),
+    updated_at = NOW(),
+    completed_at = NULL
+WHERE job_key = $1;
+
+-- name: AdvanceUsageBackfill :one
+UPDATE usage_backfills
+SET cursor_at = sqlc.arg(cursor_at),
+    filled = filled + sqlc.arg(filled),
+    present = present + sqlc.arg(present),
+    empty = empty + sqlc.arg(empty),
+    updated_at = NOW(),
+    completed_at = CASE WHEN sqlc.arg(cursor_at) >= range_end THEN NOW() END
+WHERE job_key = sqlc.arg(job_key)
+RETURNING job_key, range_start, range_end, services, cursor_at, filled, present, empty, started_at, updated_at, completed_at;
+
+-- name: ListUsageCoverage :many
+SELECT service_id, window_start, window_end, primary_bytes, backup_bytes, first_seen_at
+FROM usage_snapshots
+WHERE window_start >= sqlc.arg(range_start)
+  AND window_start < sqlc.arg(range_end)
+ORDER BY service_id, window_start;
+
+-- name: ListServiceUsageCoverage :many
+SELECT service_id, window_start, window_end, primary_bytes, backup_bytes, first_seen_at
+FROM usage_snapshots
+WHERE service_id = sqlc.arg(service_id)
+  AND window_start >= sqlc.arg(range_start)
+  AND window_start < sqlc.arg(range_end)
+ORDER BY window_start;
+
+-- name: AddServicePathHits :exec
+INSERT INTO service_path_hits (service_id, day, path, hits)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (service_id, day, path)
+DO UPDATE SET hits = service_path_hits.hits + EXCLUDED.hits;
+
+-- name: ListTopServicePaths :many
+SELECT path, SUM(hits)::BIGINT AS hits
+FROM service_path_hits
+WHERE service_id = sqlc.arg(service_id)
+  AND day >= sqlc.arg(since)
+GROUP BY path
+ORDER BY hits DESC, path
+LIMIT sqlc.arg(row_limit);
+
+-- name: DeleteServicePathHitsBefore :execrows
+DELETE FROM service_path_hits
+WHERE day < $1;
+
+-- name: InsertPricingPlan :one
+INSERT INTO pricing_plans (
+    name,
+    primary_rate_cents_per_gb,
+    backup_rate_cents_per_gb,
+    tiers,
+    minimum_monthly_cents,
+    storm_discount_rate,
+    sla_definition_id,
+    currency
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING *;
+
+-- name: ListPricingPlans :many
+SELECT * FROM pricing_plans
+ORDER BY id;
+
+-- name: GetPricingPlan :one
+SELECT * FROM pricing_plans
+WHERE id = $1;
+
+-- name: UpdatePricingPlan :one
+UPDATE pricing_plans
+SET name = $2,
+    primary_rate_cents_per_gb = $3,
+    backup_rate_cents_per_gb = $4,
+    tiers = $5,
+    minimum_monthly_cents = $6,
+    storm_discount_rate = $7,
+    sla_definition_id = $8,
+    currency = $9,
+    updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: InsertCustomerPlan :one
+INSERT INTO customer_plans (customer_id, plan_id, effective_from)
+VALUES ($1, $2, $3)
+RETURNING *;
+
+-- name: ListCustomerPlans :many
+SELECT * FROM customer_plans
+WHERE customer_id = $1
+ORDER BY effective_from;
+
+-- name: DeleteCustomerPlan :one
+DELETE FROM customer_plans
+WHERE id = $1
+  AND customer_id = $2
+RETURNING *;
+
+-- name: GetCustomerBilledBytes :one
+SELECT COALESCE(SUM(li.primary_bytes + li.backup_bytes), 0)::BIGINT AS bytes
+FROM invoice_line_items li
+JOIN invoices i ON i.id = li.invoice_id
+WHERE i.customer_id = sqlc.arg(customer_id)
+  AND i.currency = sqlc.arg(currency)
+  AND i.status <> 'void'
+  AND li.kind IN ('usage', 'adjustment')
+  AND li.window_start >= sqlc.arg(period_start)
+  AND li.window_start < sqlc.arg(period_end);
+
+-- name: GetCustomerBillingSettings :one
+SELECT billing_timezone, billing_anchor_day
+FROM customers
+WHERE id = $1;
+
+-- name: UpdateCustomerBillingSettings :one
+UPDATE customers
+SET billing_timezone = $2,
+    billing_anchor_day = $3
+WHERE id = $1
+RETURNING id, name, created_at, billing_timezone, billing_anchor_day, external_customer_id;
+
+-- name: GetInvoiceForPeriod :one
+-- The newest invoice that is not void for a customer's billing period in a currency.
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE customer_id = $1
+  AND period_start = $2
+  AND currency = $3
+  AND status <> 'void'
+ORDER BY id DESC
+LIMIT 1
+FOR UPDATE;
+
+-- name: SetInvoiceAmounts :execrows
+-- Exact amounts in micros alongside the rounded cents shown on the invoice.
+UPDATE invoices
+SET subtotal_micros = $2,
+    discount_micros = $3,
+    subtotal_cents = $4,
+    discount_cents = $5,
+    total_cents = $6
+WHERE id = $1
+  AND status = 'draft';
+
+-- name: UpdateInvoiceLineItemCents :exec
+UPDATE invoice_line_items
+SET amount_cents = $2,
+    discount_cents = $3
+WHERE id = $1;
+
+-- name: ListDueDraftInvoices :many
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE status = 'draft'
+  AND period_end <= $1
+ORDER BY id
+FOR UPDATE SKIP LOCKED;
+
+-- name: FinalizeInvoice :one
+UPDATE invoices
+SET status = 'finalized',
+    finalized_at = NOW()
+WHERE id = $1
+  AND status = 'draft'
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id;
+
+-- name: MarkInvoicePaid :one
+UPDATE invoices
+SET status = 'paid',
+    paid_at = NOW()
+WHERE id = $1
+  AND status = 'finalized'
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id;
+
+-- name: GetInvoice :one
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE id = $1;
+
+-- name: ListInvoicesForCustomer :many
+-- Newest first, paging backwards by ID. Invoices are kept when their period overlaps
+-- [from, to); either bound may be NULL.
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE customer_id = sqlc.arg(customer_id)
+  AND id < sqlc.arg(before_id)
+  AND (sqlc.narg(period_from)::TIMESTAMPTZ IS NULL OR period_end > sqlc.narg(period_from))
+  AND (sqlc.narg(period_to)::TIMESTAMPTZ IS NULL OR period_start < sqlc.narg(period_to))
+ORDER BY id DESC
+LIMIT sqlc.arg(row_limit);
+
+-- name: GetInvoiceForCustomer :one
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE id = $1
+  AND customer_id = $2;
+
+-- name: ListInvoiceLineItems :many
+SELECT id, invoice_id, service_id, window_start, window_end, primary_bytes, backup_bytes, coverage_factor, amount_cents, discount_cents, created_at, kind, adjusts_invoice_id, primary_requests, backup_requests, amount_micros, discount_micros, storm_breakdown, pricing
+FROM invoice_line_items
+WHERE invoice_id = $1
+ORDER BY id;
+
+-- name: ListServiceUsage :many
+-- Usage per UTC hour, day or month by window start, counting the latest revision of
+-- windows that changed after they were invoiced.
+SELECT (date_trunc(sqlc.arg(granularity)::TEXT, us.window_start AT TIME ZONE 'UTC') AT TIME ZONE 'UTC')::TIMESTAMPTZ AS bucket_start,
+       COALESCE(SUM(COALESCE(latest.primary_bytes, us.primary_bytes)), 0)::BIGINT AS primary_bytes,
+       COALESCE(SUM(COALESCE(latest.backup_bytes, us.backup_bytes)), 0)::BIGINT AS backup_bytes,
+       COALESCE(SUM(COALESCE(latest.primary_requests, us.primary_requests)), 0)::BIGINT AS primary_requests,
+       COALESCE(SUM(COALESCE(latest.backup_requests, us.backup_requests)), 0)::BIGINT AS backup_requests,
+       COUNT(*)::BIGINT AS windows
+FROM usage_snapshots us
+LEFT JOIN LATERAL (
+    SELECT ur.primary_bytes, ur.backup_bytes, ur.primary_requests, ur.backup_requests
+    FROM usage_revisions ur
+    WHERE ur.snapshot_id = us.id
+    ORDER BY ur.id DESC
+    LIMIT 1
+) latest ON TRUE
+WHERE us.service_id = sqlc.arg(service_id)
+  AND us.window_start >= sqlc.arg(window_from)
+  AND us.window_start < sqlc.arg(window_to)
+GROUP BY 1
+ORDER BY 1
+LIMIT sqlc.arg(row_limit);
+
+-- name: ListStormEventsForService :many
+-- Newest first, paging backwards by ID. Storms are kept when they overlap [from, to);
+-- either bound may be NULL.
+SELECT id, service_id, kind, started_at, ended_at
+FROM storm_events
+WHERE service_id = sqlc.arg(service_id)
+  AND id < sqlc.arg(before_id)
+  AND (sqlc.narg(storm_from)::TIMESTAMPTZ IS NULL OR ended_at IS NULL OR ended_at > sqlc.narg(storm_from))
+  AND (sqlc.narg(storm_to)::TIMESTAMPTZ IS NULL OR started_at < sqlc.narg(storm_to))
+ORDER BY id DESC
+LIMIT sqlc.arg(row_limit);
+
+-- name: GetCustomer :one
+SELECT id, name, created_at, billing_timezone, billing_anchor_day, external_customer_id
+FROM customers
+WHERE id = $1;
+
+-- name: ListInvoiceServices :many
+-- Services billed on an invoice, including deleted ones.
+SELECT s.id, s.name
+FROM services s
+WHERE s.id IN (SELECT li.service_id FROM invoice_line_items li WHERE li.invoice_id = $1)
+ORDER BY s.id;
+
+-- name: InsertSLADefinition :one
+INSERT INTO sla_definitions (name, tiers)
+VALUES ($1, $2)
+RETURNING *;
+
+-- name: ListSLADefinitions :many
+SELECT * FROM sla_definitions
+ORDER BY id;
+
+-- name: GetSLADefinition :one
+SELECT * FROM sla_definitions
+WHERE id = $1;
+
+-- name: UpdateSLADefinition :one
+UPDATE sla_definitions
+SET name = $2,
+    tiers = $3,
+    updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: GetCustomerPlanAt :one
+-- The pricing plan assigned to a customer at a point in time.
+SELECT pp.id, pp.name, pp.primary_rate_cents_per_gb, pp.backup_rate_cents_per_gb, pp.tiers, pp.minimum_monthly_cents, pp.storm_discount_rate, pp.created_at, pp.updated_at, pp.sla_definition_id, pp.currency
+FROM customer_plans cp
+JOIN pricing_plans pp ON pp.id = cp.plan_id
+WHERE cp.customer_id = $1
+  AND cp.effective_from <= $2
+ORDER BY cp.effective_from DESC
+LIMIT 1;
+
+-- name: GetServiceDowntime :one
+-- Minutes of [period_start, period_end) in which most direct domain probes failed, and
+-- minutes inside a storm that have no probe samples at all.
+WITH probed AS (
+    SELECT date_trunc('minute', probed_at) AS minute,
+           COUNT(*) FILTER (WHERE NOT ok) * 2 > COUNT(*) AS down
+    FROM probe_samples
+    WHERE service_id = sqlc.arg(service_id)
+      AND probed_at >= sqlc.arg(period_start)::TIMESTAMPTZ
+      AND probed_at < sqlc.arg(period_end)::TIMESTAMPTZ
+      AND strpos(metrics_key, '@') = 0
+    GROUP BY 1
+),
+storm_minutes AS (
+    SELECT DISTINCT m AS minute
+    FROM storm_events se,
+         generate_series(
+             date_trunc('minute', GREATEST(se.started_at, sqlc.arg(period_start)::TIMESTAMPTZ)),
+             LEAST(COALESCE(se.ended_at, sqlc.arg(period_end)::TIMESTAMPTZ), sqlc.arg(period_end)::TIMESTAMPTZ) - INTERVAL '1 microsecond',
+             INTERVAL '1 minute'
+         ) AS m
+    WHERE se.service_id = sqlc.arg(service_id)
+      AND se.started_at < sqlc.arg(period_end)::TIMESTAMPTZ
+      AND (se.ended_at IS NULL OR se.ended_at > sqlc.arg(period_start)::TIMESTAMPTZ)
+)
+SELECT
+    (SELECT COUNT(*) FROM probed WHERE down)::BIGINT AS down_minutes,
+    (SELECT COUNT(*) FROM storm_minutes sm
+     WHERE NOT EXISTS (SELECT 1 FROM probed p WHERE p.minute = sm.minute))::BIGINT AS unprobed_storm_minutes;
+
+-- name: ListInvoiceServiceCharges :many
+-- Each service's net usage charges on an invoice, adjustments included.
+SELECT li.service_id::BIGINT AS service_id,
+       s.created_at AS service_created_at,
+       COALESCE(SUM(li.amount_micros - li.discount_micros), 0)::BIGINT AS net_micros
+FROM invoice_line_items li
+JOIN services s ON s.id = li.service_id
+WHERE li.invoice_id = $1
+  AND li.kind IN ('usage', 'adjustment')
+GROUP BY li.service_id, s.created_at
+ORDER BY li.service_id;
+
+-- name: InsertSLAResult :one
+INSERT INTO sla_results (
+    invoice_id,
+    service_id,
+    sla_definition_id,
+    period_start,
+    period_end,
+    availability_percent,
+    down_minutes,
+    total_minutes,
+    credit_percent,
+    credit_cents
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING *;
+
+-- name: ListSLAResultsForService :many
+SELECT * FROM sla_results
+WHERE service_id = $1
+ORDER BY period_start DESC
+LIMIT $2;
+
+-- name: ListInvoicesDueForExport :many
+-- Finalized or paid invoices waiting to be pushed to the payment processor, and voided
+-- finalized invoices waiting to be voided there, oldest first. A replacement waits until
+-- the invoice it replaces has been voided at the processor.
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE export_status = 'pending'
+  AND (status IN ('finalized', 'paid') OR (status = 'void' AND finalized_at IS NOT NULL))
+  AND (export_next_attempt_at IS NULL OR export_next_attempt_at <= $1)
+  AND NOT EXISTS (
+      SELECT 1
+      FROM invoices replaced
+      WHERE replaced.id = invoices.replaces_invoice_id
+        AND replaced.finalized_at IS NOT NULL
+        AND replaced.export_status IN ('pending', 'failed')
+  )
+ORDER BY export_next_attempt_at NULLS FIRST, id
+LIMIT $2;
+
+-- name: ClaimInvoiceExport :execrows
+-- Pushes the invoice's next attempt out to lease_until so concurrent workers skip it.
+UPDATE invoices
+SET export_next_attempt_at = sqlc.arg(lease_until)
+WHERE id = sqlc.arg(id)
+  AND export_status = 'pending'
+  AND (export_next_attempt_at IS NULL OR export_next_attempt_at <= sqlc.arg(now));
+
+-- name: SetInvoiceExternalID :exec
+UPDATE invoices
+SET external_id = $2
+WHERE id = $1;
+
+-- name: SetCustomerExternalID :exec
+UPDATE customers
+SET external_customer_id = $2
+WHERE id = $1;
+
+-- name: InsertInvoiceLineItemExport :exec
+INSERT INTO invoice_line_item_exports (line_item_id, invoice_id, external_id)
+VALUES ($1, $2, $3)
+ON CONFLICT (line_item_id) DO NOTHING;
+
+-- name: ListInvoiceLineItemExports :many
+SELECT line_item_id, invoice_id, external_id, created_at
+FROM invoice_line_item_exports
+WHERE invoice_id = $1
+ORDER BY line_item_id;
+
+-- name: MarkInvoiceExported :one
+-- Records a successful attempt, unless the invoice's status changed while it ran: an invoice
+-- voided during its export stays pending so that it is voided at the processor next.
+UPDATE invoices
+SET export_status = 'synced',
+    export_attempts = export_attempts + 1,
+    export_error = NULL,
+    export_next_attempt_at = NULL,
+    exported_at = NOW()
+WHERE id = $1
+  AND status = $2
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id;
+
+-- name: MarkInvoiceExportFailed :one
+-- Records a failed attempt. The invoice stays pending and is retried at next_attempt_at,
+-- unless export_status is 'failed'. Like MarkInvoiceExported, it leaves an invoice whose
+-- status changed during the attempt alone.
+UPDATE invoices
+SET export_status = $2,
+    export_attempts = export_attempts + 1,
+    export_error = $3,
+    export_next_attempt_at = $4
+WHERE id = $1
+  AND status = $5
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id;
+
+-- name: RequeueInvoiceExport :one
+-- Queues a failed or skipped invoice for another round of export attempts.
+UPDATE invoices
+SET export_status = 'pending',
+    export_attempts = 0,
+    export_error = NULL,
+    export_next_attempt_at = NULL
+WHERE id = $1
+  AND export_status IN ('failed', 'skipped')
+  AND (status IN ('finalized', 'paid') OR (status = 'void' AND finalized_at IS NOT NULL))
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id;
+
+-- name: ListUnbilledUsageSnapshotsForCustomer :many
+-- LockUnbilledUsageSnapshots for one customer, without locking, for billing previews.
+SELECT
+    us.id,
+    us.service_id,
+    s.customer_id,
+    us.window_start,
+    us.window_end,
+    us.primary_bytes,
+    us.backup_bytes,
+    us.primary_requests,
+    us.backup_requests,
+    us.regions
+FROM usage_snapshots us
+JOIN services s ON s.id = us.service_id
+WHERE s.customer_id = sqlc.arg(customer_id)
+  AND us.invoice_id IS NULL
+  AND us.window_end <= sqlc.arg(window_end)
+ORDER BY us.window_start;
+
+-- name: ListUnsettledUsageRevisionsForCustomer :many
+-- LockUnsettledUsageRevisions for one customer, without locking, for billing previews.
+SELECT
+    ur.id,
+    ur.snapshot_id,
+    us.service_id,
+    s.customer_id,
+    us.window_start,
+    us.window_end,
+    ur.primary_bytes,
+    ur.backup_bytes,
+    ur.primary_requests,
+    ur.backup_requests,
+    ur.regions,
+    us.invoice_id
+FROM usage_revisions ur
+JOIN usage_snapshots us ON us.id = ur.snapshot_id
+JOIN services s ON s.id = us.service_id
+WHERE s.customer_id = $1
+  AND ur.settled_at IS NULL
+ORDER BY ur.snapshot_id, ur.id;
+
+-- name: GetInvoiceForPeriodNoLock :one
+-- GetInvoiceForPeriod without the row lock, for billing previews.
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE customer_id = $1
+  AND period_start = $2
+  AND currency = $3
+  AND status <> 'void'
+ORDER BY id DESC
+LIMIT 1;
+
+-- name: LockInvoice :one
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE id = $1
+FOR UPDATE;
+
+-- name: VoidInvoice :execrows
+UPDATE invoices
+SET status = 'void'
+WHERE id = $1
+  AND status IN ('draft', 'finalized');
+
+-- name: QueueInvoiceVoidExport :exec
+-- Queues a voided invoice to be voided at the payment processor too. An attempt still
+-- holding the invoice's lease keeps it, so the void runs after that attempt. Invoices whose
+-- export was skipped were never pushed and stay skipped.
+UPDATE invoices
+SET export_status = 'pending',
+    export_attempts = 0,
+    export_error = NULL,
+    export_next_attempt_at = CASE WHEN export_status = 'pending' THEN export_next_attempt_at END
+WHERE id = $1
+  AND status = 'void'
+  AND export_status <> 'skipped';
+
+-- name: ListInvoicesBillingLaterWindowChanges :many
+-- Invoices that are not void with line items for a window the invoice bills, added after the
+-- invoice's own. Their amounts were worked out against the invoice's.
+SELECT DISTINCT later.invoice_id
+FROM invoice_line_items mine
+JOIN invoice_line_items later
+  ON later.service_id = mine.service_id
+ AND later.window_start = mine.window_start
+ AND later.window_end = mine.window_end
+ AND later.id > mine.id
+ AND later.invoice_id <> mine.invoice_id
+JOIN invoices i ON i.id = later.invoice_id
+WHERE mine.invoice_id = $1
+  AND mine.kind IN ('usage', 'adjustment')
+  AND i.status <> 'void'
+ORDER BY later.invoice_id;
+
+-- name: ReleaseInvoiceUsageRevisions :many
+-- Unsettles the revisions billed on an invoice, returning them as LockUnsettledUsageRevisions
+-- does.
+UPDATE usage_revisions ur
+SET settled_at = NULL,
+    invoice_id = NULL
+FROM usage_snapshots us
+JOIN services s ON s.id = us.service_id
+WHERE us.id = ur.snapshot_id
+  AND ur.invoice_id = $1
+RETURNING
+    ur.id,
+    ur.snapshot_id,
+    us.service_id,
+    s.customer_id,
+    us.window_start,
+    us.window_end,
+    ur.primary_bytes,
+    ur.backup_bytes,
+    ur.primary_requests,
+    ur.backup_requests,
+    ur.regions,
+    us.invoice_id;
+
+-- name: ReleaseInvoiceUsageSnapshots :many
+-- Marks the snapshots billed on an invoice unbilled, returning them as
+-- LockUnbilledUsageSnapshots does.
+UPDATE usage_snapshots us
+SET invoice_id = NULL
+FROM services s
+WHERE s.id = us.service_id
+  AND us.invoice_id = $1
+RETURNING
+    us.id,
+    us.service_id,
+    s.customer_id,
+    us.window_start,
+    us.window_end,
+    us.primary_bytes,
+    us.backup_bytes,
+    us.primary_requests,
+    us.backup_requests,
+    us.regions;
+
+-- name: InsertInvoiceVoid :one
+INSERT INTO invoice_voids (
+    invoice_id,
+    replacement_invoice_id,
+    reason,
+    previous_status,
+    released_snapshots,
+    released_revisions,
+    old_subtotal_cents,
+    old_discount_cents,
+    old_total_cents,
+    new_subtotal_cents,
+    new_discount_cents,
+    new_total_cents
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+RETURNING id, invoice_id, replacement_invoice_id, reason, previous_status, released_snapshots, released_revisions, old_subtotal_cents, old_discount_cents, old_total_cents, new_subtotal_cents, new_discount_cents, new_total_cents, created_at;
+
+-- name: GetInvoiceVoid :one
+SELECT id, invoice_id, replacement_invoice_id, reason, previous_status, released_snapshots, released_revisions, old_subtotal_cents, old_discount_cents, old_total_cents, new_subtotal_cents, new_discount_cents, new_total_cents, created_at
+FROM invoice_voids
+WHERE invoice_id = $1;
+
+-- name: InsertDNSWeightChangeIfChanged :execrows
+-- Records the weights applied to a domain unless they are the ones last recorded for it.
+INSERT INTO dns_weight_changes (service_id, domain, primary_weight, backup_weight)
+SELECT sqlc.arg(service_id), sqlc.arg(domain), sqlc.arg(primary_weight)::INTEGER, sqlc.arg(backup_weight)::INTEGER
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM (
+        SELECT primary_weight, backup_weight
+        FROM dns_weight_changes
+        WHERE service_id = sqlc.arg(service_id)
+          AND domain = sqlc.arg(domain)
+        ORDER BY applied_at DESC, id DESC
+        LIMIT 1
+    ) latest
+    WHERE latest.primary_weight = sqlc.arg(primary_weight)
+      AND latest.backup_weight = sqlc.arg(backup_weight)
+);
+
+-- name: ListDNSWeightChangesForWindow :many
+-- The weights in force on each of a service's domains at the window start, followed by the
+-- changes applied during the window, oldest first. Domains since removed from the service
+-- are left out, so they no longer count towards its mean backup share.
+SELECT domain, primary_weight, backup_weight, applied_at
+FROM (
+    SELECT DISTINCT ON (domain) domain, primary_weight, backup_weight, applied_at
+    FROM dns_weight_changes
+    WHERE service_id = sqlc.arg(service_id)
+      AND applied_at <= sqlc.arg(window_start)
+      AND domain IN (SELECT name FROM service_domains WHERE service_id = sqlc.arg(service_id))
+    ORDER BY domain, applied_at DESC, id DESC
+) in_force
+UNION ALL
+SELECT domain, primary_weight, backup_weight, applied_at
+FROM dns_weight_changes
+WHERE service_id = sqlc.arg(service_id)
+  AND applied_at > sqlc.arg(window_start)
+  AND applied_at < sqlc.arg(window_end)
+  AND domain IN (SELECT name FROM service_domains WHERE service_id = sqlc.arg(service_id))
+ORDER BY applied_at, domain;
+
+-- name: ListBilledStormDiscountsForWindow :many
+-- Storm discounts billed so far for a window on invoices that are not void, per storm.
+SELECT
+    (share->>'storm_event_id')::BIGINT AS storm_event_id,
+    MAX(share->>'kind')::TEXT AS kind,
+    SUM((share->>'discount_micros')::BIGINT)::BIGINT AS discount_micros
+FROM invoice_line_items li
+JOIN invoices i ON i.id = li.invoice_id
+CROSS JOIN LATERAL jsonb_array_elements(li.storm_breakdown) share
+WHERE li.service_id = $1
+  AND li.window_start = $2
+  AND li.window_end = $3
+  AND i.status <> 'void'
+GROUP BY 1
+ORDER BY 1;
+
+-- name: RecordUsageIngestCoverage :exec
+-- Extends a service's ingested range by a fetch that overlaps or touches it. A fetch after a
+-- gap leaves the range as it was.
+INSERT INTO usage_ingest_coverage (service_id, covered_from, covered_through)
+VALUES ($1, $2, $3)
+ON CONFLICT (service_id) DO UPDATE SET
+    covered_from = LEAST(usage_ingest_coverage.covered_from, EXCLUDED.covered_from),
+    covered_through = GREATEST(usage_ingest_coverage.covered_through, EXCLUDED.covered_through),
+    updated_at = NOW()
+WHERE EXCLUDED.covered_from <= usage_ingest_coverage.covered_through
+  AND EXCLUDED.covered_through >= usage_ingest_coverage.covered_from;
+
+-- name: ListUsageIngestCoverage :many
+SELECT service_id, covered_from, covered_through, updated_at
+FROM usage_ingest_coverage
+ORDER BY service_id;
+
+-- name: GetUsageIngestCoverage :one
+SELECT service_id, covered_from, covered_through, updated_at
+FROM usage_ingest_coverage
+WHERE service_id = $1;
@@ -11,11 +11,30 @@ import (
 	"time"
 )
 
+const deleteServiceDNSSettings = `-- name: DeleteServiceDNSSettings :one
+DELETE FROM service_dns_settings
+WHERE service_id = $1
+RETURNING service_id, ttl_seconds, storm_ttl_seconds, prestorm_margin, updated_at
+`
+
+func (q *Queries) DeleteServiceDNSSettings(ctx context.Context, serviceID int64) (ServiceDnsSetting, error) {
+	row := q.db.QueryRowContext(ctx, deleteServiceDNSSettings, serviceID)
+	var i ServiceDnsSetting
+	err := row.Scan(
+		&i.ServiceID,
+		&i.TtlSeconds,
+		&i.StormTtlSeconds,
+		&i.PrestormMargin,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
 const deleteServiceDomain = `-- name: DeleteServiceDomain :one
 DELETE FROM service_domains
 WHERE id = $1
   AND service_id = $2
-RETURNING id, service_id, name, created_at
+RETURNING id, service_id, name, created_at, routing_strategy
 `
 
 type DeleteServiceDomainParams struct {
@@ -31,6 +50,7 @@ func (q *Queries) DeleteServiceDomain(ctx context.Context, arg DeleteServiceDoma
 		&i.ServiceID,
 		&i.Name,
 		&i.CreatedAt,
+		&i.RoutingStrategy,
 	)
 	return i, err
 }
@@ -141,7 +161,7 @@ func (q *Queries) GetActiveServicesForCustomer(ctx context.Context, customerID i
 }
 
 const getUsageSnapshotForWindow = `-- name: GetUsageSnapshotForWindow :one
-SELECT id, service_id, window_start, window_end, primary_bytes, backup_bytes, created_at, invoice_id
+SELECT id, service_id, window_start, window_end, primary_bytes, backup_bytes, created_at, invoice_id, primary_requests, backup_requests, regions, first_seen_at
 FROM usage_snapshots
 WHERE service_id = $1
   AND window_start = $2
@@ -166,6 +186,10 @@ func (q *Queries) GetUsageSnapshotForWindow(ctx context.Context, arg GetUsageSna
 		&i.BackupBytes,
 		&i.CreatedAt,
 		&i.InvoiceID,
+		&i.PrimaryRequests,
+		&i.BackupRequests,
+		&i.Regions,
+		&i.FirstSeenAt,
 	)
 	return i, err
 }
@@ -275,17 +299,41 @@ func (q *Queries) GetLastStormEvent(ctx context.Context, arg GetLastStormEventPa
 	return i, err
 }
 
-const getMaxCoverageFactorForService = `-- name: GetMaxCoverageFactorForService :one
-SELECT COALESCE(MAX(max_coverage_factor), 1.0)::double precision AS max_coverage_factor
+const listStormCoverageFactorsForService = `-- name: ListStormCoverageFactorsForService :many
+SELECT kind, MAX(max_coverage_factor)::double precision AS max_coverage_factor
 FROM storm_policies
 WHERE service_id = $1
+GROUP BY kind
+ORDER BY kind
 `
 
-func (q *Queries) GetMaxCoverageFactorForService(ctx context.Context, serviceID int64) (float64, error) {
-	row := q.db.QueryRowContext(ctx, getMaxCoverageFactorForService, serviceID)
-	var max_coverage_factor float64
-	err := row.Scan(&max_coverage_factor)
-	return max_coverage_factor, err
+type ListStormCoverageFactorsForServiceRow struct {
+	Kind              string  `json:"kind"`
+	MaxCoverageFactor float64 `json:"max_coverage_factor"`
+}
+
+// The largest coverage factor among a service's storm policies of each kind.
+func (q *Queries) ListStormCoverageFactorsForService(ctx context.Context, serviceID int64) ([]ListStormCoverageFactorsForServiceRow, error) {
+	rows, err := q.db.QueryContext(ctx, listStormCoverageFactorsForService, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListStormCoverageFactorsForServiceRow{}
+	for rows.Next() {
+		var i ListStormCoverageFactorsForServiceRow
+		if err := rows.Scan(&i.Kind, &i.MaxCoverageFactor); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
 const getProbeAvailability = `-- name: GetProbeAvailability :one
@@ -312,8 +360,27 @@ func (q *Queries) GetProbeAvailability(ctx context.Context, arg GetProbeAvailabi
 	return availability, err
 }
 
+const getServiceDNSSettings = `-- name: GetServiceDNSSettings :one
+SELECT service_id, ttl_seconds, storm_ttl_seconds, prestorm_margin, updated_at
+FROM service_dns_settings
+WHERE service_id = $1
+`
+
+func (q *Queries) GetServiceDNSSettings(ctx context.Context, serviceID int64) (ServiceDnsSetting, error) {
+	row := q.db.QueryRowContext(ctx, getServiceDNSSettings, serviceID)
+	var i ServiceDnsSetting
+	err := row.Scan(
+		&i.ServiceID,
+		&i.TtlSeconds,
+		&i.StormTtlSeconds,
+		&i.PrestormMargin,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
 const getServiceDomains = `-- name: GetServiceDomains :many
-SELECT id, service_id, name, created_at
+SELECT id, service_id, name, created_at, routing_strategy
 FROM service_domains
 WHERE service_id = $1
 ORDER BY id
@@ -333,6 +400,7 @@ func (q *Queries) GetServiceDomains(ctx context.Context, serviceID int64) ([]Ser
 			&i.ServiceID,
 			&i.Name,
 			&i.CreatedAt,
+			&i.RoutingStrategy,
 		); err != nil {
 			return nil, err
 		}
@@ -348,7 +416,7 @@ func (q *Queries) GetServiceDomains(ctx context.Context, serviceID int64) ([]Ser
 }
 
 const getAllServiceDomains = `-- name: GetAllServiceDomains :many
-SELECT id, service_id, name, created_at
+SELECT id, service_id, name, created_at, routing_strategy
 FROM service_domains
 ORDER BY service_id, id
 `
@@ -367,6 +435,7 @@ func (q *Queries) GetAllServiceDomains(ctx context.Context) ([]ServiceDomain, er
 			&i.ServiceID,
 			&i.Name,
 			&i.CreatedAt,
+			&i.RoutingStrategy,
 		); err != nil {
 			return nil, err
 		}
@@ -528,7 +597,10 @@ SELECT
     us.window_start,
     us.window_end,
     us.primary_bytes,
-    us.backup_bytes
+    us.backup_bytes,
+    us.primary_requests,
+    us.backup_requests,
+    us.regions
 FROM usage_snapshots us
 JOIN services s ON s.id = us.service_id
 WHERE us.invoice_id IS NULL
@@ -543,13 +615,16 @@ type GetUnbilledUsageSnapshotsParams struct {
 }
 
 type GetUnbilledUsageSnapshotsRow struct {
-	ID           int64     `json:"id"`
-	ServiceID    int64     `json:"service_id"`
-	CustomerID   int64     `json:"customer_id"`
-	WindowStart  time.Time `json:"window_start"`
-	WindowEnd    time.Time `json:"window_end"`
-	PrimaryBytes int64     `json:"primary_bytes"`
-	BackupBytes  int64     `json:"backup_bytes"`
+	ID              int64        `json:"id"`
+	ServiceID       int64        `json:"service_id"`
+	CustomerID      int64        `json:"customer_id"`
+	WindowStart     time.Time    `json:"window_start"`
+	WindowEnd       time.Time    `json:"window_end"`
+	PrimaryBytes    int64        `json:"primary_bytes"`
+	BackupBytes     int64        `json:"backup_bytes"`
+	PrimaryRequests int64        `json:"primary_requests"`
+	BackupRequests  int64        `json:"backup_requests"`
+	Regions         UsageRegions `json:"regions"`
 }
 
 func (q *Queries) GetUnbilledUsageSnapshots(ctx context.Context, arg GetUnbilledUsageSnapshotsParams) ([]GetUnbilledUsageSnapshotsRow, error) {
@@ -569,6 +644,9 @@ func (q *Queries) GetUnbilledUsageSnapshots(ctx context.Context, arg GetUnbilled
 			&i.WindowEnd,
 			&i.PrimaryBytes,
 			&i.BackupBytes,
+			&i.PrimaryRequests,
+			&i.BackupRequests,
+			&i.Regions,
 		); err != nil {
 			return nil, err
 		}
@@ -583,29 +661,27 @@ func (q *Queries) GetUnbilledUsageSnapshots(ctx context.Context, arg GetUnbilled
 	return items, nil
 }
 
-const insertInvoice = `-- name: InsertInvoice :one
-INSERT INTO invoices (customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents)
-VALUES ($1, $2, $3, $4, $5, $6)
-RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at
+const insertDraftInvoice = `-- name: InsertDraftInvoice :one
+INSERT INTO invoices (customer_id, period_start, period_end, currency, replaces_invoice_id, subtotal_cents, discount_cents, total_cents, status)
+VALUES ($1, $2, $3, $4, $5, 0, 0, 0, 'draft')
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
 `
 
-type InsertInvoiceParams struct {
-	CustomerID    int64     `json:"customer_id"`
-	PeriodStart   time.Time `json:"period_start"`
-	PeriodEnd     time.Time `json:"period_end"`
-	SubtotalCents int64     `json:"subtotal_cents"`
-	DiscountCents int64     `json:"discount_cents"`
-	TotalCents    int64     `json:"total_cents"`
+type InsertDraftInvoiceParams struct {
+	CustomerID        int64         `json:"customer_id"`
+	PeriodStart       time.Time     `json:"period_start"`
+	PeriodEnd         time.Time     `json:"period_end"`
+	Currency          string        `json:"currency"`
+	ReplacesInvoiceID sql.NullInt64 `json:"replaces_invoice_id"`
 }
 
-func (q *Queries) InsertInvoice(ctx context.Context, arg InsertInvoiceParams) (Invoice, error) {
-	row := q.db.QueryRowContext(ctx, insertInvoice,
+func (q *Queries) InsertDraftInvoice(ctx context.Context, arg InsertDraftInvoiceParams) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, insertDraftInvoice,
 		arg.CustomerID,
 		arg.PeriodStart,
 		arg.PeriodEnd,
-		arg.SubtotalCents,
-		arg.DiscountCents,
-		arg.TotalCents,
+		arg.Currency,
+		arg.ReplacesInvoiceID,
 	)
 	var i Invoice
 	err := row.Scan(
@@ -617,6 +693,19 @@ func (q *Queries) InsertInvoice(ctx context.Context, arg InsertInvoiceParams) (I
 		&i.DiscountCents,
 		&i.TotalCents,
 		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
 	)
 	return i, err
 }
@@ -631,21 +720,37 @@ INSERT INTO invoice_line_items (
     backup_bytes,
     coverage_factor,
     amount_cents,
-    discount_cents
-) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-RETURNING id, invoice_id, service_id, window_start, window_end, primary_bytes, backup_bytes, coverage_factor, amount_cents, discount_cents, created_at
+    discount_cents,
+    kind,
+    adjusts_invoice_id,
+    primary_requests,
+    backup_requests,
+    amount_micros,
+    discount_micros,
+    storm_breakdown,
+    pricing
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+RETURNING id, invoice_id, service_id, window_start, window_end, primary_bytes, backup_bytes, coverage_factor, amount_cents, discount_cents, created_at, kind, adjusts_invoice_id, primary_requests, backup_requests, amount_micros, discount_micros, storm_breakdown, pricing
 `
 
 type InsertInvoiceLineItemParams struct {
-	InvoiceID      int64     `json:"invoice_id"`
-	ServiceID      int64     `json:"service_id"`
-	WindowStart    time.Time `json:"window_start"`
-	WindowEnd      time.Time `json:"window_end"`
-	PrimaryBytes   int64     `json:"primary_bytes"`
-	BackupBytes    int64     `json:"backup_bytes"`
-	CoverageFactor float64   `json:"coverage_factor"`
-	AmountCents    int64     `json:"amount_cents"`
-	DiscountCents  int64     `json:"discount_cents"`
+	InvoiceID        int64          `json:"invoice_id"`
+	ServiceID        sql.NullInt64  `json:"service_id"`
+	WindowStart      time.Time      `json:"window_start"`
+	WindowEnd        time.Time      `json:"window_end"`
+	PrimaryBytes     int64          `json:"primary_bytes"`
+	BackupBytes      int64          `json:"backup_bytes"`
+	CoverageFactor   float64        `json:"coverage_factor"`
+	AmountCents      int64          `json:"amount_cents"`
+	DiscountCents    int64          `json:"discount_cents"`
+	Kind             string         `json:"kind"`
+	AdjustsInvoiceID sql.NullInt64  `json:"adjusts_invoice_id"`
+	PrimaryRequests  int64          `json:"primary_requests"`
+	BackupRequests   int64          `json:"backup_requests"`
+	AmountMicros     int64          `json:"amount_micros"`
+	DiscountMicros   int64          `json:"discount_micros"`
+	StormBreakdown   StormBreakdown `json:"storm_breakdown"`
+	Pricing          LinePricing    `json:"pricing"`
 }
 
 func (q *Queries) InsertInvoiceLineItem(ctx context.Context, arg InsertInvoiceLineItemParams) (InvoiceLineItem, error) {
@@ -659,6 +764,14 @@ func (q *Queries) InsertInvoiceLineItem(ctx context.Context, arg InsertInvoiceLi
 		arg.CoverageFactor,
 		arg.AmountCents,
 		arg.DiscountCents,
+		arg.Kind,
+		arg.AdjustsInvoiceID,
+		arg.PrimaryRequests,
+		arg.BackupRequests,
+		arg.AmountMicros,
+		arg.DiscountMicros,
+		arg.StormBreakdown,
+		arg.Pricing,
 	)
 	var i InvoiceLineItem
 	err := row.Scan(
@@ -673,6 +786,14 @@ func (q *Queries) InsertInvoiceLineItem(ctx context.Context, arg InsertInvoiceLi
 		&i.AmountCents,
 		&i.DiscountCents,
 		&i.CreatedAt,
+		&i.Kind,
+		&i.AdjustsInvoiceID,
+		&i.PrimaryRequests,
+		&i.BackupRequests,
+		&i.AmountMicros,
+		&i.DiscountMicros,
+		&i.StormBreakdown,
+		&i.Pricing,
 	)
 	return i, err
 }
@@ -735,24 +856,26 @@ func (q *Queries) InsertService(ctx context.Context, arg InsertServiceParams) (S
 }
 
 const insertServiceDomain = `-- name: InsertServiceDomain :one
-INSERT INTO service_domains (service_id, name)
-VALUES ($1, $2)
-RETURNING id, service_id, name, created_at
+INSERT INTO service_domains (service_id, name, routing_strategy)
+VALUES ($1, $2, $3)
+RETURNING id, service_id, name, created_at, routing_strategy
 `
 
 type InsertServiceDomainParams struct {
-	ServiceID int64  `json:"service_id"`
-	Name      string `json:"name"`
+	ServiceID       int64  `json:"service_id"`
+	Name            string `json:"name"`
+	RoutingStrategy string `json:"routing_strategy"`
 }
 
 func (q *Queries) InsertServiceDomain(ctx context.Context, arg InsertServiceDomainParams) (ServiceDomain, error) {
-	row := q.db.QueryRowContext(ctx, insertServiceDomain, arg.ServiceID, arg.Name)
+	row := q.db.QueryRowContext(ctx, insertServiceDomain, arg.ServiceID, arg.Name, arg.RoutingStrategy)
 	var i ServiceDomain
 	err := row.Scan(
 		&i.ID,
 		&i.ServiceID,
 		&i.Name,
 		&i.CreatedAt,
+		&i.RoutingStrategy,
 	)
 	return i, err
 }
@@ -825,6 +948,225 @@ func (q *Queries) InsertStormPolicy(ctx context.Context, arg InsertStormPolicyPa
 	return i, err
 }
 
+const insertUsageRevisionIfChanged = `-- name: InsertUsageRevisionIfChanged :execrows
+INSERT INTO usage_revisions (snapshot_id, primary_bytes, backup_bytes, primary_requests, backup_requests, regions)
+SELECT us.id, $1, $2, $3::BIGINT, $4::BIGINT, $5::JSONB
+FROM usage_snapshots us
+LEFT JOIN LATERAL (
+    SELECT ur.primary_bytes, ur.backup_bytes, ur.primary_requests, ur.backup_requests, ur.regions
+    FROM usage_revisions ur
+    WHERE ur.snapshot_id = us.id
+    ORDER BY ur.id DESC
+    LIMIT 1
+) latest ON TRUE
+WHERE us.service_id = $6
+  AND us.window_start = $7
+  AND us.window_end = $8
+  AND us.invoice_id IS NOT NULL
+  AND (COALESCE(latest.primary_bytes, us.primary_bytes),
+       COALESCE(latest.backup_bytes, us.backup_bytes),
+       COALESCE(latest.primary_requests, us.primary_requests),
+       COALESCE(latest.backup_requests, us.backup_requests),
+       COALESCE(latest.regions, us.regions))
+      IS DISTINCT FROM ($1::BIGINT, $2::BIGINT, $3::BIGINT, $4::BIGINT, $5::JSONB)
+`
+
+type InsertUsageRevisionIfChangedParams struct {
+	PrimaryBytes    int64        `json:"primary_bytes"`
+	BackupBytes     int64        `json:"backup_bytes"`
+	PrimaryRequests int64        `json:"primary_requests"`
+	BackupRequests  int64        `json:"backup_requests"`
+	Regions         UsageRegions `json:"regions"`
+	ServiceID       int64        `json:"service_id"`
+	WindowStart     time.Time    `json:"window_start"`
+	WindowEnd       time.Time    `json:"window_end"`
+}
+
+func (q *Queries) InsertUsageRevisionIfChanged(ctx context.Context, arg InsertUsageRevisionIfChangedParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, insertUsageRevisionIfChanged,
+		arg.PrimaryBytes,
+		arg.BackupBytes,
+		arg.PrimaryRequests,
+		arg.BackupRequests,
+		arg.Regions,
+		arg.ServiceID,
+		arg.WindowStart,
+		arg.WindowEnd,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const lockUnsettledUsageRevisions = `-- name: LockUnsettledUsageRevisions :many
+SELECT
+    ur.id,
+    ur.snapshot_id,
+    us.service_id,
+    s.customer_id,
+    us.window_start,
+    us.window_end,
+    ur.primary_bytes,
+    ur.backup_bytes,
+    ur.primary_requests,
+    ur.backup_requests,
+    ur.regions,
+    us.invoice_id
+FROM usage_revisions ur
+JOIN usage_snapshots us ON us.id = ur.snapshot_id
+JOIN services s ON s.id = us.service_id
+WHERE ur.settled_at IS NULL
+ORDER BY ur.snapshot_id, ur.id
+FOR UPDATE OF ur SKIP LOCKED
+`
+
+type LockUnsettledUsageRevisionsRow struct {
+	ID              int64         `json:"id"`
+	SnapshotID      int64         `json:"snapshot_id"`
+	ServiceID       int64         `json:"service_id"`
+	CustomerID      int64         `json:"customer_id"`
+	WindowStart     time.Time     `json:"window_start"`
+	WindowEnd       time.Time     `json:"window_end"`
+	PrimaryBytes    int64         `json:"primary_bytes"`
+	BackupBytes     int64         `json:"backup_bytes"`
+	PrimaryRequests int64         `json:"primary_requests"`
+	BackupRequests  int64         `json:"backup_requests"`
+	Regions         UsageRegions  `json:"regions"`
+	InvoiceID       sql.NullInt64 `json:"invoice_id"`
+}
+
+func (q *Queries) LockUnsettledUsageRevisions(ctx context.Context) ([]LockUnsettledUsageRevisionsRow, error) {
+	rows, err := q.db.QueryContext(ctx, lockUnsettledUsageRevisions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []LockUnsettledUsageRevisionsRow{}
+	for rows.Next() {
+		var i LockUnsettledUsageRevisionsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.SnapshotID,
+			&i.ServiceID,
+			&i.CustomerID,
+			&i.WindowStart,
+			&i.WindowEnd,
+			&i.PrimaryBytes,
+			&i.BackupBytes,
+			&i.PrimaryRequests,
+			&i.BackupRequests,
+			&i.Regions,
+			&i.InvoiceID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getBilledUsageForWindow = `-- name: GetBilledUsageForWindow :one
+SELECT
+    COALESCE(SUM(li.primary_bytes), 0)::BIGINT AS primary_bytes,
+    COALESCE(SUM(li.backup_bytes), 0)::BIGINT AS backup_bytes,
+    COALESCE(SUM(li.primary_requests), 0)::BIGINT AS primary_requests,
+    COALESCE(SUM(li.backup_requests), 0)::BIGINT AS backup_requests,
+    COALESCE(SUM(li.amount_micros), 0)::BIGINT AS amount_micros,
+    COALESCE(SUM(li.discount_micros), 0)::BIGINT AS discount_micros
+FROM invoice_line_items li
+JOIN invoices i ON i.id = li.invoice_id
+WHERE li.service_id = $1
+  AND li.window_start = $2
+  AND li.window_end = $3
+  AND i.status <> 'void'
+`
+
+type GetBilledUsageForWindowParams struct {
+	ServiceID   int64     `json:"service_id"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+}
+
+type GetBilledUsageForWindowRow struct {
+	PrimaryBytes    int64 `json:"primary_bytes"`
+	BackupBytes     int64 `json:"backup_bytes"`
+	PrimaryRequests int64 `json:"primary_requests"`
+	BackupRequests  int64 `json:"backup_requests"`
+	AmountMicros    int64 `json:"amount_micros"`
+	DiscountMicros  int64 `json:"discount_micros"`
+}
+
+func (q *Queries) GetBilledUsageForWindow(ctx context.Context, arg GetBilledUsageForWindowParams) (GetBilledUsageForWindowRow, error) {
+	row := q.db.QueryRowContext(ctx, getBilledUsageForWindow, arg.ServiceID, arg.WindowStart, arg.WindowEnd)
+	var i GetBilledUsageForWindowRow
+	err := row.Scan(
+		&i.PrimaryBytes,
+		&i.BackupBytes,
+		&i.PrimaryRequests,
+		&i.BackupRequests,
+		&i.AmountMicros,
+		&i.DiscountMicros,
+	)
+	return i, err
+}
+
+const getUsagePricingForWindow = `-- name: GetUsagePricingForWindow :one
+SELECT li.pricing, i.currency
+FROM invoice_line_items li
+JOIN invoices i ON i.id = li.invoice_id
+WHERE li.service_id = $1
+  AND li.window_start = $2
+  AND li.window_end = $3
+  AND li.kind = 'usage'
+  AND i.status <> 'void'
+ORDER BY li.id DESC
+LIMIT 1
+`
+
+type GetUsagePricingForWindowParams struct {
+	ServiceID   int64     `json:"service_id"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+}
+
+type GetUsagePricingForWindowRow struct {
+	Pricing  LinePricing `json:"pricing"`
+	Currency string      `json:"currency"`
+}
+
+// How a window was first billed: the pricing of its usage line item on an invoice that
+// has not been voided, and that invoice's currency.
+func (q *Queries) GetUsagePricingForWindow(ctx context.Context, arg GetUsagePricingForWindowParams) (GetUsagePricingForWindowRow, error) {
+	row := q.db.QueryRowContext(ctx, getUsagePricingForWindow, arg.ServiceID, arg.WindowStart, arg.WindowEnd)
+	var i GetUsagePricingForWindowRow
+	err := row.Scan(&i.Pricing, &i.Currency)
+	return i, err
+}
+
+const settleUsageRevision = `-- name: SettleUsageRevision :exec
+UPDATE usage_revisions
+SET settled_at = NOW(),
+    invoice_id = $2
+WHERE id = $1
+`
+
+type SettleUsageRevisionParams struct {
+	ID        int64         `json:"id"`
+	InvoiceID sql.NullInt64 `json:"invoice_id"`
+}
+
+func (q *Queries) SettleUsageRevision(ctx context.Context, arg SettleUsageRevisionParams) error {
+	_, err := q.db.ExecContext(ctx, settleUsageRevision, arg.ID, arg.InvoiceID)
+	return err
+}
+
 const lockUnbilledUsageSnapshots = `-- name: LockUnbilledUsageSnapshots :many
 SELECT
     us.id,
@@ -833,33 +1175,33 @@ SELECT
     us.window_start,
     us.window_end,
     us.primary_bytes,
-    us.backup_bytes
+    us.backup_bytes,
+    us.primary_requests,
+    us.backup_requests,
+    us.regions
 FROM usage_snapshots us
 JOIN services s ON s.id = us.service_id
 WHERE us.invoice_id IS NULL
   AND us.window_end <= $1
-  AND us.window_end > $2
 ORDER BY us.window_start
 FOR UPDATE SKIP LOCKED
 `
 
-type LockUnbilledUsageSnapshotsParams struct {
-	WindowEnd   time.Time `json:"window_end"`
-	WindowStart time.Time `json:"window_start"`
-}
-
 type LockUnbilledUsageSnapshotsRow struct {
-	ID           int64     `json:"id"`
-	ServiceID    int64     `json:"service_id"`
-	CustomerID   int64     `json:"customer_id"`
-	WindowStart  time.Time `json:"window_start"`
-	WindowEnd    time.Time `json:"window_end"`
-	PrimaryBytes int64     `json:"primary_bytes"`
-	BackupBytes  int64     `json:"backup_bytes"`
+	ID              int64        `json:"id"`
+	ServiceID       int64        `json:"service_id"`
+	CustomerID      int64        `json:"customer_id"`
+	WindowStart     time.Time    `json:"window_start"`
+	WindowEnd       time.Time    `json:"window_end"`
+	PrimaryBytes    int64        `json:"primary_bytes"`
+	BackupBytes     int64        `json:"backup_bytes"`
+	PrimaryRequests int64        `json:"primary_requests"`
+	BackupRequests  int64        `json:"backup_requests"`
+	Regions         UsageRegions `json:"regions"`
 }
 
-func (q *Queries) LockUnbilledUsageSnapshots(ctx context.Context, arg LockUnbilledUsageSnapshotsParams) ([]LockUnbilledUsageSnapshotsRow, error) {
-	rows, err := q.db.QueryContext(ctx, lockUnbilledUsageSnapshots, arg.WindowEnd, arg.WindowStart)
+func (q *Queries) LockUnbilledUsageSnapshots(ctx context.Context, windowEnd time.Time) ([]LockUnbilledUsageSnapshotsRow, error) {
+	rows, err := q.db.QueryContext(ctx, lockUnbilledUsageSnapshots, windowEnd)
 	if err != nil {
 		return nil, err
 	}
@@ -875,6 +1217,9 @@ func (q *Queries) LockUnbilledUsageSnapshots(ctx context.Context, arg LockUnbill
 			&i.WindowEnd,
 			&i.PrimaryBytes,
 			&i.BackupBytes,
+			&i.PrimaryRequests,
+			&i.BackupRequests,
+			&i.Regions,
 		); err != nil {
 			return nil, err
 		}
@@ -930,27 +1275,78 @@ func (q *Queries) MarkUsageSnapshotInvoiced(ctx context.Context, arg MarkUsageSn
 	return err
 }
 
+const upsertServiceDNSSettings = `-- name: UpsertServiceDNSSettings :one
+INSERT INTO service_dns_settings (
+        service_id,
+        ttl_seconds,
+        storm_ttl_seconds,
+        prestorm_margin)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (service_id)
+DO UPDATE SET
+        ttl_seconds = EXCLUDED.ttl_seconds,
+        storm_ttl_seconds = EXCLUDED.storm_ttl_seconds,
+        prestorm_margin = EXCLUDED.prestorm_margin,
+        updated_at = NOW()
+RETURNING service_id, ttl_seconds, storm_ttl_seconds, prestorm_margin, updated_at
+`
+
+type UpsertServiceDNSSettingsParams struct {
+	ServiceID       int64   `json:"service_id"`
+	TtlSeconds      int32   `json:"ttl_seconds"`
+	StormTtlSeconds int32   `json:"storm_ttl_seconds"`
+	PrestormMargin  float64 `json:"prestorm_margin"`
+}
+
+func (q *Queries) UpsertServiceDNSSettings(ctx context.Context, arg UpsertServiceDNSSettingsParams) (ServiceDnsSetting, error) {
+	row := q.db.QueryRowContext(ctx, upsertServiceDNSSettings,
+		arg.ServiceID,
+		arg.TtlSeconds,
+		arg.StormTtlSeconds,
+		arg.PrestormMargin,
+	)
+	var i ServiceDnsSetting
+	err := row.Scan(
+		&i.ServiceID,
+		&i.TtlSeconds,
+		&i.StormTtlSeconds,
+		&i.PrestormMargin,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
 const upsertUsageSnapshot = `-- name: UpsertUsageSnapshot :exec
 INSERT INTO usage_snapshots (
         service_id,
         window_start,
         window_end,
         primary_bytes,
-        backup_bytes)
-VALUES ($1, $2, $3, $4, $5)
+        backup_bytes,
+        primary_requests,
+        backup_requests,
+        regions)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 ON CONFLICT (service_id, window_start, window_end)
 DO UPDATE SET
         primary_bytes = EXCLUDED.primary_bytes,
         backup_bytes = EXCLUDED.backup_bytes,
+        primary_requests = EXCLUDED.primary_requests,
+        backup_requests = EXCLUDED.backup_requests,
+        regions = EXCLUDED.regions,
         created_at = NOW()
+WHERE usage_snapshots.invoice_id IS NULL
 `
 
 type UpsertUsageSnapshotParams struct {
-	ServiceID    int64     `json:"service_id"`
-	WindowStart  time.Time `json:"window_start"`
-	WindowEnd    time.Time `json:"window_end"`
-	PrimaryBytes int64     `json:"primary_bytes"`
-	BackupBytes  int64     `json:"backup_bytes"`
+	ServiceID       int64        `json:"service_id"`
+	WindowStart     time.Time    `json:"window_start"`
+	WindowEnd       time.Time    `json:"window_end"`
+	PrimaryBytes    int64        `json:"primary_bytes"`
+	BackupBytes     int64        `json:"backup_bytes"`
+	PrimaryRequests int64        `json:"primary_requests"`
+	BackupRequests  int64        `json:"backup_requests"`
+	Regions         UsageRegions `json:"regions"`
 }
 
 func (q *Queries) UpsertUsageSnapshot(ctx context.Context, arg UpsertUsageSnapshotParams) error {
@@ -960,6 +1356,9 @@ func (q *Queries) UpsertUsageSnapshot(ctx context.Context, arg UpsertUsageSnapsh
 		arg.WindowEnd,
 		arg.PrimaryBytes,
 		arg.BackupBytes,
+		arg.PrimaryRequests,
+		arg.BackupRequests,
+		arg.Regions,
 	)
 	return err
 }
@@ -1032,6 +1431,33 @@ func (q *Queries) UpdateService(ctx context.Context, arg UpdateServiceParams) (S
 	return i, err
 }
 
+const updateServiceDomainStrategy = `-- name: UpdateServiceDomainStrategy :one
+UPDATE service_domains
+SET routing_strategy = $3
+WHERE id = $1
+  AND service_id = $2
+RETURNING id, service_id, name, created_at, routing_strategy
+`
+
+type UpdateServiceDomainStrategyParams struct {
+	ID              int64  `json:"id"`
+	ServiceID       int64  `json:"service_id"`
+	RoutingStrategy string `json:"routing_strategy"`
+}
+
+func (q *Queries) UpdateServiceDomainStrategy(ctx context.Context, arg UpdateServiceDomainStrategyParams) (ServiceDomain, error) {
+	row := q.db.QueryRowContext(ctx, updateServiceDomainStrategy, arg.ID, arg.ServiceID, arg.RoutingStrategy)
+	var i ServiceDomain
+	err := row.Scan(
+		&i.ID,
+		&i.ServiceID,
+		&i.Name,
+		&i.CreatedAt,
+		&i.RoutingStrategy,
+	)
+	return i, err
+}
+
 const updateStormPolicy = `-- name: UpdateStormPolicy :one
 UPDATE storm_policies
 SET kind = $3,
@@ -1077,3 +1503,2942 @@ func (q *Queries) UpdateStormPolicy(ctx context.Context, arg UpdateStormPolicyPa
 	)
 	return i, err
 }
+
+const getUsageLogFile = `-- name: GetUsageLogFile :one
+SELECT source, object_key, size_bytes, etag, records, skipped, processed_at, usage
+FROM usage_log_files
+WHERE source = $1 AND object_key = $2
+`
+
+type GetUsageLogFileParams struct {
+	Source    string `json:"source"`
+	ObjectKey string `json:"object_key"`
+}
+
+func (q *Queries) GetUsageLogFile(ctx context.Context, arg GetUsageLogFileParams) (UsageLogFile, error) {
+	row := q.db.QueryRowContext(ctx, getUsageLogFile, arg.Source, arg.ObjectKey)
+	var i UsageLogFile
+	err := row.Scan(
+		&i.Source,
+		&i.ObjectKey,
+		&i.SizeBytes,
+		&i.Etag,
+		&i.Records,
+		&i.Skipped,
+		&i.ProcessedAt,
+		&i.Usage,
+	)
+	return i, err
+}
+
+const lockUsageLogFile = `-- name: LockUsageLogFile :one
+SELECT source, object_key, size_bytes, etag, records, skipped, processed_at, usage
+FROM usage_log_files
+WHERE source = $1 AND object_key = $2
+FOR UPDATE
+`
+
+type LockUsageLogFileParams struct {
+	Source    string `json:"source"`
+	ObjectKey string `json:"object_key"`
+}
+
+// Locks a processed file's row while a new version of it replaces its counts.
+func (q *Queries) LockUsageLogFile(ctx context.Context, arg LockUsageLogFileParams) (UsageLogFile, error) {
+	row := q.db.QueryRowContext(ctx, lockUsageLogFile, arg.Source, arg.ObjectKey)
+	var i UsageLogFile
+	err := row.Scan(
+		&i.Source,
+		&i.ObjectKey,
+		&i.SizeBytes,
+		&i.Etag,
+		&i.Records,
+		&i.Skipped,
+		&i.ProcessedAt,
+		&i.Usage,
+	)
+	return i, err
+}
+
+const insertUsageLogFile = `-- name: InsertUsageLogFile :execrows
+INSERT INTO usage_log_files (source, object_key, size_bytes, etag, records, skipped, usage)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (source, object_key) DO NOTHING
+`
+
+type InsertUsageLogFileParams struct {
+	Source    string       `json:"source"`
+	ObjectKey string       `json:"object_key"`
+	SizeBytes int64        `json:"size_bytes"`
+	Etag      string       `json:"etag"`
+	Records   int64        `json:"records"`
+	Skipped   int64        `json:"skipped"`
+	Usage     LogFileUsage `json:"usage"`
+}
+
+func (q *Queries) InsertUsageLogFile(ctx context.Context, arg InsertUsageLogFileParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, insertUsageLogFile,
+		arg.Source,
+		arg.ObjectKey,
+		arg.SizeBytes,
+		arg.Etag,
+		arg.Records,
+		arg.Skipped,
+		arg.Usage,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const updateUsageLogFile = `-- name: UpdateUsageLogFile :exec
+UPDATE usage_log_files
+SET size_bytes = $3,
+    etag = $4,
+    records = $5,
+    skipped = $6,
+    usage = $7,
+    processed_at = NOW()
+WHERE source = $1 AND object_key = $2
+`
+
+type UpdateUsageLogFileParams struct {
+	Source    string       `json:"source"`
+	ObjectKey string       `json:"object_key"`
+	SizeBytes int64        `json:"size_bytes"`
+	Etag      string       `json:"etag"`
+	Records   int64        `json:"records"`
+	Skipped   int64        `json:"skipped"`
+	Usage     LogFileUsage `json:"usage"`
+}
+
+// Records a new version of an already processed file.
+func (q *Queries) UpdateUsageLogFile(ctx context.Context, arg UpdateUsageLogFileParams) error {
+	_, err := q.db.ExecContext(ctx, updateUsageLogFile,
+		arg.Source,
+		arg.ObjectKey,
+		arg.SizeBytes,
+		arg.Etag,
+		arg.Records,
+		arg.Skipped,
+		arg.Usage,
+	)
+	return err
+}
+
+const addUsageSnapshotBytes = `-- name: AddUsageSnapshotBytes :execrows
+INSERT INTO usage_snapshots (
+        service_id,
+        window_start,
+        window_end,
+        primary_bytes,
+        backup_bytes,
+        primary_requests,
+        backup_requests)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (service_id, window_start, window_end)
+DO UPDATE SET
+        primary_bytes = usage_snapshots.primary_bytes + EXCLUDED.primary_bytes,
+        backup_bytes = usage_snapshots.backup_bytes + EXCLUDED.backup_bytes,
+        primary_requests = usage_snapshots.primary_requests + EXCLUDED.primary_requests,
+        backup_requests = usage_snapshots.backup_requests + EXCLUDED.backup_requests,
+        created_at = NOW()
+WHERE usage_snapshots.invoice_id IS NULL
+`
+
+type AddUsageSnapshotBytesParams struct {
+	ServiceID       int64     `json:"service_id"`
+	WindowStart     time.Time `json:"window_start"`
+	WindowEnd       time.Time `json:"window_end"`
+	PrimaryBytes    int64     `json:"primary_bytes"`
+	BackupBytes     int64     `json:"backup_bytes"`
+	PrimaryRequests int64     `json:"primary_requests"`
+	BackupRequests  int64     `json:"backup_requests"`
+}
+
+func (q *Queries) AddUsageSnapshotBytes(ctx context.Context, arg AddUsageSnapshotBytesParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, addUsageSnapshotBytes,
+		arg.ServiceID,
+		arg.WindowStart,
+		arg.WindowEnd,
+		arg.PrimaryBytes,
+		arg.BackupBytes,
+		arg.PrimaryRequests,
+		arg.BackupRequests,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const addUsageRevisionBytes = `-- name: AddUsageRevisionBytes :exec
+INSERT INTO usage_revisions (snapshot_id, primary_bytes, backup_bytes, primary_requests, backup_requests, regions)
+SELECT us.id,
+       COALESCE(latest.primary_bytes, us.primary_bytes) + $1::BIGINT,
+       COALESCE(latest.backup_bytes, us.backup_bytes) + $2::BIGINT,
+       COALESCE(latest.primary_requests, us.primary_requests) + $3::BIGINT,
+       COALESCE(latest.backup_requests, us.backup_requests) + $4::BIGINT,
+       COALESCE(latest.regions, us.regions)
+FROM usage_snapshots us
+LEFT JOIN LATERAL (
+    SELECT ur.primary_bytes, ur.backup_bytes, ur.primary_requests, ur.backup_requests, ur.regions
+    FROM usage_revisions ur
+    WHERE ur.snapshot_id = us.id
+    ORDER BY ur.id DESC
+    LIMIT 1
+) latest ON TRUE
+WHERE us.service_id = $5
+  AND us.window_start = $6
+  AND us.window_end = $7
+  AND us.invoice_id IS NOT NULL
+`
+
+type AddUsageRevisionBytesParams struct {
+	PrimaryBytes    int64     `json:"primary_bytes"`
+	BackupBytes     int64     `json:"backup_bytes"`
+	PrimaryRequests int64     `json:"primary_requests"`
+	BackupRequests  int64     `json:"backup_requests"`
+	ServiceID       int64     `json:"service_id"`
+	WindowStart     time.Time `json:"window_start"`
+	WindowEnd       time.Time `json:"window_end"`
+}
+
+func (q *Queries) AddUsageRevisionBytes(ctx context.Context, arg AddUsageRevisionBytesParams) error {
+	_, err := q.db.ExecContext(ctx, addUsageRevisionBytes,
+		arg.PrimaryBytes,
+		arg.BackupBytes,
+		arg.PrimaryRequests,
+		arg.BackupRequests,
+		arg.ServiceID,
+		arg.WindowStart,
+		arg.WindowEnd,
+	)
+	return err
+}
+
+const listUsageSnapshotWindows = `-- name: ListUsageSnapshotWindows :many
+SELECT service_id, window_start
+FROM usage_snapshots
+WHERE window_start >= $1
+  AND window_start < $2
+ORDER BY service_id, window_start
+`
+
+type ListUsageSnapshotWindowsParams struct {
+	RangeStart time.Time `json:"range_start"`
+	RangeEnd   time.Time `json:"range_end"`
+}
+
+type ListUsageSnapshotWindowsRow struct {
+	ServiceID   int64     `json:"service_id"`
+	WindowStart time.Time `json:"window_start"`
+}
+
+func (q *Queries) ListUsageSnapshotWindows(ctx context.Context, arg ListUsageSnapshotWindowsParams) ([]ListUsageSnapshotWindowsRow, error) {
+	rows, err := q.db.QueryContext(ctx, listUsageSnapshotWindows, arg.RangeStart, arg.RangeEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListUsageSnapshotWindowsRow{}
+	for rows.Next() {
+		var i ListUsageSnapshotWindowsRow
+		if err := rows.Scan(&i.ServiceID, &i.WindowStart); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const startUsageBackfill = `-- name: StartUsageBackfill :one
+INSERT INTO usage_backfills (job_key, range_start, range_end, services, cursor_at)
+VALUES ($1, $2, $3, $4, $2)
+ON CONFLICT (job_key) DO UPDATE SET updated_at = NOW()
+RETURNING job_key, range_start, range_end, services, cursor_at, filled, present, empty, started_at, updated_at, completed_at
+`
+
+type StartUsageBackfillParams struct {
+	JobKey     string    `json:"job_key"`
+	RangeStart time.Time `json:"range_start"`
+	RangeEnd   time.Time `json:"range_end"`
+	Services   string    `json:"services"`
+}
+
+func (q *Queries) StartUsageBackfill(ctx context.Context, arg StartUsageBackfillParams) (UsageBackfill, error) {
+	row := q.db.QueryRowContext(ctx, startUsageBackfill,
+		arg.JobKey,
+		arg.RangeStart,
+		arg.RangeEnd,
+		arg.Services,
+	)
+	var i UsageBackfill
+	err := row.Scan(
+		&i.JobKey,
+		&i.RangeStart,
+		&i.RangeEnd,
+		&i.Services,
+		&i.CursorAt,
+		&i.Filled,
+		&i.Present,
+		&i.Empty,
+		&i.StartedAt,
+		&i.UpdatedAt,
+		&i.CompletedAt,
+	)
+	return i, err
+}
+
+const resetUsageBackfill = `-- name: ResetUsageBackfill :exec
+UPDATE usage_backfills
+SET cursor_at = range_start,
+    filled = 0,
+    present = 0,
+    empty = 0,
+    started_at = NOW(),
+    updated_at = NOW(),
+    completed_at = NULL
+WHERE job_key = $1
+`
+
+func (q *Queries) ResetUsageBackfill(ctx context.Context, jobKey string) error {
+	_, err := q.db.ExecContext(ctx, resetUsageBackfill, jobKey)
+	return err
+}
+
+const advanceUsageBackfill = `-- name: AdvanceUsageBackfill :one
+UPDATE usage_backfills
+SET cursor_at = $1,
+    filled = filled + $2,
+    present = present + $3,
+    empty = empty + $4,
+    updated_at = NOW(),
+    completed_at = CASE WHEN $1 >= range_end THEN NOW() END
+WHERE job_key = $5
+RETURNING job_key, range_start, range_end, services, cursor_at, filled, present, empty, started_at, updated_at, completed_at
+`
+
+type AdvanceUsageBackfillParams struct {
+	CursorAt time.Time `json:"cursor_at"`
+	Filled   int64     `json:"filled"`
+	Present  int64     `json:"present"`
+	Empty    int64     `json:"empty"`
+	JobKey   string    `json:"job_key"`
+}
+
+func (q *Queries) AdvanceUsageBackfill(ctx context.Context, arg AdvanceUsageBackfillParams) (UsageBackfill, error) {
+	row := q.db.QueryRowContext(ctx, advanceUsageBackfill,
+		arg.CursorAt,
+		arg.Filled,
+		arg.Present,
+		arg.Empty,
+		arg.JobKey,
+	)
+	var i UsageBackfill
+	err := row.Scan(
+		&i.JobKey,
+		&i.RangeStart,
+		&i.RangeEnd,
+		&i.Services,
+		&i.CursorAt,
+		&i.Filled,
+		&i.Present,
+		&i.Empty,
+		&i.StartedAt,
+		&i.UpdatedAt,
+		&i.CompletedAt,
+	)
+	return i, err
+}
+
+const listUsageCoverage = `-- name: ListUsageCoverage :many
+SELECT service_id, window_start, window_end, primary_bytes, backup_bytes, first_seen_at
+FROM usage_snapshots
+WHERE window_start >= $1
+  AND window_start < $2
+ORDER BY service_id, window_start
+`
+
+type ListUsageCoverageParams struct {
+	RangeStart time.Time `json:"range_start"`
+	RangeEnd   time.Time `json:"range_end"`
+}
+
+type ListUsageCoverageRow struct {
+	ServiceID    int64     `json:"service_id"`
+	WindowStart  time.Time `json:"window_start"`
+	WindowEnd    time.Time `json:"window_end"`
+	PrimaryBytes int64     `json:"primary_bytes"`
+	BackupBytes  int64     `json:"backup_bytes"`
+	FirstSeenAt  time.Time `json:"first_seen_at"`
+}
+
+func (q *Queries) ListUsageCoverage(ctx context.Context, arg ListUsageCoverageParams) ([]ListUsageCoverageRow, error) {
+	rows, err := q.db.QueryContext(ctx, listUsageCoverage, arg.RangeStart, arg.RangeEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListUsageCoverageRow{}
+	for rows.Next() {
+		var i ListUsageCoverageRow
+		if err := rows.Scan(
+			&i.ServiceID,
+			&i.WindowStart,
+			&i.WindowEnd,
+			&i.PrimaryBytes,
+			&i.BackupBytes,
+			&i.FirstSeenAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listServiceUsageCoverage = `-- name: ListServiceUsageCoverage :many
+SELECT service_id, window_start, window_end, primary_bytes, backup_bytes, first_seen_at
+FROM usage_snapshots
+WHERE service_id = $1
+  AND window_start >= $2
+  AND window_start < $3
+ORDER BY window_start
+`
+
+type ListServiceUsageCoverageParams struct {
+	ServiceID  int64     `json:"service_id"`
+	RangeStart time.Time `json:"range_start"`
+	RangeEnd   time.Time `json:"range_end"`
+}
+
+type ListServiceUsageCoverageRow struct {
+	ServiceID    int64     `json:"service_id"`
+	WindowStart  time.Time `json:"window_start"`
+	WindowEnd    time.Time `json:"window_end"`
+	PrimaryBytes int64     `json:"primary_bytes"`
+	BackupBytes  int64     `json:"backup_bytes"`
+	FirstSeenAt  time.Time `json:"first_seen_at"`
+}
+
+func (q *Queries) ListServiceUsageCoverage(ctx context.Context, arg ListServiceUsageCoverageParams) ([]ListServiceUsageCoverageRow, error) {
+	rows, err := q.db.QueryContext(ctx, listServiceUsageCoverage, arg.ServiceID, arg.RangeStart, arg.RangeEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListServiceUsageCoverageRow{}
+	for rows.Next() {
+		var i ListServiceUsageCoverageRow
+		if err := rows.Scan(
+			&i.ServiceID,
+			&i.WindowStart,
+			&i.WindowEnd,
+			&i.PrimaryBytes,
+			&i.BackupBytes,
+			&i.FirstSeenAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const addServicePathHits = `-- name: AddServicePathHits :exec
+INSERT INTO service_path_hits (service_id, day, path, hits)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (service_id, day, path)
+DO UPDATE SET hits = service_path_hits.hits + EXCLUDED.hits
+`
+
+type AddServicePathHitsParams struct {
+	ServiceID int64     `json:"service_id"`
+	Day       time.Time `json:"day"`
+	Path      string    `json:"path"`
+	Hits      int64     `json:"hits"`
+}
+
+func (q *Queries) AddServicePathHits(ctx context.Context, arg AddServicePathHitsParams) error {
+	_, err := q.db.ExecContext(ctx, addServicePathHits,
+		arg.ServiceID,
+		arg.Day,
+		arg.Path,
+		arg.Hits,
+	)
+	return err
+}
+
+const listTopServicePaths = `-- name: ListTopServicePaths :many
+SELECT path, SUM(hits)::BIGINT AS hits
+FROM service_path_hits
+WHERE service_id = $1
+  AND day >= $2
+GROUP BY path
+ORDER BY hits DESC, path
+LIMIT $3
+`
+
+type ListTopServicePathsParams struct {
+	ServiceID int64     `json:"service_id"`
+	Since     time.Time `json:"since"`
+	RowLimit  int32     `json:"row_limit"`
+}
+
+type ListTopServicePathsRow struct {
+	Path string `json:"path"`
+	Hits int64  `json:"hits"`
+}
+
+func (q *Queries) ListTopServicePaths(ctx context.Context, arg ListTopServicePathsParams) ([]ListTopServicePathsRow, error) {
+	rows, err := q.db.QueryContext(ctx, listTopServicePaths, arg.ServiceID, arg.Since, arg.RowLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListTopServicePathsRow{}
+	for rows.Next() {
+		var i ListTopServicePathsRow
+		if err := rows.Scan(&i.Path, &i.Hits); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const deleteServicePathHitsBefore = `-- name: DeleteServicePathHitsBefore :execrows
+DELETE FROM service_path_hits
+WHERE day < $1
+`
+
+func (q *Queries) DeleteServicePathHitsBefore(ctx context.Context, day time.Time) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteServicePathHitsBefore, day)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const insertPricingPlan = `-- name: InsertPricingPlan :one
+INSERT INTO pricing_plans (
+    name,
+    primary_rate_cents_per_gb,
+    backup_rate_cents_per_gb,
+    tiers,
+    minimum_monthly_cents,
+    storm_discount_rate,
+    sla_definition_id,
+    currency
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING id, name, primary_rate_cents_per_gb, backup_rate_cents_per_gb, tiers, minimum_monthly_cents, storm_discount_rate, created_at, updated_at, sla_definition_id, currency
+`
+
+type InsertPricingPlanParams struct {
+	Name                  string        `json:"name"`
+	PrimaryRateCentsPerGb int64         `json:"primary_rate_cents_per_gb"`
+	BackupRateCentsPerGb  int64         `json:"backup_rate_cents_per_gb"`
+	Tiers                 PlanTiers     `json:"tiers"`
+	MinimumMonthlyCents   int64         `json:"minimum_monthly_cents"`
+	StormDiscountRate     float64       `json:"storm_discount_rate"`
+	SlaDefinitionID       sql.NullInt64 `json:"sla_definition_id"`
+	Currency              string        `json:"currency"`
+}
+
+func (q *Queries) InsertPricingPlan(ctx context.Context, arg InsertPricingPlanParams) (PricingPlan, error) {
+	row := q.db.QueryRowContext(ctx, insertPricingPlan,
+		arg.Name,
+		arg.PrimaryRateCentsPerGb,
+		arg.BackupRateCentsPerGb,
+		arg.Tiers,
+		arg.MinimumMonthlyCents,
+		arg.StormDiscountRate,
+		arg.SlaDefinitionID,
+		arg.Currency,
+	)
+	var i PricingPlan
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.PrimaryRateCentsPerGb,
+		&i.BackupRateCentsPerGb,
+		&i.Tiers,
+		&i.MinimumMonthlyCents,
+		&i.StormDiscountRate,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.SlaDefinitionID,
+		&i.Currency,
+	)
+	return i, err
+}
+
+const listPricingPlans = `-- name: ListPricingPlans :many
+SELECT id, name, primary_rate_cents_per_gb, backup_rate_cents_per_gb, tiers, minimum_monthly_cents, storm_discount_rate, created_at, updated_at, sla_definition_id, currency FROM pricing_plans
+ORDER BY id
+`
+
+func (q *Queries) ListPricingPlans(ctx context.Context) ([]PricingPlan, error) {
+	rows, err := q.db.QueryContext(ctx, listPricingPlans)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []PricingPlan{}
+	for rows.Next() {
+		var i PricingPlan
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.PrimaryRateCentsPerGb,
+			&i.BackupRateCentsPerGb,
+			&i.Tiers,
+			&i.MinimumMonthlyCents,
+			&i.StormDiscountRate,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.SlaDefinitionID,
+			&i.Currency,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPricingPlan = `-- name: GetPricingPlan :one
+SELECT id, name, primary_rate_cents_per_gb, backup_rate_cents_per_gb, tiers, minimum_monthly_cents, storm_discount_rate, created_at, updated_at, sla_definition_id, currency FROM pricing_plans
+WHERE id = $1
+`
+
+func (q *Queries) GetPricingPlan(ctx context.Context, id int64) (PricingPlan, error) {
+	row := q.db.QueryRowContext(ctx, getPricingPlan, id)
+	var i PricingPlan
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.PrimaryRateCentsPerGb,
+		&i.BackupRateCentsPerGb,
+		&i.Tiers,
+		&i.MinimumMonthlyCents,
+		&i.StormDiscountRate,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.SlaDefinitionID,
+		&i.Currency,
+	)
+	return i, err
+}
+
+const updatePricingPlan = `-- name: UpdatePricingPlan :one
+UPDATE pricing_plans
+SET name = $2,
+    primary_rate_cents_per_gb = $3,
+    backup_rate_cents_per_gb = $4,
+    tiers = $5,
+    minimum_monthly_cents = $6,
+    storm_discount_rate = $7,
+    sla_definition_id = $8,
+    currency = $9,
+    updated_at = NOW()
+WHERE id = $1
+RETURNING id, name, primary_rate_cents_per_gb, backup_rate_cents_per_gb, tiers, minimum_monthly_cents, storm_discount_rate, created_at, updated_at, sla_definition_id, currency
+`
+
+type UpdatePricingPlanParams struct {
+	ID                    int64         `json:"id"`
+	Name                  string        `json:"name"`
+	PrimaryRateCentsPerGb int64         `json:"primary_rate_cents_per_gb"`
+	BackupRateCentsPerGb  int64         `json:"backup_rate_cents_per_gb"`
+	Tiers                 PlanTiers     `json:"tiers"`
+	MinimumMonthlyCents   int64         `json:"minimum_monthly_cents"`
+	StormDiscountRate     float64       `json:"storm_discount_rate"`
+	SlaDefinitionID       sql.NullInt64 `json:"sla_definition_id"`
+	Currency              string        `json:"currency"`
+}
+
+func (q *Queries) UpdatePricingPlan(ctx context.Context, arg UpdatePricingPlanParams) (PricingPlan, error) {
+	row := q.db.QueryRowContext(ctx, updatePricingPlan,
+		arg.ID,
+		arg.Name,
+		arg.PrimaryRateCentsPerGb,
+		arg.BackupRateCentsPerGb,
+		arg.Tiers,
+		arg.MinimumMonthlyCents,
+		arg.StormDiscountRate,
+		arg.SlaDefinitionID,
+		arg.Currency,
+	)
+	var i PricingPlan
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.PrimaryRateCentsPerGb,
+		&i.BackupRateCentsPerGb,
+		&i.Tiers,
+		&i.MinimumMonthlyCents,
+		&i.StormDiscountRate,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.SlaDefinitionID,
+		&i.Currency,
+	)
+	return i, err
+}
+
+const insertCustomerPlan = `-- name: InsertCustomerPlan :one
+INSERT INTO customer_plans (customer_id, plan_id, effective_from)
+VALUES ($1, $2, $3)
+RETURNING id, customer_id, plan_id, effective_from, created_at
+`
+
+type InsertCustomerPlanParams struct {
+	CustomerID    int64     `json:"customer_id"`
+	PlanID        int64     `json:"plan_id"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
+
+func (q *Queries) InsertCustomerPlan(ctx context.Context, arg InsertCustomerPlanParams) (CustomerPlan, error) {
+	row := q.db.QueryRowContext(ctx, insertCustomerPlan, arg.CustomerID, arg.PlanID, arg.EffectiveFrom)
+	var i CustomerPlan
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PlanID,
+		&i.EffectiveFrom,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const listCustomerPlans = `-- name: ListCustomerPlans :many
+SELECT id, customer_id, plan_id, effective_from, created_at FROM customer_plans
+WHERE customer_id = $1
+ORDER BY effective_from
+`
+
+func (q *Queries) ListCustomerPlans(ctx context.Context, customerID int64) ([]CustomerPlan, error) {
+	rows, err := q.db.QueryContext(ctx, listCustomerPlans, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []CustomerPlan{}
+	for rows.Next() {
+		var i CustomerPlan
+		if err := rows.Scan(
+			&i.ID,
+			&i.CustomerID,
+			&i.PlanID,
+			&i.EffectiveFrom,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const deleteCustomerPlan = `-- name: DeleteCustomerPlan :one
+DELETE FROM customer_plans
+WHERE id = $1
+  AND customer_id = $2
+RETURNING id, customer_id, plan_id, effective_from, created_at
+`
+
+type DeleteCustomerPlanParams struct {
+	ID         int64 `json:"id"`
+	CustomerID int64 `json:"customer_id"`
+}
+
+func (q *Queries) DeleteCustomerPlan(ctx context.Context, arg DeleteCustomerPlanParams) (CustomerPlan, error) {
+	row := q.db.QueryRowContext(ctx, deleteCustomerPlan, arg.ID, arg.CustomerID)
+	var i CustomerPlan
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PlanID,
+		&i.EffectiveFrom,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getCustomerBilledBytes = `-- name: GetCustomerBilledBytes :one
+SELECT COALESCE(SUM(li.primary_bytes + li.backup_bytes), 0)::BIGINT AS bytes
+FROM invoice_line_items li
+JOIN invoices i ON i.id = li.invoice_id
+WHERE i.customer_id = $1
+  AND i.currency = $2
+  AND i.status <> 'void'
+  AND li.kind IN ('usage', 'adjustment')
+  AND li.window_start >= $3
+  AND li.window_start < $4
+`
+
+type GetCustomerBilledBytesParams struct {
+	CustomerID  int64     `json:"customer_id"`
+	Currency    string    `json:"currency"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+}
+
+func (q *Queries) GetCustomerBilledBytes(ctx context.Context, arg GetCustomerBilledBytesParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getCustomerBilledBytes,
+		arg.CustomerID,
+		arg.Currency,
+		arg.PeriodStart,
+		arg.PeriodEnd,
+	)
+	var bytes int64
+	err := row.Scan(&bytes)
+	return bytes, err
+}
+
+const getCustomerBillingSettings = `-- name: GetCustomerBillingSettings :one
+SELECT billing_timezone, billing_anchor_day
+FROM customers
+WHERE id = $1
+`
+
+type GetCustomerBillingSettingsRow struct {
+	BillingTimezone  string `json:"billing_timezone"`
+	BillingAnchorDay int16  `json:"billing_anchor_day"`
+}
+
+func (q *Queries) GetCustomerBillingSettings(ctx context.Context, id int64) (GetCustomerBillingSettingsRow, error) {
+	row := q.db.QueryRowContext(ctx, getCustomerBillingSettings, id)
+	var i GetCustomerBillingSettingsRow
+	err := row.Scan(&i.BillingTimezone, &i.BillingAnchorDay)
+	return i, err
+}
+
+const updateCustomerBillingSettings = `-- name: UpdateCustomerBillingSettings :one
+UPDATE customers
+SET billing_timezone = $2,
+    billing_anchor_day = $3
+WHERE id = $1
+RETURNING id, name, created_at, billing_timezone, billing_anchor_day, external_customer_id
+`
+
+type UpdateCustomerBillingSettingsParams struct {
+	ID               int64  `json:"id"`
+	BillingTimezone  string `json:"billing_timezone"`
+	BillingAnchorDay int16  `json:"billing_anchor_day"`
+}
+
+func (q *Queries) UpdateCustomerBillingSettings(ctx context.Context, arg UpdateCustomerBillingSettingsParams) (Customer, error) {
+	row := q.db.QueryRowContext(ctx, updateCustomerBillingSettings, arg.ID, arg.BillingTimezone, arg.BillingAnchorDay)
+	var i Customer
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.CreatedAt,
+		&i.BillingTimezone,
+		&i.BillingAnchorDay,
+		&i.ExternalCustomerID,
+	)
+	return i, err
+}
+
+const getInvoiceForPeriod = `-- name: GetInvoiceForPeriod :one
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE customer_id = $1
+  AND period_start = $2
+  AND currency = $3
+  AND status <> 'void'
+ORDER BY id DESC
+LIMIT 1
+FOR UPDATE
+`
+
+type GetInvoiceForPeriodParams struct {
+	CustomerID  int64     `json:"customer_id"`
+	PeriodStart time.Time `json:"period_start"`
+	Currency    string    `json:"currency"`
+}
+
+// The newest invoice that is not void for a customer's billing period in a currency.
+func (q *Queries) GetInvoiceForPeriod(ctx context.Context, arg GetInvoiceForPeriodParams) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, getInvoiceForPeriod, arg.CustomerID, arg.PeriodStart, arg.Currency)
+	var i Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.SubtotalCents,
+		&i.DiscountCents,
+		&i.TotalCents,
+		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
+	)
+	return i, err
+}
+
+const setInvoiceAmounts = `-- name: SetInvoiceAmounts :execrows
+UPDATE invoices
+SET subtotal_micros = $2,
+    discount_micros = $3,
+    subtotal_cents = $4,
+    discount_cents = $5,
+    total_cents = $6
+WHERE id = $1
+  AND status = 'draft'
+`
+
+type SetInvoiceAmountsParams struct {
+	ID             int64 `json:"id"`
+	SubtotalMicros int64 `json:"subtotal_micros"`
+	DiscountMicros int64 `json:"discount_micros"`
+	SubtotalCents  int64 `json:"subtotal_cents"`
+	DiscountCents  int64 `json:"discount_cents"`
+	TotalCents     int64 `json:"total_cents"`
+}
+
+// Exact amounts in micros alongside the rounded cents shown on the invoice.
+func (q *Queries) SetInvoiceAmounts(ctx context.Context, arg SetInvoiceAmountsParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, setInvoiceAmounts,
+		arg.ID,
+		arg.SubtotalMicros,
+		arg.DiscountMicros,
+		arg.SubtotalCents,
+		arg.DiscountCents,
+		arg.TotalCents,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const updateInvoiceLineItemCents = `-- name: UpdateInvoiceLineItemCents :exec
+UPDATE invoice_line_items
+SET amount_cents = $2,
+    discount_cents = $3
+WHERE id = $1
+`
+
+type UpdateInvoiceLineItemCentsParams struct {
+	ID            int64 `json:"id"`
+	AmountCents   int64 `json:"amount_cents"`
+	DiscountCents int64 `json:"discount_cents"`
+}
+
+func (q *Queries) UpdateInvoiceLineItemCents(ctx context.Context, arg UpdateInvoiceLineItemCentsParams) error {
+	_, err := q.db.ExecContext(ctx, updateInvoiceLineItemCents, arg.ID, arg.AmountCents, arg.DiscountCents)
+	return err
+}
+
+const listDueDraftInvoices = `-- name: ListDueDraftInvoices :many
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE status = 'draft'
+  AND period_end <= $1
+ORDER BY id
+FOR UPDATE SKIP LOCKED
+`
+
+func (q *Queries) ListDueDraftInvoices(ctx context.Context, periodEnd time.Time) ([]Invoice, error) {
+	rows, err := q.db.QueryContext(ctx, listDueDraftInvoices, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []Invoice{}
+	for rows.Next() {
+		var i Invoice
+		if err := rows.Scan(
+			&i.ID,
+			&i.CustomerID,
+			&i.PeriodStart,
+			&i.PeriodEnd,
+			&i.SubtotalCents,
+			&i.DiscountCents,
+			&i.TotalCents,
+			&i.CreatedAt,
+			&i.Status,
+			&i.FinalizedAt,
+			&i.PaidAt,
+			&i.ExportStatus,
+			&i.ExternalID,
+			&i.ExportAttempts,
+			&i.ExportError,
+			&i.ExportNextAttemptAt,
+			&i.ExportedAt,
+			&i.Currency,
+			&i.SubtotalMicros,
+			&i.DiscountMicros,
+			&i.ReplacesInvoiceID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const finalizeInvoice = `-- name: FinalizeInvoice :one
+UPDATE invoices
+SET status = 'finalized',
+    finalized_at = NOW()
+WHERE id = $1
+  AND status = 'draft'
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+`
+
+func (q *Queries) FinalizeInvoice(ctx context.Context, id int64) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, finalizeInvoice, id)
+	var i Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.SubtotalCents,
+		&i.DiscountCents,
+		&i.TotalCents,
+		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
+	)
+	return i, err
+}
+
+const markInvoicePaid = `-- name: MarkInvoicePaid :one
+UPDATE invoices
+SET status = 'paid',
+    paid_at = NOW()
+WHERE id = $1
+  AND status = 'finalized'
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+`
+
+func (q *Queries) MarkInvoicePaid(ctx context.Context, id int64) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, markInvoicePaid, id)
+	var i Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.SubtotalCents,
+		&i.DiscountCents,
+		&i.TotalCents,
+		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
+	)
+	return i, err
+}
+
+const getInvoice = `-- name: GetInvoice :one
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE id = $1
+`
+
+func (q *Queries) GetInvoice(ctx context.Context, id int64) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, getInvoice, id)
+	var i Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.SubtotalCents,
+		&i.DiscountCents,
+		&i.TotalCents,
+		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
+	)
+	return i, err
+}
+
+const listInvoicesForCustomer = `-- name: ListInvoicesForCustomer :many
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE customer_id = $1
+  AND id < $2
+  AND ($3::TIMESTAMPTZ IS NULL OR period_end > $3)
+  AND ($4::TIMESTAMPTZ IS NULL OR period_start < $4)
+ORDER BY id DESC
+LIMIT $5
+`
+
+type ListInvoicesForCustomerParams struct {
+	CustomerID int64        `json:"customer_id"`
+	BeforeID   int64        `json:"before_id"`
+	PeriodFrom sql.NullTime `json:"period_from"`
+	PeriodTo   sql.NullTime `json:"period_to"`
+	RowLimit   int32        `json:"row_limit"`
+}
+
+// Newest first, paging backwards by ID. Invoices are kept when their period overlaps
+// [from, to); either bound may be NULL.
+func (q *Queries) ListInvoicesForCustomer(ctx context.Context, arg ListInvoicesForCustomerParams) ([]Invoice, error) {
+	rows, err := q.db.QueryContext(ctx, listInvoicesForCustomer,
+		arg.CustomerID,
+		arg.BeforeID,
+		arg.PeriodFrom,
+		arg.PeriodTo,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []Invoice{}
+	for rows.Next() {
+		var i Invoice
+		if err := rows.Scan(
+			&i.ID,
+			&i.CustomerID,
+			&i.PeriodStart,
+			&i.PeriodEnd,
+			&i.SubtotalCents,
+			&i.DiscountCents,
+			&i.TotalCents,
+			&i.CreatedAt,
+			&i.Status,
+			&i.FinalizedAt,
+			&i.PaidAt,
+			&i.ExportStatus,
+			&i.ExternalID,
+			&i.ExportAttempts,
+			&i.ExportError,
+			&i.ExportNextAttemptAt,
+			&i.ExportedAt,
+			&i.Currency,
+			&i.SubtotalMicros,
+			&i.DiscountMicros,
+			&i.ReplacesInvoiceID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getInvoiceForCustomer = `-- name: GetInvoiceForCustomer :one
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE id = $1
+  AND customer_id = $2
+`
+
+type GetInvoiceForCustomerParams struct {
+	ID         int64 `json:"id"`
+	CustomerID int64 `json:"customer_id"`
+}
+
+func (q *Queries) GetInvoiceForCustomer(ctx context.Context, arg GetInvoiceForCustomerParams) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, getInvoiceForCustomer, arg.ID, arg.CustomerID)
+	var i Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.SubtotalCents,
+		&i.DiscountCents,
+		&i.TotalCents,
+		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
+	)
+	return i, err
+}
+
+const listInvoiceLineItems = `-- name: ListInvoiceLineItems :many
+SELECT id, invoice_id, service_id, window_start, window_end, primary_bytes, backup_bytes, coverage_factor, amount_cents, discount_cents, created_at, kind, adjusts_invoice_id, primary_requests, backup_requests, amount_micros, discount_micros, storm_breakdown, pricing
+FROM invoice_line_items
+WHERE invoice_id = $1
+ORDER BY id
+`
+
+func (q *Queries) ListInvoiceLineItems(ctx context.Context, invoiceID int64) ([]InvoiceLineItem, error) {
+	rows, err := q.db.QueryContext(ctx, listInvoiceLineItems, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []InvoiceLineItem{}
+	for rows.Next() {
+		var i InvoiceLineItem
+		if err := rows.Scan(
+			&i.ID,
+			&i.InvoiceID,
+			&i.ServiceID,
+			&i.WindowStart,
+			&i.WindowEnd,
+			&i.PrimaryBytes,
+			&i.BackupBytes,
+			&i.CoverageFactor,
+			&i.AmountCents,
+			&i.DiscountCents,
+			&i.CreatedAt,
+			&i.Kind,
+			&i.AdjustsInvoiceID,
+			&i.PrimaryRequests,
+			&i.BackupRequests,
+			&i.AmountMicros,
+			&i.DiscountMicros,
+			&i.StormBreakdown,
+			&i.Pricing,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listServiceUsage = `-- name: ListServiceUsage :many
+SELECT (date_trunc($1::TEXT, us.window_start AT TIME ZONE 'UTC') AT TIME ZONE 'UTC')::TIMESTAMPTZ AS bucket_start,
+       COALESCE(SUM(COALESCE(latest.primary_bytes, us.primary_bytes)), 0)::BIGINT AS primary_bytes,
+       COALESCE(SUM(COALESCE(latest.backup_bytes, us.backup_bytes)), 0)::BIGINT AS backup_bytes,
+       COALESCE(SUM(COALESCE(latest.primary_requests, us.primary_requests)), 0)::BIGINT AS primary_requests,
+       COALESCE(SUM(COALESCE(latest.backup_requests, us.backup_requests)), 0)::BIGINT AS backup_requests,
+       COUNT(*)::BIGINT AS windows
+FROM usage_snapshots us
+LEFT JOIN LATERAL (
+    SELECT ur.primary_bytes, ur.backup_bytes, ur.primary_requests, ur.backup_requests
+    FROM usage_revisions ur
+    WHERE ur.snapshot_id = us.id
+    ORDER BY ur.id DESC
+    LIMIT 1
+) latest ON TRUE
+WHERE us.service_id = $2
+  AND us.window_start >= $3
+  AND us.window_start < $4
+GROUP BY 1
+ORDER BY 1
+LIMIT $5
+`
+
+type ListServiceUsageParams struct {
+	Granularity string    `json:"granularity"`
+	ServiceID   int64     `json:"service_id"`
+	WindowFrom  time.Time `json:"window_from"`
+	WindowTo    time.Time `json:"window_to"`
+	RowLimit    int32     `json:"row_limit"`
+}
+
+type ListServiceUsageRow struct {
+	BucketStart     time.Time `json:"bucket_start"`
+	PrimaryBytes    int64     `json:"primary_bytes"`
+	BackupBytes     int64     `json:"backup_bytes"`
+	PrimaryRequests int64     `json:"primary_requests"`
+	BackupRequests  int64     `json:"backup_requests"`
+	Windows         int64     `json:"windows"`
+}
+
+// Usage per UTC hour, day or month by window start, counting the latest revision of
+// windows that changed after they were invoiced.
+func (q *Queries) ListServiceUsage(ctx context.Context, arg ListServiceUsageParams) ([]ListServiceUsageRow, error) {
+	rows, err := q.db.QueryContext(ctx, listServiceUsage,
+		arg.Granularity,
+		arg.ServiceID,
+		arg.WindowFrom,
+		arg.WindowTo,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListServiceUsageRow{}
+	for rows.Next() {
+		var i ListServiceUsageRow
+		if err := rows.Scan(
+			&i.BucketStart,
+			&i.PrimaryBytes,
+			&i.BackupBytes,
+			&i.PrimaryRequests,
+			&i.BackupRequests,
+			&i.Windows,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listStormEventsForService = `-- name: ListStormEventsForService :many
+SELECT id, service_id, kind, started_at, ended_at
+FROM storm_events
+WHERE service_id = $1
+  AND id < $2
+  AND ($3::TIMESTAMPTZ IS NULL OR ended_at IS NULL OR ended_at > $3)
+  AND ($4::TIMESTAMPTZ IS NULL OR started_at < $4)
+ORDER BY id DESC
+LIMIT $5
+`
+
+type ListStormEventsForServiceParams struct {
+	ServiceID int64        `json:"service_id"`
+	BeforeID  int64        `json:"before_id"`
+	StormFrom sql.NullTime `json:"storm_from"`
+	StormTo   sql.NullTime `json:"storm_to"`
+	RowLimit  int32        `json:"row_limit"`
+}
+
+// Newest first, paging backwards by ID. Storms are kept when they overlap [from, to);
+// either bound may be NULL.
+func (q *Queries) ListStormEventsForService(ctx context.Context, arg ListStormEventsForServiceParams) ([]StormEvent, error) {
+	rows, err := q.db.QueryContext(ctx, listStormEventsForService,
+		arg.ServiceID,
+		arg.BeforeID,
+		arg.StormFrom,
+		arg.StormTo,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []StormEvent{}
+	for rows.Next() {
+		var i StormEvent
+		if err := rows.Scan(
+			&i.ID,
+			&i.ServiceID,
+			&i.Kind,
+			&i.StartedAt,
+			&i.EndedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getCustomer = `-- name: GetCustomer :one
+SELECT id, name, created_at, billing_timezone, billing_anchor_day, external_customer_id
+FROM customers
+WHERE id = $1
+`
+
+func (q *Queries) GetCustomer(ctx context.Context, id int64) (Customer, error) {
+	row := q.db.QueryRowContext(ctx, getCustomer, id)
+	var i Customer
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.CreatedAt,
+		&i.BillingTimezone,
+		&i.BillingAnchorDay,
+		&i.ExternalCustomerID,
+	)
+	return i, err
+}
+
+const listInvoiceServices = `-- name: ListInvoiceServices :many
+SELECT s.id, s.name
+FROM services s
+WHERE s.id IN (SELECT li.service_id FROM invoice_line_items li WHERE li.invoice_id = $1)
+ORDER BY s.id
+`
+
+type ListInvoiceServicesRow struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// Services billed on an invoice, including deleted ones.
+func (q *Queries) ListInvoiceServices(ctx context.Context, invoiceID int64) ([]ListInvoiceServicesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listInvoiceServices, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListInvoiceServicesRow{}
+	for rows.Next() {
+		var i ListInvoiceServicesRow
+		if err := rows.Scan(&i.ID, &i.Name); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertSLADefinition = `-- name: InsertSLADefinition :one
+INSERT INTO sla_definitions (name, tiers)
+VALUES ($1, $2)
+RETURNING id, name, tiers, created_at, updated_at
+`
+
+type InsertSLADefinitionParams struct {
+	Name  string   `json:"name"`
+	Tiers SLATiers `json:"tiers"`
+}
+
+func (q *Queries) InsertSLADefinition(ctx context.Context, arg InsertSLADefinitionParams) (SlaDefinition, error) {
+	row := q.db.QueryRowContext(ctx, insertSLADefinition, arg.Name, arg.Tiers)
+	var i SlaDefinition
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Tiers,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const listSLADefinitions = `-- name: ListSLADefinitions :many
+SELECT id, name, tiers, created_at, updated_at FROM sla_definitions
+ORDER BY id
+`
+
+func (q *Queries) ListSLADefinitions(ctx context.Context) ([]SlaDefinition, error) {
+	rows, err := q.db.QueryContext(ctx, listSLADefinitions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []SlaDefinition{}
+	for rows.Next() {
+		var i SlaDefinition
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Tiers,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSLADefinition = `-- name: GetSLADefinition :one
+SELECT id, name, tiers, created_at, updated_at FROM sla_definitions
+WHERE id = $1
+`
+
+func (q *Queries) GetSLADefinition(ctx context.Context, id int64) (SlaDefinition, error) {
+	row := q.db.QueryRowContext(ctx, getSLADefinition, id)
+	var i SlaDefinition
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Tiers,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const updateSLADefinition = `-- name: UpdateSLADefinition :one
+UPDATE sla_definitions
+SET name = $2,
+    tiers = $3,
+    updated_at = NOW()
+WHERE id = $1
+RETURNING id, name, tiers, created_at, updated_at
+`
+
+type UpdateSLADefinitionParams struct {
+	ID    int64    `json:"id"`
+	Name  string   `json:"name"`
+	Tiers SLATiers `json:"tiers"`
+}
+
+func (q *Queries) UpdateSLADefinition(ctx context.Context, arg UpdateSLADefinitionParams) (SlaDefinition, error) {
+	row := q.db.QueryRowContext(ctx, updateSLADefinition, arg.ID, arg.Name, arg.Tiers)
+	var i SlaDefinition
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Tiers,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const getCustomerPlanAt = `-- name: GetCustomerPlanAt :one
+SELECT pp.id, pp.name, pp.primary_rate_cents_per_gb, pp.backup_rate_cents_per_gb, pp.tiers, pp.minimum_monthly_cents, pp.storm_discount_rate, pp.created_at, pp.updated_at, pp.sla_definition_id, pp.currency
+FROM customer_plans cp
+JOIN pricing_plans pp ON pp.id = cp.plan_id
+WHERE cp.customer_id = $1
+  AND cp.effective_from <= $2
+ORDER BY cp.effective_from DESC
+LIMIT 1
+`
+
+type GetCustomerPlanAtParams struct {
+	CustomerID    int64     `json:"customer_id"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
+
+// The pricing plan assigned to a customer at a point in time.
+func (q *Queries) GetCustomerPlanAt(ctx context.Context, arg GetCustomerPlanAtParams) (PricingPlan, error) {
+	row := q.db.QueryRowContext(ctx, getCustomerPlanAt, arg.CustomerID, arg.EffectiveFrom)
+	var i PricingPlan
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.PrimaryRateCentsPerGb,
+		&i.BackupRateCentsPerGb,
+		&i.Tiers,
+		&i.MinimumMonthlyCents,
+		&i.StormDiscountRate,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.SlaDefinitionID,
+		&i.Currency,
+	)
+	return i, err
+}
+
+const getServiceDowntime = `-- name: GetServiceDowntime :one
+WITH probed AS (
+    SELECT date_trunc('minute', probed_at) AS minute,
+           COUNT(*) FILTER (WHERE NOT ok) * 2 > COUNT(*) AS down
+    FROM probe_samples
+    WHERE service_id = $1
+      AND probed_at >= $2::TIMESTAMPTZ
+      AND probed_at < $3::TIMESTAMPTZ
+      AND strpos(metrics_key, '@') = 0
+    GROUP BY 1
+),
+storm_minutes AS (
+    SELECT DISTINCT m AS minute
+    FROM storm_events se,
+         generate_series(
+             date_trunc('minute', GREATEST(se.started_at, $2::TIMESTAMPTZ)),
+             LEAST(COALESCE(se.ended_at, $3::TIMESTAMPTZ), $3::TIMESTAMPTZ) - INTERVAL '1 microsecond',
+             INTERVAL '1 minute'
+         ) AS m
+    WHERE se.service_id = $1
+      AND se.started_at < $3::TIMESTAMPTZ
+      AND (se.ended_at IS NULL OR se.ended_at > $2::TIMESTAMPTZ)
+)
+SELECT
+    (SELECT COUNT(*) FROM probed WHERE down)::BIGINT AS down_minutes,
+    (SELECT COUNT(*) FROM storm_minutes sm
+     WHERE NOT EXISTS (SELECT 1 FROM probed p WHERE p.minute = sm.minute))::BIGINT AS unprobed_storm_minutes
+`
+
+type GetServiceDowntimeParams struct {
+	ServiceID   int64     `json:"service_id"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+}
+
+type GetServiceDowntimeRow struct {
+	DownMinutes          int64 `json:"down_minutes"`
+	UnprobedStormMinutes int64 `json:"unprobed_storm_minutes"`
+}
+
+// Minutes of [period_start, period_end) in which most direct domain probes failed, and
+// minutes inside a storm that have no probe samples at all.
+func (q *Queries) GetServiceDowntime(ctx context.Context, arg GetServiceDowntimeParams) (GetServiceDowntimeRow, error) {
+	row := q.db.QueryRowContext(ctx, getServiceDowntime, arg.ServiceID, arg.PeriodStart, arg.PeriodEnd)
+	var i GetServiceDowntimeRow
+	err := row.Scan(&i.DownMinutes, &i.UnprobedStormMinutes)
+	return i, err
+}
+
+const listInvoiceServiceCharges = `-- name: ListInvoiceServiceCharges :many
+SELECT li.service_id::BIGINT AS service_id,
+       s.created_at AS service_created_at,
+       COALESCE(SUM(li.amount_micros - li.discount_micros), 0)::BIGINT AS net_micros
+FROM invoice_line_items li
+JOIN services s ON s.id = li.service_id
+WHERE li.invoice_id = $1
+  AND li.kind IN ('usage', 'adjustment')
+GROUP BY li.service_id, s.created_at
+ORDER BY li.service_id
+`
+
+type ListInvoiceServiceChargesRow struct {
+	ServiceID        int64     `json:"service_id"`
+	ServiceCreatedAt time.Time `json:"service_created_at"`
+	NetMicros        int64     `json:"net_micros"`
+}
+
+// Each service's net usage charges on an invoice, adjustments included.
+func (q *Queries) ListInvoiceServiceCharges(ctx context.Context, invoiceID int64) ([]ListInvoiceServiceChargesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listInvoiceServiceCharges, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListInvoiceServiceChargesRow{}
+	for rows.Next() {
+		var i ListInvoiceServiceChargesRow
+		if err := rows.Scan(
+			&i.ServiceID,
+			&i.ServiceCreatedAt,
+			&i.NetMicros,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertSLAResult = `-- name: InsertSLAResult :one
+INSERT INTO sla_results (
+    invoice_id,
+    service_id,
+    sla_definition_id,
+    period_start,
+    period_end,
+    availability_percent,
+    down_minutes,
+    total_minutes,
+    credit_percent,
+    credit_cents
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING id, invoice_id, service_id, sla_definition_id, period_start, period_end, availability_percent, down_minutes, total_minutes, credit_percent, credit_cents, created_at
+`
+
+type InsertSLAResultParams struct {
+	InvoiceID           int64     `json:"invoice_id"`
+	ServiceID           int64     `json:"service_id"`
+	SlaDefinitionID     int64     `json:"sla_definition_id"`
+	PeriodStart         time.Time `json:"period_start"`
+	PeriodEnd           time.Time `json:"period_end"`
+	AvailabilityPercent float64   `json:"availability_percent"`
+	DownMinutes         int64     `json:"down_minutes"`
+	TotalMinutes        int64     `json:"total_minutes"`
+	CreditPercent       float64   `json:"credit_percent"`
+	CreditCents         int64     `json:"credit_cents"`
+}
+
+func (q *Queries) InsertSLAResult(ctx context.Context, arg InsertSLAResultParams) (SlaResult, error) {
+	row := q.db.QueryRowContext(ctx, insertSLAResult,
+		arg.InvoiceID,
+		arg.ServiceID,
+		arg.SlaDefinitionID,
+		arg.PeriodStart,
+		arg.PeriodEnd,
+		arg.AvailabilityPercent,
+		arg.DownMinutes,
+		arg.TotalMinutes,
+		arg.CreditPercent,
+		arg.CreditCents,
+	)
+	var i SlaResult
+	err := row.Scan(
+		&i.ID,
+		&i.InvoiceID,
+		&i.ServiceID,
+		&i.SlaDefinitionID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.AvailabilityPercent,
+		&i.DownMinutes,
+		&i.TotalMinutes,
+		&i.CreditPercent,
+		&i.CreditCents,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const listSLAResultsForService = `-- name: ListSLAResultsForService :many
+SELECT id, invoice_id, service_id, sla_definition_id, period_start, period_end, availability_percent, down_minutes, total_minutes, credit_percent, credit_cents, created_at FROM sla_results
+WHERE service_id = $1
+ORDER BY period_start DESC
+LIMIT $2
+`
+
+type ListSLAResultsForServiceParams struct {
+	ServiceID int64 `json:"service_id"`
+	Limit     int32 `json:"limit"`
+}
+
+func (q *Queries) ListSLAResultsForService(ctx context.Context, arg ListSLAResultsForServiceParams) ([]SlaResult, error) {
+	rows, err := q.db.QueryContext(ctx, listSLAResultsForService, arg.ServiceID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []SlaResult{}
+	for rows.Next() {
+		var i SlaResult
+		if err := rows.Scan(
+			&i.ID,
+			&i.InvoiceID,
+			&i.ServiceID,
+			&i.SlaDefinitionID,
+			&i.PeriodStart,
+			&i.PeriodEnd,
+			&i.AvailabilityPercent,
+			&i.DownMinutes,
+			&i.TotalMinutes,
+			&i.CreditPercent,
+			&i.CreditCents,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listInvoicesDueForExport = `-- name: ListInvoicesDueForExport :many
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE export_status = 'pending'
+  AND (status IN ('finalized', 'paid') OR (status = 'void' AND finalized_at IS NOT NULL))
+  AND (export_next_attempt_at IS NULL OR export_next_attempt_at <= $1)
+  AND NOT EXISTS (
+      SELECT 1
+      FROM invoices replaced
+      WHERE replaced.id = invoices.replaces_invoice_id
+        AND replaced.finalized_at IS NOT NULL
+        AND replaced.export_status IN ('pending', 'failed')
+  )
+ORDER BY export_next_attempt_at NULLS FIRST, id
+LIMIT $2
+`
+
+type ListInvoicesDueForExportParams struct {
+	ExportNextAttemptAt sql.NullTime `json:"export_next_attempt_at"`
+	Limit               int32        `json:"limit"`
+}
+
+// Finalized or paid invoices waiting to be pushed to the payment processor, and voided
+// finalized invoices waiting to be voided there, oldest first. A replacement waits until
+// the invoice it replaces has been voided at the processor.
+func (q *Queries) ListInvoicesDueForExport(ctx context.Context, arg ListInvoicesDueForExportParams) ([]Invoice, error) {
+	rows, err := q.db.QueryContext(ctx, listInvoicesDueForExport, arg.ExportNextAttemptAt, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []Invoice{}
+	for rows.Next() {
+		var i Invoice
+		if err := rows.Scan(
+			&i.ID,
+			&i.CustomerID,
+			&i.PeriodStart,
+			&i.PeriodEnd,
+			&i.SubtotalCents,
+			&i.DiscountCents,
+			&i.TotalCents,
+			&i.CreatedAt,
+			&i.Status,
+			&i.FinalizedAt,
+			&i.PaidAt,
+			&i.ExportStatus,
+			&i.ExternalID,
+			&i.ExportAttempts,
+			&i.ExportError,
+			&i.ExportNextAttemptAt,
+			&i.ExportedAt,
+			&i.Currency,
+			&i.SubtotalMicros,
+			&i.DiscountMicros,
+			&i.ReplacesInvoiceID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const claimInvoiceExport = `-- name: ClaimInvoiceExport :execrows
+UPDATE invoices
+SET export_next_attempt_at = $1
+WHERE id = $2
+  AND export_status = 'pending'
+  AND (export_next_attempt_at IS NULL OR export_next_attempt_at <= $3)
+`
+
+type ClaimInvoiceExportParams struct {
+	LeaseUntil sql.NullTime `json:"lease_until"`
+	ID         int64        `json:"id"`
+	Now        sql.NullTime `json:"now"`
+}
+
+// Pushes the invoice's next attempt out to lease_until so concurrent workers skip it.
+func (q *Queries) ClaimInvoiceExport(ctx context.Context, arg ClaimInvoiceExportParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, claimInvoiceExport, arg.LeaseUntil, arg.ID, arg.Now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const setInvoiceExternalID = `-- name: SetInvoiceExternalID :exec
+UPDATE invoices
+SET external_id = $2
+WHERE id = $1
+`
+
+type SetInvoiceExternalIDParams struct {
+	ID         int64          `json:"id"`
+	ExternalID sql.NullString `json:"external_id"`
+}
+
+func (q *Queries) SetInvoiceExternalID(ctx context.Context, arg SetInvoiceExternalIDParams) error {
+	_, err := q.db.ExecContext(ctx, setInvoiceExternalID, arg.ID, arg.ExternalID)
+	return err
+}
+
+const setCustomerExternalID = `-- name: SetCustomerExternalID :exec
+UPDATE customers
+SET external_customer_id = $2
+WHERE id = $1
+`
+
+type SetCustomerExternalIDParams struct {
+	ID                 int64          `json:"id"`
+	ExternalCustomerID sql.NullString `json:"external_customer_id"`
+}
+
+func (q *Queries) SetCustomerExternalID(ctx context.Context, arg SetCustomerExternalIDParams) error {
+	_, err := q.db.ExecContext(ctx, setCustomerExternalID, arg.ID, arg.ExternalCustomerID)
+	return err
+}
+
+const insertInvoiceLineItemExport = `-- name: InsertInvoiceLineItemExport :exec
+INSERT INTO invoice_line_item_exports (line_item_id, invoice_id, external_id)
+VALUES ($1, $2, $3)
+ON CONFLICT (line_item_id) DO NOTHING
+`
+
+type InsertInvoiceLineItemExportParams struct {
+	LineItemID int64  `json:"line_item_id"`
+	InvoiceID  int64  `json:"invoice_id"`
+	ExternalID string `json:"external_id"`
+}
+
+func (q *Queries) InsertInvoiceLineItemExport(ctx context.Context, arg InsertInvoiceLineItemExportParams) error {
+	_, err := q.db.ExecContext(ctx, insertInvoiceLineItemExport, arg.LineItemID, arg.InvoiceID, arg.ExternalID)
+	return err
+}
+
+const listInvoiceLineItemExports = `-- name: ListInvoiceLineItemExports :many
+SELECT line_item_id, invoice_id, external_id, created_at
+FROM invoice_line_item_exports
+WHERE invoice_id = $1
+ORDER BY line_item_id
+`
+
+func (q *Queries) ListInvoiceLineItemExports(ctx context.Context, invoiceID int64) ([]InvoiceLineItemExport, error) {
+	rows, err := q.db.QueryContext(ctx, listInvoiceLineItemExports, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []InvoiceLineItemExport{}
+	for rows.Next() {
+		var i InvoiceLineItemExport
+		if err := rows.Scan(
+			&i.LineItemID,
+			&i.InvoiceID,
+			&i.ExternalID,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const markInvoiceExported = `-- name: MarkInvoiceExported :one
+UPDATE invoices
+SET export_status = 'synced',
+    export_attempts = export_attempts + 1,
+    export_error = NULL,
+    export_next_attempt_at = NULL,
+    exported_at = NOW()
+WHERE id = $1
+  AND status = $2
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+`
+
+type MarkInvoiceExportedParams struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+}
+
+// Records a successful attempt, unless the invoice's status changed while it ran: an invoice
+// voided during its export stays pending so that it is voided at the processor next.
+func (q *Queries) MarkInvoiceExported(ctx context.Context, arg MarkInvoiceExportedParams) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, markInvoiceExported, arg.ID, arg.Status)
+	var i Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.SubtotalCents,
+		&i.DiscountCents,
+		&i.TotalCents,
+		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
+	)
+	return i, err
+}
+
+const markInvoiceExportFailed = `-- name: MarkInvoiceExportFailed :one
+UPDATE invoices
+SET export_status = $2,
+    export_attempts = export_attempts + 1,
+    export_error = $3,
+    export_next_attempt_at = $4
+WHERE id = $1
+  AND status = $5
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+`
+
+type MarkInvoiceExportFailedParams struct {
+	ID                  int64          `json:"id"`
+	ExportStatus        string         `json:"export_status"`
+	ExportError         sql.NullString `json:"export_error"`
+	ExportNextAttemptAt sql.NullTime   `json:"export_next_attempt_at"`
+	Status              string         `json:"status"`
+}
+
+// Records a failed attempt. The invoice stays pending and is retried at next_attempt_at,
+// unless export_status is 'failed'. Like MarkInvoiceExported, it leaves an invoice whose
+// status changed during the attempt alone.
+func (q *Queries) MarkInvoiceExportFailed(ctx context.Context, arg MarkInvoiceExportFailedParams) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, markInvoiceExportFailed,
+		arg.ID,
+		arg.ExportStatus,
+		arg.ExportError,
+		arg.ExportNextAttemptAt,
+		arg.Status,
+	)
+	var i Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.SubtotalCents,
+		&i.DiscountCents,
+		&i.TotalCents,
+		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
+	)
+	return i, err
+}
+
+const requeueInvoiceExport = `-- name: RequeueInvoiceExport :one
+UPDATE invoices
+SET export_status = 'pending',
+    export_attempts = 0,
+    export_error = NULL,
+    export_next_attempt_at = NULL
+WHERE id = $1
+  AND export_status IN ('failed', 'skipped')
+  AND (status IN ('finalized', 'paid') OR (status = 'void' AND finalized_at IS NOT NULL))
+RETURNING id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+`
+
+// Queues a failed or skipped invoice for another round of export attempts.
+func (q *Queries) RequeueInvoiceExport(ctx context.Context, id int64) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, requeueInvoiceExport, id)
+	var i Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.SubtotalCents,
+		&i.DiscountCents,
+		&i.TotalCents,
+		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
+	)
+	return i, err
+}
+
+const listUnbilledUsageSnapshotsForCustomer = `-- name: ListUnbilledUsageSnapshotsForCustomer :many
+SELECT
+    us.id,
+    us.service_id,
+    s.customer_id,
+    us.window_start,
+    us.window_end,
+    us.primary_bytes,
+    us.backup_bytes,
+    us.primary_requests,
+    us.backup_requests,
+    us.regions
+FROM usage_snapshots us
+JOIN services s ON s.id = us.service_id
+WHERE s.customer_id = $1
+  AND us.invoice_id IS NULL
+  AND us.window_end <= $2
+ORDER BY us.window_start
+`
+
+type ListUnbilledUsageSnapshotsForCustomerParams struct {
+	CustomerID int64     `json:"customer_id"`
+	WindowEnd  time.Time `json:"window_end"`
+}
+
+type ListUnbilledUsageSnapshotsForCustomerRow struct {
+	ID              int64        `json:"id"`
+	ServiceID       int64        `json:"service_id"`
+	CustomerID      int64        `json:"customer_id"`
+	WindowStart     time.Time    `json:"window_start"`
+	WindowEnd       time.Time    `json:"window_end"`
+	PrimaryBytes    int64        `json:"primary_bytes"`
+	BackupBytes     int64        `json:"backup_bytes"`
+	PrimaryRequests int64        `json:"primary_requests"`
+	BackupRequests  int64        `json:"backup_requests"`
+	Regions         UsageRegions `json:"regions"`
+}
+
+// LockUnbilledUsageSnapshots for one customer, without locking, for billing previews.
+func (q *Queries) ListUnbilledUsageSnapshotsForCustomer(ctx context.Context, arg ListUnbilledUsageSnapshotsForCustomerParams) ([]ListUnbilledUsageSnapshotsForCustomerRow, error) {
+	rows, err := q.db.QueryContext(ctx, listUnbilledUsageSnapshotsForCustomer, arg.CustomerID, arg.WindowEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListUnbilledUsageSnapshotsForCustomerRow{}
+	for rows.Next() {
+		var i ListUnbilledUsageSnapshotsForCustomerRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.ServiceID,
+			&i.CustomerID,
+			&i.WindowStart,
+			&i.WindowEnd,
+			&i.PrimaryBytes,
+			&i.BackupBytes,
+			&i.PrimaryRequests,
+			&i.BackupRequests,
+			&i.Regions,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listUnsettledUsageRevisionsForCustomer = `-- name: ListUnsettledUsageRevisionsForCustomer :many
+SELECT
+    ur.id,
+    ur.snapshot_id,
+    us.service_id,
+    s.customer_id,
+    us.window_start,
+    us.window_end,
+    ur.primary_bytes,
+    ur.backup_bytes,
+    ur.primary_requests,
+    ur.backup_requests,
+    ur.regions,
+    us.invoice_id
+FROM usage_revisions ur
+JOIN usage_snapshots us ON us.id = ur.snapshot_id
+JOIN services s ON s.id = us.service_id
+WHERE s.customer_id = $1
+  AND ur.settled_at IS NULL
+ORDER BY ur.snapshot_id, ur.id
+`
+
+type ListUnsettledUsageRevisionsForCustomerRow struct {
+	ID              int64         `json:"id"`
+	SnapshotID      int64         `json:"snapshot_id"`
+	ServiceID       int64         `json:"service_id"`
+	CustomerID      int64         `json:"customer_id"`
+	WindowStart     time.Time     `json:"window_start"`
+	WindowEnd       time.Time     `json:"window_end"`
+	PrimaryBytes    int64         `json:"primary_bytes"`
+	BackupBytes     int64         `json:"backup_bytes"`
+	PrimaryRequests int64         `json:"primary_requests"`
+	BackupRequests  int64         `json:"backup_requests"`
+	Regions         UsageRegions  `json:"regions"`
+	InvoiceID       sql.NullInt64 `json:"invoice_id"`
+}
+
+// LockUnsettledUsageRevisions for one customer, without locking, for billing previews.
+func (q *Queries) ListUnsettledUsageRevisionsForCustomer(ctx context.Context, customerID int64) ([]ListUnsettledUsageRevisionsForCustomerRow, error) {
+	rows, err := q.db.QueryContext(ctx, listUnsettledUsageRevisionsForCustomer, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListUnsettledUsageRevisionsForCustomerRow{}
+	for rows.Next() {
+		var i ListUnsettledUsageRevisionsForCustomerRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.SnapshotID,
+			&i.ServiceID,
+			&i.CustomerID,
+			&i.WindowStart,
+			&i.WindowEnd,
+			&i.PrimaryBytes,
+			&i.BackupBytes,
+			&i.PrimaryRequests,
+			&i.BackupRequests,
+			&i.Regions,
+			&i.InvoiceID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getInvoiceForPeriodNoLock = `-- name: GetInvoiceForPeriodNoLock :one
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE customer_id = $1
+  AND period_start = $2
+  AND currency = $3
+  AND status <> 'void'
+ORDER BY id DESC
+LIMIT 1
+`
+
+type GetInvoiceForPeriodNoLockParams struct {
+	CustomerID  int64     `json:"customer_id"`
+	PeriodStart time.Time `json:"period_start"`
+	Currency    string    `json:"currency"`
+}
+
+// GetInvoiceForPeriod without the row lock, for billing previews.
+func (q *Queries) GetInvoiceForPeriodNoLock(ctx context.Context, arg GetInvoiceForPeriodNoLockParams) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, getInvoiceForPeriodNoLock, arg.CustomerID, arg.PeriodStart, arg.Currency)
+	var i Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.SubtotalCents,
+		&i.DiscountCents,
+		&i.TotalCents,
+		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
+	)
+	return i, err
+}
+
+const lockInvoice = `-- name: LockInvoice :one
+SELECT id, customer_id, period_start, period_end, subtotal_cents, discount_cents, total_cents, created_at, status, finalized_at, paid_at, export_status, external_id, export_attempts, export_error, export_next_attempt_at, exported_at, currency, subtotal_micros, discount_micros, replaces_invoice_id
+FROM invoices
+WHERE id = $1
+FOR UPDATE
+`
+
+func (q *Queries) LockInvoice(ctx context.Context, id int64) (Invoice, error) {
+	row := q.db.QueryRowContext(ctx, lockInvoice, id)
+	var i Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.CustomerID,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.SubtotalCents,
+		&i.DiscountCents,
+		&i.TotalCents,
+		&i.CreatedAt,
+		&i.Status,
+		&i.FinalizedAt,
+		&i.PaidAt,
+		&i.ExportStatus,
+		&i.ExternalID,
+		&i.ExportAttempts,
+		&i.ExportError,
+		&i.ExportNextAttemptAt,
+		&i.ExportedAt,
+		&i.Currency,
+		&i.SubtotalMicros,
+		&i.DiscountMicros,
+		&i.ReplacesInvoiceID,
+	)
+	return i, err
+}
+
+const voidInvoice = `-- name: VoidInvoice :execrows
+UPDATE invoices
+SET status = 'void'
+WHERE id = $1
+  AND status IN ('draft', 'finalized')
+`
+
+func (q *Queries) VoidInvoice(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, voidInvoice, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const queueInvoiceVoidExport = `-- name: QueueInvoiceVoidExport :exec
+UPDATE invoices
+SET export_status = 'pending',
+    export_attempts = 0,
+    export_error = NULL,
+    export_next_attempt_at = CASE WHEN export_status = 'pending' THEN export_next_attempt_at END
+WHERE id = $1
+  AND status = 'void'
+  AND export_status <> 'skipped'
+`
+
+// Queues a voided invoice to be voided at the payment processor too. An attempt still
+// holding the invoice's lease keeps it, so the void runs after that attempt. Invoices whose
+// export was skipped were never pushed and stay skipped.
+func (q *Queries) QueueInvoiceVoidExport(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, queueInvoiceVoidExport, id)
+	return err
+}
+
+const listInvoicesBillingLaterWindowChanges = `-- name: ListInvoicesBillingLaterWindowChanges :many
+SELECT DISTINCT later.invoice_id
+FROM invoice_line_items mine
+JOIN invoice_line_items later
+  ON later.service_id = mine.service_id
+ AND later.window_start = mine.window_start
+ AND later.window_end = mine.window_end
+ AND later.id > mine.id
+ AND later.invoice_id <> mine.invoice_id
+JOIN invoices i ON i.id = later.invoice_id
+WHERE mine.invoice_id = $1
+  AND mine.kind IN ('usage', 'adjustment')
+  AND i.status <> 'void'
+ORDER BY later.invoice_id
+`
+
+// Invoices that are not void with line items for a window the invoice bills, added after the
+// invoice's own. Their amounts were worked out against the invoice's.
+func (q *Queries) ListInvoicesBillingLaterWindowChanges(ctx context.Context, invoiceID int64) ([]int64, error) {
+	rows, err := q.db.QueryContext(ctx, listInvoicesBillingLaterWindowChanges, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []int64{}
+	for rows.Next() {
+		var invoice_id int64
+		if err := rows.Scan(&invoice_id); err != nil {
+			return nil, err
+		}
+		items = append(items, invoice_id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const releaseInvoiceUsageRevisions = `-- name: ReleaseInvoiceUsageRevisions :many
+UPDATE usage_revisions ur
+SET settled_at = NULL,
+    invoice_id = NULL
+FROM usage_snapshots us
+JOIN services s ON s.id = us.service_id
+WHERE us.id = ur.snapshot_id
+  AND ur.invoice_id = $1
+RETURNING
+    ur.id,
+    ur.snapshot_id,
+    us.service_id,
+    s.customer_id,
+    us.window_start,
+    us.window_end,
+    ur.primary_bytes,
+    ur.backup_bytes,
+    ur.primary_requests,
+    ur.backup_requests,
+    ur.regions,
+    us.invoice_id
+`
+
+type ReleaseInvoiceUsageRevisionsRow struct {
+	ID              int64         `json:"id"`
+	SnapshotID      int64         `json:"snapshot_id"`
+	ServiceID       int64         `json:"service_id"`
+	CustomerID      int64         `json:"customer_id"`
+	WindowStart     time.Time     `json:"window_start"`
+	WindowEnd       time.Time     `json:"window_end"`
+	PrimaryBytes    int64         `json:"primary_bytes"`
+	BackupBytes     int64         `json:"backup_bytes"`
+	PrimaryRequests int64         `json:"primary_requests"`
+	BackupRequests  int64         `json:"backup_requests"`
+	Regions         UsageRegions  `json:"regions"`
+	InvoiceID       sql.NullInt64 `json:"invoice_id"`
+}
+
+// Unsettles the revisions billed on an invoice, returning them as LockUnsettledUsageRevisions
+// does.
+func (q *Queries) ReleaseInvoiceUsageRevisions(ctx context.Context, invoiceID sql.NullInt64) ([]ReleaseInvoiceUsageRevisionsRow, error) {
+	rows, err := q.db.QueryContext(ctx, releaseInvoiceUsageRevisions, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ReleaseInvoiceUsageRevisionsRow{}
+	for rows.Next() {
+		var i ReleaseInvoiceUsageRevisionsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.SnapshotID,
+			&i.ServiceID,
+			&i.CustomerID,
+			&i.WindowStart,
+			&i.WindowEnd,
+			&i.PrimaryBytes,
+			&i.BackupBytes,
+			&i.PrimaryRequests,
+			&i.BackupRequests,
+			&i.Regions,
+			&i.InvoiceID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const releaseInvoiceUsageSnapshots = `-- name: ReleaseInvoiceUsageSnapshots :many
+UPDATE usage_snapshots us
+SET invoice_id = NULL
+FROM services s
+WHERE s.id = us.service_id
+  AND us.invoice_id = $1
+RETURNING
+    us.id,
+    us.service_id,
+    s.customer_id,
+    us.window_start,
+    us.window_end,
+    us.primary_bytes,
+    us.backup_bytes,
+    us.primary_requests,
+    us.backup_requests,
+    us.regions
+`
+
+type ReleaseInvoiceUsageSnapshotsRow struct {
+	ID              int64        `json:"id"`
+	ServiceID       int64        `json:"service_id"`
+	CustomerID      int64        `json:"customer_id"`
+	WindowStart     time.Time    `json:"window_start"`
+	WindowEnd       time.Time    `json:"window_end"`
+	PrimaryBytes    int64        `json:"primary_bytes"`
+	BackupBytes     int64        `json:"backup_bytes"`
+	PrimaryRequests int64        `json:"primary_requests"`
+	BackupRequests  int64        `json:"backup_requests"`
+	Regions         UsageRegions `json:"regions"`
+}
+
+// Marks the snapshots billed on an invoice unbilled, returning them as
+// LockUnbilledUsageSnapshots does.
+func (q *Queries) ReleaseInvoiceUsageSnapshots(ctx context.Context, invoiceID sql.NullInt64) ([]ReleaseInvoiceUsageSnapshotsRow, error) {
+	rows, err := q.db.QueryContext(ctx, releaseInvoiceUsageSnapshots, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ReleaseInvoiceUsageSnapshotsRow{}
+	for rows.Next() {
+		var i ReleaseInvoiceUsageSnapshotsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.ServiceID,
+			&i.CustomerID,
+			&i.WindowStart,
+			&i.WindowEnd,
+			&i.PrimaryBytes,
+			&i.BackupBytes,
+			&i.PrimaryRequests,
+			&i.BackupRequests,
+			&i.Regions,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertInvoiceVoid = `-- name: InsertInvoiceVoid :one
+INSERT INTO invoice_voids (
+    invoice_id,
+    replacement_invoice_id,
+    reason,
+    previous_status,
+    released_snapshots,
+    released_revisions,
+    old_subtotal_cents,
+    old_discount_cents,
+    old_total_cents,
+    new_subtotal_cents,
+    new_discount_cents,
+    new_total_cents
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+RETURNING id, invoice_id, replacement_invoice_id, reason, previous_status, released_snapshots, released_revisions, old_subtotal_cents, old_discount_cents, old_total_cents, new_subtotal_cents, new_discount_cents, new_total_cents, created_at
+`
+
+type InsertInvoiceVoidParams struct {
+	InvoiceID            int64  `json:"invoice_id"`
+	ReplacementInvoiceID int64  `json:"replacement_invoice_id"`
+	Reason               string `json:"reason"`
+	PreviousStatus       string `json:"previous_status"`
+	ReleasedSnapshots    int32  `json:"released_snapshots"`
+	ReleasedRevisions    int32  `json:"released_revisions"`
+	OldSubtotalCents     int64  `json:"old_subtotal_cents"`
+	OldDiscountCents     int64  `json:"old_discount_cents"`
+	OldTotalCents        int64  `json:"old_total_cents"`
+	NewSubtotalCents     int64  `json:"new_subtotal_cents"`
+	NewDiscountCents     int64  `json:"new_discount_cents"`
+	NewTotalCents        int64  `json:"new_total_cents"`
+}
+
+func (q *Queries) InsertInvoiceVoid(ctx context.Context, arg InsertInvoiceVoidParams) (InvoiceVoid, error) {
+	row := q.db.QueryRowContext(ctx, insertInvoiceVoid,
+		arg.InvoiceID,
+		arg.ReplacementInvoiceID,
+		arg.Reason,
+		arg.PreviousStatus,
+		arg.ReleasedSnapshots,
+		arg.ReleasedRevisions,
+		arg.OldSubtotalCents,
+		arg.OldDiscountCents,
+		arg.OldTotalCents,
+		arg.NewSubtotalCents,
+		arg.NewDiscountCents,
+		arg.NewTotalCents,
+	)
+	var i InvoiceVoid
+	err := row.Scan(
+		&i.ID,
+		&i.InvoiceID,
+		&i.ReplacementInvoiceID,
+		&i.Reason,
+		&i.PreviousStatus,
+		&i.ReleasedSnapshots,
+		&i.ReleasedRevisions,
+		&i.OldSubtotalCents,
+		&i.OldDiscountCents,
+		&i.OldTotalCents,
+		&i.NewSubtotalCents,
+		&i.NewDiscountCents,
+		&i.NewTotalCents,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getInvoiceVoid = `-- name: GetInvoiceVoid :one
+SELECT id, invoice_id, replacement_invoice_id, reason, previous_status, released_snapshots, released_revisions, old_subtotal_cents, old_discount_cents, old_total_cents, new_subtotal_cents, new_discount_cents, new_total_cents, created_at
+FROM invoice_voids
+WHERE invoice_id = $1
+`
+
+func (q *Queries) GetInvoiceVoid(ctx context.Context, invoiceID int64) (InvoiceVoid, error) {
+	row := q.db.QueryRowContext(ctx, getInvoiceVoid, invoiceID)
+	var i InvoiceVoid
+	err := row.Scan(
+		&i.ID,
+		&i.InvoiceID,
+		&i.ReplacementInvoiceID,
+		&i.Reason,
+		&i.PreviousStatus,
+		&i.ReleasedSnapshots,
+		&i.ReleasedRevisions,
+		&i.OldSubtotalCents,
+		&i.OldDiscountCents,
+		&i.OldTotalCents,
+		&i.NewSubtotalCents,
+		&i.NewDiscountCents,
+		&i.NewTotalCents,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const insertDNSWeightChangeIfChanged = `-- name: InsertDNSWeightChangeIfChanged :execrows
+INSERT INTO dns_weight_changes (service_id, domain, primary_weight, backup_weight)
+SELECT $1, $2, $3::INTEGER, $4::INTEGER
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM (
+        SELECT primary_weight, backup_weight
+        FROM dns_weight_changes
+        WHERE service_id = $1
+          AND domain = $2
+        ORDER BY applied_at DESC, id DESC
+        LIMIT 1
+    ) latest
+    WHERE latest.primary_weight = $3
+      AND latest.backup_weight = $4
+)
+`
+
+type InsertDNSWeightChangeIfChangedParams struct {
+	ServiceID     int64  `json:"service_id"`
+	Domain        string `json:"domain"`
+	PrimaryWeight int32  `json:"primary_weight"`
+	BackupWeight  int32  `json:"backup_weight"`
+}
+
+// Records the weights applied to a domain unless they are the ones last recorded for it.
+func (q *Queries) InsertDNSWeightChangeIfChanged(ctx context.Context, arg InsertDNSWeightChangeIfChangedParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, insertDNSWeightChangeIfChanged,
+		arg.ServiceID,
+		arg.Domain,
+		arg.PrimaryWeight,
+		arg.BackupWeight,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const listDNSWeightChangesForWindow = `-- name: ListDNSWeightChangesForWindow :many
+SELECT domain, primary_weight, backup_weight, applied_at
+FROM (
+    SELECT DISTINCT ON (domain) domain, primary_weight, backup_weight, applied_at
+    FROM dns_weight_changes
+    WHERE service_id = $1
+      AND applied_at <= $2
+      AND domain IN (SELECT name FROM service_domains WHERE service_id = $1)
+    ORDER BY domain, applied_at DESC, id DESC
+) in_force
+UNION ALL
+SELECT domain, primary_weight, backup_weight, applied_at
+FROM dns_weight_changes
+WHERE service_id = $1
+  AND applied_at > $2
+  AND applied_at < $3
+  AND domain IN (SELECT name FROM service_domains WHERE service_id = $1)
+ORDER BY applied_at, domain
+`
+
+type ListDNSWeightChangesForWindowParams struct {
+	ServiceID   int64     `json:"service_id"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+}
+
+type ListDNSWeightChangesForWindowRow struct {
+	Domain        string    `json:"domain"`
+	PrimaryWeight int32     `json:"primary_weight"`
+	BackupWeight  int32     `json:"backup_weight"`
+	AppliedAt     time.Time `json:"applied_at"`
+}
+
+// The weights in force on each of a service's domains at the window start, followed by the
+// changes applied during the window, oldest first. Domains since removed from the service
+// are left out, so they no longer count towards its mean backup share.
+func (q *Queries) ListDNSWeightChangesForWindow(ctx context.Context, arg ListDNSWeightChangesForWindowParams) ([]ListDNSWeightChangesForWindowRow, error) {
+	rows, err := q.db.QueryContext(ctx, listDNSWeightChangesForWindow, arg.ServiceID, arg.WindowStart, arg.WindowEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListDNSWeightChangesForWindowRow{}
+	for rows.Next() {
+		var i ListDNSWeightChangesForWindowRow
+		if err := rows.Scan(
+			&i.Domain,
+			&i.PrimaryWeight,
+			&i.BackupWeight,
+			&i.AppliedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listBilledStormDiscountsForWindow = `-- name: ListBilledStormDiscountsForWindow :many
+SELECT
+    (share->>'storm_event_id')::BIGINT AS storm_event_id,
+    MAX(share->>'kind')::TEXT AS kind,
+    SUM((share->>'discount_micros')::BIGINT)::BIGINT AS discount_micros
+FROM invoice_line_items li
+JOIN invoices i ON i.id = li.invoice_id
+CROSS JOIN LATERAL jsonb_array_elements(li.storm_breakdown) share
+WHERE li.service_id = $1
+  AND li.window_start = $2
+  AND li.window_end = $3
+  AND i.status <> 'void'
+GROUP BY 1
+ORDER BY 1
+`
+
+type ListBilledStormDiscountsForWindowParams struct {
+	ServiceID   int64     `json:"service_id"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+}
+
+type ListBilledStormDiscountsForWindowRow struct {
+	StormEventID   int64  `json:"storm_event_id"`
+	Kind           string `json:"kind"`
+	DiscountMicros int64  `json:"discount_micros"`
+}
+
+// Storm discounts billed so far for a window on invoices that are not void, per storm.
+func (q *Queries) ListBilledStormDiscountsForWindow(ctx context.Context, arg ListBilledStormDiscountsForWindowParams) ([]ListBilledStormDiscountsForWindowRow, error) {
+	rows, err := q.db.QueryContext(ctx, listBilledStormDiscountsForWindow, arg.ServiceID, arg.WindowStart, arg.WindowEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListBilledStormDiscountsForWindowRow{}
+	for rows.Next() {
+		var i ListBilledStormDiscountsForWindowRow
+		if err := rows.Scan(&i.StormEventID, &i.Kind, &i.DiscountMicros); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const recordUsageIngestCoverage = `-- name: RecordUsageIngestCoverage :exec
+INSERT INTO usage_ingest_coverage (service_id, covered_from, covered_through)
+VALUES ($1, $2, $3)
+ON CONFLICT (service_id) DO UPDATE SET
+    covered_from = LEAST(usage_ingest_coverage.covered_from, EXCLUDED.covered_from),
+    covered_through = GREATEST(usage_ingest_coverage.covered_through, EXCLUDED.covered_through),
+    updated_at = NOW()
+WHERE EXCLUDED.covered_from <= usage_ingest_coverage.covered_through
+  AND EXCLUDED.covered_through >= usage_ingest_coverage.covered_from
+`
+
+type RecordUsageIngestCoverageParams struct {
+	ServiceID      int64     `json:"service_id"`
+	CoveredFrom    time.Time `json:"covered_from"`
+	CoveredThrough time.Time `json:"covered_through"`
+}
+
+// Extends a service's ingested range by a fetch that overlaps or touches it. A fetch after a
+// gap leaves the range as it was.
+func (q *Queries) RecordUsageIngestCoverage(ctx context.Context, arg RecordUsageIngestCoverageParams) error {
+	_, err := q.db.ExecContext(ctx, recordUsageIngestCoverage, arg.ServiceID, arg.CoveredFrom, arg.CoveredThrough)
+	return err
+}
+
+const listUsageIngestCoverage = `-- name: ListUsageIngestCoverage :many
+SELECT service_id, covered_from, covered_through, updated_at
+FROM usage_ingest_coverage
+ORDER BY service_id
+`
+
+func (q *Queries) ListUsageIngestCoverage(ctx context.Context) ([]UsageIngestCoverage, error) {
+	rows, err := q.db.QueryContext(ctx, listUsageIngestCoverage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []UsageIngestCoverage{}
+	for rows.Next() {
+		var i UsageIngestCoverage
+		if err := rows.Scan(
+			&i.ServiceID,
+			&i.CoveredFrom,
+			&i.CoveredThrough,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUsageIngestCoverage = `-- name: GetUsageIngestCoverage :one
+SELECT service_id, covered_from, covered_through, updated_at
+FROM usage_ingest_coverage
+WHERE service_id = $1
+`
+
+func (q *Queries) GetUsageIngestCoverage(ctx context.Context, serviceID int64) (UsageIngestCoverage, error) {
+	row := q.db.QueryRowContext(ctx, getUsageIngestCoverage, serviceID)
+	var i UsageIngestCoverage
+	err := row.Scan(
+		&i.ServiceID,
+		&i.CoveredFrom,
+		&i.CoveredThrough,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
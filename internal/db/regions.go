@@ -0,0 +1,52 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// RegionUsage is one region's share of a usage window.
+type RegionUsage struct {
+	PrimaryBytes    int64 `json:"primary_bytes,omitempty"`
+	BackupBytes     int64 `json:"backup_bytes,omitempty"`
+	PrimaryRequests int64 `json:"primary_requests,omitempty"`
+	BackupRequests  int64 `json:"backup_requests,omitempty"`
+}
+
+// UsageRegions is the regions JSONB column of usage_snapshots and usage_revisions, keyed by
+// the region or price zone the CDN reported. It may cover only part of the window's totals.
+type UsageRegions map[string]RegionUsage
+
+// Value encodes the breakdown as a JSON object; a nil map is stored as {}.
+func (r UsageRegions) Value() (driver.Value, error) {
+	if r == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(map[string]RegionUsage(r))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (r *UsageRegions) Scan(src any) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("scan usage regions: unsupported type %T", src)
+	}
+	regions := UsageRegions{}
+	if err := json.Unmarshal(raw, &regions); err != nil {
+		return fmt.Errorf("scan usage regions: %w", err)
+	}
+	*r = regions
+	return nil
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// SLATier credits CreditPercent of a service's charges for a billing period in which its
+// availability fell below BelowPercent.
+type SLATier struct {
+	BelowPercent  float64 `json:"below_percent"`
+	CreditPercent float64 `json:"credit_percent"`
+}
+
+// SLATiers is the tiers JSONB column of sla_definitions.
+type SLATiers []SLATier
+
+// Value encodes the tiers as a JSON array; a nil slice is stored as [].
+func (t SLATiers) Value() (driver.Value, error) {
+	if t == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]SLATier(t))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (t *SLATiers) Scan(src any) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("scan sla tiers: unsupported type %T", src)
+	}
+	tiers := SLATiers{}
+	if err := json.Unmarshal(raw, &tiers); err != nil {
+		return fmt.Errorf("scan sla tiers: %w", err)
+	}
+	*t = tiers
+	return nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// StormShare is one storm's part in a line item's discount: the share of the window's
+// backup traffic it moved, the coverage factor of its kind and the discount that earned.
+// On adjustments DiscountMicros is the change from what was billed before.
+type StormShare struct {
+	StormEventID   int64   `json:"storm_event_id"`
+	Kind           string  `json:"kind"`
+	Share          float64 `json:"share"`
+	CoverageFactor float64 `json:"coverage_factor"`
+	DiscountMicros int64   `json:"discount_micros"`
+}
+
+// StormBreakdown is the storm_breakdown JSONB column of invoice_line_items.
+type StormBreakdown []StormShare
+
+// Value encodes the breakdown as a JSON array; a nil slice is stored as [].
+func (b StormBreakdown) Value() (driver.Value, error) {
+	if b == nil {
+		return "[]", nil
+	}
+	raw, err := json.Marshal([]StormShare(b))
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+func (b *StormBreakdown) Scan(src any) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*b = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("scan storm breakdown: unsupported type %T", src)
+	}
+	shares := StormBreakdown{}
+	if err := json.Unmarshal(raw, &shares); err != nil {
+		return fmt.Errorf("scan storm breakdown: %w", err)
+	}
+	*b = shares
+	return nil
+}
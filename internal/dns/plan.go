@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// RecordState captures the routing state of the primary/backup record pair for a domain.
+// Weighted domains use the weights; failover domains carry a non-nil Failover instead.
+type RecordState struct {
+	PrimaryWeight int            `json:"primary_weight"`
+	BackupWeight  int            `json:"backup_weight"`
+	Failover      *FailoverState `json:"failover,omitempty"`
+	TTL           int64          `json:"ttl,omitempty"`
+}
+
+// FailoverState captures the Tranche-controlled health of a failover primary record.
+type FailoverState struct {
+	PrimaryHealthy bool `json:"primary_healthy"`
+}
+
+// Reader exposes the live record state so changes can be previewed before they are applied.
+type Reader interface {
+	CurrentWeights(ctx context.Context, domain string) (RecordState, error)
+}
+
+// FailoverReader exposes the live state of failover-routed domains.
+type FailoverReader interface {
+	CurrentFailover(ctx context.Context, domain string) (RecordState, error)
+}
+
+// RecordDiff compares the live and desired state for a single domain.
+type RecordDiff struct {
+	ServiceID int64        `json:"service_id"`
+	Domain    string       `json:"domain"`
+	Current   *RecordState `json:"current,omitempty"`
+	Desired   RecordState  `json:"desired"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// Changed reports whether applying the desired state would modify the live records.
+// A desired TTL of zero means the TTL is not managed and never counts as drift.
+func (d RecordDiff) Changed() bool {
+	if d.Current == nil {
+		return false
+	}
+	if d.Desired.Failover != nil {
+		if d.Current.Failover == nil || *d.Current.Failover != *d.Desired.Failover {
+			return true
+		}
+	} else if d.Current.PrimaryWeight != d.Desired.PrimaryWeight || d.Current.BackupWeight != d.Desired.BackupWeight {
+		return true
+	}
+	return d.Desired.TTL > 0 && d.Current.TTL != d.Desired.TTL
+}
+
+// Plan is the set of diffs computed for every managed domain.
+type Plan struct {
+	Diffs []RecordDiff `json:"diffs"`
+}
+
+// PlanSummary counts the diffs in a plan by outcome.
+type PlanSummary struct {
+	Change    int `json:"change"`
+	Unchanged int `json:"unchanged"`
+	Errored   int `json:"errored"`
+}
+
+// Summary tallies the plan's diffs.
+func (p Plan) Summary() PlanSummary {
+	var s PlanSummary
+	for _, d := range p.Diffs {
+		switch {
+		case d.Error != "":
+			s.Errored++
+		case d.Changed():
+			s.Change++
+		default:
+			s.Unchanged++
+		}
+	}
+	return s
+}
+
+// HasDrift reports whether any domain differs from its desired state.
+func (p Plan) HasDrift() bool {
+	return p.Summary().Change > 0
+}
+
+// WritePlanJSON encodes the plan and its summary as a single JSON document.
+func WritePlanJSON(w io.Writer, p Plan) error {
+	diffs := p.Diffs
+	if diffs == nil {
+		diffs = []RecordDiff{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Diffs   []RecordDiff `json:"diffs"`
+		Summary PlanSummary  `json:"summary"`
+	}{Diffs: diffs, Summary: p.Summary()})
+}
+
+// WritePlanText renders the plan as a Terraform-style human readable diff.
+func WritePlanText(w io.Writer, p Plan) error {
+	for _, d := range p.Diffs {
+		var err error
+		switch {
+		case d.Error != "":
+			_, err = fmt.Fprintf(w, "! %s (service %d)\n    error: %s\n", d.Domain, d.ServiceID, d.Error)
+		case d.Changed() && d.Desired.Failover != nil:
+			current := "unknown"
+			if d.Current.Failover != nil {
+				current = fmt.Sprint(d.Current.Failover.PrimaryHealthy)
+			}
+			line := fmt.Sprintf("    primary healthy: %t\n", d.Desired.Failover.PrimaryHealthy)
+			if current != fmt.Sprint(d.Desired.Failover.PrimaryHealthy) {
+				line = fmt.Sprintf("    primary healthy: %s -> %t\n", current, d.Desired.Failover.PrimaryHealthy)
+			}
+			_, err = fmt.Fprintf(w, "~ %s (service %d, failover)\n%s", d.Domain, d.ServiceID, line)
+			if err == nil && d.Desired.TTL > 0 {
+				_, err = io.WriteString(w, valueLine("ttl:             ", d.Current.TTL, d.Desired.TTL))
+			}
+		case d.Changed():
+			_, err = fmt.Fprintf(w, "~ %s (service %d)\n%s%s", d.Domain, d.ServiceID,
+				valueLine("primary weight: ", int64(d.Current.PrimaryWeight), int64(d.Desired.PrimaryWeight)),
+				valueLine("backup weight:  ", int64(d.Current.BackupWeight), int64(d.Desired.BackupWeight)))
+			if err == nil && d.Desired.TTL > 0 {
+				_, err = io.WriteString(w, valueLine("ttl:            ", d.Current.TTL, d.Desired.TTL))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s := p.Summary()
+	if s.Change == 0 && s.Errored == 0 {
+		_, err := fmt.Fprintf(w, "No changes. %d domain(s) match the desired state.\n", s.Unchanged)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\nPlan: %d to change, %d unchanged, %d errored.\n", s.Change, s.Unchanged, s.Errored)
+	return err
+}
+
+func valueLine(label string, current, desired int64) string {
+	if current == desired {
+		return fmt.Sprintf("    %s%d\n", label, current)
+	}
+	return fmt.Sprintf("    %s%d -> %d\n", label, current, desired)
+}
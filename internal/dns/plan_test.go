@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPlanSummaryAndDrift(t *testing.T) {
+	plan := Plan{Diffs: []RecordDiff{
+		{Domain: "a.example.com", Current: &RecordState{PrimaryWeight: 100}, Desired: RecordState{PrimaryWeight: 100}},
+		{Domain: "b.example.com", Current: &RecordState{PrimaryWeight: 100}, Desired: RecordState{BackupWeight: 100}},
+		{Domain: "c.example.com", Desired: RecordState{PrimaryWeight: 100}, Error: "weighted records not found"},
+	}}
+
+	got := plan.Summary()
+	if got != (PlanSummary{Change: 1, Unchanged: 1, Errored: 1}) {
+		t.Fatalf("unexpected summary %+v", got)
+	}
+	if !plan.HasDrift() {
+		t.Fatalf("expected drift")
+	}
+	if (Plan{Diffs: plan.Diffs[:1]}).HasDrift() {
+		t.Fatalf("expected no drift for matching records")
+	}
+}
+
+func TestWritePlanText(t *testing.T) {
+	plan := Plan{Diffs: []RecordDiff{
+		{ServiceID: 1, Domain: "a.example.com", Current: &RecordState{PrimaryWeight: 100}, Desired: RecordState{PrimaryWeight: 100}},
+		{ServiceID: 2, Domain: "b.example.com", Current: &RecordState{PrimaryWeight: 100}, Desired: RecordState{BackupWeight: 100}},
+	}}
+
+	var buf bytes.Buffer
+	if err := WritePlanText(&buf, plan); err != nil {
+		t.Fatalf("WritePlanText: %v", err)
+	}
+	want := "~ b.example.com (service 2)\n" +
+		"    primary weight: 100 -> 0\n" +
+		"    backup weight:  0 -> 100\n" +
+		"\nPlan: 1 to change, 1 unchanged, 0 errored.\n"
+	if buf.String() != want {
+		t.Fatalf("unexpected plan text:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "a.example.com") {
+		t.Fatalf("unchanged domains should not be listed")
+	}
+}
+
+func TestWritePlanJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WritePlanJSON(&buf, Plan{}); err != nil {
+		t.Fatalf("WritePlanJSON: %v", err)
+	}
+	var decoded struct {
+		Diffs   []RecordDiff `json:"diffs"`
+		Summary PlanSummary  `json:"summary"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if decoded.Diffs == nil || len(decoded.Diffs) != 0 {
+		t.Fatalf("expected empty diffs array, got %#v", decoded.Diffs)
+	}
+}
+
+func TestRecordDiffIgnoresUnmanagedTTL(t *testing.T) {
+	current := &RecordState{PrimaryWeight: 100, TTL: 300}
+	if (RecordDiff{Current: current, Desired: RecordState{PrimaryWeight: 100}}).Changed() {
+		t.Fatalf("zero desired TTL should not count as drift")
+	}
+	if !(RecordDiff{Current: current, Desired: RecordState{PrimaryWeight: 100, TTL: 30}}).Changed() {
+		t.Fatalf("expected TTL change to count as drift")
+	}
+}
@@ -1,13 +1,78 @@
 package dns
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
 
 type Logger interface {
 	Printf(string, ...any)
 }
 
+// Provider applies routing weights to a domain's primary/backup records. A ttl of zero
+// leaves the records' existing TTL untouched.
 type Provider interface {
-	SetWeights(ctx context.Context, domain string, primaryWeight, backupWeight int) error
+	SetWeights(ctx context.Context, domain string, primaryWeight, backupWeight int, ttl int64) error
+	// SetWeightsBatch applies several weight changes at once so providers can submit them
+	// together. Per-domain failures are reported through a *BatchError.
+	SetWeightsBatch(ctx context.Context, changes []WeightChange) error
+}
+
+// WeightChange is a single domain's entry in a SetWeightsBatch call.
+type WeightChange struct {
+	Domain        string
+	PrimaryWeight int
+	BackupWeight  int
+	TTL           int64
+}
+
+// BatchError reports which domains of a batch failed. Domains absent from Failed were applied.
+type BatchError struct {
+	Failed map[string]error
+}
+
+func (e *BatchError) Error() string {
+	domains := make([]string, 0, len(e.Failed))
+	for domain := range e.Failed {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	parts := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		parts = append(parts, fmt.Sprintf("%s: %v", domain, e.Failed[domain]))
+	}
+	return fmt.Sprintf("%d domain(s) failed: %s", len(domains), strings.Join(parts, "; "))
+}
+
+// DomainError returns the error for a single domain of a batch, given the error returned by
+// SetWeightsBatch. Errors that are not a *BatchError apply to every domain.
+func DomainError(err error, domain string) error {
+	if err == nil {
+		return nil
+	}
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return batchErr.Failed[domain]
+	}
+	return err
+}
+
+// Routing strategies selectable per domain.
+const (
+	// StrategyWeighted steers traffic by flipping the weights of primary/backup records.
+	StrategyWeighted = "weighted"
+	// StrategyFailover relies on the DNS provider's failover routing and health checks,
+	// with Tranche only toggling the primary's health to reflect storm state.
+	StrategyFailover = "failover"
+)
+
+// FailoverProvider manages PRIMARY/SECONDARY failover records whose primary health is
+// driven by Tranche's storm state. A ttl of zero leaves the records' TTL untouched.
+type FailoverProvider interface {
+	SetFailover(ctx context.Context, domain string, primaryHealthy bool, ttl int64) error
 }
 
 type NoopProvider struct {
@@ -18,7 +83,19 @@ func NewNoopProvider(log Logger) *NoopProvider {
 	return &NoopProvider{log: log}
 }
 
-func (p *NoopProvider) SetWeights(_ context.Context, domain string, primaryWeight, backupWeight int) error {
-	p.log.Printf("noop SetWeights(%s, primary=%d, backup=%d)", domain, primaryWeight, backupWeight)
+func (p *NoopProvider) SetWeights(_ context.Context, domain string, primaryWeight, backupWeight int, ttl int64) error {
+	p.log.Printf("noop SetWeights(%s, primary=%d, backup=%d, ttl=%d)", domain, primaryWeight, backupWeight, ttl)
+	return nil
+}
+
+func (p *NoopProvider) SetWeightsBatch(ctx context.Context, changes []WeightChange) error {
+	for _, c := range changes {
+		_ = p.SetWeights(ctx, c.Domain, c.PrimaryWeight, c.BackupWeight, c.TTL)
+	}
+	return nil
+}
+
+func (p *NoopProvider) SetFailover(_ context.Context, domain string, primaryHealthy bool, ttl int64) error {
+	p.log.Printf("noop SetFailover(%s, primary_healthy=%t, ttl=%d)", domain, primaryHealthy, ttl)
 	return nil
 }
@@ -2,8 +2,11 @@ package dns
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +18,12 @@ import (
 	route53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
 )
 
+// Route53 rejects change batches above these limits. UPSERTs count twice towards both.
+const (
+	maxBatchResourceRecords = 1000
+	maxBatchValueChars      = 32000
+)
+
 // Route53ProviderConfig captures the configuration necessary to talk to Route53.
 type Route53ProviderConfig struct {
 	Region          string
@@ -29,6 +38,9 @@ type route53API interface {
 	ListHostedZonesByName(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error)
 	ListResourceRecordSets(ctx context.Context, params *route53.ListResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ListResourceRecordSetsOutput, error)
 	ChangeResourceRecordSets(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error)
+	CreateHealthCheck(ctx context.Context, params *route53.CreateHealthCheckInput, optFns ...func(*route53.Options)) (*route53.CreateHealthCheckOutput, error)
+	GetHealthCheck(ctx context.Context, params *route53.GetHealthCheckInput, optFns ...func(*route53.Options)) (*route53.GetHealthCheckOutput, error)
+	UpdateHealthCheck(ctx context.Context, params *route53.UpdateHealthCheckInput, optFns ...func(*route53.Options)) (*route53.UpdateHealthCheckOutput, error)
 }
 
 // Route53Provider implements Provider backed by AWS Route53.
@@ -75,32 +87,254 @@ func newRoute53Provider(log Logger, client route53API, cfg Route53ProviderConfig
 	}
 }
 
-// SetWeights updates the weighted DNS entries for a domain.
-func (p *Route53Provider) SetWeights(ctx context.Context, domain string, primaryWeight, backupWeight int) error {
+// SetWeights updates the weighted DNS entries for a domain. A positive ttl is applied to
+// both records; alias records have no TTL of their own and are left as-is.
+func (p *Route53Provider) SetWeights(ctx context.Context, domain string, primaryWeight, backupWeight int, ttl int64) error {
+	return p.withRetries(ctx, "SetWeights", domain, func(normalizedDomain string) error {
+		return p.setWeightsOnce(ctx, normalizedDomain, primaryWeight, backupWeight, ttl)
+	})
+}
+
+// SetFailover drives the PRIMARY/SECONDARY failover records for a domain. The primary
+// record is attached to a Tranche-managed calculated health check with no children, which
+// Route53 reports healthy; inverting it marks the primary unhealthy so Route53 fails over
+// on its own, independent of whether the operator stays up.
+func (p *Route53Provider) SetFailover(ctx context.Context, domain string, primaryHealthy bool, ttl int64) error {
+	return p.withRetries(ctx, "SetFailover", domain, func(normalizedDomain string) error {
+		return p.setFailoverOnce(ctx, normalizedDomain, primaryHealthy, ttl)
+	})
+}
+
+// SetWeightsBatch groups weight changes by hosted zone and submits one change batch per
+// zone, so domains sharing a zone flip atomically. Each zone's records are listed once for
+// the whole batch. Zones whose changes exceed Route53's per-request limits are split into
+// several batches, never separating a domain's records. A domain listed more than once is
+// set to its last change.
+func (p *Route53Provider) SetWeightsBatch(ctx context.Context, changes []WeightChange) error {
+	failed := make(map[string]error)
+	var (
+		zoneOrder []string
+		byZone    = make(map[string][]batchEntry)
+		position  = make(map[string]int)
+	)
+	for _, c := range changes {
+		if strings.TrimSpace(c.Domain) == "" {
+			failed[c.Domain] = errors.New("domain is required")
+			continue
+		}
+		normalizedDomain := strings.ToLower(strings.TrimSuffix(c.Domain, "."))
+		zoneID, err := p.lookupHostedZone(ctx, normalizedDomain)
+		if err != nil {
+			failed[c.Domain] = fmt.Errorf("route53 SetWeightsBatch(%s): %w", normalizedDomain, err)
+			continue
+		}
+		if i, ok := position[normalizedDomain]; ok {
+			p.log.Printf("route53 SetWeightsBatch: %s is in the batch more than once; applying its last change", normalizedDomain)
+			byZone[zoneID][i].change = c
+			continue
+		}
+		if _, ok := byZone[zoneID]; !ok {
+			zoneOrder = append(zoneOrder, zoneID)
+		}
+		position[normalizedDomain] = len(byZone[zoneID])
+		byZone[zoneID] = append(byZone[zoneID], batchEntry{change: c, domain: normalizedDomain})
+	}
+
+	for _, zoneID := range zoneOrder {
+		p.setZoneWeights(ctx, zoneID, byZone[zoneID], failed)
+	}
+	if len(failed) > 0 {
+		return &BatchError{Failed: failed}
+	}
+	return nil
+}
+
+type batchEntry struct {
+	change  WeightChange
+	domain  string
+	updates []route53types.Change
+}
+
+func (p *Route53Provider) setZoneWeights(ctx context.Context, zoneID string, entries []batchEntry, failed map[string]error) {
+	domains := make([]string, len(entries))
+	for i, entry := range entries {
+		domains[i] = entry.domain
+	}
+	var pairs map[string]recordPair
+	err := p.retry(ctx, "SetWeightsBatch", zoneID, func() error {
+		var err error
+		pairs, err = p.fetchZoneWeightedRecords(ctx, zoneID, domains)
+		return err
+	})
+	if err != nil {
+		for _, entry := range entries {
+			failed[entry.change.Domain] = err
+		}
+		return
+	}
+
+	ready := make([]batchEntry, 0, len(entries))
+	for _, entry := range entries {
+		pair := pairs[entry.domain]
+		if pair.primary == nil || pair.backup == nil {
+			failed[entry.change.Domain] = fmt.Errorf("route53 SetWeightsBatch(%s): weighted records for %s not found", entry.domain, entry.domain)
+			continue
+		}
+		entry.updates = weightUpdates(pair.primary, pair.backup, entry.change.PrimaryWeight, entry.change.BackupWeight, entry.change.TTL)
+		ready = append(ready, entry)
+	}
+
+	for _, chunk := range chunkBatch(ready) {
+		var changes []route53types.Change
+		for _, entry := range chunk {
+			changes = append(changes, entry.updates...)
+		}
+		err := p.retry(ctx, "SetWeightsBatch", zoneID, func() error {
+			_, err := p.client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+				HostedZoneId: aws.String(zoneID),
+				ChangeBatch: &route53types.ChangeBatch{
+					Comment: aws.String(fmt.Sprintf("tranche weight update (%d domains) %s", len(chunk), time.Now().UTC().Format(time.RFC3339))),
+					Changes: changes,
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("change record sets: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			for _, entry := range chunk {
+				failed[entry.change.Domain] = err
+			}
+		}
+	}
+}
+
+// chunkBatch splits entries into groups that fit within a single Route53 change batch.
+func chunkBatch(entries []batchEntry) [][]batchEntry {
+	var (
+		chunks        [][]batchEntry
+		current       []batchEntry
+		records, vals int
+	)
+	for _, entry := range entries {
+		entryRecords, entryVals := 0, 0
+		for _, change := range entry.updates {
+			r, v := changeCost(change)
+			entryRecords += r
+			entryVals += v
+		}
+		if len(current) > 0 && (records+entryRecords > maxBatchResourceRecords || vals+entryVals > maxBatchValueChars) {
+			chunks = append(chunks, current)
+			current, records, vals = nil, 0, 0
+		}
+		current = append(current, entry)
+		records += entryRecords
+		vals += entryVals
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// changeCost reports how many ResourceRecord elements and value characters a change counts
+// for. Alias records carry no ResourceRecords but are counted as one to stay conservative.
+func changeCost(change route53types.Change) (int, int) {
+	rr := change.ResourceRecordSet
+	records, vals := len(rr.ResourceRecords), 0
+	if records == 0 {
+		records = 1
+	}
+	for _, r := range rr.ResourceRecords {
+		vals += len(aws.ToString(r.Value))
+	}
+	if change.Action == route53types.ChangeActionUpsert {
+		records, vals = records*2, vals*2
+	}
+	return records, vals
+}
+
+func (p *Route53Provider) withRetries(ctx context.Context, op, domain string, fn func(normalizedDomain string) error) error {
 	if strings.TrimSpace(domain) == "" {
 		return errors.New("domain is required")
 	}
 
 	normalizedDomain := strings.ToLower(strings.TrimSuffix(domain, "."))
+	return p.retry(ctx, op, normalizedDomain, func() error { return fn(normalizedDomain) })
+}
+
+// retry runs fn up to maxAttempts times with exponential backoff. target names the domain or
+// hosted zone in log lines and errors.
+func (p *Route53Provider) retry(ctx context.Context, op, target string, fn func() error) error {
 	var lastErr error
 	for attempt := 1; attempt <= p.maxAttempts; attempt++ {
 		if err := ctx.Err(); err != nil {
-			return fmt.Errorf("route53 SetWeights(%s): %w", normalizedDomain, err)
+			return fmt.Errorf("route53 %s(%s): %w", op, target, err)
 		}
-		if err := p.setWeightsOnce(ctx, normalizedDomain, primaryWeight, backupWeight); err != nil {
+		if err := fn(); err != nil {
 			lastErr = err
-			p.log.Printf("route53 SetWeights attempt %d/%d for %s failed: %v", attempt, p.maxAttempts, normalizedDomain, err)
+			p.log.Printf("route53 %s attempt %d/%d for %s failed: %v", op, attempt, p.maxAttempts, target, err)
 			if attempt < p.maxAttempts {
 				backoff := time.Duration(1<<uint(attempt-1)) * 200 * time.Millisecond
 				if err := p.sleepWithContext(ctx, backoff); err != nil {
-					return fmt.Errorf("route53 SetWeights(%s): %w", normalizedDomain, err)
+					return fmt.Errorf("route53 %s(%s): %w", op, target, err)
 				}
 			}
 			continue
 		}
 		return nil
 	}
-	return fmt.Errorf("route53 SetWeights(%s) failed: %w", normalizedDomain, lastErr)
+	return fmt.Errorf("route53 %s(%s) failed: %w", op, target, lastErr)
+}
+
+// CurrentWeights reads the live weights of the primary/backup records for a domain.
+func (p *Route53Provider) CurrentWeights(ctx context.Context, domain string) (RecordState, error) {
+	if strings.TrimSpace(domain) == "" {
+		return RecordState{}, errors.New("domain is required")
+	}
+
+	normalizedDomain := strings.ToLower(strings.TrimSuffix(domain, "."))
+	zoneID, err := p.lookupHostedZone(ctx, normalizedDomain)
+	if err != nil {
+		return RecordState{}, fmt.Errorf("route53 CurrentWeights(%s): %w", normalizedDomain, err)
+	}
+	primary, backup, err := p.fetchWeightedRecords(ctx, zoneID, normalizedDomain)
+	if err != nil {
+		return RecordState{}, fmt.Errorf("route53 CurrentWeights(%s): %w", normalizedDomain, err)
+	}
+	return RecordState{
+		PrimaryWeight: int(aws.ToInt64(primary.Weight)),
+		BackupWeight:  int(aws.ToInt64(backup.Weight)),
+		TTL:           aws.ToInt64(primary.TTL),
+	}, nil
+}
+
+// CurrentFailover reads the live failover state for a domain. A primary record without a
+// health check is reported healthy, matching how Route53 evaluates it.
+func (p *Route53Provider) CurrentFailover(ctx context.Context, domain string) (RecordState, error) {
+	if strings.TrimSpace(domain) == "" {
+		return RecordState{}, errors.New("domain is required")
+	}
+
+	normalizedDomain := strings.ToLower(strings.TrimSuffix(domain, "."))
+	zoneID, err := p.lookupHostedZone(ctx, normalizedDomain)
+	if err != nil {
+		return RecordState{}, fmt.Errorf("route53 CurrentFailover(%s): %w", normalizedDomain, err)
+	}
+	primary, _, err := p.fetchFailoverRecords(ctx, zoneID, normalizedDomain)
+	if err != nil {
+		return RecordState{}, fmt.Errorf("route53 CurrentFailover(%s): %w", normalizedDomain, err)
+	}
+	state := RecordState{Failover: &FailoverState{PrimaryHealthy: true}, TTL: aws.ToInt64(primary.TTL)}
+	if checkID := aws.ToString(primary.HealthCheckId); checkID != "" {
+		inverted, err := p.healthCheckInverted(ctx, checkID)
+		if err != nil {
+			return RecordState{}, fmt.Errorf("route53 CurrentFailover(%s): %w", normalizedDomain, err)
+		}
+		state.Failover.PrimaryHealthy = !inverted
+	}
+	return state, nil
 }
 
 func (p *Route53Provider) sleepWithContext(ctx context.Context, d time.Duration) error {
@@ -118,7 +352,7 @@ func (p *Route53Provider) sleepWithContext(ctx context.Context, d time.Duration)
 	}
 }
 
-func (p *Route53Provider) setWeightsOnce(ctx context.Context, domain string, primaryWeight, backupWeight int) error {
+func (p *Route53Provider) setWeightsOnce(ctx context.Context, domain string, primaryWeight, backupWeight int, ttl int64) error {
 	zoneID, err := p.lookupHostedZone(ctx, domain)
 	if err != nil {
 		return err
@@ -129,28 +363,130 @@ func (p *Route53Provider) setWeightsOnce(ctx context.Context, domain string, pri
 		return err
 	}
 
+	_, err = p.client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneID),
+		ChangeBatch: &route53types.ChangeBatch{
+			Comment: aws.String(fmt.Sprintf("tranche weight update %s", time.Now().UTC().Format(time.RFC3339))),
+			Changes: weightUpdates(primary, backup, primaryWeight, backupWeight, ttl),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("change record sets: %w", err)
+	}
+
+	return nil
+}
+
+// weightUpdates builds the UPSERTs that move a primary/backup pair to the given weights.
+func weightUpdates(primary, backup *route53types.ResourceRecordSet, primaryWeight, backupWeight int, ttl int64) []route53types.Change {
 	primaryUpdate := cloneRecordSet(primary)
 	backupUpdate := cloneRecordSet(backup)
 	primaryUpdate.Weight = aws.Int64(int64(primaryWeight))
 	backupUpdate.Weight = aws.Int64(int64(backupWeight))
+	applyTTL(primaryUpdate, ttl)
+	applyTTL(backupUpdate, ttl)
+	return []route53types.Change{
+		{Action: route53types.ChangeActionUpsert, ResourceRecordSet: primaryUpdate},
+		{Action: route53types.ChangeActionUpsert, ResourceRecordSet: backupUpdate},
+	}
+}
+
+func (p *Route53Provider) setFailoverOnce(ctx context.Context, domain string, primaryHealthy bool, ttl int64) error {
+	zoneID, err := p.lookupHostedZone(ctx, domain)
+	if err != nil {
+		return err
+	}
+
+	primary, secondary, err := p.fetchFailoverRecords(ctx, zoneID, domain)
+	if err != nil {
+		return err
+	}
+
+	primaryUpdate := cloneRecordSet(primary)
+	secondaryUpdate := cloneRecordSet(secondary)
+	recordsChanged := false
+
+	checkID := aws.ToString(primary.HealthCheckId)
+	if checkID == "" {
+		config := &route53types.HealthCheckConfig{
+			Type:              route53types.HealthCheckTypeCalculated,
+			HealthThreshold:   aws.Int32(0),
+			ChildHealthChecks: []string{},
+			Inverted:          aws.Bool(!primaryHealthy),
+		}
+		out, err := p.client.CreateHealthCheck(ctx, &route53.CreateHealthCheckInput{
+			CallerReference:   aws.String(healthCheckReference(zoneID, domain, config)),
+			HealthCheckConfig: config,
+		})
+		if err != nil {
+			return fmt.Errorf("create health check: %w", err)
+		}
+		if out.HealthCheck == nil || aws.ToString(out.HealthCheck.Id) == "" {
+			return errors.New("create health check: empty health check id")
+		}
+		primaryUpdate.HealthCheckId = out.HealthCheck.Id
+		recordsChanged = true
+	} else {
+		inverted, err := p.healthCheckInverted(ctx, checkID)
+		if err != nil {
+			return err
+		}
+		if inverted == primaryHealthy {
+			if _, err := p.client.UpdateHealthCheck(ctx, &route53.UpdateHealthCheckInput{
+				HealthCheckId: aws.String(checkID),
+				Inverted:      aws.Bool(!primaryHealthy),
+			}); err != nil {
+				return fmt.Errorf("update health check %s: %w", checkID, err)
+			}
+		}
+	}
+
+	if ttl > 0 && (ttlDiffers(primary, ttl) || ttlDiffers(secondary, ttl)) {
+		applyTTL(primaryUpdate, ttl)
+		applyTTL(secondaryUpdate, ttl)
+		recordsChanged = true
+	}
+	if !recordsChanged {
+		return nil
+	}
 
 	_, err = p.client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
 		HostedZoneId: aws.String(zoneID),
 		ChangeBatch: &route53types.ChangeBatch{
-			Comment: aws.String(fmt.Sprintf("tranche weight update %s", time.Now().UTC().Format(time.RFC3339))),
+			Comment: aws.String(fmt.Sprintf("tranche failover update %s", time.Now().UTC().Format(time.RFC3339))),
 			Changes: []route53types.Change{
 				{Action: route53types.ChangeActionUpsert, ResourceRecordSet: primaryUpdate},
-				{Action: route53types.ChangeActionUpsert, ResourceRecordSet: backupUpdate},
+				{Action: route53types.ChangeActionUpsert, ResourceRecordSet: secondaryUpdate},
 			},
 		},
 	})
 	if err != nil {
 		return fmt.Errorf("change record sets: %w", err)
 	}
-
 	return nil
 }
 
+// healthCheckReference derives the CallerReference of the health check created for a
+// domain's primary record from the zone, the domain and the check's settings. Route53 answers
+// a repeated CreateHealthCheck with the same reference and settings with the check it already
+// created, so a retry after a create that timed out but succeeded reuses that check instead
+// of leaving it orphaned. References of deleted checks cannot be reused.
+func healthCheckReference(zoneID, domain string, config *route53types.HealthCheckConfig) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%d|%t", zoneID, domain, config.Type, aws.ToInt32(config.HealthThreshold), aws.ToBool(config.Inverted))))
+	return "tranche-failover-" + hex.EncodeToString(sum[:20])
+}
+
+func (p *Route53Provider) healthCheckInverted(ctx context.Context, checkID string) (bool, error) {
+	out, err := p.client.GetHealthCheck(ctx, &route53.GetHealthCheckInput{HealthCheckId: aws.String(checkID)})
+	if err != nil {
+		return false, fmt.Errorf("get health check %s: %w", checkID, err)
+	}
+	if out.HealthCheck == nil || out.HealthCheck.HealthCheckConfig == nil {
+		return false, fmt.Errorf("health check %s has no config", checkID)
+	}
+	return aws.ToBool(out.HealthCheck.HealthCheckConfig.Inverted), nil
+}
+
 func (p *Route53Provider) lookupHostedZone(ctx context.Context, domain string) (string, error) {
 	domain = strings.ToLower(domain)
 	p.cacheMu.RLock()
@@ -195,6 +531,102 @@ func (p *Route53Provider) lookupHostedZone(ctx context.Context, domain string) (
 }
 
 func (p *Route53Provider) fetchWeightedRecords(ctx context.Context, zoneID, domain string) (*route53types.ResourceRecordSet, *route53types.ResourceRecordSet, error) {
+	return p.fetchRecordPair(ctx, zoneID, domain, "weighted", func(rr route53types.ResourceRecordSet) string {
+		if rr.SetIdentifier == nil || rr.Weight == nil {
+			return ""
+		}
+		return strings.ToLower(aws.ToString(rr.SetIdentifier))
+	})
+}
+
+func (p *Route53Provider) fetchFailoverRecords(ctx context.Context, zoneID, domain string) (*route53types.ResourceRecordSet, *route53types.ResourceRecordSet, error) {
+	return p.fetchRecordPair(ctx, zoneID, domain, "failover", func(rr route53types.ResourceRecordSet) string {
+		switch rr.Failover {
+		case route53types.ResourceRecordSetFailoverPrimary:
+			return "primary"
+		case route53types.ResourceRecordSetFailoverSecondary:
+			return "backup"
+		}
+		return ""
+	})
+}
+
+type recordPair struct {
+	primary, backup *route53types.ResourceRecordSet
+}
+
+// fetchZoneWeightedRecords finds the weighted record pairs of several domains of one zone in
+// a single listing. Route53 lists a zone's records ordered by name with the labels reversed,
+// so the listing starts at the first of the domains in that order and pages until every pair
+// is found or it has passed the last of them.
+func (p *Route53Provider) fetchZoneWeightedRecords(ctx context.Context, zoneID string, domains []string) (map[string]recordPair, error) {
+	sorted := append([]string(nil), domains...)
+	sort.Slice(sorted, func(i, j int) bool { return compareRecordNames(sorted[i], sorted[j]) < 0 })
+	last := sorted[len(sorted)-1]
+	wanted := make(map[string]bool, len(sorted))
+	for _, domain := range sorted {
+		wanted[domain] = true
+	}
+
+	input := &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(zoneID),
+		StartRecordName: aws.String(sorted[0]),
+	}
+	pairs := make(map[string]recordPair, len(sorted))
+	complete := 0
+	for {
+		resp, err := p.client.ListResourceRecordSets(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("list record sets: %w", err)
+		}
+		for i := range resp.ResourceRecordSets {
+			rr := resp.ResourceRecordSets[i]
+			name := strings.ToLower(strings.TrimSuffix(aws.ToString(rr.Name), "."))
+			if !wanted[name] || rr.SetIdentifier == nil || rr.Weight == nil {
+				continue
+			}
+			pair := pairs[name]
+			found := pair.primary != nil && pair.backup != nil
+			switch strings.ToLower(aws.ToString(rr.SetIdentifier)) {
+			case "primary":
+				pair.primary = &rr
+			case "backup":
+				pair.backup = &rr
+			}
+			pairs[name] = pair
+			if !found && pair.primary != nil && pair.backup != nil {
+				complete++
+			}
+		}
+		if complete == len(sorted) || !resp.IsTruncated {
+			break
+		}
+		next := strings.ToLower(strings.TrimSuffix(aws.ToString(resp.NextRecordName), "."))
+		if compareRecordNames(next, last) > 0 {
+			break
+		}
+		input.StartRecordName = resp.NextRecordName
+		input.StartRecordType = resp.NextRecordType
+		input.StartRecordIdentifier = resp.NextRecordIdentifier
+	}
+	return pairs, nil
+}
+
+// compareRecordNames orders domain names the way Route53 lists them: label by label from the
+// right.
+func compareRecordNames(a, b string) int {
+	al, bl := strings.Split(a, "."), strings.Split(b, ".")
+	for i, j := len(al)-1, len(bl)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(al[i], bl[j]); c != 0 {
+			return c
+		}
+	}
+	return len(al) - len(bl)
+}
+
+// fetchRecordPair pages through the zone until it finds the primary and backup records for
+// domain. role maps a record to "primary", "backup", or "" when it is not part of the pair.
+func (p *Route53Provider) fetchRecordPair(ctx context.Context, zoneID, domain, kind string, role func(route53types.ResourceRecordSet) string) (*route53types.ResourceRecordSet, *route53types.ResourceRecordSet, error) {
 	domain = strings.ToLower(domain)
 	input := &route53.ListResourceRecordSetsInput{
 		HostedZoneId:    aws.String(zoneID),
@@ -214,10 +646,7 @@ func (p *Route53Provider) fetchWeightedRecords(ctx context.Context, zoneID, doma
 			if name != domain {
 				continue
 			}
-			if rr.SetIdentifier == nil || rr.Weight == nil {
-				continue
-			}
-			switch strings.ToLower(aws.ToString(rr.SetIdentifier)) {
+			switch role(rr) {
 			case "primary":
 				copy := rr
 				primary = &copy
@@ -241,7 +670,7 @@ func (p *Route53Provider) fetchWeightedRecords(ctx context.Context, zoneID, doma
 	}
 
 	if primary == nil || backup == nil {
-		return nil, nil, fmt.Errorf("weighted records for %s not found", domain)
+		return nil, nil, fmt.Errorf("%s records for %s not found", kind, domain)
 	}
 
 	return primary, backup, nil
@@ -257,3 +686,14 @@ func cloneRecordSet(in *route53types.ResourceRecordSet) *route53types.ResourceRe
 	}
 	return &copy
 }
+
+func ttlDiffers(rr *route53types.ResourceRecordSet, ttl int64) bool {
+	return rr.AliasTarget == nil && aws.ToInt64(rr.TTL) != ttl
+}
+
+func applyTTL(rr *route53types.ResourceRecordSet, ttl int64) {
+	if ttl <= 0 || rr.AliasTarget != nil {
+		return
+	}
+	rr.TTL = aws.Int64(ttl)
+}
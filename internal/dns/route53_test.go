@@ -3,7 +3,10 @@ package dns
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +19,9 @@ type mockRoute53Client struct {
 	listZonesFn    func(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error)
 	listRecordsFn  func(ctx context.Context, params *route53.ListResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ListResourceRecordSetsOutput, error)
 	changeRecordFn func(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error)
+	createHCFn     func(ctx context.Context, params *route53.CreateHealthCheckInput, optFns ...func(*route53.Options)) (*route53.CreateHealthCheckOutput, error)
+	getHCFn        func(ctx context.Context, params *route53.GetHealthCheckInput, optFns ...func(*route53.Options)) (*route53.GetHealthCheckOutput, error)
+	updateHCFn     func(ctx context.Context, params *route53.UpdateHealthCheckInput, optFns ...func(*route53.Options)) (*route53.UpdateHealthCheckOutput, error)
 }
 
 func (m *mockRoute53Client) ListHostedZonesByName(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error) {
@@ -30,6 +36,18 @@ func (m *mockRoute53Client) ChangeResourceRecordSets(ctx context.Context, params
 	return m.changeRecordFn(ctx, params, optFns...)
 }
 
+func (m *mockRoute53Client) CreateHealthCheck(ctx context.Context, params *route53.CreateHealthCheckInput, optFns ...func(*route53.Options)) (*route53.CreateHealthCheckOutput, error) {
+	return m.createHCFn(ctx, params, optFns...)
+}
+
+func (m *mockRoute53Client) GetHealthCheck(ctx context.Context, params *route53.GetHealthCheckInput, optFns ...func(*route53.Options)) (*route53.GetHealthCheckOutput, error) {
+	return m.getHCFn(ctx, params, optFns...)
+}
+
+func (m *mockRoute53Client) UpdateHealthCheck(ctx context.Context, params *route53.UpdateHealthCheckInput, optFns ...func(*route53.Options)) (*route53.UpdateHealthCheckOutput, error) {
+	return m.updateHCFn(ctx, params, optFns...)
+}
+
 func discardLogger() Logger {
 	return log.New(testWriter{}, "", 0)
 }
@@ -83,7 +101,7 @@ func TestRoute53ProviderSetWeights(t *testing.T) {
 
 	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 1})
 
-	if err := provider.SetWeights(context.Background(), "app.example.com", 50, 10); err != nil {
+	if err := provider.SetWeights(context.Background(), "app.example.com", 50, 10, 0); err != nil {
 		t.Fatalf("SetWeights returned error: %v", err)
 	}
 
@@ -126,7 +144,7 @@ func TestRoute53ProviderRetriesFailures(t *testing.T) {
 	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 2})
 	provider.sleepFn = func(d time.Duration) {}
 
-	if err := provider.SetWeights(context.Background(), "app.example.com", 10, 5); err != nil {
+	if err := provider.SetWeights(context.Background(), "app.example.com", 10, 5, 0); err != nil {
 		t.Fatalf("expected success after retry, got %v", err)
 	}
 
@@ -160,7 +178,7 @@ func TestRoute53ProviderContextCancellationStopsRetries(t *testing.T) {
 	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 3})
 	provider.sleepFn = time.Sleep
 
-	err := provider.SetWeights(ctx, "app.example.com", 10, 5)
+	err := provider.SetWeights(ctx, "app.example.com", 10, 5, 0)
 	if !errors.Is(err, context.Canceled) {
 		t.Fatalf("expected context cancellation error, got %v", err)
 	}
@@ -193,7 +211,7 @@ func TestRoute53ProviderNormalizesDomainCase(t *testing.T) {
 	}
 
 	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 1})
-	if err := provider.SetWeights(context.Background(), "App.Example.COM", 15, 25); err != nil {
+	if err := provider.SetWeights(context.Background(), "App.Example.COM", 15, 25, 0); err != nil {
 		t.Fatalf("SetWeights returned error: %v", err)
 	}
 
@@ -207,3 +225,412 @@ func TestRoute53ProviderNormalizesDomainCase(t *testing.T) {
 		t.Fatalf("expected backup weight 25, got %d", got)
 	}
 }
+
+func TestRoute53ProviderCurrentWeights(t *testing.T) {
+	mock := &mockRoute53Client{}
+	mock.listZonesFn = func(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error) {
+		return &route53.ListHostedZonesByNameOutput{
+			HostedZones: []route53types.HostedZone{{Name: aws.String("example.com."), Id: aws.String("/hostedzone/Z123")}},
+		}, nil
+	}
+
+	primary := route53types.ResourceRecordSet{Name: aws.String("app.example.com."), SetIdentifier: aws.String("primary"), Weight: aws.Int64(100)}
+	backup := route53types.ResourceRecordSet{Name: aws.String("app.example.com."), SetIdentifier: aws.String("backup"), Weight: aws.Int64(0)}
+	mock.listRecordsFn = func(ctx context.Context, params *route53.ListResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ListResourceRecordSetsOutput, error) {
+		return &route53.ListResourceRecordSetsOutput{ResourceRecordSets: []route53types.ResourceRecordSet{primary, backup}}, nil
+	}
+	mock.changeRecordFn = func(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+		t.Fatalf("CurrentWeights must not change records")
+		return nil, nil
+	}
+
+	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 1})
+	state, err := provider.CurrentWeights(context.Background(), "App.Example.com.")
+	if err != nil {
+		t.Fatalf("CurrentWeights returned error: %v", err)
+	}
+	if state.PrimaryWeight != 100 || state.BackupWeight != 0 {
+		t.Fatalf("unexpected state %+v", state)
+	}
+}
+
+func TestRoute53ProviderSetWeightsAppliesTTL(t *testing.T) {
+	mock := &mockRoute53Client{}
+	mock.listZonesFn = func(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error) {
+		return &route53.ListHostedZonesByNameOutput{
+			HostedZones: []route53types.HostedZone{{Name: aws.String("example.com."), Id: aws.String("/hostedzone/Z123")}},
+		}, nil
+	}
+
+	primary := route53types.ResourceRecordSet{Name: aws.String("app.example.com."), SetIdentifier: aws.String("primary"), Weight: aws.Int64(100), TTL: aws.Int64(300)}
+	backup := route53types.ResourceRecordSet{
+		Name:          aws.String("app.example.com."),
+		SetIdentifier: aws.String("backup"),
+		Weight:        aws.Int64(0),
+		AliasTarget:   &route53types.AliasTarget{DNSName: aws.String("d111.cloudfront.net."), HostedZoneId: aws.String("Z2FDTNDATAQYW2")},
+	}
+	mock.listRecordsFn = func(ctx context.Context, params *route53.ListResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ListResourceRecordSetsOutput, error) {
+		return &route53.ListResourceRecordSetsOutput{ResourceRecordSets: []route53types.ResourceRecordSet{primary, backup}}, nil
+	}
+
+	var captured *route53.ChangeResourceRecordSetsInput
+	mock.changeRecordFn = func(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+		captured = params
+		return &route53.ChangeResourceRecordSetsOutput{}, nil
+	}
+
+	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 1})
+	if err := provider.SetWeights(context.Background(), "app.example.com", 0, 100, 30); err != nil {
+		t.Fatalf("SetWeights returned error: %v", err)
+	}
+
+	if got := aws.ToInt64(captured.ChangeBatch.Changes[0].ResourceRecordSet.TTL); got != 30 {
+		t.Fatalf("expected primary TTL 30, got %d", got)
+	}
+	if ttl := captured.ChangeBatch.Changes[1].ResourceRecordSet.TTL; ttl != nil {
+		t.Fatalf("expected alias record to carry no TTL, got %d", *ttl)
+	}
+	if aws.ToInt64(primary.TTL) != 300 {
+		t.Fatalf("source record set must not be mutated")
+	}
+}
+
+func failoverZoneMock(records ...route53types.ResourceRecordSet) *mockRoute53Client {
+	mock := &mockRoute53Client{}
+	mock.listZonesFn = func(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error) {
+		return &route53.ListHostedZonesByNameOutput{
+			HostedZones: []route53types.HostedZone{{Name: aws.String("example.com."), Id: aws.String("/hostedzone/Z123")}},
+		}, nil
+	}
+	mock.listRecordsFn = func(ctx context.Context, params *route53.ListResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ListResourceRecordSetsOutput, error) {
+		return &route53.ListResourceRecordSetsOutput{ResourceRecordSets: records}, nil
+	}
+	return mock
+}
+
+func TestRoute53ProviderSetFailoverCreatesHealthCheck(t *testing.T) {
+	primary := route53types.ResourceRecordSet{Name: aws.String("app.example.com."), SetIdentifier: aws.String("primary"), Failover: route53types.ResourceRecordSetFailoverPrimary, TTL: aws.Int64(60)}
+	secondary := route53types.ResourceRecordSet{Name: aws.String("app.example.com."), SetIdentifier: aws.String("backup"), Failover: route53types.ResourceRecordSetFailoverSecondary, TTL: aws.Int64(60)}
+	mock := failoverZoneMock(primary, secondary)
+
+	var createdInverted bool
+	mock.createHCFn = func(ctx context.Context, params *route53.CreateHealthCheckInput, optFns ...func(*route53.Options)) (*route53.CreateHealthCheckOutput, error) {
+		if params.HealthCheckConfig.Type != route53types.HealthCheckTypeCalculated {
+			t.Fatalf("expected calculated health check, got %s", params.HealthCheckConfig.Type)
+		}
+		createdInverted = aws.ToBool(params.HealthCheckConfig.Inverted)
+		return &route53.CreateHealthCheckOutput{HealthCheck: &route53types.HealthCheck{Id: aws.String("hc-1")}}, nil
+	}
+	var captured *route53.ChangeResourceRecordSetsInput
+	mock.changeRecordFn = func(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+		captured = params
+		return &route53.ChangeResourceRecordSetsOutput{}, nil
+	}
+
+	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 1})
+	if err := provider.SetFailover(context.Background(), "app.example.com", false, 0); err != nil {
+		t.Fatalf("SetFailover returned error: %v", err)
+	}
+
+	if !createdInverted {
+		t.Fatalf("expected health check to be inverted for an unhealthy primary")
+	}
+	if captured == nil {
+		t.Fatalf("expected primary record to be attached to the health check")
+	}
+	if got := aws.ToString(captured.ChangeBatch.Changes[0].ResourceRecordSet.HealthCheckId); got != "hc-1" {
+		t.Fatalf("expected primary health check hc-1, got %q", got)
+	}
+}
+
+func TestRoute53ProviderSetFailoverRetryReusesHealthCheckReference(t *testing.T) {
+	primary := route53types.ResourceRecordSet{Name: aws.String("app.example.com."), SetIdentifier: aws.String("primary"), Failover: route53types.ResourceRecordSetFailoverPrimary, TTL: aws.Int64(60)}
+	secondary := route53types.ResourceRecordSet{Name: aws.String("app.example.com."), SetIdentifier: aws.String("backup"), Failover: route53types.ResourceRecordSetFailoverSecondary, TTL: aws.Int64(60)}
+	mock := failoverZoneMock(primary, secondary)
+
+	// The first create succeeds at Route53 but times out on the way back; Route53 answers a
+	// repeat of the same reference and settings with the check it already made.
+	created := make(map[string]string)
+	var references []string
+	mock.createHCFn = func(ctx context.Context, params *route53.CreateHealthCheckInput, optFns ...func(*route53.Options)) (*route53.CreateHealthCheckOutput, error) {
+		ref := aws.ToString(params.CallerReference)
+		references = append(references, ref)
+		id, ok := created[ref]
+		if !ok {
+			id = fmt.Sprintf("hc-%d", len(created)+1)
+			created[ref] = id
+			return nil, errors.New("request timed out")
+		}
+		return &route53.CreateHealthCheckOutput{HealthCheck: &route53types.HealthCheck{Id: aws.String(id)}}, nil
+	}
+	var captured *route53.ChangeResourceRecordSetsInput
+	mock.changeRecordFn = func(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+		captured = params
+		return &route53.ChangeResourceRecordSetsOutput{}, nil
+	}
+
+	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 2})
+	provider.sleepFn = func(time.Duration) {}
+	if err := provider.SetFailover(context.Background(), "app.example.com", false, 0); err != nil {
+		t.Fatalf("SetFailover returned error: %v", err)
+	}
+	if len(references) != 2 || references[0] != references[1] {
+		t.Fatalf("expected the retry to repeat the caller reference, got %v", references)
+	}
+	if len(references[0]) > 64 {
+		t.Fatalf("caller reference %q exceeds Route53's 64 characters", references[0])
+	}
+	if len(created) != 1 {
+		t.Fatalf("expected a single health check, got %d", len(created))
+	}
+	if got := aws.ToString(captured.ChangeBatch.Changes[0].ResourceRecordSet.HealthCheckId); got != "hc-1" {
+		t.Fatalf("expected primary health check hc-1, got %q", got)
+	}
+
+	healthy := &route53types.HealthCheckConfig{Type: route53types.HealthCheckTypeCalculated, HealthThreshold: aws.Int32(0), Inverted: aws.Bool(false)}
+	if healthCheckReference("Z123", "app.example.com", healthy) == references[0] {
+		t.Fatalf("expected different settings to get a different caller reference")
+	}
+}
+
+func TestRoute53ProviderSetFailoverTogglesExistingHealthCheck(t *testing.T) {
+	primary := route53types.ResourceRecordSet{Name: aws.String("app.example.com."), SetIdentifier: aws.String("primary"), Failover: route53types.ResourceRecordSetFailoverPrimary, HealthCheckId: aws.String("hc-1"), TTL: aws.Int64(60)}
+	secondary := route53types.ResourceRecordSet{Name: aws.String("app.example.com."), SetIdentifier: aws.String("backup"), Failover: route53types.ResourceRecordSetFailoverSecondary, TTL: aws.Int64(60)}
+	mock := failoverZoneMock(primary, secondary)
+
+	inverted := true
+	mock.getHCFn = func(ctx context.Context, params *route53.GetHealthCheckInput, optFns ...func(*route53.Options)) (*route53.GetHealthCheckOutput, error) {
+		return &route53.GetHealthCheckOutput{HealthCheck: &route53types.HealthCheck{
+			Id:                params.HealthCheckId,
+			HealthCheckConfig: &route53types.HealthCheckConfig{Type: route53types.HealthCheckTypeCalculated, Inverted: aws.Bool(inverted)},
+		}}, nil
+	}
+	updates := 0
+	mock.updateHCFn = func(ctx context.Context, params *route53.UpdateHealthCheckInput, optFns ...func(*route53.Options)) (*route53.UpdateHealthCheckOutput, error) {
+		updates++
+		inverted = aws.ToBool(params.Inverted)
+		return &route53.UpdateHealthCheckOutput{}, nil
+	}
+	mock.changeRecordFn = func(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+		t.Fatalf("records should not change when only health flips")
+		return nil, nil
+	}
+
+	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 1})
+	if err := provider.SetFailover(context.Background(), "app.example.com", true, 60); err != nil {
+		t.Fatalf("SetFailover returned error: %v", err)
+	}
+	if updates != 1 || inverted {
+		t.Fatalf("expected one update restoring primary health, got updates=%d inverted=%t", updates, inverted)
+	}
+
+	if err := provider.SetFailover(context.Background(), "app.example.com", true, 60); err != nil {
+		t.Fatalf("SetFailover returned error: %v", err)
+	}
+	if updates != 1 {
+		t.Fatalf("expected no update when health already matches, got %d", updates)
+	}
+
+	state, err := provider.CurrentFailover(context.Background(), "app.example.com")
+	if err != nil {
+		t.Fatalf("CurrentFailover returned error: %v", err)
+	}
+	if state.Failover == nil || !state.Failover.PrimaryHealthy || state.TTL != 60 {
+		t.Fatalf("unexpected failover state %+v", state)
+	}
+}
+
+func weightedPair(domain string) []route53types.ResourceRecordSet {
+	return []route53types.ResourceRecordSet{
+		{Name: aws.String(domain + "."), Type: route53types.RRTypeCname, SetIdentifier: aws.String("primary"), Weight: aws.Int64(100), TTL: aws.Int64(60),
+			ResourceRecords: []route53types.ResourceRecord{{Value: aws.String("primary.example.net.")}}},
+		{Name: aws.String(domain + "."), Type: route53types.RRTypeCname, SetIdentifier: aws.String("backup"), Weight: aws.Int64(0), TTL: aws.Int64(60),
+			ResourceRecords: []route53types.ResourceRecord{{Value: aws.String("backup.example.net.")}}},
+	}
+}
+
+// batchZoneMock serves the weighted pairs of domains from two zones, listing each zone in
+// Route53's record order a page of pageSize records at a time. listCalls counts the listings
+// per zone.
+func batchZoneMock(pageSize int, listCalls map[string]int, domains ...string) *mockRoute53Client {
+	mock := &mockRoute53Client{}
+	mock.listZonesFn = func(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error) {
+		return &route53.ListHostedZonesByNameOutput{
+			HostedZones: []route53types.HostedZone{
+				{Name: aws.String("example.com."), Id: aws.String("/hostedzone/ZCOM")},
+				{Name: aws.String("example.org."), Id: aws.String("/hostedzone/ZORG")},
+			},
+		}, nil
+	}
+	zones := map[string][]route53types.ResourceRecordSet{}
+	for _, domain := range domains {
+		zone := "ZCOM"
+		if strings.HasSuffix(domain, ".org") {
+			zone = "ZORG"
+		}
+		zones[zone] = append(zones[zone], weightedPair(domain)...)
+	}
+	for _, records := range zones {
+		sort.SliceStable(records, func(i, j int) bool {
+			return compareRecordNames(strings.TrimSuffix(aws.ToString(records[i].Name), "."), strings.TrimSuffix(aws.ToString(records[j].Name), ".")) < 0
+		})
+	}
+	mock.listRecordsFn = func(ctx context.Context, params *route53.ListResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ListResourceRecordSetsOutput, error) {
+		zone := aws.ToString(params.HostedZoneId)
+		listCalls[zone]++
+		records := zones[zone]
+		startName := strings.TrimSuffix(aws.ToString(params.StartRecordName), ".")
+		i := 0
+		for i < len(records) && compareRecordNames(strings.TrimSuffix(aws.ToString(records[i].Name), "."), startName) < 0 {
+			i++
+		}
+		if id := aws.ToString(params.StartRecordIdentifier); id != "" {
+			for i < len(records) && aws.ToString(records[i].SetIdentifier) != id {
+				i++
+			}
+		}
+		out := &route53.ListResourceRecordSetsOutput{ResourceRecordSets: records[i:min(i+pageSize, len(records))]}
+		if next := i + pageSize; next < len(records) {
+			out.IsTruncated = true
+			out.NextRecordName = records[next].Name
+			out.NextRecordIdentifier = records[next].SetIdentifier
+		}
+		return out, nil
+	}
+	return mock
+}
+
+func TestRoute53ProviderSetWeightsBatchGroupsByZone(t *testing.T) {
+	listCalls := map[string]int{}
+	mock := batchZoneMock(100, listCalls, "a.example.com", "b.example.org", "c.example.com", "d.example.com")
+	var calls []*route53.ChangeResourceRecordSetsInput
+	mock.changeRecordFn = func(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+		calls = append(calls, params)
+		return &route53.ChangeResourceRecordSetsOutput{}, nil
+	}
+
+	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 1})
+	err := provider.SetWeightsBatch(context.Background(), []WeightChange{
+		{Domain: "a.example.com", PrimaryWeight: 0, BackupWeight: 100},
+		{Domain: "b.example.org", PrimaryWeight: 0, BackupWeight: 100},
+		{Domain: "c.example.com", PrimaryWeight: 0, BackupWeight: 100, TTL: 30},
+	})
+	if err != nil {
+		t.Fatalf("SetWeightsBatch returned error: %v", err)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("expected one change batch per zone, got %d", len(calls))
+	}
+	if zone := aws.ToString(calls[0].HostedZoneId); zone != "ZCOM" {
+		t.Fatalf("expected first batch for ZCOM, got %s", zone)
+	}
+	if got := len(calls[0].ChangeBatch.Changes); got != 4 {
+		t.Fatalf("expected 4 changes in the example.com batch, got %d", got)
+	}
+	if got := len(calls[1].ChangeBatch.Changes); got != 2 {
+		t.Fatalf("expected 2 changes in the example.org batch, got %d", got)
+	}
+	for _, change := range calls[0].ChangeBatch.Changes {
+		rr := change.ResourceRecordSet
+		if aws.ToString(rr.SetIdentifier) == "primary" && aws.ToInt64(rr.Weight) != 0 {
+			t.Fatalf("expected primary weight 0 for %s, got %d", aws.ToString(rr.Name), aws.ToInt64(rr.Weight))
+		}
+	}
+	if got := aws.ToInt64(calls[0].ChangeBatch.Changes[2].ResourceRecordSet.TTL); got != 30 {
+		t.Fatalf("expected ttl 30 for c.example.com, got %d", got)
+	}
+	if listCalls["ZCOM"] != 1 || listCalls["ZORG"] != 1 {
+		t.Fatalf("expected each zone to be listed once, got %v", listCalls)
+	}
+}
+
+func TestRoute53ProviderSetWeightsBatchReportsPerDomainFailures(t *testing.T) {
+	mock := batchZoneMock(100, map[string]int{}, "app.example.com")
+	var changed []string
+	mock.changeRecordFn = func(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+		for _, change := range params.ChangeBatch.Changes {
+			changed = append(changed, aws.ToString(change.ResourceRecordSet.Name))
+		}
+		return &route53.ChangeResourceRecordSetsOutput{}, nil
+	}
+
+	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 1})
+	err := provider.SetWeightsBatch(context.Background(), []WeightChange{
+		{Domain: "app.example.com", PrimaryWeight: 100},
+		{Domain: "missing.example.com", PrimaryWeight: 100},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected *BatchError, got %v", err)
+	}
+	if DomainError(err, "missing.example.com") == nil {
+		t.Fatalf("expected missing.example.com to fail")
+	}
+	if err := DomainError(err, "app.example.com"); err != nil {
+		t.Fatalf("expected app.example.com to succeed, got %v", err)
+	}
+	if len(changed) != 2 || changed[0] != "app.example.com." {
+		t.Fatalf("expected only app.example.com records to change, got %v", changed)
+	}
+}
+
+func TestRoute53ProviderSetWeightsBatchDeduplicatesDomains(t *testing.T) {
+	mock := batchZoneMock(100, map[string]int{}, "app.example.com", "web.example.com")
+	var calls []*route53.ChangeResourceRecordSetsInput
+	mock.changeRecordFn = func(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+		calls = append(calls, params)
+		return &route53.ChangeResourceRecordSetsOutput{}, nil
+	}
+
+	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 1})
+	err := provider.SetWeightsBatch(context.Background(), []WeightChange{
+		{Domain: "app.example.com", PrimaryWeight: 100},
+		{Domain: "web.example.com", PrimaryWeight: 100},
+		{Domain: "App.example.com.", PrimaryWeight: 0, BackupWeight: 100},
+	})
+	if err != nil {
+		t.Fatalf("SetWeightsBatch returned error: %v", err)
+	}
+	if len(calls) != 1 || len(calls[0].ChangeBatch.Changes) != 4 {
+		t.Fatalf("expected one batch with each domain's records once, got %+v", calls)
+	}
+	for _, change := range calls[0].ChangeBatch.Changes {
+		rr := change.ResourceRecordSet
+		if aws.ToString(rr.Name) == "app.example.com." && aws.ToString(rr.SetIdentifier) == "primary" && aws.ToInt64(rr.Weight) != 0 {
+			t.Fatalf("expected app.example.com to take its last change, got primary weight %d", aws.ToInt64(rr.Weight))
+		}
+	}
+}
+
+func TestRoute53ProviderSetWeightsBatchChunksLargeZones(t *testing.T) {
+	var domains []string
+	for i := 0; i < 300; i++ {
+		domains = append(domains, fmt.Sprintf("d%d.example.com", i))
+	}
+	listCalls := map[string]int{}
+	mock := batchZoneMock(300, listCalls, domains...)
+	var sizes []int
+	mock.changeRecordFn = func(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+		sizes = append(sizes, len(params.ChangeBatch.Changes))
+		return &route53.ChangeResourceRecordSetsOutput{}, nil
+	}
+
+	var changes []WeightChange
+	for _, domain := range domains {
+		changes = append(changes, WeightChange{Domain: domain, PrimaryWeight: 100})
+	}
+	provider := newRoute53Provider(discardLogger(), mock, Route53ProviderConfig{MaxAttempts: 1})
+	if err := provider.SetWeightsBatch(context.Background(), changes); err != nil {
+		t.Fatalf("SetWeightsBatch returned error: %v", err)
+	}
+
+	// Each UPSERT of a single-value record counts as two ResourceRecord elements, so
+	// 1000 elements fit 250 domains (500 changes) per batch.
+	if len(sizes) != 2 || sizes[0] != 500 || sizes[1] != 100 {
+		t.Fatalf("expected batches of 500 and 100 changes, got %v", sizes)
+	}
+	// 600 records at 300 per page.
+	if listCalls["ZCOM"] != 2 {
+		t.Fatalf("expected the zone to be listed in 2 pages, got %d", listCalls["ZCOM"])
+	}
+}
@@ -0,0 +1,274 @@
+// Package export pushes finalized invoices to a payment processor and voids them there once
+// they are voided in Tranche. An Exporter speaks one processor's API; the Syncer finds
+// invoices due for export, hands them to the exporter and records the outcome, retrying
+// failures with exponential backoff.
+package export
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/invoicerender"
+)
+
+type Logger interface {
+	Printf(string, ...any)
+}
+
+// Invoice is one invoice to export. ExportedLineItems maps the IDs of line items an earlier
+// attempt already pushed to their processor IDs; the invoice's ExternalID and the
+// customer's ExternalCustomerID are likewise set once pushed.
+type Invoice struct {
+	invoicerender.Document
+	ExportedLineItems map[int64]string
+}
+
+// Recorder saves processor IDs as soon as the processor has accepted each object, so an
+// attempt that fails halfway resumes where it stopped.
+type Recorder interface {
+	CustomerExported(ctx context.Context, customerID int64, externalID string) error
+	InvoiceExported(ctx context.Context, invoiceID int64, externalID string) error
+	LineItemExported(ctx context.Context, invoiceID, lineItemID int64, externalID string) error
+}
+
+// Exporter pushes an invoice and its line items to a payment processor. Export must be safe
+// to call again for the same invoice after any error: implementations skip objects the
+// Invoice already carries IDs for and key every create by an idempotency key derived from
+// Tranche IDs. Void cancels whatever an earlier Export left at the processor, finished or
+// not, and is likewise safe to repeat. Errors wrapped with Permanent are not retried.
+type Exporter interface {
+	Name() string
+	Export(ctx context.Context, inv Invoice, rec Recorder) error
+	Void(ctx context.Context, inv Invoice) error
+}
+
+// PermanentError marks a failure retrying cannot fix, such as the processor rejecting the
+// request as invalid.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err so the Syncer stops retrying the invoice.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err or anything it wraps is a PermanentError.
+func IsPermanent(err error) bool {
+	var p *PermanentError
+	return errors.As(err, &p)
+}
+
+// Export statuses stored on invoices.
+const (
+	StatusPending = "pending"
+	StatusSynced  = "synced"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+type Config struct {
+	// BatchSize is how many due invoices one run exports.
+	BatchSize int
+	// MaxAttempts is how many times an invoice is tried before it is marked failed.
+	MaxAttempts int
+	// RetryBase is the delay after the first failure; it doubles with each further one up
+	// to RetryMax.
+	RetryBase time.Duration
+	RetryMax  time.Duration
+	// Lease is how long an invoice being exported is hidden from other workers.
+	Lease time.Duration
+}
+
+// Syncer exports due invoices through one Exporter.
+type Syncer struct {
+	db  *db.Queries
+	exp Exporter
+	log Logger
+	cfg Config
+}
+
+func NewSyncer(queries *db.Queries, exp Exporter, log Logger, cfg Config) *Syncer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 20
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 8
+	}
+	if cfg.RetryBase <= 0 {
+		cfg.RetryBase = time.Minute
+	}
+	if cfg.RetryMax < cfg.RetryBase {
+		cfg.RetryMax = 6 * time.Hour
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = 10 * time.Minute
+	}
+	return &Syncer{db: queries, exp: exp, log: log, cfg: cfg}
+}
+
+// RunOnce exports up to BatchSize due invoices. A failed invoice does not stop the others;
+// only errors reading the queue are returned.
+func (s *Syncer) RunOnce(ctx context.Context, now time.Time) error {
+	due, err := s.db.ListInvoicesDueForExport(ctx, db.ListInvoicesDueForExportParams{
+		ExportNextAttemptAt: sql.NullTime{Time: now, Valid: true},
+		Limit:               int32(s.cfg.BatchSize),
+	})
+	if err != nil {
+		return fmt.Errorf("list invoices due for export: %w", err)
+	}
+	for _, invoice := range due {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		claimed, err := s.db.ClaimInvoiceExport(ctx, db.ClaimInvoiceExportParams{
+			LeaseUntil: sql.NullTime{Time: now.Add(s.cfg.Lease), Valid: true},
+			ID:         invoice.ID,
+			Now:        sql.NullTime{Time: now, Valid: true},
+		})
+		if err != nil {
+			return fmt.Errorf("claim invoice %d: %w", invoice.ID, err)
+		}
+		if claimed == 0 {
+			continue
+		}
+		s.sync(ctx, invoice, now)
+	}
+	return nil
+}
+
+// sync exports the invoice, or voids it at the processor if it was voided. An invoice voided
+// while its export runs is not marked either way; it is voided once the lease expires.
+func (s *Syncer) sync(ctx context.Context, invoice db.Invoice, now time.Time) {
+	action := "export"
+	inv, err := s.load(ctx, invoice)
+	if err == nil {
+		if invoice.Status == "void" {
+			action = "void"
+			err = s.exp.Void(ctx, inv)
+		} else {
+			err = s.exp.Export(ctx, inv, recorder{q: s.db})
+		}
+	}
+	if err == nil {
+		if _, err := s.db.MarkInvoiceExported(ctx, db.MarkInvoiceExportedParams{ID: invoice.ID, Status: invoice.Status}); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.log.Printf("invoice %d changed during its %s; it is picked up again once the lease expires", invoice.ID, action)
+				return
+			}
+			// The lease expires and the next run finds everything already done.
+			s.log.Printf("mark invoice %d exported: %v", invoice.ID, err)
+			return
+		}
+		if action == "void" {
+			s.log.Printf("voided invoice %d at %s", invoice.ID, s.exp.Name())
+		} else {
+			s.log.Printf("exported invoice %d to %s", invoice.ID, s.exp.Name())
+		}
+		return
+	}
+
+	attempt := int(invoice.ExportAttempts) + 1
+	params := db.MarkInvoiceExportFailedParams{
+		ID:           invoice.ID,
+		ExportStatus: StatusPending,
+		ExportError:  sql.NullString{String: err.Error(), Valid: true},
+		Status:       invoice.Status,
+	}
+	if IsPermanent(err) || attempt >= s.cfg.MaxAttempts {
+		params.ExportStatus = StatusFailed
+	} else {
+		params.ExportNextAttemptAt = sql.NullTime{Time: now.Add(s.retryDelay(attempt)), Valid: true}
+	}
+	if _, markErr := s.db.MarkInvoiceExportFailed(ctx, params); errors.Is(markErr, sql.ErrNoRows) {
+		s.log.Printf("invoice %d changed during its %s; it is picked up again once the lease expires", invoice.ID, action)
+	} else if markErr != nil {
+		s.log.Printf("record export failure for invoice %d: %v", invoice.ID, markErr)
+	}
+	s.log.Printf("%s invoice %d with %s (attempt %d, status %s): %v", action, invoice.ID, s.exp.Name(), attempt, params.ExportStatus, err)
+}
+
+func (s *Syncer) load(ctx context.Context, invoice db.Invoice) (Invoice, error) {
+	customer, err := s.db.GetCustomer(ctx, invoice.CustomerID)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("load customer %d: %w", invoice.CustomerID, err)
+	}
+	items, err := s.db.ListInvoiceLineItems(ctx, invoice.ID)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("list line items: %w", err)
+	}
+	services, err := s.db.ListInvoiceServices(ctx, invoice.ID)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("list invoice services: %w", err)
+	}
+	exported, err := s.db.ListInvoiceLineItemExports(ctx, invoice.ID)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("list exported line items: %w", err)
+	}
+	inv := Invoice{
+		Document: invoicerender.Document{
+			Invoice:   invoice,
+			Customer:  customer,
+			LineItems: items,
+			Services:  make(map[int64]string, len(services)),
+		},
+		ExportedLineItems: make(map[int64]string, len(exported)),
+	}
+	for _, svc := range services {
+		inv.Services[svc.ID] = svc.Name
+	}
+	for _, e := range exported {
+		inv.ExportedLineItems[e.LineItemID] = e.ExternalID
+	}
+	return inv, nil
+}
+
+// retryDelay is the wait after the given failed attempt, counted from 1.
+func (s *Syncer) retryDelay(attempt int) time.Duration {
+	delay := s.cfg.RetryBase
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= s.cfg.RetryMax {
+			return s.cfg.RetryMax
+		}
+	}
+	return delay
+}
+
+// recorder writes processor IDs outside any transaction so they survive a failed attempt.
+type recorder struct {
+	q *db.Queries
+}
+
+func (r recorder) CustomerExported(ctx context.Context, customerID int64, externalID string) error {
+	return r.q.SetCustomerExternalID(ctx, db.SetCustomerExternalIDParams{
+		ID:                 customerID,
+		ExternalCustomerID: sql.NullString{String: externalID, Valid: true},
+	})
+}
+
+func (r recorder) InvoiceExported(ctx context.Context, invoiceID int64, externalID string) error {
+	return r.q.SetInvoiceExternalID(ctx, db.SetInvoiceExternalIDParams{
+		ID:         invoiceID,
+		ExternalID: sql.NullString{String: externalID, Valid: true},
+	})
+}
+
+func (r recorder) LineItemExported(ctx context.Context, invoiceID, lineItemID int64, externalID string) error {
+	return r.q.InsertInvoiceLineItemExport(ctx, db.InsertInvoiceLineItemExportParams{
+		LineItemID: lineItemID,
+		InvoiceID:  invoiceID,
+		ExternalID: externalID,
+	})
+}
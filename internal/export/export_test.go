@@ -0,0 +1,35 @@
+package export
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryDelayDoublesUpToMax(t *testing.T) {
+	s := NewSyncer(nil, nil, nil, Config{RetryBase: time.Minute, RetryMax: 10 * time.Minute})
+	for attempt, want := range map[int]time.Duration{
+		1: time.Minute,
+		2: 2 * time.Minute,
+		3: 4 * time.Minute,
+		4: 8 * time.Minute,
+		5: 10 * time.Minute,
+		9: 10 * time.Minute,
+	} {
+		if got := s.retryDelay(attempt); got != want {
+			t.Fatalf("retryDelay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestPermanentSurvivesWrapping(t *testing.T) {
+	base := errors.New("bad request")
+	err := fmt.Errorf("create invoice: %w", Permanent(base))
+	if !IsPermanent(err) || !errors.Is(err, base) {
+		t.Fatalf("expected a wrapped permanent error, got %v", err)
+	}
+	if IsPermanent(base) || Permanent(nil) != nil {
+		t.Fatalf("expected plain errors and nil to stay as they are")
+	}
+}
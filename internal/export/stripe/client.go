@@ -0,0 +1,271 @@
+// Package stripe exports invoices to Stripe or any processor speaking its REST API.
+package stripe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tranche/internal/export"
+	"tranche/internal/invoicerender"
+)
+
+const defaultEndpoint = "https://api.stripe.com"
+
+// Client pushes each Tranche invoice as a Stripe invoice in the invoice's currency carrying
+// one invoice item per line item, then finalizes it. Customers without a Stripe customer
+// are created first. Every create carries an idempotency key derived from the Tranche ID,
+// so replaying an export never duplicates objects. Voiding a Tranche invoice voids its
+// Stripe invoice, or deletes it if an unfinished export left it a draft.
+type Client struct {
+	apiKey       string
+	endpoint     string
+	client       *http.Client
+	daysUntilDue int
+}
+
+type ClientOption func(*Client)
+
+// WithEndpoint points the client at another Stripe-compatible API, such as a test stand-in.
+func WithEndpoint(endpoint string) ClientOption {
+	return func(c *Client) {
+		c.endpoint = strings.TrimRight(endpoint, "/")
+	}
+}
+
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// WithDaysUntilDue sets the payment terms on exported invoices; the default is 30 days.
+func WithDaysUntilDue(days int) ClientOption {
+	return func(c *Client) {
+		c.daysUntilDue = days
+	}
+}
+
+func NewClient(apiKey string, opts ...ClientOption) *Client {
+	c := &Client{
+		apiKey:       apiKey,
+		endpoint:     defaultEndpoint,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		daysUntilDue: 30,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+var _ export.Exporter = (*Client)(nil)
+
+func (c *Client) Name() string {
+	return "stripe"
+}
+
+// APIError is an error response from the API. Client errors other than 409 (a concurrent
+// request with the same idempotency key) and 429 are permanent.
+type APIError struct {
+	Status  int
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	if e.Code != "" {
+		return fmt.Sprintf("stripe %d %s: %s", e.Status, e.Code, msg)
+	}
+	return fmt.Sprintf("stripe %d: %s", e.Status, msg)
+}
+
+func (e *APIError) permanent() bool {
+	return e.Status >= 400 && e.Status < 500 && e.Status != http.StatusConflict && e.Status != http.StatusTooManyRequests
+}
+
+type object struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Total  int64  `json:"total"`
+}
+
+// Export creates whatever the invoice is still missing at the processor and finalizes it.
+func (c *Client) Export(ctx context.Context, inv export.Invoice, rec export.Recorder) error {
+	currency := strings.ToLower(inv.Invoice.Currency)
+	customerID := inv.Customer.ExternalCustomerID.String
+	if customerID == "" {
+		form := url.Values{}
+		form.Set("name", inv.Customer.Name)
+		form.Set("metadata[tranche_customer_id]", strconv.FormatInt(inv.Customer.ID, 10))
+		var customer object
+		if err := c.post(ctx, "/v1/customers", form, fmt.Sprintf("tranche-customer-%d", inv.Customer.ID), &customer); err != nil {
+			return fmt.Errorf("create customer: %w", err)
+		}
+		if err := rec.CustomerExported(ctx, inv.Customer.ID, customer.ID); err != nil {
+			return fmt.Errorf("record customer %s: %w", customer.ID, err)
+		}
+		customerID = customer.ID
+	}
+
+	invoiceID := inv.Invoice.ExternalID.String
+	if invoiceID == "" {
+		form := url.Values{}
+		form.Set("customer", customerID)
+		form.Set("currency", currency)
+		form.Set("collection_method", "send_invoice")
+		form.Set("days_until_due", strconv.Itoa(c.daysUntilDue))
+		form.Set("auto_advance", "false")
+		form.Set("pending_invoice_items_behavior", "exclude")
+		form.Set("description", invoicerender.Number(inv.Invoice.ID))
+		form.Set("metadata[tranche_invoice_id]", strconv.FormatInt(inv.Invoice.ID, 10))
+		var created object
+		if err := c.post(ctx, "/v1/invoices", form, fmt.Sprintf("tranche-invoice-%d", inv.Invoice.ID), &created); err != nil {
+			return fmt.Errorf("create invoice: %w", err)
+		}
+		if err := rec.InvoiceExported(ctx, inv.Invoice.ID, created.ID); err != nil {
+			return fmt.Errorf("record invoice %s: %w", created.ID, err)
+		}
+		invoiceID = created.ID
+	}
+
+	for _, item := range inv.LineItems {
+		if _, done := inv.ExportedLineItems[item.ID]; done {
+			continue
+		}
+		form := url.Values{}
+		form.Set("customer", customerID)
+		form.Set("invoice", invoiceID)
+		form.Set("currency", currency)
+		form.Set("amount", strconv.FormatInt(item.AmountCents-item.DiscountCents, 10))
+		form.Set("description", invoicerender.Describe(item, inv.Services))
+		form.Set("period[start]", strconv.FormatInt(item.WindowStart.Unix(), 10))
+		form.Set("period[end]", strconv.FormatInt(item.WindowEnd.Unix(), 10))
+		form.Set("metadata[tranche_line_item_id]", strconv.FormatInt(item.ID, 10))
+		form.Set("metadata[kind]", item.Kind)
+		var created object
+		if err := c.post(ctx, "/v1/invoiceitems", form, fmt.Sprintf("tranche-line-item-%d", item.ID), &created); err != nil {
+			return fmt.Errorf("create invoice item for line item %d: %w", item.ID, err)
+		}
+		if err := rec.LineItemExported(ctx, inv.Invoice.ID, item.ID, created.ID); err != nil {
+			return fmt.Errorf("record invoice item %s: %w", created.ID, err)
+		}
+	}
+
+	var current object
+	if err := c.do(ctx, http.MethodGet, "/v1/invoices/"+url.PathEscape(invoiceID), nil, "", &current); err != nil {
+		return fmt.Errorf("fetch invoice %s: %w", invoiceID, err)
+	}
+	switch current.Status {
+	case "draft":
+	case "open", "paid":
+		// Finalized by an earlier attempt whose response was lost.
+		return nil
+	default:
+		return export.Permanent(fmt.Errorf("invoice %s is %s at the processor", invoiceID, current.Status))
+	}
+	if current.Total != inv.Invoice.TotalCents {
+		return export.Permanent(fmt.Errorf("invoice %s totals %d at the processor, want %d", invoiceID, current.Total, inv.Invoice.TotalCents))
+	}
+	var finalized object
+	if err := c.post(ctx, "/v1/invoices/"+url.PathEscape(invoiceID)+"/finalize", url.Values{"auto_advance": {"false"}}, fmt.Sprintf("tranche-invoice-%d-finalize", inv.Invoice.ID), &finalized); err != nil {
+		return fmt.Errorf("finalize invoice %s: %w", invoiceID, err)
+	}
+	return nil
+}
+
+// Void cancels the invoice an earlier Export pushed. An invoice that never reached the
+// processor needs nothing, and one already voided or deleted there is left as it is.
+func (c *Client) Void(ctx context.Context, inv export.Invoice) error {
+	invoiceID := inv.Invoice.ExternalID.String
+	if invoiceID == "" {
+		return nil
+	}
+	path := "/v1/invoices/" + url.PathEscape(invoiceID)
+	var current object
+	if err := c.do(ctx, http.MethodGet, path, nil, "", &current); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+			// Deleted as a draft by an earlier attempt whose response was lost.
+			return nil
+		}
+		return fmt.Errorf("fetch invoice %s: %w", invoiceID, err)
+	}
+	switch current.Status {
+	case "draft":
+		// Drafts cannot be voided; deleting one deletes its invoice items too.
+		var deleted object
+		if err := c.do(ctx, http.MethodDelete, path, nil, "", &deleted); err != nil {
+			return fmt.Errorf("delete draft invoice %s: %w", invoiceID, err)
+		}
+	case "open", "uncollectible":
+		var voided object
+		if err := c.post(ctx, path+"/void", url.Values{}, fmt.Sprintf("tranche-invoice-%d-void", inv.Invoice.ID), &voided); err != nil {
+			return fmt.Errorf("void invoice %s: %w", invoiceID, err)
+		}
+	case "void":
+	default:
+		return export.Permanent(fmt.Errorf("invoice %s is %s at the processor and cannot be voided", invoiceID, current.Status))
+	}
+	return nil
+}
+
+func (c *Client) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out any) error {
+	return c.do(ctx, http.MethodPost, path, form, idempotencyKey, out)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, form url.Values, idempotencyKey string, out any) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, body)
+	if err != nil {
+		return export.Permanent(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		apiErr := &APIError{Status: resp.StatusCode}
+		var envelope struct {
+			Error *APIError `json:"error"`
+		}
+		if json.Unmarshal(raw, &envelope) == nil && envelope.Error != nil {
+			apiErr.Type, apiErr.Code, apiErr.Message = envelope.Error.Type, envelope.Error.Code, envelope.Error.Message
+		}
+		if apiErr.permanent() {
+			return export.Permanent(apiErr)
+		}
+		return apiErr
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package stripe
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/export"
+	"tranche/internal/invoicerender"
+)
+
+// fakeStripe is a stand-in for the parts of the Stripe API the exporter uses. It replays
+// responses for repeated idempotency keys the way Stripe does, and fail lets a test inject
+// an error response for the nth request to a path.
+type fakeStripe struct {
+	t *testing.T
+
+	mu        sync.Mutex
+	nextID    int
+	requests  map[string]int
+	replays   map[string][]byte
+	customers map[string]string
+	invoices  map[string]*fakeInvoice
+	items     map[string]int64
+	fail      func(path string, n int) (int, string)
+}
+
+type fakeInvoice struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Total  int64  `json:"total"`
+}
+
+func newFakeStripe(t *testing.T) (*fakeStripe, *httptest.Server) {
+	f := &fakeStripe{
+		t:         t,
+		requests:  make(map[string]int),
+		replays:   make(map[string][]byte),
+		customers: make(map[string]string),
+		invoices:  make(map[string]*fakeInvoice),
+		items:     make(map[string]int64),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeStripe) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if got := r.Header.Get("Authorization"); got != "Bearer sk_test" {
+		f.t.Errorf("unexpected authorization header %q", got)
+	}
+	f.requests[r.URL.Path]++
+	if f.fail != nil {
+		if status, code := f.fail(r.URL.Path, f.requests[r.URL.Path]); status != 0 {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"error":{"type":"api_error","code":%q,"message":"injected"}}`, code)
+			return
+		}
+	}
+	if err := r.ParseForm(); err != nil {
+		f.t.Errorf("parse form: %v", err)
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if r.Method == http.MethodPost {
+		if key == "" {
+			f.t.Errorf("POST %s without an idempotency key", r.URL.Path)
+		}
+		if body, ok := f.replays[key]; ok {
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Write(body)
+			return
+		}
+	}
+
+	var resp any
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/customers":
+		id := f.id("cus")
+		f.customers[id] = r.PostForm.Get("name")
+		resp = map[string]string{"id": id}
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/invoices":
+		if r.PostForm.Get("currency") != "usd" || r.PostForm.Get("pending_invoice_items_behavior") != "exclude" {
+			f.t.Errorf("unexpected invoice form %v", r.PostForm)
+		}
+		inv := &fakeInvoice{ID: f.id("in"), Status: "draft"}
+		f.invoices[inv.ID] = inv
+		resp = inv
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/invoiceitems":
+		inv := f.invoices[r.PostForm.Get("invoice")]
+		if inv == nil || inv.Status != "draft" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"type":"invalid_request_error","code":"invoice_not_editable","message":"invoice is not a draft"}}`)
+			return
+		}
+		amount, _ := strconv.ParseInt(r.PostForm.Get("amount"), 10, 64)
+		id := f.id("ii")
+		f.items[id] = amount
+		inv.Total += amount
+		resp = map[string]string{"id": id}
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/invoices/"):
+		inv := f.invoices[strings.TrimPrefix(r.URL.Path, "/v1/invoices/")]
+		if inv == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"type":"invalid_request_error","code":"resource_missing"}}`)
+			return
+		}
+		resp = inv
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/finalize"):
+		inv := f.invoices[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/invoices/"), "/finalize")]
+		if inv == nil || inv.Status != "draft" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"type":"invalid_request_error","code":"invoice_not_editable"}}`)
+			return
+		}
+		inv.Status = "open"
+		resp = inv
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/void"):
+		inv := f.invoices[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/invoices/"), "/void")]
+		if inv == nil || (inv.Status != "open" && inv.Status != "uncollectible") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"type":"invalid_request_error","code":"invoice_not_voidable"}}`)
+			return
+		}
+		inv.Status = "void"
+		resp = inv
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/invoices/"):
+		inv := f.invoices[strings.TrimPrefix(r.URL.Path, "/v1/invoices/")]
+		if inv == nil || inv.Status != "draft" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"type":"invalid_request_error","code":"invoice_not_deletable"}}`)
+			return
+		}
+		delete(f.invoices, inv.ID)
+		resp = map[string]any{"id": inv.ID, "deleted": true}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, _ := json.Marshal(resp)
+	if key != "" {
+		f.replays[key] = body
+	}
+	w.Write(body)
+}
+
+func (f *fakeStripe) id(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s_%d", prefix, f.nextID)
+}
+
+// memRecorder plays the part of the database, feeding recorded IDs into the next attempt.
+type memRecorder struct {
+	customer string
+	invoice  string
+	items    map[int64]string
+}
+
+func (m *memRecorder) CustomerExported(_ context.Context, _ int64, id string) error {
+	m.customer = id
+	return nil
+}
+
+func (m *memRecorder) InvoiceExported(_ context.Context, _ int64, id string) error {
+	m.invoice = id
+	return nil
+}
+
+func (m *memRecorder) LineItemExported(_ context.Context, _, lineItemID int64, id string) error {
+	if m.items == nil {
+		m.items = make(map[int64]string)
+	}
+	m.items[lineItemID] = id
+	return nil
+}
+
+// apply returns inv as the syncer would load it after the recorded progress.
+func (m *memRecorder) apply(inv export.Invoice) export.Invoice {
+	inv.Customer.ExternalCustomerID = sql.NullString{String: m.customer, Valid: m.customer != ""}
+	inv.Invoice.ExternalID = sql.NullString{String: m.invoice, Valid: m.invoice != ""}
+	inv.ExportedLineItems = make(map[int64]string)
+	for k, v := range m.items {
+		inv.ExportedLineItems[k] = v
+	}
+	return inv
+}
+
+func testInvoice() export.Invoice {
+	start := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	return export.Invoice{
+		Document: invoicerender.Document{
+			Invoice:  db.Invoice{ID: 42, CustomerID: 3, PeriodStart: start, PeriodEnd: start.AddDate(0, 1, 0), TotalCents: 2380, Status: "finalized", Currency: "USD"},
+			Customer: db.Customer{ID: 3, Name: "Acme"},
+			LineItems: []db.InvoiceLineItem{
+				{ID: 1, Kind: "usage", ServiceID: sql.NullInt64{Int64: 7, Valid: true}, WindowStart: start, WindowEnd: start.Add(time.Hour), AmountCents: 1500, DiscountCents: 20},
+				{ID: 2, Kind: "usage", ServiceID: sql.NullInt64{Int64: 7, Valid: true}, WindowStart: start.Add(time.Hour), WindowEnd: start.Add(2 * time.Hour), AmountCents: 1000},
+				{ID: 3, Kind: "sla_credit", ServiceID: sql.NullInt64{Int64: 7, Valid: true}, WindowStart: start, WindowEnd: start.AddDate(0, 1, 0), AmountCents: -100},
+			},
+			Services: map[int64]string{7: "web"},
+		},
+	}
+}
+
+func TestExportCreatesAndFinalizesInvoice(t *testing.T) {
+	f, srv := newFakeStripe(t)
+	c := NewClient("sk_test", WithEndpoint(srv.URL))
+	rec := &memRecorder{}
+
+	if err := c.Export(context.Background(), testInvoice(), rec); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if rec.customer == "" || rec.invoice == "" || len(rec.items) != 3 {
+		t.Fatalf("expected customer, invoice and 3 items recorded, got %+v", rec)
+	}
+	inv := f.invoices[rec.invoice]
+	if inv.Status != "open" || inv.Total != 2380 {
+		t.Fatalf("unexpected processor invoice %+v", inv)
+	}
+	if f.items[rec.items[1]] != 1480 || f.items[rec.items[3]] != -100 {
+		t.Fatalf("expected net amounts per item, got %v", f.items)
+	}
+}
+
+func TestExportResumesAfterFailureWithoutDuplicates(t *testing.T) {
+	f, srv := newFakeStripe(t)
+	f.fail = func(path string, n int) (int, string) {
+		if path == "/v1/invoiceitems" && n == 2 {
+			return http.StatusServiceUnavailable, ""
+		}
+		return 0, ""
+	}
+	c := NewClient("sk_test", WithEndpoint(srv.URL))
+	rec := &memRecorder{}
+
+	err := c.Export(context.Background(), testInvoice(), rec)
+	if err == nil || export.IsPermanent(err) {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+	if len(rec.items) != 1 {
+		t.Fatalf("expected the first item recorded before the failure, got %v", rec.items)
+	}
+	if err := c.Export(context.Background(), rec.apply(testInvoice()), rec); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if len(f.customers) != 1 || len(f.invoices) != 1 || len(f.items) != 3 {
+		t.Fatalf("expected no duplicates, got %d customers, %d invoices, %d items", len(f.customers), len(f.invoices), len(f.items))
+	}
+	if inv := f.invoices[rec.invoice]; inv.Status != "open" || inv.Total != 2380 {
+		t.Fatalf("unexpected processor invoice %+v", inv)
+	}
+}
+
+func TestExportReplaysIdempotentlyWhenProgressWasLost(t *testing.T) {
+	f, srv := newFakeStripe(t)
+	c := NewClient("sk_test", WithEndpoint(srv.URL))
+
+	if err := c.Export(context.Background(), testInvoice(), &memRecorder{}); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	// Nothing was recorded, so the second attempt repeats every create.
+	rec := &memRecorder{}
+	if err := c.Export(context.Background(), testInvoice(), rec); err != nil {
+		t.Fatalf("second Export: %v", err)
+	}
+	if len(f.customers) != 1 || len(f.invoices) != 1 || len(f.items) != 3 {
+		t.Fatalf("expected idempotent replays, got %d customers, %d invoices, %d items", len(f.customers), len(f.invoices), len(f.items))
+	}
+	if len(rec.items) != 3 {
+		t.Fatalf("expected replayed IDs recorded, got %v", rec.items)
+	}
+}
+
+func TestExportRejectsTotalMismatch(t *testing.T) {
+	_, srv := newFakeStripe(t)
+	c := NewClient("sk_test", WithEndpoint(srv.URL))
+	inv := testInvoice()
+	inv.Invoice.TotalCents = 9999
+
+	err := c.Export(context.Background(), inv, &memRecorder{})
+	if !export.IsPermanent(err) || !strings.Contains(err.Error(), "want 9999") {
+		t.Fatalf("expected a permanent total mismatch, got %v", err)
+	}
+}
+
+func TestAPIErrorsClassified(t *testing.T) {
+	for status, permanent := range map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusUnauthorized:        true,
+		http.StatusConflict:            false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+	} {
+		f, srv := newFakeStripe(t)
+		f.fail = func(string, int) (int, string) { return status, "some_code" }
+		err := NewClient("sk_test", WithEndpoint(srv.URL)).Export(context.Background(), testInvoice(), &memRecorder{})
+		if err == nil || export.IsPermanent(err) != permanent {
+			t.Fatalf("status %d: expected permanent=%v, got %v", status, permanent, err)
+		}
+		if !strings.Contains(err.Error(), "some_code") {
+			t.Fatalf("status %d: expected the error code in %q", status, err)
+		}
+	}
+}
+
+// voided returns inv as the syncer loads it once the invoice is voided in Tranche.
+func voided(inv export.Invoice) export.Invoice {
+	inv.Invoice.Status = "void"
+	return inv
+}
+
+func TestVoidThenExportReplacement(t *testing.T) {
+	f, srv := newFakeStripe(t)
+	c := NewClient("sk_test", WithEndpoint(srv.URL))
+	rec := &memRecorder{}
+	if err := c.Export(context.Background(), testInvoice(), rec); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	original := rec.invoice
+
+	old := voided(rec.apply(testInvoice()))
+	if err := c.Void(context.Background(), old); err != nil {
+		t.Fatalf("Void: %v", err)
+	}
+	// A retry after a lost response finds the invoice already void.
+	if err := c.Void(context.Background(), old); err != nil {
+		t.Fatalf("second Void: %v", err)
+	}
+	if inv := f.invoices[original]; inv.Status != "void" || f.requests["/v1/invoices/"+original+"/void"] != 1 {
+		t.Fatalf("expected the original voided once, got %+v after %d requests", inv, f.requests["/v1/invoices/"+original+"/void"])
+	}
+
+	replacement := testInvoice()
+	replacement.Invoice.ID = 43
+	replacement.Invoice.ReplacesInvoiceID = sql.NullInt64{Int64: 42, Valid: true}
+	replacement.Invoice.TotalCents = 1380
+	replacement.LineItems = []db.InvoiceLineItem{replacement.LineItems[0], replacement.LineItems[2]}
+	replacement.LineItems[0].ID, replacement.LineItems[1].ID = 4, 5
+	replacement.Customer.ExternalCustomerID = sql.NullString{String: rec.customer, Valid: true}
+	next := &memRecorder{customer: rec.customer}
+	if err := c.Export(context.Background(), replacement, next); err != nil {
+		t.Fatalf("Export replacement: %v", err)
+	}
+	var open []*fakeInvoice
+	for _, inv := range f.invoices {
+		if inv.Status == "open" {
+			open = append(open, inv)
+		}
+	}
+	if len(f.customers) != 1 || len(open) != 1 || open[0].ID != next.invoice || open[0].Total != 1380 {
+		t.Fatalf("expected only the replacement open at the processor, got %d customers and %+v", len(f.customers), open)
+	}
+}
+
+func TestVoidDeletesDraftLeftByUnfinishedExport(t *testing.T) {
+	f, srv := newFakeStripe(t)
+	f.fail = func(path string, n int) (int, string) {
+		if strings.HasSuffix(path, "/finalize") {
+			return http.StatusServiceUnavailable, ""
+		}
+		return 0, ""
+	}
+	c := NewClient("sk_test", WithEndpoint(srv.URL))
+	rec := &memRecorder{}
+	if err := c.Export(context.Background(), testInvoice(), rec); err == nil {
+		t.Fatalf("expected the export to stop before finalizing")
+	}
+
+	old := voided(rec.apply(testInvoice()))
+	if err := c.Void(context.Background(), old); err != nil {
+		t.Fatalf("Void: %v", err)
+	}
+	if len(f.invoices) != 0 {
+		t.Fatalf("expected the draft deleted, got %+v", f.invoices)
+	}
+	// The draft is gone, so a retry has nothing left to do.
+	if err := c.Void(context.Background(), old); err != nil {
+		t.Fatalf("second Void: %v", err)
+	}
+}
+
+func TestVoidOfInvoiceNeverExported(t *testing.T) {
+	f, srv := newFakeStripe(t)
+	if err := NewClient("sk_test", WithEndpoint(srv.URL)).Void(context.Background(), voided(testInvoice())); err != nil {
+		t.Fatalf("Void: %v", err)
+	}
+	if len(f.requests) != 0 {
+		t.Fatalf("expected no requests, got %v", f.requests)
+	}
+}
+
+func TestVoidRefusesPaidInvoice(t *testing.T) {
+	f, srv := newFakeStripe(t)
+	c := NewClient("sk_test", WithEndpoint(srv.URL))
+	rec := &memRecorder{}
+	if err := c.Export(context.Background(), testInvoice(), rec); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	f.invoices[rec.invoice].Status = "paid"
+
+	err := c.Void(context.Background(), voided(rec.apply(testInvoice())))
+	if !export.IsPermanent(err) || !strings.Contains(err.Error(), "is paid") {
+		t.Fatalf("expected a permanent error for a paid invoice, got %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+package httpapi
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"tranche/internal/billing"
+	"tranche/internal/db"
+)
+
+// handleBillingPreview shows the caller's month-to-date spend and projected bill: what their
+// drafts would hold if billing ran now. Nothing is written.
+func (s *Server) handleBillingPreview(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := s.requireCustomerID(w, r)
+	if !ok {
+		return
+	}
+	if s.billing == nil {
+		writeError(w, http.StatusNotImplemented, "billing previews are not enabled", nil)
+		return
+	}
+	preview, err := s.billing.Preview(r.Context(), customerID, time.Now().UTC())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "customer not found", nil)
+			return
+		}
+		s.log.Printf("billing preview for customer %d: %v", customerID, err)
+		writeError(w, http.StatusInternalServerError, "failed to preview billing", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, preview)
+}
+
+type billingSettingsResponse struct {
+	Timezone  string `json:"timezone"`
+	AnchorDay int16  `json:"anchor_day"`
+}
+
+func (s *Server) handleGetBillingSettings(w http.ResponseWriter, r *http.Request) {
+	customerID, err := parseIDParam(chi.URLParam(r, "customerID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	settings, err := s.db.GetCustomerBillingSettings(r.Context(), customerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "customer not found", nil)
+			return
+		}
+		s.log.Printf("GetCustomerBillingSettings: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load billing settings", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, billingSettingsResponse{Timezone: settings.BillingTimezone, AnchorDay: settings.BillingAnchorDay})
+}
+
+// handlePutBillingSettings changes where the customer's billing periods start. Existing
+// drafts keep their boundaries and are finalized when they close; usage billed from then on
+// lands on periods computed from the new settings.
+func (s *Server) handlePutBillingSettings(w http.ResponseWriter, r *http.Request) {
+	customerID, err := parseIDParam(chi.URLParam(r, "customerID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	var req billingSettingsRequest
+	if err := decodeJSON(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes), &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload", err)
+		return
+	}
+	customer, err := s.db.UpdateCustomerBillingSettings(r.Context(), db.UpdateCustomerBillingSettingsParams{
+		ID:               customerID,
+		BillingTimezone:  strings.TrimSpace(req.Timezone),
+		BillingAnchorDay: int16(req.AnchorDay),
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "customer not found", nil)
+			return
+		}
+		s.log.Printf("UpdateCustomerBillingSettings: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to update billing settings", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, billingSettingsResponse{Timezone: customer.BillingTimezone, AnchorDay: customer.BillingAnchorDay})
+}
+
+func (s *Server) handlePayInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceID, err := parseIDParam(chi.URLParam(r, "invoiceID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	invoice, err := s.db.GetInvoice(r.Context(), invoiceID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "invoice not found", nil)
+			return
+		}
+		s.log.Printf("GetInvoice: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load invoice", nil)
+		return
+	}
+	if invoice.Status != "finalized" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("invoice is %s; only finalized invoices can be paid", invoice.Status), nil)
+		return
+	}
+	invoice, err = s.db.MarkInvoicePaid(r.Context(), invoiceID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusConflict, "invoice is no longer finalized", nil)
+			return
+		}
+		s.log.Printf("MarkInvoicePaid: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to mark invoice paid", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, invoice)
+}
+
+// handleRequeueInvoiceExport queues a failed or skipped invoice for export again, with a
+// fresh set of attempts. Objects the processor already accepted are not pushed twice. For a
+// voided invoice it retries the void at the processor.
+func (s *Server) handleRequeueInvoiceExport(w http.ResponseWriter, r *http.Request) {
+	invoiceID, err := parseIDParam(chi.URLParam(r, "invoiceID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	invoice, err := s.db.RequeueInvoiceExport(r.Context(), invoiceID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			s.log.Printf("RequeueInvoiceExport: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to queue invoice export", nil)
+			return
+		}
+		current, err := s.db.GetInvoice(r.Context(), invoiceID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusNotFound, "invoice not found", nil)
+				return
+			}
+			s.log.Printf("GetInvoice: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to load invoice", nil)
+			return
+		}
+		writeError(w, http.StatusConflict, fmt.Sprintf("invoice is %s with export %s; only failed or skipped exports of finalized, paid or voided finalized invoices can be queued", current.Status, current.ExportStatus), nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, invoice)
+}
+
+// handleVoidInvoice voids an invoice and regenerates it at current pricing on a replacement.
+// With dry_run nothing is kept and the response shows what would change.
+func (s *Server) handleVoidInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceID, err := parseIDParam(chi.URLParam(r, "invoiceID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	var req voidInvoiceRequest
+	if err := decodeJSON(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes), &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload", err)
+		return
+	}
+	if s.billing == nil {
+		writeError(w, http.StatusNotImplemented, "billing is not enabled", nil)
+		return
+	}
+	result, err := s.billing.Void(r.Context(), invoiceID, strings.TrimSpace(req.Reason), time.Now().UTC(), req.DryRun)
+	if err != nil {
+		switch {
+		case errors.Is(err, billing.ErrInvoiceNotFound):
+			writeError(w, http.StatusNotFound, "invoice not found", nil)
+		case errors.Is(err, billing.ErrNotVoidable):
+			writeError(w, http.StatusConflict, err.Error(), nil)
+		default:
+			s.log.Printf("void invoice %d: %v", invoiceID, err)
+			writeError(w, http.StatusInternalServerError, "failed to void invoice", nil)
+		}
+		return
+	}
+	status := http.StatusCreated
+	if req.DryRun {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, result)
+}
+
+// handleGetInvoiceVoid returns the audit record of a voided invoice.
+func (s *Server) handleGetInvoiceVoid(w http.ResponseWriter, r *http.Request) {
+	invoiceID, err := parseIDParam(chi.URLParam(r, "invoiceID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	record, err := s.db.GetInvoiceVoid(r.Context(), invoiceID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "invoice has not been voided", nil)
+			return
+		}
+		s.log.Printf("GetInvoiceVoid: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load invoice void", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+type voidInvoiceRequest struct {
+	Reason string `json:"reason"`
+	DryRun bool   `json:"dry_run"`
+}
+
+func (r voidInvoiceRequest) Validate() map[string]string {
+	errs := map[string]string{}
+	if reason := strings.TrimSpace(r.Reason); reason == "" {
+		errs["reason"] = "is required"
+	} else if len(reason) > 1000 {
+		errs["reason"] = "must be at most 1000 characters"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+type billingSettingsRequest struct {
+	Timezone  string `json:"timezone"`
+	AnchorDay int    `json:"anchor_day"`
+}
+
+func (r billingSettingsRequest) Validate() map[string]string {
+	errs := map[string]string{}
+	if tz := strings.TrimSpace(r.Timezone); tz == "" {
+		errs["timezone"] = "is required"
+	} else if _, err := time.LoadLocation(tz); err != nil {
+		errs["timezone"] = "must be an IANA time zone such as Europe/Berlin"
+	}
+	if r.AnchorDay < 1 || r.AnchorDay > 28 {
+		errs["anchor_day"] = "must be between 1 and 28"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+package httpapi
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"tranche/internal/db"
+	"tranche/internal/invoicerender"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+	// defaultUsageRange is how far back usage is listed when the request has no from.
+	defaultUsageRange = 7 * 24 * time.Hour
+	// maxUsageRange bounds how much usage one request aggregates across its pages.
+	maxUsageRange = 366 * 24 * time.Hour
+)
+
+// pageResponse wraps one page of a list. NextCursor is passed back as ?cursor= to fetch the
+// following page and is empty on the last one.
+type pageResponse struct {
+	Items      any    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type invoiceDetailResponse struct {
+	Invoice   db.Invoice           `json:"invoice"`
+	LineItems []db.InvoiceLineItem `json:"line_items"`
+}
+
+func (s *Server) handleListInvoices(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := s.requireCustomerID(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	limit, beforeID, errs := parseIDPage(q)
+	from, to, rangeErrs := parseTimeRange(q.Get("from"), q.Get("to"))
+	for k, v := range rangeErrs {
+		errs[k] = v
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "invalid query", errs)
+		return
+	}
+	invoices, err := s.db.ListInvoicesForCustomer(r.Context(), db.ListInvoicesForCustomerParams{
+		CustomerID: customerID,
+		BeforeID:   beforeID,
+		PeriodFrom: sql.NullTime{Time: from, Valid: !from.IsZero()},
+		PeriodTo:   sql.NullTime{Time: to, Valid: !to.IsZero()},
+		RowLimit:   int32(limit + 1),
+	})
+	if err != nil {
+		s.log.Printf("ListInvoicesForCustomer: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list invoices", nil)
+		return
+	}
+	resp := pageResponse{Items: invoices}
+	if len(invoices) > limit {
+		resp.Items = invoices[:limit]
+		resp.NextCursor = strconv.FormatInt(invoices[limit-1].ID, 10)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleGetInvoice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	customerID, ok := s.requireCustomerID(w, r)
+	if !ok {
+		return
+	}
+	invoiceID, err := parseIDParam(chi.URLParam(r, "invoiceID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	invoice, err := s.db.GetInvoiceForCustomer(ctx, db.GetInvoiceForCustomerParams{ID: invoiceID, CustomerID: customerID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "invoice not found", nil)
+			return
+		}
+		s.log.Printf("GetInvoiceForCustomer: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load invoice", nil)
+		return
+	}
+	format := s.invoiceFormat(r)
+	if format == "" {
+		writeError(w, http.StatusNotAcceptable, "invoices are available as application/json, text/html, application/pdf or text/csv", nil)
+		return
+	}
+	items, err := s.db.ListInvoiceLineItems(ctx, invoice.ID)
+	if err != nil {
+		s.log.Printf("ListInvoiceLineItems: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load line items", nil)
+		return
+	}
+	if format == formatJSON {
+		writeJSON(w, http.StatusOK, invoiceDetailResponse{Invoice: invoice, LineItems: items})
+		return
+	}
+	s.writeInvoiceDocument(w, r, format, invoice, items)
+}
+
+// Invoice document formats by media type.
+const (
+	formatJSON = "application/json"
+	formatHTML = "text/html"
+	formatPDF  = "application/pdf"
+	formatCSV  = "text/csv"
+)
+
+var formatsByName = map[string]string{"json": formatJSON, "html": formatHTML, "pdf": formatPDF, "csv": formatCSV}
+
+// invoiceFormat picks the invoice representation from ?format= (json, html, pdf or csv) or
+// else the Accept header. It returns "" when nothing acceptable can be served.
+func (s *Server) invoiceFormat(r *http.Request) string {
+	offers := []string{formatJSON}
+	if s.docs != nil {
+		offers = append(offers, formatHTML, formatPDF, formatCSV)
+	}
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, offer := range offers {
+			if formatsByName[strings.ToLower(name)] == offer {
+				return offer
+			}
+		}
+		return ""
+	}
+	return negotiate(r.Header.Get("Accept"), offers)
+}
+
+func (s *Server) writeInvoiceDocument(w http.ResponseWriter, r *http.Request, format string, invoice db.Invoice, items []db.InvoiceLineItem) {
+	ctx := r.Context()
+	customer, err := s.db.GetCustomer(ctx, invoice.CustomerID)
+	if err != nil {
+		s.log.Printf("GetCustomer: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load customer", nil)
+		return
+	}
+	services, err := s.db.ListInvoiceServices(ctx, invoice.ID)
+	if err != nil {
+		s.log.Printf("ListInvoiceServices: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load services", nil)
+		return
+	}
+	doc := invoicerender.Document{Invoice: invoice, Customer: customer, LineItems: items, Services: make(map[int64]string, len(services))}
+	for _, svc := range services {
+		doc.Services[svc.ID] = svc.Name
+	}
+
+	// Render into memory so a failure can still be reported as a JSON error.
+	var buf bytes.Buffer
+	filename := invoicerender.Number(invoice.ID)
+	switch format {
+	case formatHTML:
+		err = s.docs.HTML(&buf, doc)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	case formatPDF:
+		err = s.docs.PDF(&buf, doc)
+		w.Header().Set("Content-Type", formatPDF)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".pdf"))
+	case formatCSV:
+		err = s.docs.CSV(&buf, doc)
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".csv"))
+	}
+	if err != nil {
+		w.Header().Del("Content-Disposition")
+		s.log.Printf("render invoice %d as %s: %v", invoice.ID, format, err)
+		writeError(w, http.StatusInternalServerError, "failed to render invoice", nil)
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// negotiate returns the offer the Accept header prefers, honouring q-values and wildcards.
+// Ties go to the earlier offer, and an empty header accepts the first offer.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q := 0.0
+		specificity := -1
+		for _, part := range strings.Split(accept, ",") {
+			fields := strings.Split(part, ";")
+			mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+			rangeQ := 1.0
+			for _, param := range fields[1:] {
+				if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(k, "q") {
+					if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+						rangeQ = parsed
+					}
+				}
+			}
+			// The most specific matching range decides the offer's quality.
+			var spec int
+			switch {
+			case mediaRange == offer:
+				spec = 2
+			case mediaRange == strings.SplitN(offer, "/", 2)[0]+"/*":
+				spec = 1
+			case mediaRange == "*/*":
+				spec = 0
+			default:
+				continue
+			}
+			if spec > specificity {
+				specificity, q = spec, rangeQ
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// handleListServiceUsage aggregates a service's usage windows into UTC hour, day or month
+// buckets by window start. The range defaults to the last seven days.
+func (s *Server) handleListServiceUsage(w http.ResponseWriter, r *http.Request) {
+	svc, ok := s.requireServiceContext(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	limit, errs := parsePageLimit(q.Get("limit"))
+	from, to, rangeErrs := parseTimeRange(q.Get("from"), q.Get("to"))
+	for k, v := range rangeErrs {
+		errs[k] = v
+	}
+	granularity := q.Get("granularity")
+	switch granularity {
+	case "":
+		granularity = "hour"
+	case "hour", "day", "month":
+	default:
+		errs["granularity"] = "must be hour, day or month"
+	}
+	if len(errs) == 0 {
+		if to.IsZero() {
+			to = time.Now().UTC()
+		}
+		if from.IsZero() {
+			from = to.Add(-defaultUsageRange)
+		}
+		if !to.After(from) {
+			errs["from"] = "must be before to"
+		} else if to.Sub(from) > maxUsageRange {
+			errs["from"] = "range cannot exceed 366 days"
+		}
+	}
+	// The cursor is the start of the next bucket, so it moves from forward.
+	if raw := q.Get("cursor"); raw != "" && len(errs) == 0 {
+		cursor, err := time.Parse(time.RFC3339, raw)
+		switch {
+		case err != nil:
+			errs["cursor"] = "invalid cursor"
+		case cursor.After(from):
+			from = cursor
+		}
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "invalid query", errs)
+		return
+	}
+	usage, err := s.db.ListServiceUsage(r.Context(), db.ListServiceUsageParams{
+		Granularity: granularity,
+		ServiceID:   svc.ID,
+		WindowFrom:  from,
+		WindowTo:    to,
+		RowLimit:    int32(limit + 1),
+	})
+	if err != nil {
+		s.log.Printf("ListServiceUsage: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list usage", nil)
+		return
+	}
+	resp := pageResponse{Items: usage}
+	if len(usage) > limit {
+		resp.Items = usage[:limit]
+		resp.NextCursor = usage[limit].BucketStart.UTC().Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleListServiceStorms(w http.ResponseWriter, r *http.Request) {
+	svc, ok := s.requireServiceContext(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	limit, beforeID, errs := parseIDPage(q)
+	from, to, rangeErrs := parseTimeRange(q.Get("from"), q.Get("to"))
+	for k, v := range rangeErrs {
+		errs[k] = v
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "invalid query", errs)
+		return
+	}
+	storms, err := s.db.ListStormEventsForService(r.Context(), db.ListStormEventsForServiceParams{
+		ServiceID: svc.ID,
+		BeforeID:  beforeID,
+		StormFrom: sql.NullTime{Time: from, Valid: !from.IsZero()},
+		StormTo:   sql.NullTime{Time: to, Valid: !to.IsZero()},
+		RowLimit:  int32(limit + 1),
+	})
+	if err != nil {
+		s.log.Printf("ListStormEventsForService: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list storms", nil)
+		return
+	}
+	resp := pageResponse{Items: storms}
+	if len(storms) > limit {
+		resp.Items = storms[:limit]
+		resp.NextCursor = strconv.FormatInt(storms[limit-1].ID, 10)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parsePageLimit reads ?limit=, defaulting to 50 and capped at 200.
+func parsePageLimit(raw string) (int, map[string]string) {
+	errs := make(map[string]string)
+	if raw == "" {
+		return defaultPageLimit, errs
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit <= 0 || limit > maxPageLimit {
+		errs["limit"] = "must be between 1 and 200"
+		return 0, errs
+	}
+	return limit, errs
+}
+
+// parseIDPage reads ?limit= and an ID ?cursor= for lists returned newest first; without a
+// cursor the page starts at the newest row.
+func parseIDPage(q url.Values) (int, int64, map[string]string) {
+	limit, errs := parsePageLimit(q.Get("limit"))
+	beforeID := int64(math.MaxInt64)
+	if raw := q.Get("cursor"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id <= 0 {
+			errs["cursor"] = "invalid cursor"
+		} else {
+			beforeID = id
+		}
+	}
+	return limit, beforeID, errs
+}
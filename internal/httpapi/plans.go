@@ -0,0 +1,353 @@
+package httpapi
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"tranche/internal/db"
+	"tranche/internal/money"
+)
+
+func (s *Server) handleListPricingPlans(w http.ResponseWriter, r *http.Request) {
+	plans, err := s.db.ListPricingPlans(r.Context())
+	if err != nil {
+		s.log.Printf("ListPricingPlans: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list pricing plans", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, plans)
+}
+
+func (s *Server) handleCreatePricingPlan(w http.ResponseWriter, r *http.Request) {
+	var req pricingPlanRequest
+	if err := decodeJSON(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes), &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload", err)
+		return
+	}
+	plan, err := s.db.InsertPricingPlan(r.Context(), req.ToInsertParams())
+	if err != nil {
+		s.log.Printf("InsertPricingPlan: %v", err)
+		writeDBError(w, err, "failed to create pricing plan")
+		return
+	}
+	writeJSON(w, http.StatusCreated, plan)
+}
+
+func (s *Server) handleGetPricingPlan(w http.ResponseWriter, r *http.Request) {
+	plan, ok := s.requirePricingPlan(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func (s *Server) handleUpdatePricingPlan(w http.ResponseWriter, r *http.Request) {
+	existing, ok := s.requirePricingPlan(w, r)
+	if !ok {
+		return
+	}
+	var req pricingPlanPatchRequest
+	if err := decodeJSON(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes), &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload", err)
+		return
+	}
+	plan, err := s.db.UpdatePricingPlan(r.Context(), req.Apply(existing))
+	if err != nil {
+		s.log.Printf("UpdatePricingPlan: %v", err)
+		writeDBError(w, err, "failed to update pricing plan")
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func (s *Server) requirePricingPlan(w http.ResponseWriter, r *http.Request) (db.PricingPlan, bool) {
+	planID, err := parseIDParam(chi.URLParam(r, "planID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return db.PricingPlan{}, false
+	}
+	plan, err := s.db.GetPricingPlan(r.Context(), planID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "pricing plan not found", nil)
+			return db.PricingPlan{}, false
+		}
+		s.log.Printf("GetPricingPlan: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load pricing plan", nil)
+		return db.PricingPlan{}, false
+	}
+	return plan, true
+}
+
+func (s *Server) handleListCustomerPlans(w http.ResponseWriter, r *http.Request) {
+	customerID, err := parseIDParam(chi.URLParam(r, "customerID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	assignments, err := s.db.ListCustomerPlans(r.Context(), customerID)
+	if err != nil {
+		s.log.Printf("ListCustomerPlans: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list customer plans", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, assignments)
+}
+
+func (s *Server) handleCreateCustomerPlan(w http.ResponseWriter, r *http.Request) {
+	customerID, err := parseIDParam(chi.URLParam(r, "customerID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	var req customerPlanRequest
+	if err := decodeJSON(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes), &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload", err)
+		return
+	}
+	assignment, err := s.db.InsertCustomerPlan(r.Context(), db.InsertCustomerPlanParams{
+		CustomerID:    customerID,
+		PlanID:        req.PlanID,
+		EffectiveFrom: req.EffectiveFrom.UTC(),
+	})
+	if err != nil {
+		s.log.Printf("InsertCustomerPlan: %v", err)
+		writeDBError(w, err, "failed to assign pricing plan")
+		return
+	}
+	writeJSON(w, http.StatusCreated, assignment)
+}
+
+func (s *Server) handleDeleteCustomerPlan(w http.ResponseWriter, r *http.Request) {
+	customerID, err := parseIDParam(chi.URLParam(r, "customerID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	assignmentID, err := parseIDParam(chi.URLParam(r, "assignmentID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	_, err = s.db.DeleteCustomerPlan(r.Context(), db.DeleteCustomerPlanParams{ID: assignmentID, CustomerID: customerID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "plan assignment not found", nil)
+			return
+		}
+		s.log.Printf("DeleteCustomerPlan: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete plan assignment", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type pricingPlanRequest struct {
+	Name                  string        `json:"name"`
+	PrimaryRateCentsPerGB int64         `json:"primary_rate_cents_per_gb"`
+	BackupRateCentsPerGB  int64         `json:"backup_rate_cents_per_gb"`
+	Tiers                 []db.PlanTier `json:"tiers"`
+	MinimumMonthlyCents   int64         `json:"minimum_monthly_cents"`
+	StormDiscountRate     float64       `json:"storm_discount_rate"`
+	SLADefinitionID       *int64        `json:"sla_definition_id"`
+	// Currency is the lowercase ISO 4217 code the plan's rates are in; usd when omitted.
+	Currency string `json:"currency"`
+}
+
+func (r pricingPlanRequest) Validate() map[string]string {
+	errs := map[string]string{}
+	if strings.TrimSpace(r.Name) == "" {
+		errs["name"] = "cannot be blank"
+	}
+	if r.PrimaryRateCentsPerGB < 0 {
+		errs["primary_rate_cents_per_gb"] = "cannot be negative"
+	}
+	if r.BackupRateCentsPerGB < 0 {
+		errs["backup_rate_cents_per_gb"] = "cannot be negative"
+	}
+	validatePlanTiers(r.Tiers, errs)
+	if r.MinimumMonthlyCents < 0 {
+		errs["minimum_monthly_cents"] = "cannot be negative"
+	}
+	if r.StormDiscountRate < 0 || r.StormDiscountRate > 1 {
+		errs["storm_discount_rate"] = "must be between 0 and 1"
+	}
+	if r.SLADefinitionID != nil && *r.SLADefinitionID <= 0 {
+		errs["sla_definition_id"] = "must be positive"
+	}
+	if r.Currency != "" && !money.ValidCurrency(r.Currency) {
+		errs["currency"] = "must be a lowercase three-letter currency code"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (r pricingPlanRequest) ToInsertParams() db.InsertPricingPlanParams {
+	return db.InsertPricingPlanParams{
+		Name:                  strings.TrimSpace(r.Name),
+		PrimaryRateCentsPerGb: r.PrimaryRateCentsPerGB,
+		BackupRateCentsPerGb:  r.BackupRateCentsPerGB,
+		Tiers:                 db.PlanTiers(r.Tiers),
+		MinimumMonthlyCents:   r.MinimumMonthlyCents,
+		StormDiscountRate:     r.StormDiscountRate,
+		SlaDefinitionID:       nullableID(r.SLADefinitionID),
+		Currency:              planCurrency(r.Currency),
+	}
+}
+
+// planCurrency defaults a plan's currency to usd.
+func planCurrency(currency string) string {
+	if currency == "" {
+		return "usd"
+	}
+	return currency
+}
+
+type pricingPlanPatchRequest struct {
+	Name                  *string        `json:"name"`
+	PrimaryRateCentsPerGB *int64         `json:"primary_rate_cents_per_gb"`
+	BackupRateCentsPerGB  *int64         `json:"backup_rate_cents_per_gb"`
+	Tiers                 *[]db.PlanTier `json:"tiers"`
+	MinimumMonthlyCents   *int64         `json:"minimum_monthly_cents"`
+	StormDiscountRate     *float64       `json:"storm_discount_rate"`
+	// SLADefinitionID attaches an SLA to the plan; 0 detaches it.
+	SLADefinitionID *int64  `json:"sla_definition_id"`
+	Currency        *string `json:"currency"`
+}
+
+func (r pricingPlanPatchRequest) Validate() map[string]string {
+	if r.Name == nil && r.PrimaryRateCentsPerGB == nil && r.BackupRateCentsPerGB == nil && r.Tiers == nil &&
+		r.MinimumMonthlyCents == nil && r.StormDiscountRate == nil && r.SLADefinitionID == nil && r.Currency == nil {
+		return map[string]string{"body": "at least one field is required"}
+	}
+	errs := map[string]string{}
+	if r.Name != nil && strings.TrimSpace(*r.Name) == "" {
+		errs["name"] = "cannot be blank"
+	}
+	if r.PrimaryRateCentsPerGB != nil && *r.PrimaryRateCentsPerGB < 0 {
+		errs["primary_rate_cents_per_gb"] = "cannot be negative"
+	}
+	if r.BackupRateCentsPerGB != nil && *r.BackupRateCentsPerGB < 0 {
+		errs["backup_rate_cents_per_gb"] = "cannot be negative"
+	}
+	if r.Tiers != nil {
+		validatePlanTiers(*r.Tiers, errs)
+	}
+	if r.MinimumMonthlyCents != nil && *r.MinimumMonthlyCents < 0 {
+		errs["minimum_monthly_cents"] = "cannot be negative"
+	}
+	if r.StormDiscountRate != nil && (*r.StormDiscountRate < 0 || *r.StormDiscountRate > 1) {
+		errs["storm_discount_rate"] = "must be between 0 and 1"
+	}
+	if r.SLADefinitionID != nil && *r.SLADefinitionID < 0 {
+		errs["sla_definition_id"] = "cannot be negative"
+	}
+	if r.Currency != nil && !money.ValidCurrency(*r.Currency) {
+		errs["currency"] = "must be a lowercase three-letter currency code"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (r pricingPlanPatchRequest) Apply(existing db.PricingPlan) db.UpdatePricingPlanParams {
+	if r.Name != nil {
+		existing.Name = strings.TrimSpace(*r.Name)
+	}
+	if r.PrimaryRateCentsPerGB != nil {
+		existing.PrimaryRateCentsPerGb = *r.PrimaryRateCentsPerGB
+	}
+	if r.BackupRateCentsPerGB != nil {
+		existing.BackupRateCentsPerGb = *r.BackupRateCentsPerGB
+	}
+	if r.Tiers != nil {
+		existing.Tiers = db.PlanTiers(*r.Tiers)
+	}
+	if r.MinimumMonthlyCents != nil {
+		existing.MinimumMonthlyCents = *r.MinimumMonthlyCents
+	}
+	if r.StormDiscountRate != nil {
+		existing.StormDiscountRate = *r.StormDiscountRate
+	}
+	if r.SLADefinitionID != nil {
+		existing.SlaDefinitionID = nullableID(r.SLADefinitionID)
+	}
+	if r.Currency != nil {
+		existing.Currency = *r.Currency
+	}
+	return db.UpdatePricingPlanParams{
+		ID:                    existing.ID,
+		Name:                  existing.Name,
+		PrimaryRateCentsPerGb: existing.PrimaryRateCentsPerGb,
+		BackupRateCentsPerGb:  existing.BackupRateCentsPerGb,
+		Tiers:                 existing.Tiers,
+		MinimumMonthlyCents:   existing.MinimumMonthlyCents,
+		StormDiscountRate:     existing.StormDiscountRate,
+		SlaDefinitionID:       existing.SlaDefinitionID,
+		Currency:              existing.Currency,
+	}
+}
+
+// nullableID maps a missing or zero ID to NULL.
+func nullableID(id *int64) sql.NullInt64 {
+	if id == nil || *id == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *id, Valid: true}
+}
+
+// validatePlanTiers requires tiers to start above zero in ascending from_gb order; volume
+// below the first tier is billed at the plan's base rates.
+func validatePlanTiers(tiers []db.PlanTier, errs map[string]string) {
+	var prev int64
+	for i, tier := range tiers {
+		key := fmt.Sprintf("tiers[%d]", i)
+		switch {
+		case tier.FromGB <= prev:
+			errs[key] = "from_gb must be positive and greater than the previous tier's"
+		case tier.PrimaryRateCentsPerGB < 0 || tier.BackupRateCentsPerGB < 0:
+			errs[key] = "rates cannot be negative"
+		}
+		prev = tier.FromGB
+	}
+}
+
+type customerPlanRequest struct {
+	PlanID        int64     `json:"plan_id"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
+
+func (r customerPlanRequest) Validate() map[string]string {
+	errs := map[string]string{}
+	if r.PlanID <= 0 {
+		errs["plan_id"] = "must be positive"
+	}
+	if r.EffectiveFrom.IsZero() {
+		errs["effective_from"] = "is required"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -17,8 +17,13 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/jackc/pgx/v5/pgconn"
 
+	"tranche/internal/billing"
 	"tranche/internal/db"
+	"tranche/internal/dns"
+	"tranche/internal/invoicerender"
 	"tranche/internal/logging"
+	"tranche/internal/sla"
+	"tranche/internal/usagehealth"
 )
 
 type Server struct {
@@ -27,6 +32,10 @@ type Server struct {
 	sqlDB      *sql.DB
 	r          chi.Router
 	adminToken string
+	usage      *usagehealth.Checker
+	docs       *invoicerender.Renderer
+	sla        *sla.Meter
+	billing    *billing.Engine
 }
 
 type authContextKey struct{}
@@ -38,22 +47,69 @@ type authContext struct {
 
 const maxRequestBodyBytes int64 = 1 << 20 // 1 MiB
 
-func NewServer(log *logging.Logger, conn *sql.DB, dbx *db.Queries, adminToken string) *Server {
-	s := &Server{log: log, db: dbx, sqlDB: conn, r: chi.NewRouter(), adminToken: strings.TrimSpace(adminToken)}
+func NewServer(log *logging.Logger, conn *sql.DB, dbx *db.Queries, adminToken string, usage *usagehealth.Checker) *Server {
+	s := &Server{log: log, db: dbx, sqlDB: conn, r: chi.NewRouter(), adminToken: strings.TrimSpace(adminToken), usage: usage, sla: sla.NewMeter(dbx)}
 	s.routes()
 	return s
 }
 
 func (s *Server) Router() http.Handler { return s.r }
 
+// WithInvoiceRenderer lets GET /v1/invoices/{id} serve HTML, PDF and CSV documents; without
+// it invoices are JSON only.
+func (s *Server) WithInvoiceRenderer(docs *invoicerender.Renderer) *Server {
+	s.docs = docs
+	return s
+}
+
+// WithBilling enables the endpoints that run engine: GET /v1/billing/preview and
+// POST /v1/admin/invoices/{invoiceID}/void.
+func (s *Server) WithBilling(engine *billing.Engine) *Server {
+	s.billing = engine
+	return s
+}
+
 func (s *Server) routes() {
 	s.r.Use(middleware.RequestID)
 	s.r.Use(s.loggingMiddleware)
 	s.r.Get("/healthz", s.handleHealth)
 	s.r.Get("/readyz", s.handleReady)
 	s.r.Route("/v1", func(r chi.Router) {
-		r.Use(s.authMiddleware)
-		r.Route("/services", func(r chi.Router) {
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(s.adminMiddleware)
+			r.Route("/pricing-plans", func(r chi.Router) {
+				r.Get("/", s.handleListPricingPlans)
+				r.Post("/", s.handleCreatePricingPlan)
+				r.Get("/{planID}", s.handleGetPricingPlan)
+				r.Patch("/{planID}", s.handleUpdatePricingPlan)
+			})
+			r.Route("/sla-definitions", func(r chi.Router) {
+				r.Get("/", s.handleListSLADefinitions)
+				r.Post("/", s.handleCreateSLADefinition)
+				r.Get("/{slaID}", s.handleGetSLADefinition)
+				r.Patch("/{slaID}", s.handleUpdateSLADefinition)
+			})
+			r.Route("/customers/{customerID}/plans", func(r chi.Router) {
+				r.Get("/", s.handleListCustomerPlans)
+				r.Post("/", s.handleCreateCustomerPlan)
+				r.Delete("/{assignmentID}", s.handleDeleteCustomerPlan)
+			})
+			r.Get("/customers/{customerID}/billing-settings", s.handleGetBillingSettings)
+			r.Put("/customers/{customerID}/billing-settings", s.handlePutBillingSettings)
+			r.Post("/invoices/{invoiceID}/pay", s.handlePayInvoice)
+			r.Post("/invoices/{invoiceID}/export", s.handleRequeueInvoiceExport)
+			r.Post("/invoices/{invoiceID}/void", s.handleVoidInvoice)
+			r.Get("/invoices/{invoiceID}/void", s.handleGetInvoiceVoid)
+		})
+
+		r.With(s.authMiddleware).Get("/billing/preview", s.handleBillingPreview)
+
+		r.With(s.authMiddleware).Route("/invoices", func(r chi.Router) {
+			r.Get("/", s.handleListInvoices)
+			r.Get("/{invoiceID}", s.handleGetInvoice)
+		})
+
+		r.With(s.authMiddleware).Route("/services", func(r chi.Router) {
 			r.Get("/", s.handleListServices)
 			r.Post("/", s.handleCreateService)
 
@@ -65,6 +121,7 @@ func (s *Server) routes() {
 				r.Route("/domains", func(r chi.Router) {
 					r.Get("/", s.handleListDomains)
 					r.Post("/", s.handleCreateDomain)
+					r.Patch("/{domainID}", s.handleUpdateDomain)
 					r.Delete("/{domainID}", s.handleDeleteDomain)
 				})
 
@@ -74,6 +131,17 @@ func (s *Server) routes() {
 					r.Patch("/{policyID}", s.handleUpdateStormPolicy)
 					r.Delete("/{policyID}", s.handleDeleteStormPolicy)
 				})
+
+				r.Route("/dns-settings", func(r chi.Router) {
+					r.Get("/", s.handleGetDNSSettings)
+					r.Put("/", s.handlePutDNSSettings)
+					r.Delete("/", s.handleDeleteDNSSettings)
+				})
+
+				r.Get("/usage", s.handleListServiceUsage)
+				r.Get("/usage/coverage", s.handleGetUsageCoverage)
+				r.Get("/storms", s.handleListServiceStorms)
+				r.Get("/sla", s.handleGetServiceSLA)
 			})
 		})
 	})
@@ -87,13 +155,7 @@ var (
 func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		baseLogger := logging.FromContext(r.Context(), s.log)
-		token := strings.TrimSpace(r.Header.Get("Authorization"))
-		if strings.HasPrefix(strings.ToLower(token), "bearer ") {
-			token = strings.TrimSpace(token[7:])
-		}
-		if token == "" {
-			token = strings.TrimSpace(r.Header.Get("X-API-Key"))
-		}
+		token := requestToken(r)
 		if token == "" {
 			writeError(w, http.StatusUnauthorized, "missing API token", nil)
 			return
@@ -133,6 +195,35 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// adminMiddleware admits only the admin token. Admin routes act across customers, so no
+// customer scope is required.
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if token == "" {
+			writeError(w, http.StatusUnauthorized, "missing API token", nil)
+			return
+		}
+		if s.adminToken == "" || token != s.adminToken {
+			writeError(w, http.StatusForbidden, "admin token required", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestToken reads the API token from a bearer Authorization header or X-API-Key.
+func requestToken(r *http.Request) string {
+	token := strings.TrimSpace(r.Header.Get("Authorization"))
+	if strings.HasPrefix(strings.ToLower(token), "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	if token == "" {
+		token = strings.TrimSpace(r.Header.Get("X-API-Key"))
+	}
+	return token
+}
+
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		reqID := middleware.GetReqID(r.Context())
@@ -393,8 +484,9 @@ func (s *Server) handleCreateDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	domain, err := s.db.InsertServiceDomain(r.Context(), db.InsertServiceDomainParams{
-		ServiceID: svc.ID,
-		Name:      req.Name,
+		ServiceID:       svc.ID,
+		Name:            req.Name,
+		RoutingStrategy: req.Strategy(),
 	})
 	if err != nil {
 		s.log.Printf("InsertServiceDomain: %v", err)
@@ -404,6 +496,42 @@ func (s *Server) handleCreateDomain(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusCreated, domain)
 }
 
+func (s *Server) handleUpdateDomain(w http.ResponseWriter, r *http.Request) {
+	svc, ok := s.requireServiceContext(w, r)
+	if !ok {
+		return
+	}
+	domainID, err := parseIDParam(chi.URLParam(r, "domainID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	var req domainPatchRequest
+	if err := decodeJSON(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes), &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload", err)
+		return
+	}
+	domain, err := s.db.UpdateServiceDomainStrategy(r.Context(), db.UpdateServiceDomainStrategyParams{
+		ID:              domainID,
+		ServiceID:       svc.ID,
+		RoutingStrategy: strings.TrimSpace(*req.RoutingStrategy),
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "domain not found", nil)
+			return
+		}
+		s.log.Printf("UpdateServiceDomainStrategy: %v", err)
+		writeDBError(w, err, "failed to update domain")
+		return
+	}
+	writeJSON(w, http.StatusOK, domain)
+}
+
 func (s *Server) handleDeleteDomain(w http.ResponseWriter, r *http.Request) {
 	svc, ok := s.requireServiceContext(w, r)
 	if !ok {
@@ -528,6 +656,91 @@ func (s *Server) handleDeleteStormPolicy(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *Server) handleGetDNSSettings(w http.ResponseWriter, r *http.Request) {
+	svc, ok := s.requireServiceContext(w, r)
+	if !ok {
+		return
+	}
+	settings, err := s.db.GetServiceDNSSettings(r.Context(), svc.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "dns settings not configured", nil)
+			return
+		}
+		s.log.Printf("GetServiceDNSSettings: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load dns settings", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+func (s *Server) handlePutDNSSettings(w http.ResponseWriter, r *http.Request) {
+	svc, ok := s.requireServiceContext(w, r)
+	if !ok {
+		return
+	}
+	var req dnsSettingsRequest
+	if err := decodeJSON(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes), &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload", err)
+		return
+	}
+	settings, err := s.db.UpsertServiceDNSSettings(r.Context(), req.ToUpsertParams(svc.ID))
+	if err != nil {
+		s.log.Printf("UpsertServiceDNSSettings: %v", err)
+		writeDBError(w, err, "failed to save dns settings")
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+func (s *Server) handleDeleteDNSSettings(w http.ResponseWriter, r *http.Request) {
+	svc, ok := s.requireServiceContext(w, r)
+	if !ok {
+		return
+	}
+	_, err := s.db.DeleteServiceDNSSettings(r.Context(), svc.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "dns settings not configured", nil)
+			return
+		}
+		s.log.Printf("DeleteServiceDNSSettings: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete dns settings", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maxCoverageRange bounds how many days of windows one coverage request scans.
+const maxCoverageRange = 90 * 24 * time.Hour
+
+func (s *Server) handleGetUsageCoverage(w http.ResponseWriter, r *http.Request) {
+	svc, ok := s.requireServiceContext(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	from, to, errs := parseTimeRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	if errs == nil && !from.IsZero() && now.Sub(from) > maxCoverageRange {
+		errs = map[string]string{"from": "must be within the last 90 days"}
+	}
+	if errs != nil {
+		writeError(w, http.StatusBadRequest, "invalid query", errs)
+		return
+	}
+	cov, err := s.usage.CheckService(r.Context(), svc, from, to, now)
+	if err != nil {
+		s.log.Printf("CheckService: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to compute usage coverage", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, cov)
+}
+
 func (s *Server) requireServiceContext(w http.ResponseWriter, r *http.Request) (db.Service, bool) {
 	ctx := r.Context()
 	serviceID, err := parseIDParam(chi.URLParam(r, "serviceID"))
@@ -563,6 +776,33 @@ func parseIDParam(raw string) (int64, error) {
 	return id, nil
 }
 
+// parseTimeRange reads optional RFC3339 from/to query parameters; missing values are zero.
+func parseTimeRange(rawFrom, rawTo string) (time.Time, time.Time, map[string]string) {
+	errs := make(map[string]string)
+	var from, to time.Time
+	if rawFrom != "" {
+		t, err := time.Parse(time.RFC3339, rawFrom)
+		if err != nil {
+			errs["from"] = "must be an RFC3339 timestamp"
+		}
+		from = t
+	}
+	if rawTo != "" {
+		t, err := time.Parse(time.RFC3339, rawTo)
+		if err != nil {
+			errs["to"] = "must be an RFC3339 timestamp"
+		}
+		to = t
+	}
+	if len(errs) == 0 && !from.IsZero() && !to.IsZero() && !to.After(from) {
+		errs["to"] = "must be after from"
+	}
+	if len(errs) > 0 {
+		return time.Time{}, time.Time{}, errs
+	}
+	return from, to, nil
+}
+
 func decodeJSON(body io.ReadCloser, dst any) error {
 	defer body.Close()
 	dec := json.NewDecoder(body)
@@ -681,16 +921,50 @@ func (r updateServiceRequest) Apply(svc db.Service) db.Service {
 }
 
 type domainRequest struct {
-	Name string `json:"name"`
+	Name            string `json:"name"`
+	RoutingStrategy string `json:"routing_strategy"`
 }
 
 func (r domainRequest) Validate() map[string]string {
+	errs := map[string]string{}
 	if strings.TrimSpace(r.Name) == "" {
-		return map[string]string{"name": "cannot be blank"}
+		errs["name"] = "cannot be blank"
+	}
+	if strategy := strings.TrimSpace(r.RoutingStrategy); strategy != "" && !validRoutingStrategy(strategy) {
+		errs["routing_strategy"] = "must be weighted or failover"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Strategy returns the requested routing strategy, defaulting to weighted records.
+func (r domainRequest) Strategy() string {
+	if strategy := strings.TrimSpace(r.RoutingStrategy); strategy != "" {
+		return strategy
+	}
+	return dns.StrategyWeighted
+}
+
+type domainPatchRequest struct {
+	RoutingStrategy *string `json:"routing_strategy"`
+}
+
+func (r domainPatchRequest) Validate() map[string]string {
+	if r.RoutingStrategy == nil {
+		return map[string]string{"body": "at least one field is required"}
+	}
+	if !validRoutingStrategy(strings.TrimSpace(*r.RoutingStrategy)) {
+		return map[string]string{"routing_strategy": "must be weighted or failover"}
 	}
 	return nil
 }
 
+func validRoutingStrategy(strategy string) bool {
+	return strategy == dns.StrategyWeighted || strategy == dns.StrategyFailover
+}
+
 type stormPolicyRequest struct {
 	Kind              string  `json:"kind"`
 	ThresholdAvail    float64 `json:"threshold_avail"`
@@ -795,3 +1069,37 @@ func (r stormPolicyPatchRequest) Apply(existing db.StormPolicy) db.UpdateStormPo
 		MaxCoverageFactor: existing.MaxCoverageFactor,
 	}
 }
+
+type dnsSettingsRequest struct {
+	TTLSeconds      int32   `json:"ttl_seconds"`
+	StormTTLSeconds int32   `json:"storm_ttl_seconds"`
+	PrestormMargin  float64 `json:"prestorm_margin"`
+}
+
+func (r dnsSettingsRequest) Validate() map[string]string {
+	errs := map[string]string{}
+	if r.TTLSeconds <= 0 {
+		errs["ttl_seconds"] = "must be positive"
+	}
+	if r.StormTTLSeconds <= 0 {
+		errs["storm_ttl_seconds"] = "must be positive"
+	} else if r.TTLSeconds > 0 && r.StormTTLSeconds > r.TTLSeconds {
+		errs["storm_ttl_seconds"] = "cannot exceed ttl_seconds"
+	}
+	if r.PrestormMargin < 0 || r.PrestormMargin >= 1 {
+		errs["prestorm_margin"] = "must be between 0 and 1"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (r dnsSettingsRequest) ToUpsertParams(serviceID int64) db.UpsertServiceDNSSettingsParams {
+	return db.UpsertServiceDNSSettingsParams{
+		ServiceID:       serviceID,
+		TtlSeconds:      r.TTLSeconds,
+		StormTtlSeconds: r.StormTTLSeconds,
+		PrestormMargin:  r.PrestormMargin,
+	}
+}
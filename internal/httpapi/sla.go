@@ -0,0 +1,281 @@
+package httpapi
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"tranche/internal/billing"
+	"tranche/internal/db"
+	"tranche/internal/sla"
+)
+
+func (s *Server) handleListSLADefinitions(w http.ResponseWriter, r *http.Request) {
+	defs, err := s.db.ListSLADefinitions(r.Context())
+	if err != nil {
+		s.log.Printf("ListSLADefinitions: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list sla definitions", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, defs)
+}
+
+func (s *Server) handleCreateSLADefinition(w http.ResponseWriter, r *http.Request) {
+	var req slaDefinitionRequest
+	if err := decodeJSON(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes), &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload", err)
+		return
+	}
+	tiers := db.SLATiers(req.Tiers)
+	sla.SortTiers(tiers)
+	def, err := s.db.InsertSLADefinition(r.Context(), db.InsertSLADefinitionParams{
+		Name:  strings.TrimSpace(req.Name),
+		Tiers: tiers,
+	})
+	if err != nil {
+		s.log.Printf("InsertSLADefinition: %v", err)
+		writeDBError(w, err, "failed to create sla definition")
+		return
+	}
+	writeJSON(w, http.StatusCreated, def)
+}
+
+func (s *Server) handleGetSLADefinition(w http.ResponseWriter, r *http.Request) {
+	def, ok := s.requireSLADefinition(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, def)
+}
+
+// handleUpdateSLADefinition changes an SLA in place. Invoices already finalized keep the
+// credits computed under the old tiers.
+func (s *Server) handleUpdateSLADefinition(w http.ResponseWriter, r *http.Request) {
+	existing, ok := s.requireSLADefinition(w, r)
+	if !ok {
+		return
+	}
+	var req slaDefinitionPatchRequest
+	if err := decodeJSON(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes), &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid payload", err)
+		return
+	}
+	def, err := s.db.UpdateSLADefinition(r.Context(), req.Apply(existing))
+	if err != nil {
+		s.log.Printf("UpdateSLADefinition: %v", err)
+		writeDBError(w, err, "failed to update sla definition")
+		return
+	}
+	writeJSON(w, http.StatusOK, def)
+}
+
+func (s *Server) requireSLADefinition(w http.ResponseWriter, r *http.Request) (db.SlaDefinition, bool) {
+	slaID, err := parseIDParam(chi.URLParam(r, "slaID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return db.SlaDefinition{}, false
+	}
+	def, err := s.db.GetSLADefinition(r.Context(), slaID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "sla definition not found", nil)
+			return db.SlaDefinition{}, false
+		}
+		s.log.Printf("GetSLADefinition: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load sla definition", nil)
+		return db.SlaDefinition{}, false
+	}
+	return def, true
+}
+
+// slaAttainmentResponse is a service's availability so far in the billing period containing
+// the requested time, and the credit it would earn if the period ended now.
+type slaAttainmentResponse struct {
+	SLA                    *db.SlaDefinition `json:"sla"`
+	PeriodStart            time.Time         `json:"period_start"`
+	PeriodEnd              time.Time         `json:"period_end"`
+	MeasuredThrough        time.Time         `json:"measured_through"`
+	AvailabilityPercent    float64           `json:"availability_percent"`
+	DownMinutes            int64             `json:"down_minutes"`
+	TotalMinutes           int64             `json:"total_minutes"`
+	ProjectedCreditPercent float64           `json:"projected_credit_percent"`
+	History                []db.SlaResult    `json:"history"`
+}
+
+// slaHistoryLimit is how many finalized periods the attainment endpoint returns.
+const slaHistoryLimit = 12
+
+// handleGetServiceSLA reports attainment for the billing period containing ?at=, which
+// defaults to now. The SLA is the one on the customer's plan at that time; without one the
+// availability is still reported and no credit is projected.
+func (s *Server) handleGetServiceSLA(w http.ResponseWriter, r *http.Request) {
+	svc, ok := s.requireServiceContext(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	at := now
+	if raw := r.URL.Query().Get("at"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid query", map[string]string{"at": "must be RFC3339"})
+			return
+		}
+		at = t.UTC()
+	}
+	ctx := r.Context()
+
+	settings, err := s.db.GetCustomerBillingSettings(ctx, svc.CustomerID)
+	if err != nil {
+		s.log.Printf("GetCustomerBillingSettings: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load billing settings", nil)
+		return
+	}
+	loc, err := time.LoadLocation(settings.BillingTimezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	start, end := billing.Period(at, loc, int(settings.BillingAnchorDay))
+
+	resp := slaAttainmentResponse{PeriodStart: start, PeriodEnd: end, History: []db.SlaResult{}}
+	plan, err := s.db.GetCustomerPlanAt(ctx, db.GetCustomerPlanAtParams{CustomerID: svc.CustomerID, EffectiveFrom: end.Add(-time.Nanosecond)})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		s.log.Printf("GetCustomerPlanAt: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load pricing plan", nil)
+		return
+	case plan.SlaDefinitionID.Valid:
+		def, err := s.db.GetSLADefinition(ctx, plan.SlaDefinitionID.Int64)
+		if err != nil {
+			s.log.Printf("GetSLADefinition: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to load sla definition", nil)
+			return
+		}
+		resp.SLA = &def
+	}
+
+	from, to := start, end
+	if svc.CreatedAt.After(from) {
+		from = svc.CreatedAt
+	}
+	if now.Before(to) {
+		to = now
+	}
+	a, err := s.sla.Measure(ctx, svc.ID, from, to)
+	if err != nil {
+		s.log.Printf("GetServiceDowntime: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to measure availability", nil)
+		return
+	}
+	resp.MeasuredThrough = a.To
+	resp.AvailabilityPercent = a.AvailabilityPercent
+	resp.DownMinutes = a.DownMinutes
+	resp.TotalMinutes = a.TotalMinutes
+	if resp.SLA != nil {
+		resp.ProjectedCreditPercent = sla.CreditPercent(resp.SLA.Tiers, a.AvailabilityPercent)
+	}
+
+	history, err := s.db.ListSLAResultsForService(ctx, db.ListSLAResultsForServiceParams{ServiceID: svc.ID, Limit: slaHistoryLimit})
+	if err != nil {
+		s.log.Printf("ListSLAResultsForService: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list sla results", nil)
+		return
+	}
+	resp.History = history
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type slaDefinitionRequest struct {
+	Name  string       `json:"name"`
+	Tiers []db.SLATier `json:"tiers"`
+}
+
+func (r slaDefinitionRequest) Validate() map[string]string {
+	errs := map[string]string{}
+	if strings.TrimSpace(r.Name) == "" {
+		errs["name"] = "cannot be blank"
+	}
+	validateSLATiers(r.Tiers, errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+type slaDefinitionPatchRequest struct {
+	Name  *string       `json:"name"`
+	Tiers *[]db.SLATier `json:"tiers"`
+}
+
+func (r slaDefinitionPatchRequest) Validate() map[string]string {
+	if r.Name == nil && r.Tiers == nil {
+		return map[string]string{"body": "at least one field is required"}
+	}
+	errs := map[string]string{}
+	if r.Name != nil && strings.TrimSpace(*r.Name) == "" {
+		errs["name"] = "cannot be blank"
+	}
+	if r.Tiers != nil {
+		validateSLATiers(*r.Tiers, errs)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (r slaDefinitionPatchRequest) Apply(existing db.SlaDefinition) db.UpdateSLADefinitionParams {
+	if r.Name != nil {
+		existing.Name = strings.TrimSpace(*r.Name)
+	}
+	if r.Tiers != nil {
+		existing.Tiers = db.SLATiers(*r.Tiers)
+		sla.SortTiers(existing.Tiers)
+	}
+	return db.UpdateSLADefinitionParams{ID: existing.ID, Name: existing.Name, Tiers: existing.Tiers}
+}
+
+// validateSLATiers requires at least one tier, distinct thresholds and credits that grow as
+// the threshold falls, so a worse month never earns a smaller credit.
+func validateSLATiers(tiers []db.SLATier, errs map[string]string) {
+	if len(tiers) == 0 {
+		errs["tiers"] = "at least one tier is required"
+		return
+	}
+	for i, tier := range tiers {
+		key := fmt.Sprintf("tiers[%d]", i)
+		switch {
+		case tier.BelowPercent <= 0 || tier.BelowPercent > 100:
+			errs[key] = "below_percent must be above 0 and at most 100"
+		case tier.CreditPercent <= 0 || tier.CreditPercent > 100:
+			errs[key] = "credit_percent must be above 0 and at most 100"
+		}
+	}
+	if len(errs) > 0 {
+		return
+	}
+	sorted := append(db.SLATiers(nil), tiers...)
+	sla.SortTiers(sorted)
+	for i := 1; i < len(sorted); i++ {
+		switch {
+		case sorted[i].BelowPercent == sorted[i-1].BelowPercent:
+			errs["tiers"] = "below_percent values must be distinct"
+		case sorted[i].CreditPercent <= sorted[i-1].CreditPercent:
+			errs["tiers"] = "credit_percent must increase as below_percent decreases"
+		}
+	}
+}
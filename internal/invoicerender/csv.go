@@ -0,0 +1,67 @@
+package invoicerender
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+var csvHeader = []string{
+	"line_item_id",
+	"kind",
+	"service_id",
+	"service",
+	"window_start",
+	"window_end",
+	"primary_bytes",
+	"backup_bytes",
+	"primary_requests",
+	"backup_requests",
+	"coverage_factor",
+	"amount_cents",
+	"discount_cents",
+	"net_cents",
+	"adjusts_invoice_id",
+}
+
+// CSV writes one row per line item with raw values: UTC RFC3339 windows, bytes, requests
+// and cents. Minimum commit rows have no service, and adjusts_invoice_id is only set on
+// adjustments.
+func (r *Renderer) CSV(w io.Writer, doc Document) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, item := range doc.LineItems {
+		var serviceID, service, adjusts string
+		if item.ServiceID.Valid {
+			serviceID = strconv.FormatInt(item.ServiceID.Int64, 10)
+			service = serviceName(item, doc.Services)
+		}
+		if item.AdjustsInvoiceID.Valid {
+			adjusts = strconv.FormatInt(item.AdjustsInvoiceID.Int64, 10)
+		}
+		if err := cw.Write([]string{
+			strconv.FormatInt(item.ID, 10),
+			item.Kind,
+			serviceID,
+			service,
+			item.WindowStart.UTC().Format(time.RFC3339),
+			item.WindowEnd.UTC().Format(time.RFC3339),
+			strconv.FormatInt(item.PrimaryBytes, 10),
+			strconv.FormatInt(item.BackupBytes, 10),
+			strconv.FormatInt(item.PrimaryRequests, 10),
+			strconv.FormatInt(item.BackupRequests, 10),
+			strconv.FormatFloat(item.CoverageFactor, 'f', 4, 64),
+			strconv.FormatInt(item.AmountCents, 10),
+			strconv.FormatInt(item.DiscountCents, 10),
+			strconv.FormatInt(item.AmountCents-item.DiscountCents, 10),
+			adjusts,
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,14 @@
+package invoicerender
+
+import (
+	"embed"
+	"io"
+)
+
+//go:embed invoice.html.tmpl
+var templates embed.FS
+
+// HTML writes the invoice as a standalone HTML page with inline styles.
+func (r *Renderer) HTML(w io.Writer, doc Document) error {
+	return r.html.Execute(w, r.view(doc))
+}
@@ -0,0 +1,291 @@
+package invoicerender
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The PDF is laid out on US Letter pages in points, with the origin at the bottom left.
+const (
+	pageWidth    = 612.0
+	pageHeight   = 792.0
+	margin       = 40.0
+	rowHeight    = 14.0
+	tableBottom  = 80.0
+	totalsHeight = 3*rowHeight + 12
+)
+
+// pdfColumn is one table column. Numeric columns are right-aligned at x; text columns start
+// at x and are cut to width.
+type pdfColumn struct {
+	title string
+	x     float64
+	width float64
+	right bool
+	value func(row) string
+}
+
+var pdfColumns = []pdfColumn{
+	{title: "Description", x: margin, width: 112, value: func(r row) string { return r.Description }},
+	{title: "Window", x: 156, width: 140, value: func(r row) string { return r.Window }},
+	{title: "Primary GB", x: 344, right: true, value: func(r row) string { return r.PrimaryGB }},
+	{title: "Backup GB", x: 394, right: true, value: func(r row) string { return r.BackupGB }},
+	{title: "Coverage", x: 436, right: true, value: func(r row) string { return r.Coverage }},
+	{title: "Amount", x: 484, right: true, value: func(r row) string { return r.Amount }},
+	{title: "Discount", x: 530, right: true, value: func(r row) string { return r.Discount }},
+	{title: "Net", x: pageWidth - margin, right: true, value: func(r row) string { return r.Net }},
+}
+
+// PDF writes the invoice as a PDF using only the standard Helvetica fonts, so no fonts are
+// embedded. Characters outside Latin-1 print as "?". Output is deterministic: the document
+// carries no creation date or ID.
+func (r *Renderer) PDF(w io.Writer, doc Document) error {
+	v := r.view(doc)
+	var pages []*pdfCanvas
+
+	page := r.firstPage(v)
+	pages = append(pages, page)
+	y := r.tableHeader(page, 596)
+	for _, rw := range v.Rows {
+		if y < tableBottom {
+			page = &pdfCanvas{}
+			pages = append(pages, page)
+			y = r.tableHeader(page, pageHeight-margin-10)
+		}
+		for _, col := range pdfColumns {
+			page.cell(col, col.value(rw), y, fontRegular, 8)
+		}
+		y -= rowHeight
+	}
+	if len(v.Rows) == 0 {
+		page.text(margin, y, fontRegular, 8, "No usage billed yet.")
+		y -= rowHeight
+	}
+	if y-totalsHeight < tableBottom-rowHeight {
+		page = &pdfCanvas{}
+		pages = append(pages, page)
+		y = pageHeight - margin - 10
+	}
+	r.totals(page, v, y-4)
+
+	for i, p := range pages {
+		p.color(0.4, 0.4, 0.4)
+		p.text(margin, 40, fontRegular, 7, fitText(strings.TrimSpace(v.TimezoneNote+" "+v.Brand.Footer), fontRegular, 7, 440))
+		p.textRight(pageWidth-margin, 40, fontRegular, 7, fmt.Sprintf("Page %d of %d", i+1, len(pages)))
+	}
+	return writePDF(w, pages)
+}
+
+func (r *Renderer) firstPage(v view) *pdfCanvas {
+	p := &pdfCanvas{}
+	p.color(float64(r.color.r)/255, float64(r.color.g)/255, float64(r.color.b)/255)
+	p.rect(0, pageHeight-56, pageWidth, 56)
+	p.color(1, 1, 1)
+	p.text(margin, pageHeight-36, fontBold, 20, v.Brand.BrandName)
+
+	p.color(0.4, 0.4, 0.4)
+	y := pageHeight - 74
+	for _, line := range strings.Split(v.Brand.BrandAddress, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			p.text(margin, y, fontRegular, 9, line)
+			y -= 12
+		}
+	}
+
+	p.color(0, 0, 0)
+	p.text(margin, 690, fontBold, 16, "Invoice "+v.Number)
+	if v.Draft {
+		p.color(0.7, 0, 0)
+	}
+	p.textRight(pageWidth-margin, 690, fontBold, 11, strings.ToUpper(v.Status))
+	for i, field := range [][2]string{{"Billed to", v.Customer}, {"Billing period", v.Period}, {"Issued", v.Issued}} {
+		y := 664 - float64(i)*15
+		p.color(0.4, 0.4, 0.4)
+		p.text(margin, y, fontRegular, 10, field[0])
+		p.color(0, 0, 0)
+		p.text(130, y, fontRegular, 10, fitText(field[1], fontRegular, 10, pageWidth-margin-130))
+	}
+	return p
+}
+
+// tableHeader draws the column titles with y as their baseline and returns the first row's.
+func (r *Renderer) tableHeader(p *pdfCanvas, y float64) float64 {
+	p.color(0, 0, 0)
+	for _, col := range pdfColumns {
+		p.cell(col, col.title, y, fontBold, 8)
+	}
+	r.rule(p, y-5, 1.5)
+	return y - rowHeight - 4
+}
+
+func (r *Renderer) totals(p *pdfCanvas, v view, y float64) {
+	r.rule(p, y+rowHeight-4, 0.5)
+	labelX := pdfColumns[len(pdfColumns)-2].x
+	for i, line := range [][2]string{{"Subtotal", v.Subtotal}, {"Storm discounts", v.Discount}, {"Total due", v.Total}} {
+		font := fontRegular
+		if i == 2 {
+			font = fontBold
+			r.rule(p, y+rowHeight-4, 1.5)
+		}
+		p.color(0, 0, 0)
+		p.textRight(labelX, y, font, 9, line[0])
+		p.textRight(pageWidth-margin, y, font, 9, line[1])
+		y -= rowHeight
+	}
+}
+
+func (r *Renderer) rule(p *pdfCanvas, y, width float64) {
+	p.color(float64(r.color.r)/255, float64(r.color.g)/255, float64(r.color.b)/255)
+	p.rect(margin, y, pageWidth-2*margin, width)
+}
+
+type pdfFont int
+
+const (
+	fontRegular pdfFont = iota
+	fontBold
+)
+
+// pdfCanvas accumulates one page's content stream.
+type pdfCanvas struct {
+	buf bytes.Buffer
+}
+
+func (p *pdfCanvas) color(r, g, b float64) {
+	fmt.Fprintf(&p.buf, "%s %s %s rg\n", num(r), num(g), num(b))
+}
+
+func (p *pdfCanvas) rect(x, y, w, h float64) {
+	fmt.Fprintf(&p.buf, "%s %s %s %s re f\n", num(x), num(y), num(w), num(h))
+}
+
+func (p *pdfCanvas) text(x, y float64, font pdfFont, size float64, s string) {
+	fmt.Fprintf(&p.buf, "BT /F%d %s Tf %s %s Td (%s) Tj ET\n", int(font)+1, num(size), num(x), num(y), pdfString(s))
+}
+
+func (p *pdfCanvas) textRight(x, y float64, font pdfFont, size float64, s string) {
+	p.text(x-textWidth(s, font, size), y, font, size, s)
+}
+
+func (p *pdfCanvas) cell(col pdfColumn, s string, y float64, font pdfFont, size float64) {
+	if col.right {
+		p.textRight(col.x, y, font, size, s)
+		return
+	}
+	p.text(col.x, y, font, size, fitText(s, font, size, col.width))
+}
+
+func num(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 3, 64)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// pdfString escapes s for a literal string in WinAnsiEncoding, which matches Latin-1 for
+// the accented letters.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c >= 160 && c <= 255:
+			fmt.Fprintf(&b, "\\%03o", c)
+		case c < 32 || c > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// fitText cuts s so that it is at most width points wide, marking the cut with "...".
+func fitText(s string, font pdfFont, size, width float64) string {
+	if textWidth(s, font, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && textWidth(string(runes)+"...", font, size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
+
+func textWidth(s string, font pdfFont, size float64) float64 {
+	widths := helveticaWidths
+	if font == fontBold {
+		widths = helveticaBoldWidths
+	}
+	var total int
+	for _, c := range s {
+		switch {
+		case c >= 160 && c <= 255:
+			// Close enough for the accented letters, which are as wide as their base letter.
+			total += 556
+			continue
+		case c < 32 || c > 126:
+			c = '?'
+		}
+		total += widths[c-32]
+	}
+	return float64(total) * size / 1000
+}
+
+// writePDF writes the pages as a PDF 1.4 file. Objects 1-4 are the catalog, the page tree
+// and the two fonts; each page then takes a page object and a content stream.
+func writePDF(w io.Writer, pages []*pdfCanvas) error {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, p := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			num(pageWidth), num(pageHeight), 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.buf.Len(), p.buf.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// Glyph widths of the standard Helvetica fonts for ASCII 32-126, in 1/1000 em.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var helveticaBoldWidths = [95]int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
@@ -0,0 +1,185 @@
+// Package invoicerender turns an invoice and its line items into customer-facing documents:
+// a branded HTML page, a PDF and a CSV of the line items.
+package invoicerender
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+
+	"tranche/internal/config"
+	"tranche/internal/db"
+	"tranche/internal/money"
+)
+
+// Document is everything rendered on one invoice. Services maps the line items' service IDs
+// to names; items for services missing from it show the ID instead.
+type Document struct {
+	Invoice   db.Invoice
+	Customer  db.Customer
+	LineItems []db.InvoiceLineItem
+	Services  map[int64]string
+}
+
+// Renderer renders documents with one brand. It is safe for concurrent use.
+type Renderer struct {
+	brand config.InvoiceConfig
+	color rgb
+	html  *template.Template
+}
+
+type rgb struct{ r, g, b uint8 }
+
+func New(cfg config.InvoiceConfig) (*Renderer, error) {
+	if strings.TrimSpace(cfg.BrandName) == "" {
+		cfg.BrandName = "Tranche"
+	}
+	if cfg.BrandColor == "" {
+		cfg.BrandColor = "#1f4e79"
+	}
+	color, err := parseColor(cfg.BrandColor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("invoice.html.tmpl").ParseFS(templates, "invoice.html.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("parse invoice template: %w", err)
+	}
+	return &Renderer{brand: cfg, color: color, html: tmpl}, nil
+}
+
+func parseColor(hex string) (rgb, error) {
+	if len(hex) != 7 || hex[0] != '#' {
+		return rgb{}, fmt.Errorf("invoice brand color %q must look like #1f4e79", hex)
+	}
+	v, err := strconv.ParseUint(hex[1:], 16, 32)
+	if err != nil {
+		return rgb{}, fmt.Errorf("invoice brand color %q must look like #1f4e79", hex)
+	}
+	return rgb{r: uint8(v >> 16), g: uint8(v >> 8), b: uint8(v)}, nil
+}
+
+// view is a document with every value formatted for display. Dates are shown in the
+// customer's billing timezone.
+type view struct {
+	Brand        config.InvoiceConfig
+	Number       string
+	Status       string
+	Draft        bool
+	Customer     string
+	Period       string
+	Issued       string
+	Rows         []row
+	Subtotal     string
+	Discount     string
+	Total        string
+	TimezoneNote string
+}
+
+type row struct {
+	Description string
+	Window      string
+	PrimaryGB   string
+	BackupGB    string
+	Coverage    string
+	Amount      string
+	Discount    string
+	Net         string
+}
+
+func (r *Renderer) view(doc Document) view {
+	loc := location(doc.Customer.BillingTimezone)
+	inv := doc.Invoice
+	format := func(units int64) string { return money.Format(units, inv.Currency) }
+	v := view{
+		Brand:        r.brand,
+		Number:       Number(inv.ID),
+		Status:       inv.Status,
+		Draft:        inv.Status == "draft",
+		Customer:     doc.Customer.Name,
+		Period:       formatPeriod(inv.PeriodStart, inv.PeriodEnd, loc),
+		Issued:       "Not yet issued",
+		Subtotal:     format(inv.SubtotalCents),
+		Discount:     format(-inv.DiscountCents),
+		Total:        format(inv.TotalCents),
+		TimezoneNote: "Times are shown in " + loc.String() + ".",
+	}
+	if inv.FinalizedAt.Valid {
+		v.Issued = inv.FinalizedAt.Time.In(loc).Format("January 2, 2006")
+	}
+	for _, item := range doc.LineItems {
+		v.Rows = append(v.Rows, row{
+			Description: Describe(item, doc.Services),
+			Window:      formatWindow(item.WindowStart, item.WindowEnd, loc),
+			PrimaryGB:   formatGB(item.PrimaryBytes),
+			BackupGB:    formatGB(item.BackupBytes),
+			Coverage:    formatCoverage(item.CoverageFactor),
+			Amount:      format(item.AmountCents),
+			Discount:    format(-item.DiscountCents),
+			Net:         format(item.AmountCents - item.DiscountCents),
+		})
+	}
+	return v
+}
+
+func location(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Number is the invoice number printed on documents, e.g. INV-000042.
+func Number(id int64) string {
+	return fmt.Sprintf("INV-%06d", id)
+}
+
+func serviceName(item db.InvoiceLineItem, services map[int64]string) string {
+	if name, ok := services[item.ServiceID.Int64]; ok {
+		return name
+	}
+	return fmt.Sprintf("service %d", item.ServiceID.Int64)
+}
+
+// Describe is the line item description printed on documents.
+func Describe(item db.InvoiceLineItem, services map[int64]string) string {
+	switch item.Kind {
+	case "adjustment":
+		return fmt.Sprintf("%s (adjusts %s)", serviceName(item, services), Number(item.AdjustsInvoiceID.Int64))
+	case "minimum_commit":
+		return "Minimum commit shortfall"
+	case "sla_credit":
+		return "SLA credit: " + serviceName(item, services)
+	default:
+		return serviceName(item, services)
+	}
+}
+
+// formatPeriod shows a billing period by its first and last day; periods end at midnight.
+func formatPeriod(start, end time.Time, loc *time.Location) string {
+	return start.In(loc).Format("Jan 2, 2006") + " - " + end.In(loc).Add(-time.Nanosecond).Format("Jan 2, 2006")
+}
+
+func formatWindow(start, end time.Time, loc *time.Location) string {
+	s, e := start.In(loc), end.In(loc)
+	if last := e.Add(-time.Nanosecond); last.Year() == s.Year() && last.YearDay() == s.YearDay() {
+		return s.Format("2006-01-02 15:04") + "-" + e.Format("15:04")
+	}
+	return s.Format("2006-01-02 15:04") + " - " + e.Format("2006-01-02 15:04")
+}
+
+const bytesPerGB = 1024 * 1024 * 1024
+
+func formatGB(bytes int64) string {
+	return strconv.FormatFloat(float64(bytes)/bytesPerGB, 'f', 2, 64)
+}
+
+func formatCoverage(factor float64) string {
+	return strconv.FormatFloat(factor*100, 'f', 1, 64) + "%"
+}
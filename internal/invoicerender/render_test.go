@@ -0,0 +1,200 @@
+package invoicerender
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"tranche/internal/config"
+	"tranche/internal/db"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func testDocument() Document {
+	at := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	return Document{
+		Invoice: db.Invoice{
+			ID:            42,
+			CustomerID:    3,
+			PeriodStart:   at("2026-09-01T04:00:00Z"),
+			PeriodEnd:     at("2026-10-01T04:00:00Z"),
+			SubtotalCents: 5234567,
+			DiscountCents: 1250,
+			TotalCents:    5233317,
+			Status:        "finalized",
+			FinalizedAt:   sql.NullTime{Time: at("2026-10-04T04:10:00Z"), Valid: true},
+			Currency:      "usd",
+		},
+		Customer: db.Customer{ID: 3, Name: "Acme <Media> & Co", BillingTimezone: "America/New_York", BillingAnchorDay: 1},
+		LineItems: []db.InvoiceLineItem{
+			{
+				ID: 1, InvoiceID: 42, Kind: "usage",
+				ServiceID:   sql.NullInt64{Int64: 7, Valid: true},
+				WindowStart: at("2026-09-14T13:00:00Z"), WindowEnd: at("2026-09-14T14:00:00Z"),
+				PrimaryBytes: 5 * bytesPerGB, BackupBytes: bytesPerGB / 2,
+				PrimaryRequests: 120000, BackupRequests: 8000,
+				CoverageFactor: 0.25, AmountCents: 67, DiscountCents: 1,
+			},
+			{
+				ID: 2, InvoiceID: 42, Kind: "adjustment",
+				ServiceID:        sql.NullInt64{Int64: 9, Valid: true},
+				AdjustsInvoiceID: sql.NullInt64{Int64: 40, Valid: true},
+				WindowStart:      at("2026-08-31T23:00:00Z"), WindowEnd: at("2026-09-01T01:00:00Z"),
+				PrimaryBytes: -bytesPerGB, CoverageFactor: 0, AmountCents: -12,
+			},
+			{
+				ID: 3, InvoiceID: 42, Kind: "minimum_commit",
+				WindowStart: at("2026-09-01T04:00:00Z"), WindowEnd: at("2026-10-01T04:00:00Z"),
+				AmountCents: 5233262,
+			},
+			{
+				ID: 4, InvoiceID: 42, Kind: "usage",
+				ServiceID:   sql.NullInt64{Int64: 11, Valid: true},
+				WindowStart: at("2026-09-20T00:00:00Z"), WindowEnd: at("2026-09-20T01:00:00Z"),
+				BackupBytes: 40 * bytesPerGB, CoverageFactor: 1, AmountCents: 2500, DiscountCents: 1249,
+			},
+			{
+				ID: 5, InvoiceID: 42, Kind: "sla_credit",
+				ServiceID:   sql.NullInt64{Int64: 9, Valid: true},
+				WindowStart: at("2026-09-01T04:00:00Z"), WindowEnd: at("2026-10-01T04:00:00Z"),
+				AmountCents: -125,
+			},
+		},
+		Services: map[int64]string{
+			7:  "Café (EU) storefront",
+			9:  "api",
+			11: "a-service-with-a-name-far-too-long-for-the-pdf-column",
+		},
+	}
+}
+
+func testRenderer(t *testing.T) *Renderer {
+	t.Helper()
+	r, err := New(config.InvoiceConfig{
+		BrandName:    "Tranche",
+		BrandColor:   "#1f4e79",
+		BrandAddress: "1 Failover Way\nSpringfield",
+		Footer:       "Questions? billing@example.com",
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return r
+}
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("write golden: %v", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden (run go test -update to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s differs from golden file; run go test ./internal/invoicerender -update and review the diff\ngot:\n%s", name, got)
+	}
+}
+
+func TestHTMLGolden(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testRenderer(t).HTML(&buf, testDocument()); err != nil {
+		t.Fatalf("HTML: %v", err)
+	}
+	checkGolden(t, "invoice.html", buf.Bytes())
+}
+
+func TestCSVGolden(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testRenderer(t).CSV(&buf, testDocument()); err != nil {
+		t.Fatalf("CSV: %v", err)
+	}
+	checkGolden(t, "invoice.csv", buf.Bytes())
+}
+
+func TestPDFGolden(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testRenderer(t).PDF(&buf, testDocument()); err != nil {
+		t.Fatalf("PDF: %v", err)
+	}
+	checkPDFStructure(t, buf.Bytes(), 1)
+	checkGolden(t, "invoice.pdf", buf.Bytes())
+}
+
+func TestPDFPaginatesLongInvoices(t *testing.T) {
+	doc := testDocument()
+	item := doc.LineItems[0]
+	doc.LineItems = nil
+	for i := 0; i < 120; i++ {
+		item.ID = int64(i + 1)
+		doc.LineItems = append(doc.LineItems, item)
+	}
+	var buf bytes.Buffer
+	if err := testRenderer(t).PDF(&buf, doc); err != nil {
+		t.Fatalf("PDF: %v", err)
+	}
+	checkPDFStructure(t, buf.Bytes(), 3)
+	if !bytes.Contains(buf.Bytes(), []byte("(Page 3 of 3)")) {
+		t.Fatalf("expected a page 3 of 3 footer")
+	}
+}
+
+// checkPDFStructure verifies the page count and that every xref entry points at its object.
+func checkPDFStructure(t *testing.T, pdf []byte, pages int) {
+	t.Helper()
+	if got := bytes.Count(pdf, []byte("/Type /Page /Parent")); got != pages {
+		t.Fatalf("expected %d pages, got %d", pages, got)
+	}
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatalf("missing startxref trailer")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	lines := strings.Split(string(pdf[xref:]), "\n")
+	if lines[0] != "xref" {
+		t.Fatalf("startxref does not point at the xref table")
+	}
+	count, _ := strconv.Atoi(strings.Fields(lines[1])[1])
+	for obj := 1; obj < count; obj++ {
+		off, _ := strconv.Atoi(strings.Fields(lines[2+obj])[0])
+		if want := strconv.Itoa(obj) + " 0 obj"; !bytes.HasPrefix(pdf[off:], []byte(want)) {
+			t.Fatalf("xref entry %d points at %q", obj, pdf[off:off+10])
+		}
+	}
+}
+
+func TestViewFormatsInInvoiceCurrency(t *testing.T) {
+	r := testRenderer(t)
+	for currency, want := range map[string]string{"usd": "$52,333.17", "eur": "EUR 52,333.17", "jpy": "JPY 5,233,317"} {
+		doc := testDocument()
+		doc.Invoice.Currency = currency
+		if got := r.view(doc).Total; got != want {
+			t.Fatalf("%s total = %q, want %q", currency, got, want)
+		}
+	}
+}
+
+func TestNewRejectsBadColor(t *testing.T) {
+	if _, err := New(config.InvoiceConfig{BrandColor: "navy"}); err == nil {
+		t.Fatalf("expected a non-hex brand color to be rejected")
+	}
+}
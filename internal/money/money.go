@@ -0,0 +1,221 @@
+// Package money does exact billing arithmetic. Amounts are kept in millionths of a
+// currency's minor unit (a cent for USD) and only rounded to whole minor units when an
+// invoice total is set.
+package money
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Amount is an amount of money in millionths of the minor unit.
+type Amount int64
+
+// MicrosPerUnit is the number of Amount units in one minor unit.
+const MicrosPerUnit = 1_000_000
+
+// FromCents converts whole minor units to an Amount.
+func FromCents(cents int64) Amount {
+	return Amount(cents * MicrosPerUnit)
+}
+
+// Rate prices quantity at rate minor units per per, e.g. bytes at cents per GB with per set
+// to the bytes in a GB. The result is exact to the micro, rounded half to even.
+func Rate(quantity, rate, per int64) Amount {
+	if quantity == 0 || rate == 0 || per <= 0 {
+		return 0
+	}
+	num := new(big.Int).Mul(big.NewInt(quantity), big.NewInt(rate))
+	num.Mul(num, big.NewInt(MicrosPerUnit))
+	return Amount(divRound(num, big.NewInt(per)))
+}
+
+// Share returns a×num/den, exact to the micro and rounded half to even.
+func (a Amount) Share(num, den int64) Amount {
+	if den == 0 {
+		return 0
+	}
+	n := new(big.Int).Mul(big.NewInt(int64(a)), big.NewInt(num))
+	return Amount(divRound(n, big.NewInt(den)))
+}
+
+// MulFloat scales a by f, such as a discount rate times a storm coverage ratio. The factor
+// is only as exact as a float64, so the result is rounded to the nearest micro.
+func (a Amount) MulFloat(f float64) Amount {
+	return Amount(math.RoundToEven(float64(a) * f))
+}
+
+// divRound divides num by a positive den, rounding half to even.
+func divRound(num, den *big.Int) int64 {
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	twice := new(big.Int).Abs(r)
+	twice.Lsh(twice, 1)
+	if c := twice.Cmp(den); c > 0 || (c == 0 && q.Bit(0) == 1) {
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64()
+}
+
+// RoundingMode decides how an Amount becomes whole minor units.
+type RoundingMode int
+
+const (
+	// HalfUp rounds to the nearest unit, halves away from zero.
+	HalfUp RoundingMode = iota
+	// HalfEven rounds to the nearest unit, halves to the even unit (banker's rounding).
+	HalfEven
+	// Down truncates toward zero.
+	Down
+	// Up rounds away from zero.
+	Up
+)
+
+var roundingModeNames = map[RoundingMode]string{
+	HalfUp:   "half_up",
+	HalfEven: "half_even",
+	Down:     "down",
+	Up:       "up",
+}
+
+func (m RoundingMode) String() string {
+	if name, ok := roundingModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("RoundingMode(%d)", int(m))
+}
+
+// ParseRoundingMode reads half_up, half_even, down or up.
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	for mode, name := range roundingModeNames {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rounding mode %q (want half_up, half_even, down or up)", s)
+}
+
+// Round converts a to whole minor units.
+func (a Amount) Round(mode RoundingMode) int64 {
+	units, rem := int64(a)/MicrosPerUnit, int64(a)%MicrosPerUnit
+	if rem == 0 {
+		return units
+	}
+	sign := int64(1)
+	if rem < 0 {
+		sign, rem = -1, -rem
+	}
+	switch mode {
+	case Down:
+		return units
+	case Up:
+		return units + sign
+	case HalfEven:
+		if rem > MicrosPerUnit/2 || (rem == MicrosPerUnit/2 && units%2 != 0) {
+			return units + sign
+		}
+		return units
+	default:
+		if rem >= MicrosPerUnit/2 {
+			return units + sign
+		}
+		return units
+	}
+}
+
+// Allocate splits target whole units across parts so each part gets its amount rounded
+// down or up and the results sum to target. Units left over after rounding every part down
+// go to the parts with the largest remainders, earlier parts first on ties. Target must lie
+// between the sums of the parts rounded down and up, as any rounding of their total does.
+func Allocate(target int64, parts []Amount) []int64 {
+	out := make([]int64, len(parts))
+	remainders := make([]int64, len(parts))
+	var sum int64
+	for i, p := range parts {
+		floor := int64(p) / MicrosPerUnit
+		rem := int64(p) % MicrosPerUnit
+		if rem < 0 {
+			floor--
+			rem += MicrosPerUnit
+		}
+		out[i], remainders[i] = floor, rem
+		sum += floor
+	}
+	order := make([]int, 0, len(parts))
+	for i := range parts {
+		if remainders[i] > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]] > remainders[order[b]] })
+	for _, i := range order {
+		if sum >= target {
+			break
+		}
+		out[i]++
+		sum++
+	}
+	return out
+}
+
+// zeroDecimal lists currencies whose minor unit is the major unit.
+var zeroDecimal = map[string]bool{"jpy": true, "krw": true, "vnd": true, "clp": true, "isk": true}
+
+// symbols are printed before amounts instead of the currency code. Only Latin-1 symbols
+// are used so PDF invoices can show them.
+var symbols = map[string]string{"usd": "$", "gbp": "£"}
+
+// ValidCurrency reports whether code looks like a lowercase ISO 4217 code, the form stored
+// on plans and invoices.
+func ValidCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Format shows whole minor units in currency with thousands separators, e.g. -$1,234.56,
+// EUR 10.00 or JPY 1,200.
+func Format(units int64, currency string) string {
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	currency = strings.ToLower(currency)
+	if currency == "" {
+		currency = "usd"
+	}
+	prefix, ok := symbols[currency]
+	if !ok {
+		prefix = strings.ToUpper(currency) + " "
+	}
+	major, minor := units, int64(-1)
+	if !zeroDecimal[currency] {
+		major, minor = units/100, units%100
+	}
+	whole := strconv.FormatInt(major, 10)
+	var b strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	if minor < 0 {
+		return sign + prefix + b.String()
+	}
+	return fmt.Sprintf("%s%s%s.%02d", sign, prefix, b.String(), minor)
+}
@@ -0,0 +1,138 @@
+package money
+
+import (
+	"testing"
+)
+
+const gib = 1 << 30
+
+func TestRateIsExact(t *testing.T) {
+	// One byte at 12 cents per GiB is 0.0000000111758... cents, which rounds to zero micros;
+	// a million such windows still add up to what one window of a million bytes costs.
+	var sum Amount
+	for i := 0; i < 1000; i++ {
+		sum += Rate(1_000_000, 12, gib)
+	}
+	if whole := Rate(1_000_000_000, 12, gib); sum < whole-500 || sum > whole+500 {
+		t.Fatalf("per-window sum %d drifted from %d", sum, whole)
+	}
+	if got := Rate(gib, 12, gib); got != 12*MicrosPerUnit {
+		t.Fatalf("Rate(1 GiB) = %d, want 12 cents", got)
+	}
+	if got := Rate(500_000_000, 10, 1_000_000_000); got != 5*MicrosPerUnit {
+		t.Fatalf("Rate(0.5 GB) = %d, want 5 cents", got)
+	}
+	if got := Rate(-gib, 12, gib); got != -12*MicrosPerUnit {
+		t.Fatalf("Rate(-1 GiB) = %d, want -12 cents", got)
+	}
+}
+
+func TestShareRoundsHalfToEven(t *testing.T) {
+	cases := []struct {
+		a        Amount
+		num, den int64
+		want     Amount
+	}{
+		{a: 10, num: 1, den: 4, want: 2},
+		{a: 14, num: 1, den: 4, want: 4},
+		{a: -10, num: 1, den: 4, want: -2},
+		{a: -14, num: 1, den: 4, want: -4},
+		{a: 100, num: 1, den: 3, want: 33},
+		{a: 100, num: 0, den: 0, want: 0},
+	}
+	for _, c := range cases {
+		if got := c.a.Share(c.num, c.den); got != c.want {
+			t.Fatalf("%d.Share(%d, %d) = %d, want %d", c.a, c.num, c.den, got, c.want)
+		}
+	}
+}
+
+func TestRound(t *testing.T) {
+	cases := []struct {
+		micros int64
+		want   map[RoundingMode]int64
+	}{
+		{micros: 2_500_000, want: map[RoundingMode]int64{HalfUp: 3, HalfEven: 2, Down: 2, Up: 3}},
+		{micros: 3_500_000, want: map[RoundingMode]int64{HalfUp: 4, HalfEven: 4, Down: 3, Up: 4}},
+		{micros: 2_400_001, want: map[RoundingMode]int64{HalfUp: 2, HalfEven: 2, Down: 2, Up: 3}},
+		{micros: -2_500_000, want: map[RoundingMode]int64{HalfUp: -3, HalfEven: -2, Down: -2, Up: -3}},
+		{micros: -1, want: map[RoundingMode]int64{HalfUp: 0, HalfEven: 0, Down: 0, Up: -1}},
+		{micros: 7_000_000, want: map[RoundingMode]int64{HalfUp: 7, HalfEven: 7, Down: 7, Up: 7}},
+	}
+	for _, c := range cases {
+		for mode, want := range c.want {
+			if got := Amount(c.micros).Round(mode); got != want {
+				t.Fatalf("Amount(%d).Round(%s) = %d, want %d", c.micros, mode, got, want)
+			}
+		}
+	}
+}
+
+func TestParseRoundingMode(t *testing.T) {
+	for name, want := range map[string]RoundingMode{"half_up": HalfUp, "HALF_EVEN": HalfEven, "down": Down, " up ": Up} {
+		got, err := ParseRoundingMode(name)
+		if err != nil || got != want {
+			t.Fatalf("ParseRoundingMode(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseRoundingMode("nearest"); err == nil {
+		t.Fatalf("expected an unknown mode to be rejected")
+	}
+}
+
+func TestAllocateSumsToTarget(t *testing.T) {
+	parts := []Amount{400_000, 400_000, 400_000, -1_300_000, 2_700_000}
+	var total Amount
+	for _, p := range parts {
+		total += p
+	}
+	target := total.Round(HalfUp)
+	got := Allocate(target, parts)
+	var sum int64
+	for i, cents := range got {
+		sum += cents
+		floor := Amount(parts[i]).Round(Down)
+		if parts[i] < 0 {
+			floor = Amount(parts[i]).Round(Up)
+		}
+		if cents != floor && cents != floor+1 {
+			t.Fatalf("part %d (%d micros) got %d cents", i, parts[i], cents)
+		}
+	}
+	if sum != target {
+		t.Fatalf("allocated %v sums to %d, want %d", got, sum, target)
+	}
+	// Both 0.7 remainders win a unit, then the earliest of the 0.4 ones.
+	want := []int64{1, 0, 0, -1, 3}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Allocate = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for _, c := range []struct {
+		units    int64
+		currency string
+		want     string
+	}{
+		{units: 123456789, currency: "usd", want: "$1,234,567.89"},
+		{units: -5, currency: "", want: "-$0.05"},
+		{units: 1000, currency: "eur", want: "EUR 10.00"},
+		{units: 250, currency: "gbp", want: "£2.50"},
+		{units: 1200, currency: "jpy", want: "JPY 1,200"},
+	} {
+		if got := Format(c.units, c.currency); got != c.want {
+			t.Fatalf("Format(%d, %q) = %q, want %q", c.units, c.currency, got, c.want)
+		}
+	}
+}
+
+func TestValidCurrency(t *testing.T) {
+	for code, want := range map[string]bool{"usd": true, "eur": true, "USD": false, "us": false, "usd1": false} {
+		if got := ValidCurrency(code); got != want {
+			t.Fatalf("ValidCurrency(%q) = %v", code, got)
+		}
+	}
+}
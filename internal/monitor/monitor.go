@@ -198,20 +198,55 @@ func (s *Scheduler) buildTarget(serviceID, domainID int64, domainName, host, lab
 	if label != "" {
 		metricsLabel = fmt.Sprintf("%s@%s", domainName, label)
 	}
-	hostHeader := ""
-	if !strings.EqualFold(parsed.Hostname(), domainName) {
-		hostHeader = domainName
-	}
 	return probeTarget{
 		serviceID:  serviceID,
 		domainID:   domainID,
 		domainName: domainName,
 		url:        urlStr,
-		hostHeader: hostHeader,
+		hostHeader: hostHeaderFor(parsed, domainName),
 		metricsKey: metricsLabel,
 	}, true
 }
 
+// NewHostRequest builds a request for path on a CDN host that carries domainName as its Host
+// header, the way probes reach a service through its primary or backup CDN. The path may
+// include a query string.
+func NewHostRequest(ctx context.Context, method, cdnHost, domainName, path string) (*http.Request, error) {
+	rawQuery := ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, rawQuery = path[:i], path[i+1:]
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	urlStr := buildProbeURL(cdnHost, path)
+	if urlStr == "" {
+		return nil, fmt.Errorf("invalid cdn host %q", cdnHost)
+	}
+	parsed, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	parsed.RawQuery = rawQuery
+	req, err := http.NewRequestWithContext(ctx, method, parsed.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if hostHeader := hostHeaderFor(parsed, domainName); hostHeader != "" {
+		req.Host = hostHeader
+	}
+	return req, nil
+}
+
+// hostHeaderFor returns the Host header needed for u to serve domainName, or "" when u
+// already targets the domain.
+func hostHeaderFor(u *url.URL, domainName string) string {
+	if strings.EqualFold(u.Hostname(), domainName) {
+		return ""
+	}
+	return domainName
+}
+
 func (s *Scheduler) probeTimeout() time.Duration {
 	if s.cfg.Timeout <= 0 {
 		return 5 * time.Second
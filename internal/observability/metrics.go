@@ -2,6 +2,7 @@ package observability
 
 import (
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,10 +23,21 @@ type Metrics struct {
 	BillingRunDuration prometheus.Histogram
 	BillingInvoices    prometheus.Counter
 	BillingErrors      prometheus.Counter
+
+	UsageMissingWindows *prometheus.GaugeVec
+	UsageLateWindows    *prometheus.GaugeVec
+	UsageStaleness      *prometheus.GaugeVec
+	UsageDrop           *prometheus.GaugeVec
+
+	PrewarmRequests    *prometheus.CounterVec
+	PrewarmPending     *prometheus.GaugeVec
+	PrewarmRunDuration *prometheus.HistogramVec
 }
 
-// NewMetrics constructs a registry with the collectors needed by the services.
+// NewMetrics constructs a registry with the collectors needed by the services. The service
+// name becomes the metric subsystem, with hyphens replaced as Prometheus names require.
 func NewMetrics(service string) *Metrics {
+	service = strings.ReplaceAll(service, "-", "_")
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
 	reg.MustRegister(prometheus.NewGoCollector())
@@ -86,6 +98,51 @@ func NewMetrics(service string) *Metrics {
 		Help:      "Billing run errors encountered.",
 	})
 
+	m.UsageMissingWindows = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tranche",
+		Subsystem: service,
+		Name:      "usage_missing_windows",
+		Help:      "Usage windows without a snapshot over the health lookback.",
+	}, []string{"service_id"})
+	m.UsageLateWindows = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tranche",
+		Subsystem: service,
+		Name:      "usage_late_windows",
+		Help:      "Usage windows first recorded later than the allowed delay over the health lookback.",
+	}, []string{"service_id"})
+	m.UsageStaleness = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tranche",
+		Subsystem: service,
+		Name:      "usage_staleness_seconds",
+		Help:      "Time since the end of the newest usage window.",
+	}, []string{"service_id"})
+	m.UsageDrop = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tranche",
+		Subsystem: service,
+		Name:      "usage_drop",
+		Help:      "Indicator for the newest usage window falling below the trailing average.",
+	}, []string{"service_id"})
+
+	m.PrewarmRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tranche",
+		Subsystem: service,
+		Name:      "prewarm_requests_total",
+		Help:      "Backup CDN pre-warm requests by outcome.",
+	}, []string{"service_id", "result"})
+	m.PrewarmPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tranche",
+		Subsystem: service,
+		Name:      "prewarm_pending",
+		Help:      "Pre-warm requests not yet completed in the current run.",
+	}, []string{"service_id"})
+	m.PrewarmRunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tranche",
+		Subsystem: service,
+		Name:      "prewarm_run_duration_seconds",
+		Help:      "Pre-warm run durations by trigger.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service_id", "trigger"})
+
 	reg.MustRegister(
 		m.ProbeResults,
 		m.ProbeLatency,
@@ -95,6 +152,13 @@ func NewMetrics(service string) *Metrics {
 		m.BillingRunDuration,
 		m.BillingInvoices,
 		m.BillingErrors,
+		m.UsageMissingWindows,
+		m.UsageLateWindows,
+		m.UsageStaleness,
+		m.UsageDrop,
+		m.PrewarmRequests,
+		m.PrewarmPending,
+		m.PrewarmRunDuration,
 	)
 
 	return m
@@ -149,3 +213,59 @@ func (m *Metrics) RecordStormEvent(serviceID int64, kind, phase string) {
 func (m *Metrics) SetStormActive(serviceID int64, kind string, active bool) {
 	m.RecordStorm(serviceID, kind, "active", active)
 }
+
+// ResetUsageCoverage clears the usage coverage gauges so services that are no longer checked
+// stop being reported.
+func (m *Metrics) ResetUsageCoverage() {
+	if m == nil {
+		return
+	}
+	m.UsageMissingWindows.Reset()
+	m.UsageLateWindows.Reset()
+	m.UsageStaleness.Reset()
+	m.UsageDrop.Reset()
+}
+
+// SetUsageCoverage publishes one service's usage coverage.
+func (m *Metrics) SetUsageCoverage(serviceID int64, missing, late int, staleness time.Duration, drop bool) {
+	if m == nil {
+		return
+	}
+	sid := strconv.FormatInt(serviceID, 10)
+	m.UsageMissingWindows.WithLabelValues(sid).Set(float64(missing))
+	m.UsageLateWindows.WithLabelValues(sid).Set(float64(late))
+	m.UsageStaleness.WithLabelValues(sid).Set(staleness.Seconds())
+	if drop {
+		m.UsageDrop.WithLabelValues(sid).Set(1)
+	} else {
+		m.UsageDrop.WithLabelValues(sid).Set(0)
+	}
+}
+
+// RecordPrewarmRequest counts one pre-warm request.
+func (m *Metrics) RecordPrewarmRequest(serviceID int64, ok bool) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if !ok {
+		result = "error"
+	}
+	m.PrewarmRequests.WithLabelValues(strconv.FormatInt(serviceID, 10), result).Inc()
+}
+
+// SetPrewarmPending publishes how many of a service's pre-warm requests are outstanding.
+func (m *Metrics) SetPrewarmPending(serviceID int64, pending int) {
+	if m == nil {
+		return
+	}
+	m.PrewarmPending.WithLabelValues(strconv.FormatInt(serviceID, 10)).Set(float64(pending))
+}
+
+// RecordPrewarmRun captures the duration of one service's pre-warm run.
+func (m *Metrics) RecordPrewarmRun(serviceID int64, trigger string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.PrewarmRunDuration.WithLabelValues(strconv.FormatInt(serviceID, 10), trigger).Observe(duration.Seconds())
+}
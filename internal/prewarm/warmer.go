@@ -0,0 +1,430 @@
+package prewarm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tranche/internal/config"
+	"tranche/internal/db"
+	"tranche/internal/monitor"
+)
+
+const (
+	userAgent = "tranche-prewarm"
+	// scheduleTrigger labels interval runs, which are never repeated after an overlapping run.
+	scheduleTrigger = "schedule"
+	// triggerBuffer bounds how many storm-triggered runs can wait to be started.
+	triggerBuffer = 64
+)
+
+type Store interface {
+	GetActiveServices(ctx context.Context) ([]db.Service, error)
+	GetServiceDomains(ctx context.Context, serviceID int64) ([]db.ServiceDomain, error)
+	ListTopServicePaths(ctx context.Context, arg db.ListTopServicePathsParams) ([]db.ListTopServicePathsRow, error)
+}
+
+type Logger interface {
+	Printf(string, ...any)
+}
+
+type Metrics interface {
+	RecordPrewarmRequest(serviceID int64, ok bool)
+	SetPrewarmPending(serviceID int64, pending int)
+	RecordPrewarmRun(serviceID int64, trigger string, duration time.Duration)
+}
+
+// Warmer requests each service's hot paths through its backup CDN so the backup's cache is
+// populated before traffic fails over to it. Requests go to the service's configured backup
+// host with the service domain as the Host header, like the monitor's backup probes.
+//
+// Every active service with a backup CDN is warmed on an interval, and a service is warmed
+// again as soon as a storm opens for it. Requests share one concurrency limit across services
+// and a service is never warmed by two runs at once: a storm that opens while the service is
+// being warmed is run again once the active run finishes.
+type Warmer struct {
+	store    Store
+	log      Logger
+	m        Metrics
+	cfg      config.PrewarmConfig
+	client   *http.Client
+	paths    map[int64][]string
+	hosts    map[int64]string
+	sem      chan struct{}
+	triggers chan int64
+	now      func() time.Time
+
+	mu      sync.Mutex
+	running map[int64]bool
+	reruns  map[int64]string
+}
+
+// NewWarmer builds a warmer from the pre-warm configuration; PathsJSON maps service IDs to
+// the paths that are always warmed, e.g. {"12":["/","/app.js"]}, and BackupHostsJSON maps
+// them to their backup CDN hostname, e.g. {"12":"www-example.global.ssl.fastly.net"}.
+func NewWarmer(store Store, cfg config.PrewarmConfig, log Logger) (*Warmer, error) {
+	paths, err := parsePaths(cfg.PathsJSON)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := parseHosts(cfg.BackupHostsJSON)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Minute
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.TopN <= 0 {
+		cfg.TopN = 50
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.Lookback <= 0 {
+		cfg.Lookback = 7 * 24 * time.Hour
+	}
+	return &Warmer{
+		store: store,
+		log:   log,
+		cfg:   cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			// A redirect may leave the backup CDN, which would warm nothing.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		paths:    paths,
+		hosts:    hosts,
+		sem:      make(chan struct{}, cfg.Concurrency),
+		triggers: make(chan int64, triggerBuffer),
+		now:      time.Now,
+		running:  make(map[int64]bool),
+		reruns:   make(map[int64]string),
+	}, nil
+}
+
+func (w *Warmer) WithMetrics(m Metrics) *Warmer {
+	w.m = m
+	return w
+}
+
+func parsePaths(raw string) (map[int64][]string, error) {
+	paths := make(map[int64][]string)
+	if raw == "" {
+		return paths, nil
+	}
+	var byService map[string][]string
+	if err := json.Unmarshal([]byte(raw), &byService); err != nil {
+		return nil, fmt.Errorf("parse PREWARM_PATHS: %w", err)
+	}
+	for key, list := range byService {
+		serviceID, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse PREWARM_PATHS: invalid service id %q", key)
+		}
+		for _, p := range list {
+			if !strings.HasPrefix(p, "/") {
+				return nil, fmt.Errorf("parse PREWARM_PATHS: service %d path %q must start with /", serviceID, p)
+			}
+		}
+		paths[serviceID] = list
+	}
+	return paths, nil
+}
+
+func parseHosts(raw string) (map[int64]string, error) {
+	hosts := make(map[int64]string)
+	if raw == "" {
+		return hosts, nil
+	}
+	var byService map[string]string
+	if err := json.Unmarshal([]byte(raw), &byService); err != nil {
+		return nil, fmt.Errorf("parse PREWARM_BACKUP_HOSTS: %w", err)
+	}
+	for key, host := range byService {
+		serviceID, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse PREWARM_BACKUP_HOSTS: invalid service id %q", key)
+		}
+		host = strings.TrimSpace(host)
+		if host == "" {
+			return nil, fmt.Errorf("parse PREWARM_BACKUP_HOSTS: service %d has an empty host", serviceID)
+		}
+		hosts[serviceID] = host
+	}
+	return hosts, nil
+}
+
+// StormStarted queues a warm-up of the service's backup CDN. It never blocks the storm engine;
+// when the queue is full the storm is only logged.
+func (w *Warmer) StormStarted(_ context.Context, serviceID int64, kind string) {
+	select {
+	case w.triggers <- serviceID:
+	default:
+		w.log.Printf("prewarm queue full, skipping storm-triggered warm for service %d (%s)", serviceID, kind)
+	}
+}
+
+// Run warms every service immediately and then on the configured interval, and warms single
+// services when storms open, until ctx is cancelled.
+func (w *Warmer) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+
+	schedule := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.WarmAll(ctx)
+		}()
+	}
+	schedule()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			schedule()
+		case serviceID := <-w.triggers:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := w.WarmService(ctx, serviceID, "storm"); err != nil {
+					w.log.Printf("prewarm service %d: %v", serviceID, err)
+				}
+			}()
+		}
+	}
+}
+
+// WarmAll warms every active service that has a backup CDN.
+func (w *Warmer) WarmAll(ctx context.Context) {
+	services, err := w.store.GetActiveServices(ctx)
+	if err != nil {
+		w.log.Printf("GetActiveServices: %v", err)
+		return
+	}
+	for _, svc := range services {
+		if ctx.Err() != nil {
+			return
+		}
+		if svc.BackupCdn == "" {
+			continue
+		}
+		if err := w.warm(ctx, svc, scheduleTrigger); err != nil {
+			w.log.Printf("prewarm service %d: %v", svc.ID, err)
+		}
+	}
+}
+
+// WarmService warms one active service; trigger labels the run in metrics and logs.
+func (w *Warmer) WarmService(ctx context.Context, serviceID int64, trigger string) error {
+	services, err := w.store.GetActiveServices(ctx)
+	if err != nil {
+		return fmt.Errorf("fetch services: %w", err)
+	}
+	for _, svc := range services {
+		if svc.ID != serviceID {
+			continue
+		}
+		if svc.BackupCdn == "" {
+			return nil
+		}
+		return w.warm(ctx, svc, trigger)
+	}
+	return fmt.Errorf("service %d is not active", serviceID)
+}
+
+type target struct {
+	domain string
+	path   string
+}
+
+// warm runs one warm-up of the service, plus any storm-triggered run that was requested while
+// it was in progress. A trigger that finds the service already running is recorded for that
+// rerun rather than dropped.
+func (w *Warmer) warm(ctx context.Context, svc db.Service, trigger string) error {
+	host, ok := w.hosts[svc.ID]
+	if !ok {
+		return fmt.Errorf("no PREWARM_BACKUP_HOSTS entry for backup CDN %s", svc.BackupCdn)
+	}
+	if !w.begin(svc.ID, trigger) {
+		return nil
+	}
+	for {
+		err := w.warmOnce(ctx, svc, host, trigger)
+		next, again := w.end(svc.ID, ctx.Err() == nil)
+		if !again {
+			return err
+		}
+		if err != nil {
+			w.log.Printf("prewarm service %d: %v", svc.ID, err)
+		}
+		trigger = next
+	}
+}
+
+func (w *Warmer) warmOnce(ctx context.Context, svc db.Service, host, trigger string) error {
+	paths, err := w.pathsFor(ctx, svc.ID)
+	if err != nil {
+		return err
+	}
+	domains, err := w.store.GetServiceDomains(ctx, svc.ID)
+	if err != nil {
+		return fmt.Errorf("fetch domains: %w", err)
+	}
+	var targets []target
+	for _, d := range domains {
+		for _, p := range paths {
+			targets = append(targets, target{domain: d.Name, path: p})
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	start := w.now()
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		pending = len(targets)
+		failed  int
+	)
+	w.setPending(svc.ID, pending)
+	for _, t := range targets {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			w.setPending(svc.ID, 0)
+			return ctx.Err()
+		case w.sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(t target) {
+			defer wg.Done()
+			ok := w.request(ctx, svc.ID, host, t)
+			<-w.sem
+
+			mu.Lock()
+			defer mu.Unlock()
+			pending--
+			if !ok {
+				failed++
+			}
+			w.setPending(svc.ID, pending)
+			if w.m != nil {
+				w.m.RecordPrewarmRequest(svc.ID, ok)
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	elapsed := w.now().Sub(start)
+	if w.m != nil {
+		w.m.RecordPrewarmRun(svc.ID, trigger, elapsed)
+	}
+	w.log.Printf("prewarm service %d via %s at %s (%s): %d request(s), %d failed, %s", svc.ID, svc.BackupCdn, host, trigger, len(targets), failed, elapsed.Round(time.Millisecond))
+	return nil
+}
+
+// pathsFor returns the configured paths followed by the busiest logged paths, without
+// duplicates and capped at TopN. Services with no known paths warm "/".
+func (w *Warmer) pathsFor(ctx context.Context, serviceID int64) ([]string, error) {
+	limit := int(w.cfg.TopN)
+	seen := make(map[string]bool)
+	var paths []string
+	add := func(p string) {
+		if len(paths) < limit && !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, p := range w.paths[serviceID] {
+		add(p)
+	}
+	if len(paths) < limit {
+		rows, err := w.store.ListTopServicePaths(ctx, db.ListTopServicePathsParams{
+			ServiceID: serviceID,
+			Since:     w.now().Add(-w.cfg.Lookback).UTC().Truncate(24 * time.Hour),
+			RowLimit:  int32(limit),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list top paths: %w", err)
+		}
+		for _, row := range rows {
+			add(row.Path)
+		}
+	}
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	return paths, nil
+}
+
+// request fetches one path through the backup CDN and reads the whole body so the CDN caches
+// the complete object. Anything but a 2xx or 3xx response counts as a failure.
+func (w *Warmer) request(ctx context.Context, serviceID int64, host string, t target) bool {
+	req, err := monitor.NewHostRequest(ctx, http.MethodGet, host, t.domain, t.path)
+	if err != nil {
+		w.log.Printf("prewarm service %d %s%s: %v", serviceID, t.domain, t.path, err)
+		return false
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		w.log.Printf("prewarm service %d %s%s: %v", serviceID, t.domain, t.path, err)
+		return false
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		w.log.Printf("prewarm service %d %s%s: read body: %v", serviceID, t.domain, t.path, err)
+		return false
+	}
+	return resp.StatusCode < 400
+}
+
+// begin claims the service for a run. When another run holds it, a non-scheduled trigger is
+// recorded so that run warms the service again when it ends.
+func (w *Warmer) begin(serviceID int64, trigger string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.running[serviceID] {
+		if trigger != scheduleTrigger {
+			w.reruns[serviceID] = trigger
+		}
+		return false
+	}
+	w.running[serviceID] = true
+	return true
+}
+
+// end releases the service, unless a rerun was requested and keep is set, in which case the
+// caller keeps the service and runs again with the returned trigger.
+func (w *Warmer) end(serviceID int64, keep bool) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	trigger, rerun := w.reruns[serviceID]
+	delete(w.reruns, serviceID)
+	if rerun && keep {
+		return trigger, true
+	}
+	delete(w.running, serviceID)
+	return "", false
+}
+
+func (w *Warmer) setPending(serviceID int64, pending int) {
+	if w.m != nil {
+		w.m.SetPrewarmPending(serviceID, pending)
+	}
+}
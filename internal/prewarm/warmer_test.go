@@ -0,0 +1,293 @@
+package prewarm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"tranche/internal/config"
+	"tranche/internal/db"
+)
+
+type fakeStore struct {
+	services []db.Service
+	domains  map[int64][]db.ServiceDomain
+	top      map[int64][]db.ListTopServicePathsRow
+	topArgs  []db.ListTopServicePathsParams
+}
+
+func (f *fakeStore) GetActiveServices(ctx context.Context) ([]db.Service, error) {
+	return f.services, nil
+}
+
+func (f *fakeStore) GetServiceDomains(ctx context.Context, serviceID int64) ([]db.ServiceDomain, error) {
+	return f.domains[serviceID], nil
+}
+
+func (f *fakeStore) ListTopServicePaths(ctx context.Context, arg db.ListTopServicePathsParams) ([]db.ListTopServicePathsRow, error) {
+	f.topArgs = append(f.topArgs, arg)
+	return f.top[arg.ServiceID], nil
+}
+
+type fakeLogger struct{}
+
+func (fakeLogger) Printf(string, ...any) {}
+
+type fakeMetrics struct {
+	mu       sync.Mutex
+	ok       int
+	failed   int
+	pending  []int
+	triggers []string
+}
+
+func (m *fakeMetrics) RecordPrewarmRequest(serviceID int64, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ok {
+		m.ok++
+	} else {
+		m.failed++
+	}
+}
+
+func (m *fakeMetrics) SetPrewarmPending(serviceID int64, pending int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = append(m.pending, pending)
+}
+
+func (m *fakeMetrics) RecordPrewarmRun(serviceID int64, trigger string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.triggers = append(m.triggers, trigger)
+}
+
+func TestWarmServiceRequestsPathsThroughBackup(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		seen     []string
+		inFlight int
+		maxSeen  int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxSeen {
+			maxSeen = inFlight
+		}
+		seen = append(seen, r.Host+" "+r.URL.RequestURI()+" "+r.UserAgent())
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	store := &fakeStore{
+		services: []db.Service{{ID: 1, PrimaryCdn: "cloudflare", BackupCdn: "fastly"}},
+		domains: map[int64][]db.ServiceDomain{
+			1: {{ID: 1, ServiceID: 1, Name: "www.example.com"}, {ID: 2, ServiceID: 1, Name: "static.example.com"}},
+		},
+		top: map[int64][]db.ListTopServicePathsRow{
+			1: {{Path: "/app.js", Hits: 900}, {Path: "/img.png?v=2", Hits: 500}, {Path: "/missing", Hits: 100}, {Path: "/late", Hits: 1}},
+		},
+	}
+	metrics := &fakeMetrics{}
+	w, err := NewWarmer(store, config.PrewarmConfig{
+		Concurrency:     2,
+		TopN:            4,
+		PathsJSON:       `{"1":["/","/app.js"]}`,
+		BackupHostsJSON: fmt.Sprintf(`{"1":%q}`, srv.URL),
+	}, fakeLogger{})
+	if err != nil {
+		t.Fatalf("NewWarmer: %v", err)
+	}
+	w.WithMetrics(metrics)
+
+	if err := w.WarmService(context.Background(), 1, "storm"); err != nil {
+		t.Fatalf("WarmService: %v", err)
+	}
+
+	sort.Strings(seen)
+	want := []string{
+		"static.example.com / tranche-prewarm",
+		"static.example.com /app.js tranche-prewarm",
+		"static.example.com /img.png?v=2 tranche-prewarm",
+		"static.example.com /missing tranche-prewarm",
+		"www.example.com / tranche-prewarm",
+		"www.example.com /app.js tranche-prewarm",
+		"www.example.com /img.png?v=2 tranche-prewarm",
+		"www.example.com /missing tranche-prewarm",
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("expected %d requests, got %v", len(want), seen)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Fatalf("request %d: got %q want %q", i, seen[i], want[i])
+		}
+	}
+	if maxSeen > 2 {
+		t.Fatalf("expected at most 2 requests in flight, saw %d", maxSeen)
+	}
+	if metrics.ok != 6 || metrics.failed != 2 {
+		t.Fatalf("expected 6 ok and 2 failed requests, got %d and %d", metrics.ok, metrics.failed)
+	}
+	if last := metrics.pending[len(metrics.pending)-1]; last != 0 {
+		t.Fatalf("expected pending to drain to 0, got %d", last)
+	}
+	if len(metrics.triggers) != 1 || metrics.triggers[0] != "storm" {
+		t.Fatalf("expected one storm run, got %v", metrics.triggers)
+	}
+	if len(store.topArgs) != 1 || store.topArgs[0].RowLimit != 4 {
+		t.Fatalf("expected one top path lookup limited to 4, got %+v", store.topArgs)
+	}
+}
+
+func TestWarmSkipsServicesAlreadyRunning(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer srv.Close()
+
+	store := &fakeStore{
+		services: []db.Service{{ID: 1, BackupCdn: "fastly"}, {ID: 2}},
+		domains:  map[int64][]db.ServiceDomain{1: {{Name: "www.example.com"}}},
+	}
+	w, err := NewWarmer(store, config.PrewarmConfig{BackupHostsJSON: fmt.Sprintf(`{"1":%q}`, srv.URL)}, fakeLogger{})
+	if err != nil {
+		t.Fatalf("NewWarmer: %v", err)
+	}
+
+	w.begin(1, scheduleTrigger)
+	w.WarmAll(context.Background())
+	if requests != 0 {
+		t.Fatalf("expected a running service to be skipped, got %d requests", requests)
+	}
+	if _, again := w.end(1, true); again {
+		t.Fatalf("expected an overlapping scheduled run not to be repeated")
+	}
+	w.WarmAll(context.Background())
+	if requests != 1 {
+		t.Fatalf("expected the default path to be warmed once, got %d requests", requests)
+	}
+}
+
+func TestWarmRerunsStormThatArrivesDuringARun(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if first {
+			close(started)
+			<-release
+		}
+	}))
+	defer srv.Close()
+
+	store := &fakeStore{
+		services: []db.Service{{ID: 1, BackupCdn: "fastly"}},
+		domains:  map[int64][]db.ServiceDomain{1: {{Name: "www.example.com"}}},
+	}
+	metrics := &fakeMetrics{}
+	w, err := NewWarmer(store, config.PrewarmConfig{BackupHostsJSON: fmt.Sprintf(`{"1":%q}`, srv.URL)}, fakeLogger{})
+	if err != nil {
+		t.Fatalf("NewWarmer: %v", err)
+	}
+	w.WithMetrics(metrics)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.WarmAll(context.Background())
+	}()
+	<-started
+	if err := w.WarmService(context.Background(), 1, "storm"); err != nil {
+		t.Fatalf("WarmService: %v", err)
+	}
+	close(release)
+	<-done
+
+	if requests != 2 {
+		t.Fatalf("expected the storm to warm the service again, got %d requests", requests)
+	}
+	if len(metrics.triggers) != 2 || metrics.triggers[0] != "schedule" || metrics.triggers[1] != "storm" {
+		t.Fatalf("expected a scheduled run followed by a storm run, got %v", metrics.triggers)
+	}
+	if w.running[1] {
+		t.Fatalf("expected the service to be released after the rerun")
+	}
+}
+
+func TestWarmRequiresBackupHost(t *testing.T) {
+	store := &fakeStore{services: []db.Service{{ID: 1, BackupCdn: "fastly"}}}
+	w, err := NewWarmer(store, config.PrewarmConfig{}, fakeLogger{})
+	if err != nil {
+		t.Fatalf("NewWarmer: %v", err)
+	}
+	if err := w.WarmService(context.Background(), 1, "storm"); err == nil {
+		t.Fatalf("expected a service without a backup host to be reported")
+	}
+}
+
+func TestStormStartedQueuesWithoutBlocking(t *testing.T) {
+	w, err := NewWarmer(&fakeStore{}, config.PrewarmConfig{}, fakeLogger{})
+	if err != nil {
+		t.Fatalf("NewWarmer: %v", err)
+	}
+	for i := 0; i < triggerBuffer+5; i++ {
+		w.StormStarted(context.Background(), 9, "failover")
+	}
+	if len(w.triggers) != triggerBuffer {
+		t.Fatalf("expected the queue to hold %d triggers, got %d", triggerBuffer, len(w.triggers))
+	}
+	if got := <-w.triggers; got != 9 {
+		t.Fatalf("expected service 9 to be queued, got %d", got)
+	}
+}
+
+func TestParsePaths(t *testing.T) {
+	got, err := parsePaths(`{"12":["/","/app.js"]}`)
+	if err != nil || len(got[12]) != 2 {
+		t.Fatalf("unexpected paths %v, %v", got, err)
+	}
+	if _, err := parsePaths(`{"web":["/"]}`); err == nil {
+		t.Fatalf("expected non-numeric service ids to be rejected")
+	}
+	if _, err := parsePaths(`{"12":["app.js"]}`); err == nil {
+		t.Fatalf("expected relative paths to be rejected")
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	got, err := parseHosts(`{"12":" www-example.global.ssl.fastly.net "}`)
+	if err != nil || got[12] != "www-example.global.ssl.fastly.net" {
+		t.Fatalf("unexpected hosts %v, %v", got, err)
+	}
+	if _, err := parseHosts(`{"web":"cdn.example.net"}`); err == nil {
+		t.Fatalf("expected non-numeric service ids to be rejected")
+	}
+	if _, err := parseHosts(`{"12":""}`); err == nil {
+		t.Fatalf("expected empty hosts to be rejected")
+	}
+}
@@ -2,6 +2,9 @@ package routing
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"time"
 
 	"tranche/internal/db"
 )
@@ -11,21 +14,107 @@ type Weights struct {
 	Backup  int
 }
 
+// Phase describes where a service sits in the storm lifecycle.
+type Phase string
+
+const (
+	PhaseNormal   Phase = "normal"
+	PhasePreStorm Phase = "prestorm"
+	PhaseStorm    Phase = "storm"
+)
+
+// Decision is the full routing target for a service: weights plus the TTL the records should carry.
+type Decision struct {
+	Weights Weights
+	// TTL is the record TTL in seconds. Zero leaves the existing TTL untouched.
+	TTL   int64
+	Phase Phase
+}
+
+// MetricsView exposes probe availability so the planner can detect pre-storm signals.
+type MetricsView interface {
+	Availability(ctx context.Context, serviceID int64, window time.Duration) (float64, error)
+}
+
 type Planner struct {
 	db *db.Queries
+	mv MetricsView
 }
 
 func NewPlanner(dbx *db.Queries) *Planner {
 	return &Planner{db: dbx}
 }
 
+// WithMetrics enables proactive TTL lowering based on probe availability.
+func (p *Planner) WithMetrics(mv MetricsView) *Planner {
+	p.mv = mv
+	return p
+}
+
 func (p *Planner) DesiredRouting(ctx context.Context, serviceID int64) (Weights, error) {
-	storms, err := p.db.GetActiveStormsForService(ctx, serviceID)
+	d, err := p.Decide(ctx, serviceID)
 	if err != nil {
 		return Weights{}, err
 	}
+	return d.Weights, nil
+}
+
+// Decide computes the weights and TTL for a service. Services without DNS settings keep
+// whatever TTL their records already have.
+func (p *Planner) Decide(ctx context.Context, serviceID int64) (Decision, error) {
+	storms, err := p.db.GetActiveStormsForService(ctx, serviceID)
+	if err != nil {
+		return Decision{}, err
+	}
+	settings, err := p.db.GetServiceDNSSettings(ctx, serviceID)
+	hasSettings := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Decision{}, err
+	}
+
 	if len(storms) > 0 {
-		return Weights{Primary: 0, Backup: 100}, nil
+		d := Decision{Weights: Weights{Primary: 0, Backup: 100}, Phase: PhaseStorm}
+		if hasSettings {
+			d.TTL = int64(settings.StormTtlSeconds)
+		}
+		return d, nil
+	}
+
+	d := Decision{Weights: Weights{Primary: 100, Backup: 0}, Phase: PhaseNormal}
+	if !hasSettings {
+		return d, nil
+	}
+	d.TTL = int64(settings.TtlSeconds)
+	prestorm, err := p.preStorm(ctx, serviceID, settings.PrestormMargin)
+	if err != nil {
+		return Decision{}, err
+	}
+	if prestorm {
+		d.Phase = PhasePreStorm
+		d.TTL = int64(settings.StormTtlSeconds)
+	}
+	return d, nil
+}
+
+// preStorm reports whether availability for any storm policy has dipped within margin of
+// its threshold, so TTLs can be lowered before the storm is declared.
+func (p *Planner) preStorm(ctx context.Context, serviceID int64, margin float64) (bool, error) {
+	if p.mv == nil || margin <= 0 {
+		return false, nil
+	}
+	policies, err := p.db.GetStormPoliciesForService(ctx, serviceID)
+	if err != nil {
+		return false, err
+	}
+	for _, policy := range policies {
+		window := time.Duration(policy.WindowSeconds) * time.Second
+		avail, err := p.mv.Availability(ctx, serviceID, window)
+		if err != nil {
+			return false, err
+		}
+		if avail < policy.ThresholdAvail+margin {
+			return true, nil
+		}
 	}
-	return Weights{Primary: 100, Backup: 0}, nil
+	return false, nil
 }
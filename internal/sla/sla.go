@@ -0,0 +1,99 @@
+// Package sla measures service availability over a billing period and maps it to the
+// credit an SLA definition grants.
+package sla
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"tranche/internal/db"
+)
+
+// Attainment is a service's availability over [From, To), counted in whole minutes. A
+// minute is down when most direct domain probes in it failed, or when it falls inside a
+// storm and has no probe samples at all: with nothing showing the service was reachable,
+// such a minute counts against the SLA even if the backup CDN was serving traffic.
+type Attainment struct {
+	ServiceID           int64     `json:"service_id"`
+	From                time.Time `json:"from"`
+	To                  time.Time `json:"to"`
+	TotalMinutes        int64     `json:"total_minutes"`
+	DownMinutes         int64     `json:"down_minutes"`
+	AvailabilityPercent float64   `json:"availability_percent"`
+}
+
+// downtimeStore is the query Meter reads downtime from.
+type downtimeStore interface {
+	GetServiceDowntime(ctx context.Context, arg db.GetServiceDowntimeParams) (db.GetServiceDowntimeRow, error)
+}
+
+// Meter measures availability from probe_samples and storm_events.
+type Meter struct {
+	queries downtimeStore
+}
+
+func NewMeter(queries downtimeStore) *Meter {
+	return &Meter{queries: queries}
+}
+
+// Measure computes the service's availability over [from, to). Both ends are truncated to
+// the minute; an empty range counts as fully available.
+func (m *Meter) Measure(ctx context.Context, serviceID int64, from, to time.Time) (Attainment, error) {
+	from, to = from.UTC().Truncate(time.Minute), to.UTC().Truncate(time.Minute)
+	if !to.After(from) {
+		return attainment(serviceID, from, from, 0), nil
+	}
+	row, err := m.queries.GetServiceDowntime(ctx, db.GetServiceDowntimeParams{
+		ServiceID:   serviceID,
+		PeriodStart: from,
+		PeriodEnd:   to,
+	})
+	if err != nil {
+		return Attainment{}, fmt.Errorf("service %d downtime: %w", serviceID, err)
+	}
+	return attainment(serviceID, from, to, row.DownMinutes+row.UnprobedStormMinutes), nil
+}
+
+func attainment(serviceID int64, from, to time.Time, down int64) Attainment {
+	total := int64(to.Sub(from) / time.Minute)
+	if down > total {
+		down = total
+	}
+	a := Attainment{ServiceID: serviceID, From: from, To: to, TotalMinutes: total, DownMinutes: down, AvailabilityPercent: 100}
+	if total > 0 {
+		a.AvailabilityPercent = 100 * float64(total-down) / float64(total)
+	}
+	return a
+}
+
+// CreditPercent returns the largest credit among the tiers whose threshold availability is
+// above availabilityPercent, or zero when the SLA was met.
+func CreditPercent(tiers db.SLATiers, availabilityPercent float64) float64 {
+	var credit float64
+	for _, tier := range tiers {
+		if availabilityPercent < tier.BelowPercent && tier.CreditPercent > credit {
+			credit = tier.CreditPercent
+		}
+	}
+	return credit
+}
+
+// CreditCents is the credit on chargesCents, rounded to the nearest cent. Services that
+// netted no charges get no credit.
+func CreditCents(chargesCents int64, creditPercent float64) int64 {
+	if chargesCents <= 0 || creditPercent <= 0 {
+		return 0
+	}
+	credit := int64(float64(chargesCents)*creditPercent/100 + 0.5)
+	if credit > chargesCents {
+		credit = chargesCents
+	}
+	return credit
+}
+
+// SortTiers orders tiers by descending threshold, the order they are shown in.
+func SortTiers(tiers db.SLATiers) {
+	sort.SliceStable(tiers, func(i, j int) bool { return tiers[i].BelowPercent > tiers[j].BelowPercent })
+}
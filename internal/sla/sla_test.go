@@ -0,0 +1,81 @@
+package sla
+
+import (
+	"testing"
+	"time"
+
+	"tranche/internal/db"
+)
+
+var tiers = db.SLATiers{
+	{BelowPercent: 99.9, CreditPercent: 10},
+	{BelowPercent: 99, CreditPercent: 25},
+	{BelowPercent: 95, CreditPercent: 100},
+}
+
+func TestCreditPercent(t *testing.T) {
+	for availability, want := range map[float64]float64{
+		100:    0,
+		99.9:   0,
+		99.95:  0,
+		99.89:  10,
+		99:     10,
+		98.5:   25,
+		94.999: 100,
+		0:      100,
+	} {
+		if got := CreditPercent(tiers, availability); got != want {
+			t.Fatalf("CreditPercent(%v) = %v, want %v", availability, got, want)
+		}
+	}
+	if got := CreditPercent(nil, 50); got != 0 {
+		t.Fatalf("expected no credit without tiers, got %v", got)
+	}
+}
+
+func TestCreditCents(t *testing.T) {
+	cases := []struct {
+		charges int64
+		percent float64
+		want    int64
+	}{
+		{charges: 1000, percent: 10, want: 100},
+		{charges: 1005, percent: 10, want: 101},
+		{charges: 1000, percent: 150, want: 1000},
+		{charges: -500, percent: 25, want: 0},
+		{charges: 1000, percent: 0, want: 0},
+	}
+	for _, c := range cases {
+		if got := CreditCents(c.charges, c.percent); got != c.want {
+			t.Fatalf("CreditCents(%d, %v) = %d, want %d", c.charges, c.percent, got, c.want)
+		}
+	}
+}
+
+func TestAttainment(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(30 * 24 * time.Hour)
+
+	a := attainment(7, from, to, 43)
+	if a.TotalMinutes != 43200 || a.DownMinutes != 43 {
+		t.Fatalf("unexpected minutes %+v", a)
+	}
+	if a.AvailabilityPercent < 99.900 || a.AvailabilityPercent > 99.901 {
+		t.Fatalf("unexpected availability %v", a.AvailabilityPercent)
+	}
+
+	if a := attainment(7, from, from.Add(10*time.Minute), 25); a.DownMinutes != 10 || a.AvailabilityPercent != 0 {
+		t.Fatalf("expected downtime capped at the range, got %+v", a)
+	}
+	if a := attainment(7, from, from, 0); a.AvailabilityPercent != 100 {
+		t.Fatalf("expected an empty range to be fully available, got %+v", a)
+	}
+}
+
+func TestSortTiers(t *testing.T) {
+	got := db.SLATiers{{BelowPercent: 95}, {BelowPercent: 99.9}, {BelowPercent: 99}}
+	SortTiers(got)
+	if got[0].BelowPercent != 99.9 || got[1].BelowPercent != 99 || got[2].BelowPercent != 95 {
+		t.Fatalf("unexpected order %+v", got)
+	}
+}
@@ -31,12 +31,18 @@ type Metrics interface {
 	SetStormActive(serviceID int64, kind string, active bool)
 }
 
+// Listener is notified when a storm opens, after the event has been recorded.
+type Listener interface {
+	StormStarted(ctx context.Context, serviceID int64, kind string)
+}
+
 type Engine struct {
-	db  stormStore
-	mv  MetricsView
-	log Logger
-	m   Metrics
-	now func() time.Time
+	db        stormStore
+	mv        MetricsView
+	log       Logger
+	m         Metrics
+	listeners []Listener
+	now       func() time.Time
 }
 
 func NewEngine(dbx stormStore, mv MetricsView, log Logger) *Engine {
@@ -48,6 +54,12 @@ func (e *Engine) WithMetrics(m Metrics) *Engine {
 	return e
 }
 
+// WithListener registers l to be told about every storm the engine opens.
+func (e *Engine) WithListener(l Listener) *Engine {
+	e.listeners = append(e.listeners, l)
+	return e
+}
+
 func (e *Engine) Tick(ctx context.Context) error {
 	services, err := e.db.GetActiveServices(ctx)
 	if err != nil {
@@ -107,11 +119,17 @@ func (e *Engine) evaluatePolicy(ctx context.Context, serviceID int64, p db.Storm
 		}
 
 		_, err = e.db.InsertStormEvent(ctx, db.InsertStormEventParams{ServiceID: serviceID, Kind: p.Kind})
-		if err == nil && e.m != nil {
+		if err != nil {
+			return err
+		}
+		if e.m != nil {
 			e.m.RecordStormEvent(serviceID, p.Kind, "started")
 			e.m.SetStormActive(serviceID, p.Kind, true)
 		}
-		return err
+		for _, l := range e.listeners {
+			l.StormStarted(ctx, serviceID, p.Kind)
+		}
+		return nil
 	}
 
 	if hasActive {
@@ -26,6 +26,30 @@ func TestEvaluatePolicyStartsStorm(t *testing.T) {
 	}
 }
 
+type recordingListener struct {
+	started []string
+}
+
+func (l *recordingListener) StormStarted(_ context.Context, serviceID int64, kind string) {
+	l.started = append(l.started, fmt.Sprintf("%d:%s", serviceID, kind))
+}
+
+func TestEvaluatePolicyNotifiesListenersOnce(t *testing.T) {
+	store := newFakeStormStore()
+	listener := &recordingListener{}
+	eng := NewEngine(store, &fakeMetricsView{avail: 0.4}, fakeLogger{}).WithListener(listener)
+
+	policy := db.StormPolicy{Kind: "failover", ThresholdAvail: 0.9, WindowSeconds: 60}
+	for i := 0; i < 2; i++ {
+		if err := eng.evaluatePolicy(context.Background(), 7, policy); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(listener.started) != 1 || listener.started[0] != "7:failover" {
+		t.Fatalf("expected one notification for the new storm, got %v", listener.started)
+	}
+}
+
 func TestEvaluatePolicyHonorsCooldown(t *testing.T) {
 	store := newFakeStormStore()
 	mv := &fakeMetricsView{avail: 0.1}
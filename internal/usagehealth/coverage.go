@@ -0,0 +1,294 @@
+package usagehealth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"tranche/internal/config"
+	"tranche/internal/db"
+)
+
+// Coverage describes how completely usage_snapshots covers one service over [From, To).
+// Windows ending after To are still inside the grace period and are not expected yet, but
+// they count towards LastWindowEnd and late detection.
+type Coverage struct {
+	ServiceID        int64        `json:"service_id"`
+	From             time.Time    `json:"from"`
+	To               time.Time    `json:"to"`
+	WindowSeconds    int64        `json:"window_seconds"`
+	ExpectedWindows  int          `json:"expected_windows"`
+	PresentWindows   int          `json:"present_windows"`
+	IdleWindows      int          `json:"idle_windows"`
+	MissingWindows   int          `json:"missing_windows"`
+	Gaps             []Gap        `json:"gaps"`
+	LateWindows      []LateWindow `json:"late_windows"`
+	LastWindowEnd    *time.Time   `json:"last_window_end,omitempty"`
+	IngestedThrough  *time.Time   `json:"ingested_through,omitempty"`
+	StalenessSeconds int64        `json:"staleness_seconds"`
+	Drop             *Drop        `json:"drop,omitempty"`
+}
+
+// Gap is a run of consecutive missing windows [Start, End). Ingestion writes no snapshot for
+// a window in which the CDNs reported no traffic; such windows inside the range the API
+// ingestor has fetched for the service are idle rather than missing. Log ingestion records
+// no such range, so idle services it covers show gaps.
+type Gap struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Windows int       `json:"windows"`
+}
+
+// LateWindow is a window first recorded more than the configured delay after it ended.
+type LateWindow struct {
+	WindowStart  time.Time `json:"window_start"`
+	FirstSeenAt  time.Time `json:"first_seen_at"`
+	DelaySeconds int64     `json:"delay_seconds"`
+}
+
+// Drop flags the newest expected window carrying far less traffic than the ones before it.
+type Drop struct {
+	WindowStart     time.Time `json:"window_start"`
+	Bytes           int64     `json:"bytes"`
+	TrailingAverage float64   `json:"trailing_average_bytes"`
+	Ratio           float64   `json:"ratio"`
+}
+
+// Healthy reports whether the coverage shows no gaps, late windows or drop.
+func (c Coverage) Healthy() bool {
+	return c.MissingWindows == 0 && len(c.LateWindows) == 0 && c.Drop == nil
+}
+
+// Checker computes usage coverage from usage_snapshots.
+type Checker struct {
+	queries *db.Queries
+	window  time.Duration
+	cfg     config.UsageHealthConfig
+}
+
+func NewChecker(queries *db.Queries, window time.Duration, cfg config.UsageHealthConfig) *Checker {
+	return &Checker{queries: queries, window: window, cfg: cfg}
+}
+
+// window is one recorded snapshot.
+type window struct {
+	start, end  time.Time
+	bytes       int64
+	firstSeenAt time.Time
+}
+
+// ingested is the range of windows the ingestor has fetched for a service without a
+// failure. It is zero when nothing was recorded.
+type ingested struct {
+	from, through time.Time
+}
+
+func ingestedRange(row db.UsageIngestCoverage) ingested {
+	return ingested{from: row.CoveredFrom.UTC(), through: row.CoveredThrough.UTC()}
+}
+
+// covers reports whether [start, end) lies inside the range.
+func (in ingested) covers(start, end time.Time) bool {
+	return !in.through.IsZero() && !start.Before(in.from) && !end.After(in.through)
+}
+
+// Check computes coverage over the configured lookback for every active service.
+func (c *Checker) Check(ctx context.Context, now time.Time) ([]Coverage, error) {
+	if c.window <= 0 {
+		return nil, fmt.Errorf("window must be positive")
+	}
+	services, err := c.queries.GetActiveServices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch services: %w", err)
+	}
+	from := now.Add(-c.cfg.Lookback).Truncate(c.window)
+	rows, err := c.queries.ListUsageCoverage(ctx, db.ListUsageCoverageParams{RangeStart: from, RangeEnd: now})
+	if err != nil {
+		return nil, fmt.Errorf("list usage windows: %w", err)
+	}
+	coverageRows, err := c.queries.ListUsageIngestCoverage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list ingested ranges: %w", err)
+	}
+	ranges := make(map[int64]ingested, len(coverageRows))
+	for _, row := range coverageRows {
+		ranges[row.ServiceID] = ingestedRange(row)
+	}
+	byService := make(map[int64][]window)
+	for _, row := range rows {
+		byService[row.ServiceID] = append(byService[row.ServiceID], window{
+			start:       row.WindowStart.UTC(),
+			end:         row.WindowEnd.UTC(),
+			bytes:       row.PrimaryBytes + row.BackupBytes,
+			firstSeenAt: row.FirstSeenAt.UTC(),
+		})
+	}
+
+	coverages := make([]Coverage, 0, len(services))
+	for _, svc := range services {
+		coverages = append(coverages, c.analyze(svc, from, c.expectedEnd(now), now, byService[svc.ID], ranges[svc.ID]))
+	}
+	return coverages, nil
+}
+
+// CheckService computes one service's coverage over [from, to). A zero from defaults to the
+// configured lookback; to is capped at the end of the grace period.
+func (c *Checker) CheckService(ctx context.Context, svc db.Service, from, to, now time.Time) (Coverage, error) {
+	if c.window <= 0 {
+		return Coverage{}, fmt.Errorf("window must be positive")
+	}
+	if from.IsZero() {
+		from = now.Add(-c.cfg.Lookback)
+	}
+	from = from.UTC().Truncate(c.window)
+	if expected := c.expectedEnd(now); to.IsZero() || to.After(expected) {
+		to = expected
+	}
+	rows, err := c.queries.ListServiceUsageCoverage(ctx, db.ListServiceUsageCoverageParams{ServiceID: svc.ID, RangeStart: from, RangeEnd: now})
+	if err != nil {
+		return Coverage{}, fmt.Errorf("list usage windows: %w", err)
+	}
+	var in ingested
+	switch row, err := c.queries.GetUsageIngestCoverage(ctx, svc.ID); {
+	case err == nil:
+		in = ingestedRange(row)
+	case !errors.Is(err, sql.ErrNoRows):
+		return Coverage{}, fmt.Errorf("ingested range: %w", err)
+	}
+	windows := make([]window, 0, len(rows))
+	for _, row := range rows {
+		windows = append(windows, window{
+			start:       row.WindowStart.UTC(),
+			end:         row.WindowEnd.UTC(),
+			bytes:       row.PrimaryBytes + row.BackupBytes,
+			firstSeenAt: row.FirstSeenAt.UTC(),
+		})
+	}
+	return c.analyze(svc, from, to.UTC(), now, windows, in), nil
+}
+
+// expectedEnd is the end of the last window that should have been recorded by now.
+func (c *Checker) expectedEnd(now time.Time) time.Time {
+	return now.Add(-c.cfg.Grace).UTC().Truncate(c.window)
+}
+
+// analyze compares the recorded windows, sorted by start, with the windows expected in
+// [from, to). Windows before the service was created are not expected, and windows without a
+// snapshot inside the ingested range are idle.
+func (c *Checker) analyze(svc db.Service, from, to, now time.Time, windows []window, in ingested) Coverage {
+	if created := ceil(svc.CreatedAt.UTC(), c.window); created.After(from) {
+		from = created
+	}
+	if to.Before(from) {
+		to = from
+	}
+	cov := Coverage{
+		ServiceID:     svc.ID,
+		From:          from,
+		To:            to,
+		WindowSeconds: int64(c.window / time.Second),
+		Gaps:          []Gap{},
+		LateWindows:   []LateWindow{},
+	}
+
+	present := make(map[time.Time]bool, len(windows))
+	var expected []window
+	for _, w := range windows {
+		if cov.LastWindowEnd == nil || w.end.After(*cov.LastWindowEnd) {
+			end := w.end
+			cov.LastWindowEnd = &end
+		}
+		if w.start.Before(from) {
+			continue
+		}
+		if delay := w.firstSeenAt.Sub(w.end); delay > c.cfg.LateAfter {
+			cov.LateWindows = append(cov.LateWindows, LateWindow{
+				WindowStart:  w.start,
+				FirstSeenAt:  w.firstSeenAt,
+				DelaySeconds: int64(delay / time.Second),
+			})
+		}
+		if w.start.Before(to) {
+			present[w.start] = true
+			expected = append(expected, w)
+		}
+	}
+
+	for ws := from; ws.Before(to); ws = ws.Add(c.window) {
+		cov.ExpectedWindows++
+		if present[ws] {
+			cov.PresentWindows++
+			continue
+		}
+		if in.covers(ws, ws.Add(c.window)) {
+			cov.IdleWindows++
+			continue
+		}
+		cov.MissingWindows++
+		if n := len(cov.Gaps); n > 0 && cov.Gaps[n-1].End.Equal(ws) {
+			cov.Gaps[n-1].End = ws.Add(c.window)
+			cov.Gaps[n-1].Windows++
+			continue
+		}
+		cov.Gaps = append(cov.Gaps, Gap{Start: ws, End: ws.Add(c.window), Windows: 1})
+	}
+
+	// Staleness runs from the newest window the ingestor has accounted for, with or
+	// without traffic.
+	latest := cov.LastWindowEnd
+	if !in.through.IsZero() {
+		through := in.through
+		cov.IngestedThrough = &through
+		if latest == nil || through.After(*latest) {
+			latest = &through
+		}
+	}
+	if latest != nil {
+		cov.StalenessSeconds = int64(now.Sub(*latest) / time.Second)
+	} else {
+		cov.StalenessSeconds = int64(now.Sub(from) / time.Second)
+	}
+	cov.Drop = c.drop(expected)
+	return cov
+}
+
+// drop compares the newest window with the trailing average of the windows before it. At
+// least half of the trailing windows must be present for the average to count.
+func (c *Checker) drop(windows []window) *Drop {
+	n := len(windows)
+	trailing := int(c.cfg.DropTrailing)
+	if n < 2 || trailing <= 0 || c.cfg.DropRatio <= 0 {
+		return nil
+	}
+	latest := windows[n-1]
+	prior := windows[:n-1]
+	if len(prior) > trailing {
+		prior = prior[len(prior)-trailing:]
+	}
+	if len(prior)*2 < trailing {
+		return nil
+	}
+	var total int64
+	for _, w := range prior {
+		total += w.bytes
+	}
+	avg := float64(total) / float64(len(prior))
+	if avg <= 0 {
+		return nil
+	}
+	ratio := float64(latest.bytes) / avg
+	if ratio >= c.cfg.DropRatio {
+		return nil
+	}
+	return &Drop{WindowStart: latest.start, Bytes: latest.bytes, TrailingAverage: avg, Ratio: ratio}
+}
+
+// ceil rounds t up to a multiple of d.
+func ceil(t time.Time, d time.Duration) time.Time {
+	if truncated := t.Truncate(d); truncated.Before(t) {
+		return truncated.Add(d)
+	}
+	return t
+}
@@ -0,0 +1,133 @@
+package usagehealth
+
+import (
+	"testing"
+	"time"
+
+	"tranche/internal/config"
+	"tranche/internal/db"
+)
+
+func hourly(start time.Time, bytes ...int64) []window {
+	windows := make([]window, 0, len(bytes))
+	for i, b := range bytes {
+		ws := start.Add(time.Duration(i) * time.Hour)
+		windows = append(windows, window{start: ws, end: ws.Add(time.Hour), bytes: b, firstSeenAt: ws.Add(time.Hour + 5*time.Minute)})
+	}
+	return windows
+}
+
+func testChecker() *Checker {
+	return NewChecker(nil, time.Hour, config.UsageHealthConfig{
+		Lookback:     24 * time.Hour,
+		Grace:        2 * time.Hour,
+		LateAfter:    time.Hour,
+		DropRatio:    0.5,
+		DropTrailing: 4,
+	})
+}
+
+func TestAnalyzeFindsGaps(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(8 * time.Hour)
+	now := to.Add(3 * time.Hour)
+	windows := hourly(from, 10, 10, 10, 10, 10, 10, 10, 10)
+	// Drop 02:00-04:00 and 06:00.
+	windows = append(append(windows[:2:2], windows[4:6]...), windows[7])
+
+	cov := testChecker().analyze(db.Service{ID: 7, CreatedAt: from.Add(-time.Hour)}, from, to, now, windows, ingested{})
+	if cov.ExpectedWindows != 8 || cov.PresentWindows != 5 || cov.MissingWindows != 3 {
+		t.Fatalf("unexpected counts %+v", cov)
+	}
+	if len(cov.Gaps) != 2 {
+		t.Fatalf("expected 2 gaps, got %+v", cov.Gaps)
+	}
+	if g := cov.Gaps[0]; !g.Start.Equal(from.Add(2*time.Hour)) || !g.End.Equal(from.Add(4*time.Hour)) || g.Windows != 2 {
+		t.Fatalf("unexpected first gap %+v", g)
+	}
+	if g := cov.Gaps[1]; !g.Start.Equal(from.Add(6*time.Hour)) || g.Windows != 1 {
+		t.Fatalf("unexpected second gap %+v", g)
+	}
+	if cov.LastWindowEnd == nil || !cov.LastWindowEnd.Equal(to) || cov.StalenessSeconds != int64(3*time.Hour/time.Second) {
+		t.Fatalf("unexpected staleness %v %d", cov.LastWindowEnd, cov.StalenessSeconds)
+	}
+	if cov.Healthy() {
+		t.Fatalf("coverage with gaps reported healthy")
+	}
+}
+
+func TestAnalyzeCountsIngestedWindowsWithoutTrafficAsIdle(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(8 * time.Hour)
+	now := to.Add(3 * time.Hour)
+	svc := db.Service{ID: 7, CreatedAt: from.Add(-time.Hour)}
+
+	cov := testChecker().analyze(svc, from, to, now, nil, ingested{from: from.Add(-24 * time.Hour), through: now.Add(-time.Hour)})
+	if cov.ExpectedWindows != 8 || cov.IdleWindows != 8 || cov.MissingWindows != 0 || len(cov.Gaps) != 0 {
+		t.Fatalf("expected an idle service without gaps, got %+v", cov)
+	}
+	if !cov.Healthy() {
+		t.Fatalf("idle service reported unhealthy: %+v", cov)
+	}
+	if cov.IngestedThrough == nil || cov.StalenessSeconds != int64(time.Hour/time.Second) {
+		t.Fatalf("expected staleness from the ingested range, got %v %d", cov.IngestedThrough, cov.StalenessSeconds)
+	}
+
+	// An outage before the ingested range still shows as a gap.
+	cov = testChecker().analyze(svc, from, to, now, hourly(from, 10), ingested{from: from.Add(5 * time.Hour), through: now})
+	if cov.PresentWindows != 1 || cov.IdleWindows != 3 || cov.MissingWindows != 4 {
+		t.Fatalf("unexpected counts %+v", cov)
+	}
+	if len(cov.Gaps) != 1 || !cov.Gaps[0].Start.Equal(from.Add(time.Hour)) || !cov.Gaps[0].End.Equal(from.Add(5*time.Hour)) {
+		t.Fatalf("expected the outage as one gap, got %+v", cov.Gaps)
+	}
+}
+
+func TestAnalyzeSkipsWindowsBeforeServiceCreated(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(6 * time.Hour)
+	created := from.Add(3*time.Hour + 20*time.Minute)
+
+	cov := testChecker().analyze(db.Service{ID: 7, CreatedAt: created}, from, to, to, hourly(from.Add(4*time.Hour), 5, 5), ingested{})
+	if !cov.From.Equal(from.Add(4*time.Hour)) || cov.ExpectedWindows != 2 || cov.MissingWindows != 0 {
+		t.Fatalf("expected coverage to start at the first window after creation, got %+v", cov)
+	}
+}
+
+func TestAnalyzeFlagsLateWindows(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(3 * time.Hour)
+	windows := hourly(from, 10, 10, 10)
+	windows[1].firstSeenAt = windows[1].end.Add(90 * time.Minute)
+
+	cov := testChecker().analyze(db.Service{ID: 7}, from, to, to, windows, ingested{})
+	if len(cov.LateWindows) != 1 {
+		t.Fatalf("expected one late window, got %+v", cov.LateWindows)
+	}
+	if late := cov.LateWindows[0]; !late.WindowStart.Equal(from.Add(time.Hour)) || late.DelaySeconds != 5400 {
+		t.Fatalf("unexpected late window %+v", late)
+	}
+}
+
+func TestAnalyzeDetectsDrop(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(6 * time.Hour)
+	c := testChecker()
+
+	cov := c.analyze(db.Service{ID: 7}, from, to, to, hourly(from, 1000, 100, 100, 100, 100, 40), ingested{})
+	if cov.Drop == nil {
+		t.Fatalf("expected a drop")
+	}
+	if cov.Drop.TrailingAverage != 100 || cov.Drop.Bytes != 40 || !cov.Drop.WindowStart.Equal(from.Add(5*time.Hour)) {
+		t.Fatalf("unexpected drop %+v", cov.Drop)
+	}
+
+	cov = c.analyze(db.Service{ID: 7}, from, to, to, hourly(from, 100, 100, 100, 100, 100, 60), ingested{})
+	if cov.Drop != nil {
+		t.Fatalf("expected no drop above the ratio, got %+v", cov.Drop)
+	}
+	cov = c.analyze(db.Service{ID: 7}, from, to, to, hourly(from.Add(4*time.Hour), 100, 1), ingested{})
+	if cov.Drop != nil {
+		t.Fatalf("expected no drop without enough trailing windows, got %+v", cov.Drop)
+	}
+}
@@ -0,0 +1,286 @@
+package usageingestor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/logging"
+)
+
+// BackfillOptions describes one backfill job. Chunk bounds how much of the range each
+// provider call covers and Pause spaces chunks out to stay within provider rate limits.
+type BackfillOptions struct {
+	Start      time.Time
+	End        time.Time
+	ServiceIDs []int64
+	Chunk      time.Duration
+	Pause      time.Duration
+	// Restart discards the persisted cursor and starts from Start again.
+	Restart bool
+}
+
+// Backfill walks a historical range chunk by chunk through the engine, persisting a cursor
+// in usage_backfills after every chunk so an interrupted run resumes where it stopped.
+type Backfill struct {
+	engine  rangeIngester
+	queries backfillStore
+	logger  *logging.Logger
+	opts    BackfillOptions
+}
+
+// rangeIngester is the part of Engine a backfill drives.
+type rangeIngester interface {
+	Window() time.Duration
+	IngestRange(ctx context.Context, start, end time.Time, serviceIDs []int64) (IngestResult, error)
+}
+
+// backfillStore keeps a backfill's cursor and looks up the snapshots it already has.
+type backfillStore interface {
+	StartUsageBackfill(ctx context.Context, arg db.StartUsageBackfillParams) (db.UsageBackfill, error)
+	ResetUsageBackfill(ctx context.Context, jobKey string) error
+	AdvanceUsageBackfill(ctx context.Context, arg db.AdvanceUsageBackfillParams) (db.UsageBackfill, error)
+	ListUsageSnapshotWindows(ctx context.Context, arg db.ListUsageSnapshotWindowsParams) ([]db.ListUsageSnapshotWindowsRow, error)
+}
+
+func NewBackfill(engine *Engine, queries *db.Queries, logger *logging.Logger, opts BackfillOptions) (*Backfill, error) {
+	return newBackfill(engine, queries, logger, opts)
+}
+
+func newBackfill(engine rangeIngester, queries backfillStore, logger *logging.Logger, opts BackfillOptions) (*Backfill, error) {
+	window := engine.Window()
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be positive")
+	}
+	if opts.Chunk == 0 {
+		opts.Chunk = 24 * time.Hour
+	}
+	if opts.Chunk < window || opts.Chunk%window != 0 {
+		return nil, fmt.Errorf("chunk %s must be a multiple of the %s window", opts.Chunk, window)
+	}
+	opts.Start = opts.Start.UTC().Truncate(window)
+	if end := opts.End.UTC().Truncate(window); end.Before(opts.End) {
+		opts.End = end.Add(window)
+	} else {
+		opts.End = end
+	}
+	if !opts.End.After(opts.Start) {
+		return nil, fmt.Errorf("backfill range %s - %s is empty", opts.Start.Format(time.RFC3339), opts.End.Format(time.RFC3339))
+	}
+	ids := append([]int64(nil), opts.ServiceIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	opts.ServiceIDs = ids
+	return &Backfill{engine: engine, queries: queries, logger: logger, opts: opts}, nil
+}
+
+// BackfillReport summarises a backfill. Totals include chunks completed by earlier,
+// interrupted runs of the same job; Services covers this run only.
+type BackfillReport struct {
+	JobKey      string            `json:"job_key"`
+	Start       time.Time         `json:"start"`
+	End         time.Time         `json:"end"`
+	ResumedFrom *time.Time        `json:"resumed_from,omitempty"`
+	Cursor      time.Time         `json:"cursor"`
+	Complete    bool              `json:"complete"`
+	Filled      int64             `json:"filled"`
+	Present     int64             `json:"present"`
+	Empty       int64             `json:"empty"`
+	Services    []ServiceBackfill `json:"services"`
+	Unmeasured  map[int64]string  `json:"unmeasured,omitempty"`
+	services    map[int64]*ServiceBackfill
+}
+
+// ServiceBackfill classifies one service's windows: filled windows had no snapshot before
+// the backfill wrote one, present windows already had a snapshot (they are re-fetched like
+// the regular lookback), and empty windows had no usage reported by any provider.
+type ServiceBackfill struct {
+	ServiceID int64      `json:"service_id"`
+	Filled    []TimeSpan `json:"filled"`
+	Present   int64      `json:"present"`
+	Empty     int64      `json:"empty"`
+}
+
+// TimeSpan is a run of consecutive windows [Start, End).
+type TimeSpan struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// JobKey identifies the job in usage_backfills; identical invocations share a cursor.
+func (b *Backfill) JobKey() string {
+	services := "all"
+	if len(b.opts.ServiceIDs) > 0 {
+		services = joinIDs(b.opts.ServiceIDs)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", b.opts.Start.Format(time.RFC3339), b.opts.End.Format(time.RFC3339), b.engine.Window(), services)
+}
+
+// Run processes the remaining chunks. On error the report covers the chunks completed so
+// far and the cursor stays at the start of the failed chunk. A chunk in which a service
+// could not be measured counts as failed, so re-running the job retries it.
+func (b *Backfill) Run(ctx context.Context) (*BackfillReport, error) {
+	key := b.JobKey()
+	report := &BackfillReport{
+		JobKey:     key,
+		Start:      b.opts.Start,
+		End:        b.opts.End,
+		Unmeasured: make(map[int64]string),
+		services:   make(map[int64]*ServiceBackfill),
+	}
+	defer report.finish()
+
+	if b.opts.Restart {
+		if err := b.queries.ResetUsageBackfill(ctx, key); err != nil {
+			return report, fmt.Errorf("reset backfill %s: %w", key, err)
+		}
+	}
+	job, err := b.queries.StartUsageBackfill(ctx, db.StartUsageBackfillParams{
+		JobKey:     key,
+		RangeStart: b.opts.Start,
+		RangeEnd:   b.opts.End,
+		Services:   joinIDs(b.opts.ServiceIDs),
+	})
+	if err != nil {
+		return report, fmt.Errorf("start backfill %s: %w", key, err)
+	}
+	report.setTotals(job)
+	if job.CursorAt.After(b.opts.Start) {
+		resumed := job.CursorAt.UTC()
+		report.ResumedFrom = &resumed
+		b.logger.Printf("resuming backfill %s from %s", key, resumed.Format(time.RFC3339))
+	}
+
+	window := b.engine.Window()
+	for cursor := job.CursorAt.UTC(); cursor.Before(b.opts.End); {
+		chunkEnd := cursor.Add(b.opts.Chunk)
+		if chunkEnd.After(b.opts.End) {
+			chunkEnd = b.opts.End
+		}
+
+		counts, err := b.chunk(ctx, report, cursor, chunkEnd, window)
+		if err != nil {
+			return report, fmt.Errorf("backfill chunk %s - %s: %w", cursor.Format(time.RFC3339), chunkEnd.Format(time.RFC3339), err)
+		}
+		job, err = b.queries.AdvanceUsageBackfill(ctx, db.AdvanceUsageBackfillParams{
+			CursorAt: chunkEnd,
+			Filled:   counts.filled,
+			Present:  counts.present,
+			Empty:    counts.empty,
+			JobKey:   key,
+		})
+		if err != nil {
+			return report, fmt.Errorf("save backfill cursor: %w", err)
+		}
+		report.setTotals(job)
+		b.logger.Printf("backfill %s: through %s (filled=%d present=%d empty=%d)", key, chunkEnd.Format(time.RFC3339), counts.filled, counts.present, counts.empty)
+
+		cursor = chunkEnd
+		if cursor.Before(b.opts.End) && b.opts.Pause > 0 {
+			select {
+			case <-ctx.Done():
+				return report, ctx.Err()
+			case <-time.After(b.opts.Pause):
+			}
+		}
+	}
+	return report, nil
+}
+
+type chunkCounts struct {
+	filled, present, empty int64
+}
+
+func (b *Backfill) chunk(ctx context.Context, report *BackfillReport, start, end time.Time, window time.Duration) (chunkCounts, error) {
+	var counts chunkCounts
+	rows, err := b.queries.ListUsageSnapshotWindows(ctx, db.ListUsageSnapshotWindowsParams{RangeStart: start, RangeEnd: end})
+	if err != nil {
+		return counts, fmt.Errorf("list existing snapshots: %w", err)
+	}
+	existing := make(map[WindowKey]bool, len(rows))
+	for _, row := range rows {
+		existing[WindowKey{ServiceID: row.ServiceID, WindowStart: row.WindowStart.UTC()}] = true
+	}
+
+	result, err := b.engine.IngestRange(ctx, start, end, b.opts.ServiceIDs)
+	if err != nil {
+		return counts, err
+	}
+	if len(result.Failed) > 0 {
+		return counts, fmt.Errorf("%d service(s) failed: %w", len(result.Failed), firstError(result.Failed))
+	}
+	if len(result.Unmeasured) > 0 {
+		for id, err := range result.Unmeasured {
+			report.Unmeasured[id] = err.Error()
+		}
+		return counts, fmt.Errorf("%d service(s) not measured; fix their provider mapping or leave them out of the backfill: %w", len(result.Unmeasured), firstError(result.Unmeasured))
+	}
+	written := make(map[WindowKey]bool, len(result.Written))
+	for _, key := range result.Written {
+		written[WindowKey{ServiceID: key.ServiceID, WindowStart: key.WindowStart.UTC()}] = true
+	}
+
+	for _, id := range result.ServiceIDs {
+		svc := report.service(id)
+		for ws := start; ws.Before(end); ws = ws.Add(window) {
+			key := WindowKey{ServiceID: id, WindowStart: ws}
+			switch {
+			case existing[key]:
+				svc.Present++
+				counts.present++
+			case written[key]:
+				svc.addFilled(ws, window)
+				counts.filled++
+			default:
+				svc.Empty++
+				counts.empty++
+			}
+		}
+	}
+	return counts, nil
+}
+
+func (r *BackfillReport) setTotals(job db.UsageBackfill) {
+	r.Cursor = job.CursorAt.UTC()
+	r.Complete = job.CompletedAt.Valid
+	r.Filled = job.Filled
+	r.Present = job.Present
+	r.Empty = job.Empty
+}
+
+func (r *BackfillReport) service(id int64) *ServiceBackfill {
+	svc := r.services[id]
+	if svc == nil {
+		svc = &ServiceBackfill{ServiceID: id, Filled: []TimeSpan{}}
+		r.services[id] = svc
+	}
+	return svc
+}
+
+func (r *BackfillReport) finish() {
+	r.Services = make([]ServiceBackfill, 0, len(r.services))
+	for _, svc := range r.services {
+		r.Services = append(r.Services, *svc)
+	}
+	sort.Slice(r.Services, func(i, j int) bool { return r.Services[i].ServiceID < r.Services[j].ServiceID })
+}
+
+// addFilled records a filled window, extending the last span when the windows are adjacent.
+func (s *ServiceBackfill) addFilled(ws time.Time, window time.Duration) {
+	if n := len(s.Filled); n > 0 && s.Filled[n-1].End.Equal(ws) {
+		s.Filled[n-1].End = ws.Add(window)
+		return
+	}
+	s.Filled = append(s.Filled, TimeSpan{Start: ws, End: ws.Add(window)})
+}
+
+func joinIDs(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
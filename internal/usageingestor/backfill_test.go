@@ -0,0 +1,222 @@
+package usageingestor
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tranche/internal/db"
+	"tranche/internal/logging"
+)
+
+type fakeIngester struct {
+	window time.Duration
+	calls  [][2]time.Time
+	// ingest answers each call; by default every window of service 1 is written.
+	ingest func(start, end time.Time) (IngestResult, error)
+}
+
+func (f *fakeIngester) Window() time.Duration { return f.window }
+
+func (f *fakeIngester) IngestRange(ctx context.Context, start, end time.Time, serviceIDs []int64) (IngestResult, error) {
+	f.calls = append(f.calls, [2]time.Time{start, end})
+	if f.ingest != nil {
+		return f.ingest(start, end)
+	}
+	result := IngestResult{ServiceIDs: []int64{1}, Unmeasured: map[int64]error{}, Failed: map[int64]error{}}
+	for ws := start; ws.Before(end); ws = ws.Add(f.window) {
+		result.Written = append(result.Written, WindowKey{ServiceID: 1, WindowStart: ws})
+	}
+	return result, nil
+}
+
+type fakeBackfillStore struct {
+	jobs     map[string]db.UsageBackfill
+	existing []db.ListUsageSnapshotWindowsRow
+}
+
+func newFakeBackfillStore() *fakeBackfillStore {
+	return &fakeBackfillStore{jobs: make(map[string]db.UsageBackfill)}
+}
+
+func (f *fakeBackfillStore) StartUsageBackfill(ctx context.Context, arg db.StartUsageBackfillParams) (db.UsageBackfill, error) {
+	job, ok := f.jobs[arg.JobKey]
+	if !ok {
+		job = db.UsageBackfill{JobKey: arg.JobKey, RangeStart: arg.RangeStart, RangeEnd: arg.RangeEnd, Services: arg.Services, CursorAt: arg.RangeStart}
+		f.jobs[arg.JobKey] = job
+	}
+	return job, nil
+}
+
+func (f *fakeBackfillStore) ResetUsageBackfill(ctx context.Context, jobKey string) error {
+	job, ok := f.jobs[jobKey]
+	if ok {
+		job.CursorAt, job.Filled, job.Present, job.Empty, job.CompletedAt = job.RangeStart, 0, 0, 0, sql.NullTime{}
+		f.jobs[jobKey] = job
+	}
+	return nil
+}
+
+func (f *fakeBackfillStore) AdvanceUsageBackfill(ctx context.Context, arg db.AdvanceUsageBackfillParams) (db.UsageBackfill, error) {
+	job := f.jobs[arg.JobKey]
+	job.CursorAt = arg.CursorAt
+	job.Filled += arg.Filled
+	job.Present += arg.Present
+	job.Empty += arg.Empty
+	job.CompletedAt = sql.NullTime{Time: arg.CursorAt, Valid: !arg.CursorAt.Before(job.RangeEnd)}
+	f.jobs[arg.JobKey] = job
+	return job, nil
+}
+
+func (f *fakeBackfillStore) ListUsageSnapshotWindows(ctx context.Context, arg db.ListUsageSnapshotWindowsParams) ([]db.ListUsageSnapshotWindowsRow, error) {
+	var rows []db.ListUsageSnapshotWindowsRow
+	for _, row := range f.existing {
+		if !row.WindowStart.Before(arg.RangeStart) && row.WindowStart.Before(arg.RangeEnd) {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func TestBackfillWalksRangeInChunks(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	engine := &fakeIngester{window: time.Hour}
+	store := newFakeBackfillStore()
+	b, err := newBackfill(engine, store, logging.New("test"), BackfillOptions{
+		Start: start,
+		End:   start.Add(30*time.Hour + 20*time.Minute),
+		Chunk: 12 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("newBackfill: %v", err)
+	}
+
+	report, err := b.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := [][2]time.Time{
+		{start, start.Add(12 * time.Hour)},
+		{start.Add(12 * time.Hour), start.Add(24 * time.Hour)},
+		{start.Add(24 * time.Hour), start.Add(31 * time.Hour)},
+	}
+	if !reflect.DeepEqual(engine.calls, want) {
+		t.Fatalf("expected chunks %v, got %v", want, engine.calls)
+	}
+	if !report.Complete || report.Filled != 31 || !report.Cursor.Equal(start.Add(31*time.Hour)) {
+		t.Fatalf("expected a complete job with 31 filled windows, got %+v", report)
+	}
+	if len(report.Services) != 1 || len(report.Services[0].Filled) != 1 {
+		t.Fatalf("expected one contiguous filled span, got %+v", report.Services)
+	}
+}
+
+func TestBackfillClassifiesWindows(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	engine := &fakeIngester{window: time.Hour, ingest: func(s, e time.Time) (IngestResult, error) {
+		// Usage in the first two windows only.
+		return IngestResult{ServiceIDs: []int64{1}, Written: []WindowKey{{1, s}, {1, s.Add(time.Hour)}}}, nil
+	}}
+	store := newFakeBackfillStore()
+	store.existing = []db.ListUsageSnapshotWindowsRow{{ServiceID: 1, WindowStart: start}}
+	b, err := newBackfill(engine, store, logging.New("test"), BackfillOptions{Start: start, End: start.Add(4 * time.Hour), Chunk: 4 * time.Hour})
+	if err != nil {
+		t.Fatalf("newBackfill: %v", err)
+	}
+
+	report, err := b.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if report.Present != 1 || report.Filled != 1 || report.Empty != 2 {
+		t.Fatalf("expected 1 present, 1 filled, 2 empty, got %+v", report)
+	}
+	if got := report.Services[0].Filled; len(got) != 1 || !got[0].Start.Equal(start.Add(time.Hour)) {
+		t.Fatalf("expected the second window filled, got %+v", got)
+	}
+}
+
+func TestBackfillResumesFromFailedChunk(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	fail := true
+	engine := &fakeIngester{window: time.Hour}
+	engine.ingest = func(s, e time.Time) (IngestResult, error) {
+		if fail && s.Equal(start.Add(24*time.Hour)) {
+			return IngestResult{ServiceIDs: []int64{1}, Failed: map[int64]error{1: errors.New("rate limited")}}, nil
+		}
+		return IngestResult{ServiceIDs: []int64{1}}, nil
+	}
+	store := newFakeBackfillStore()
+	opts := BackfillOptions{Start: start, End: start.Add(72 * time.Hour), Chunk: 24 * time.Hour}
+	b, err := newBackfill(engine, store, logging.New("test"), opts)
+	if err != nil {
+		t.Fatalf("newBackfill: %v", err)
+	}
+
+	report, err := b.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "rate limited") {
+		t.Fatalf("expected the failed chunk to stop the run, got %v", err)
+	}
+	if report.Complete || !report.Cursor.Equal(start.Add(24*time.Hour)) {
+		t.Fatalf("expected the cursor kept at the failed chunk, got %+v", report)
+	}
+
+	fail = false
+	engine.calls = nil
+	b, _ = newBackfill(engine, store, logging.New("test"), opts)
+	report, err = b.Run(context.Background())
+	if err != nil {
+		t.Fatalf("resumed Run: %v", err)
+	}
+	if report.ResumedFrom == nil || !report.ResumedFrom.Equal(start.Add(24*time.Hour)) || !report.Complete {
+		t.Fatalf("expected a completed run resumed from the failed chunk, got %+v", report)
+	}
+	if len(engine.calls) != 2 || !engine.calls[0][0].Equal(start.Add(24*time.Hour)) {
+		t.Fatalf("expected the remaining two chunks fetched, got %v", engine.calls)
+	}
+	if report.Empty != 72 {
+		t.Fatalf("expected every window counted once across both runs, got %d", report.Empty)
+	}
+}
+
+func TestBackfillKeepsCursorForUnmeasuredServices(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	engine := &fakeIngester{window: time.Hour, ingest: func(s, e time.Time) (IngestResult, error) {
+		return IngestResult{
+			ServiceIDs: []int64{1, 2},
+			Written:    []WindowKey{{1, s}},
+			Unmeasured: map[int64]error{2: errors.New("no distribution mapped")},
+		}, nil
+	}}
+	store := newFakeBackfillStore()
+	b, err := newBackfill(engine, store, logging.New("test"), BackfillOptions{Start: start, End: start.Add(48 * time.Hour), Chunk: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("newBackfill: %v", err)
+	}
+
+	report, err := b.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "not measured") {
+		t.Fatalf("expected unmeasured services to stop the run, got %v", err)
+	}
+	if !report.Cursor.Equal(start) || report.Complete {
+		t.Fatalf("expected the cursor kept at the start, got %+v", report)
+	}
+	if report.Unmeasured[2] != "no distribution mapped" {
+		t.Fatalf("expected service 2 reported as unmeasured, got %+v", report.Unmeasured)
+	}
+	if len(engine.calls) != 1 {
+		t.Fatalf("expected the run to stop after the first chunk, got %d calls", len(engine.calls))
+	}
+}
+
+func TestNewBackfillRejectsMisalignedChunk(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	_, err := newBackfill(&fakeIngester{window: time.Hour}, newFakeBackfillStore(), logging.New("test"), BackfillOptions{Start: start, End: start.Add(48 * time.Hour), Chunk: 90 * time.Minute})
+	if err == nil {
+		t.Fatal("expected a chunk that is not a multiple of the window to be rejected")
+	}
+}
@@ -2,7 +2,9 @@ package usageingestor
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"tranche/internal/cdn"
@@ -10,91 +12,374 @@ import (
 	"tranche/internal/logging"
 )
 
+// Engine pulls windowed per-host usage from each service's primary and backup CDN and
+// records it in usage_snapshots. The selector resolves which provider measures each CDN,
+// honouring per-service and per-customer overrides.
 type Engine struct {
-	queries  *db.Queries
-	provider cdn.Provider
+	queries  ingestStore
+	selector *cdn.Selector
 	logger   *logging.Logger
 
 	window   time.Duration
 	lookback time.Duration
 }
 
-func NewEngine(queries *db.Queries, provider cdn.Provider, logger *logging.Logger, window, lookback time.Duration) *Engine {
+// ingestStore reads the services to ingest and records their snapshots.
+type ingestStore interface {
+	GetActiveServices(ctx context.Context) ([]db.Service, error)
+	GetAllServiceDomains(ctx context.Context) ([]db.ServiceDomain, error)
+	UpsertUsageSnapshot(ctx context.Context, arg db.UpsertUsageSnapshotParams) error
+	InsertUsageRevisionIfChanged(ctx context.Context, arg db.InsertUsageRevisionIfChangedParams) (int64, error)
+	RecordUsageIngestCoverage(ctx context.Context, arg db.RecordUsageIngestCoverageParams) error
+}
+
+func NewEngine(queries *db.Queries, selector *cdn.Selector, logger *logging.Logger, window, lookback time.Duration) *Engine {
+	return newEngine(queries, selector, logger, window, lookback)
+}
+
+func newEngine(queries ingestStore, selector *cdn.Selector, logger *logging.Logger, window, lookback time.Duration) *Engine {
 	return &Engine{
 		queries:  queries,
-		provider: provider,
+		selector: selector,
 		logger:   logger,
 		window:   window,
 		lookback: lookback,
 	}
 }
 
+// hostRoute maps a hostname served by one CDN to the service and column it bills to.
+type hostRoute struct {
+	serviceID int64
+	role      cdn.Role
+}
+
+// Window returns the window length usage is bucketed into.
+func (e *Engine) Window() time.Duration {
+	return e.window
+}
+
+// RunOnce re-fetches the lookback ending at the last complete window.
 func (e *Engine) RunOnce(ctx context.Context, now time.Time) error {
-	if e.window <= 0 {
-		return fmt.Errorf("window must be positive")
+	alignedNow := now.Truncate(e.window)
+	result, err := e.IngestRange(ctx, alignedNow.Add(-e.lookback), alignedNow, nil)
+	if err != nil {
+		return err
 	}
 
-	alignedNow := now.Truncate(e.window)
-	windowStart := alignedNow.Add(-e.lookback)
+	e.logger.Printf("ingested %d windows across %d services", len(result.Written), len(result.ServiceIDs)-len(result.Skipped()))
+	if skipped := result.Skipped(); len(skipped) > 0 {
+		return fmt.Errorf("usage for %d service(s) skipped: %w", len(skipped), firstError(skipped))
+	}
+	return nil
+}
+
+// WindowKey identifies one service's usage window.
+type WindowKey struct {
+	ServiceID   int64
+	WindowStart time.Time
+}
+
+// IngestResult reports what one IngestRange pass did.
+type IngestResult struct {
+	// ServiceIDs lists the services with domains that were considered.
+	ServiceIDs []int64
+	// Written lists every snapshot window upserted.
+	Written []WindowKey
+	// Unmeasured holds services skipped because a CDN they use has no registered provider.
+	Unmeasured map[int64]error
+	// Failed holds services skipped because a provider fetch failed.
+	Failed map[int64]error
+}
+
+// Skipped merges Unmeasured and Failed.
+func (r IngestResult) Skipped() map[int64]error {
+	skipped := make(map[int64]error, len(r.Unmeasured)+len(r.Failed))
+	for id, err := range r.Unmeasured {
+		skipped[id] = err
+	}
+	for id, err := range r.Failed {
+		skipped[id] = err
+	}
+	return skipped
+}
+
+// IngestRange fetches and records usage for every window in [start, end). When serviceIDs is
+// non-empty only those active services are ingested. Skipped services are reported in the
+// result rather than as an error.
+func (e *Engine) IngestRange(ctx context.Context, start, end time.Time, serviceIDs []int64) (IngestResult, error) {
+	result := IngestResult{Unmeasured: make(map[int64]error), Failed: make(map[int64]error)}
+	if e.window <= 0 {
+		return result, fmt.Errorf("window must be positive")
+	}
+	if start.Truncate(e.window) != start || end.Truncate(e.window) != end {
+		return result, fmt.Errorf("range %s - %s is not aligned to the %s window", start.Format(time.RFC3339), end.Format(time.RFC3339), e.window)
+	}
 
 	services, err := e.queries.GetActiveServices(ctx)
 	if err != nil {
-		return fmt.Errorf("fetch services: %w", err)
+		return result, fmt.Errorf("fetch services: %w", err)
 	}
+	services = filterServices(services, serviceIDs)
 	if len(services) == 0 {
-		return nil
+		return result, nil
 	}
 
-	domainMap, hostToService, err := e.loadDomains(ctx, services)
+	domainMap, err := loadDomains(ctx, e.queries, services)
 	if err != nil {
-		return err
+		return result, err
 	}
-	if len(hostToService) == 0 {
+	if len(domainMap) == 0 {
 		e.logger.Printf("no service domains configured; skipping usage ingestion")
-		return nil
+		return result, nil
 	}
-
-	hosts := make([]string, 0, len(hostToService))
-	for h := range hostToService {
-		hosts = append(hosts, h)
+	for _, svc := range services {
+		if len(domainMap[svc.ID]) > 0 {
+			result.ServiceIDs = append(result.ServiceIDs, svc.ID)
+		}
 	}
 
-	usages, err := e.provider.Usage(ctx, windowStart, alignedNow, e.window, hosts)
-	if err != nil {
-		return fmt.Errorf("fetch usage: %w", err)
+	// Route every host to the providers measuring it. A service whose primary and backup
+	// resolve to the same provider only bills primary bytes.
+	providers := make(map[string]cdn.Provider)
+	routes := make(map[string]map[string]hostRoute)
+	missing := make(map[string][]int64)
+	for _, svc := range services {
+		if len(domainMap[svc.ID]) == 0 {
+			continue
+		}
+		for _, role := range []cdn.Role{cdn.RolePrimary, cdn.RoleBackup} {
+			name := e.selector.NameFor(svc, role)
+			if role == cdn.RoleBackup && (name == "" || name == e.selector.NameFor(svc, cdn.RolePrimary)) {
+				continue
+			}
+			prov, err := e.selector.ProviderFor(svc, role)
+			if err != nil {
+				missing[name] = append(missing[name], svc.ID)
+				result.Unmeasured[svc.ID] = err
+				continue
+			}
+			providers[prov.Name()] = prov
+			if routes[prov.Name()] == nil {
+				routes[prov.Name()] = make(map[string]hostRoute)
+			}
+			for _, d := range domainMap[svc.ID] {
+				routes[prov.Name()][d.Name] = hostRoute{serviceID: svc.ID, role: role}
+			}
+		}
+	}
+	for cdnName, serviceIDs := range missing {
+		e.logger.Error("usage provider missing; snapshots for these services are not recorded", "cdn", cdnName, "service_ids", serviceIDs)
 	}
 
 	aggregates := make(map[usageKey]db.UpsertUsageSnapshotParams)
-	for _, u := range usages {
-		svcID, ok := hostToService[u.Host]
-		if !ok {
-			e.logger.Printf("usage for unknown host %s", u.Host)
+	for cdnName, hostRoutes := range routes {
+		usages, unmeasured, err := fetchUsage(ctx, providers[cdnName], start, end, e.window, hostRoutes)
+		if err != nil {
+			e.logger.Error("usage fetch failed", "cdn", cdnName, "error", err)
+			for _, route := range hostRoutes {
+				result.Failed[route.serviceID] = fmt.Errorf("fetch %s usage: %w", cdnName, err)
+			}
 			continue
 		}
-		if u.WindowStart.Truncate(e.window) != u.WindowStart || !u.WindowEnd.Equal(u.WindowStart.Add(e.window)) {
-			e.logger.Printf("dropping misaligned window for host %s: %s - %s", u.Host, u.WindowStart, u.WindowEnd)
-			continue
+		if len(unmeasured) > 0 {
+			ids := make([]int64, 0, len(unmeasured))
+			for id, err := range unmeasured {
+				result.Unmeasured[id] = fmt.Errorf("%s: %w", cdnName, err)
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			e.logger.Error("usage provider cannot measure services; snapshots for these services are not recorded", "cdn", cdnName, "service_ids", ids)
+		}
+
+		for _, u := range usages {
+			route, ok := hostRoutes[u.Host]
+			if !ok {
+				e.logger.Printf("usage for unknown host %s from %s", u.Host, cdnName)
+				continue
+			}
+			if u.WindowStart.Truncate(e.window) != u.WindowStart || !u.WindowEnd.Equal(u.WindowStart.Add(e.window)) ||
+				u.WindowStart.Before(start) || !u.WindowStart.Before(end) {
+				e.logger.Printf("dropping misaligned window for host %s: %s - %s", u.Host, u.WindowStart, u.WindowEnd)
+				continue
+			}
+			key := usageKey{serviceID: route.serviceID, windowStart: u.WindowStart}
+			agg := aggregates[key]
+			agg.ServiceID = route.serviceID
+			agg.WindowStart = u.WindowStart
+			agg.WindowEnd = u.WindowEnd
+			if route.role == cdn.RoleBackup {
+				agg.BackupBytes += u.Bytes
+				agg.BackupRequests += u.Requests
+			} else {
+				agg.PrimaryBytes += u.Bytes
+				agg.PrimaryRequests += u.Requests
+			}
+			for region, ru := range u.Regions {
+				if agg.Regions == nil {
+					agg.Regions = make(db.UsageRegions)
+				}
+				r := agg.Regions[region]
+				if route.role == cdn.RoleBackup {
+					r.BackupBytes += ru.Bytes
+					r.BackupRequests += ru.Requests
+				} else {
+					r.PrimaryBytes += ru.Bytes
+					r.PrimaryRequests += ru.Requests
+				}
+				agg.Regions[region] = r
+			}
+			aggregates[key] = agg
 		}
-		key := usageKey{serviceID: svcID, windowStart: u.WindowStart}
-		agg := aggregates[key]
-		agg.ServiceID = svcID
-		agg.WindowStart = u.WindowStart
-		agg.WindowEnd = u.WindowEnd
-		agg.PrimaryBytes += u.Bytes
-		aggregates[key] = agg
 	}
 
+	// Snapshots are upserted whole, so a service is only written when every CDN it uses
+	// reported; otherwise a partial fetch would zero out the other column.
 	for key, params := range aggregates {
+		if _, ok := result.Unmeasured[key.serviceID]; ok {
+			continue
+		}
+		if _, ok := result.Failed[key.serviceID]; ok {
+			continue
+		}
 		if params.WindowEnd.IsZero() {
 			params.WindowEnd = params.WindowStart.Add(e.window)
 		}
 		if err := e.queries.UpsertUsageSnapshot(ctx, params); err != nil {
-			return fmt.Errorf("persist usage for service %d window %s: %w", key.serviceID, key.windowStart, err)
+			return result, fmt.Errorf("persist usage for service %d window %s: %w", key.serviceID, key.windowStart, err)
 		}
+		// Invoiced snapshots are left untouched by the upsert; changed data for them is
+		// kept as a revision for the billing engine to adjust.
+		revised, err := e.queries.InsertUsageRevisionIfChanged(ctx, db.InsertUsageRevisionIfChangedParams{
+			PrimaryBytes:    params.PrimaryBytes,
+			BackupBytes:     params.BackupBytes,
+			PrimaryRequests: params.PrimaryRequests,
+			BackupRequests:  params.BackupRequests,
+			Regions:         params.Regions,
+			ServiceID:       params.ServiceID,
+			WindowStart:     params.WindowStart,
+			WindowEnd:       params.WindowEnd,
+		})
+		if err != nil {
+			return result, fmt.Errorf("record usage revision for service %d window %s: %w", key.serviceID, key.windowStart, err)
+		}
+		if revised > 0 {
+			e.logger.Printf("usage for invoiced window %s of service %d changed; recorded revision", key.windowStart.Format(time.RFC3339), key.serviceID)
+		}
+		result.Written = append(result.Written, WindowKey{ServiceID: key.serviceID, WindowStart: key.windowStart})
 	}
 
-	e.logger.Printf("ingested %d windows across %d services", len(aggregates), len(domainMap))
-	return nil
+	// Every window of a fully measured service was fetched, so the ones left without a
+	// snapshot had no traffic. The coverage check tells them apart from missing windows.
+	for _, id := range result.ServiceIDs {
+		if _, ok := result.Unmeasured[id]; ok {
+			continue
+		}
+		if _, ok := result.Failed[id]; ok {
+			continue
+		}
+		if err := e.queries.RecordUsageIngestCoverage(ctx, db.RecordUsageIngestCoverageParams{
+			ServiceID:      id,
+			CoveredFrom:    start,
+			CoveredThrough: end,
+		}); err != nil {
+			return result, fmt.Errorf("record ingested range for service %d: %w", id, err)
+		}
+	}
+	return result, nil
+}
+
+// fetchUsage asks a provider for the usage of the hosts routed to it. ServiceProvider results
+// are keyed back onto the first of each service's hosts so they follow the same routing.
+// Services the provider could not measure are returned apart from the usage it did measure.
+func fetchUsage(ctx context.Context, prov cdn.Provider, start, end time.Time, window time.Duration, hostRoutes map[string]hostRoute) ([]cdn.WindowedUsage, map[int64]error, error) {
+	hosts := make([]string, 0, len(hostRoutes))
+	for h := range hostRoutes {
+		hosts = append(hosts, h)
+	}
+	sp, ok := prov.(cdn.ServiceProvider)
+	if !ok {
+		hp, ok := prov.(cdn.HostProvider)
+		if !ok {
+			return nil, nil, fmt.Errorf("provider %s measures neither hostnames nor services", prov.Name())
+		}
+		usages, err := hp.Usage(ctx, start, end, window, hosts)
+		var unmeasured *cdn.UnmeasuredError
+		if !errors.As(err, &unmeasured) {
+			return usages, nil, err
+		}
+		services := make(map[int64]error, len(unmeasured.Hosts))
+		for host, err := range unmeasured.Hosts {
+			if route, ok := hostRoutes[host]; ok {
+				services[route.serviceID] = fmt.Errorf("host %s: %w", host, err)
+			}
+		}
+		return usages, services, nil
+	}
+
+	sort.Strings(hosts)
+	var serviceIDs []int64
+	hostForService := make(map[int64]string)
+	for _, h := range hosts {
+		id := hostRoutes[h].serviceID
+		if _, seen := hostForService[id]; !seen {
+			hostForService[id] = h
+			serviceIDs = append(serviceIDs, id)
+		}
+	}
+	serviceUsages, err := sp.ServiceUsage(ctx, start, end, window, serviceIDs)
+	var unmeasured *cdn.UnmeasuredError
+	if errors.As(err, &unmeasured) {
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	usages := make([]cdn.WindowedUsage, 0, len(serviceUsages))
+	for _, su := range serviceUsages {
+		host, ok := hostForService[su.ServiceID]
+		if !ok {
+			continue
+		}
+		u := su.WindowedUsage
+		u.Host = host
+		usages = append(usages, u)
+	}
+	if unmeasured != nil {
+		return usages, unmeasured.Services, nil
+	}
+	return usages, nil, nil
+}
+
+// filterServices keeps the services listed in ids, or all of them when ids is empty.
+func filterServices(services []db.Service, ids []int64) []db.Service {
+	if len(ids) == 0 {
+		return services
+	}
+	want := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		want[id] = struct{}{}
+	}
+	kept := services[:0:0]
+	for _, svc := range services {
+		if _, ok := want[svc.ID]; ok {
+			kept = append(kept, svc)
+		}
+	}
+	return kept
+}
+
+// firstError returns the error of the lowest service ID so reports are stable across runs.
+func firstError(failed map[int64]error) error {
+	var (
+		lowest int64
+		err    error
+	)
+	for id, e := range failed {
+		if err == nil || id < lowest {
+			lowest, err = id, e
+		}
+	}
+	return fmt.Errorf("service %d: %w", lowest, err)
 }
 
 type usageKey struct {
@@ -102,25 +387,23 @@ type usageKey struct {
 	windowStart time.Time
 }
 
-func (e *Engine) loadDomains(ctx context.Context, services []db.Service) (map[int64][]db.ServiceDomain, map[string]int64, error) {
+func loadDomains(ctx context.Context, queries ingestStore, services []db.Service) (map[int64][]db.ServiceDomain, error) {
 	serviceSet := make(map[int64]struct{}, len(services))
 	for _, svc := range services {
 		serviceSet[svc.ID] = struct{}{}
 	}
 
-	domains, err := e.queries.GetAllServiceDomains(ctx)
+	domains, err := queries.GetAllServiceDomains(ctx)
 	if err != nil {
-		return nil, nil, fmt.Errorf("fetch domains: %w", err)
+		return nil, fmt.Errorf("fetch domains: %w", err)
 	}
 
 	byService := make(map[int64][]db.ServiceDomain)
-	hostToService := make(map[string]int64)
 	for _, d := range domains {
 		if _, ok := serviceSet[d.ServiceID]; !ok {
 			continue
 		}
 		byService[d.ServiceID] = append(byService[d.ServiceID], d)
-		hostToService[d.Name] = d.ServiceID
 	}
-	return byService, hostToService, nil
+	return byService, nil
 }
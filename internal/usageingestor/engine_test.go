@@ -0,0 +1,129 @@
+package usageingestor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"tranche/internal/cdn"
+	"tranche/internal/db"
+	"tranche/internal/logging"
+)
+
+type fakeIngestStore struct {
+	services  []db.Service
+	domains   []db.ServiceDomain
+	snapshots map[WindowKey]db.UpsertUsageSnapshotParams
+	covered   []int64
+}
+
+func (f *fakeIngestStore) GetActiveServices(ctx context.Context) ([]db.Service, error) {
+	return f.services, nil
+}
+
+func (f *fakeIngestStore) GetAllServiceDomains(ctx context.Context) ([]db.ServiceDomain, error) {
+	return f.domains, nil
+}
+
+func (f *fakeIngestStore) UpsertUsageSnapshot(ctx context.Context, arg db.UpsertUsageSnapshotParams) error {
+	if f.snapshots == nil {
+		f.snapshots = make(map[WindowKey]db.UpsertUsageSnapshotParams)
+	}
+	f.snapshots[WindowKey{ServiceID: arg.ServiceID, WindowStart: arg.WindowStart}] = arg
+	return nil
+}
+
+func (f *fakeIngestStore) InsertUsageRevisionIfChanged(ctx context.Context, arg db.InsertUsageRevisionIfChangedParams) (int64, error) {
+	return 0, nil
+}
+
+func (f *fakeIngestStore) RecordUsageIngestCoverage(ctx context.Context, arg db.RecordUsageIngestCoverageParams) error {
+	f.covered = append(f.covered, arg.ServiceID)
+	return nil
+}
+
+// fakeHostProvider reports the same usage for every window it is asked about.
+type fakeHostProvider struct {
+	name  string
+	usage map[string]cdn.WindowedUsage
+}
+
+func (f fakeHostProvider) Name() string { return f.name }
+
+func (f fakeHostProvider) Usage(ctx context.Context, start, end time.Time, window time.Duration, hosts []string) ([]cdn.WindowedUsage, error) {
+	var out []cdn.WindowedUsage
+	for ws := start; ws.Before(end); ws = ws.Add(window) {
+		for _, host := range hosts {
+			u, ok := f.usage[host]
+			if !ok {
+				continue
+			}
+			u.Host, u.WindowStart, u.WindowEnd = host, ws, ws.Add(window)
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+func TestIngestRangeSplitsPrimaryAndBackupBytes(t *testing.T) {
+	store := &fakeIngestStore{
+		services: []db.Service{
+			{ID: 1, PrimaryCdn: "fastly", BackupCdn: "cloudflare"},
+			// The backup CDN has no provider, so the service's backup usage is unknown.
+			{ID: 2, PrimaryCdn: "fastly", BackupCdn: "akamai"},
+			// Primary and backup are measured by one provider; it all bills as primary.
+			{ID: 3, PrimaryCdn: "fastly", BackupCdn: "fastly"},
+		},
+		domains: []db.ServiceDomain{
+			{ServiceID: 1, Name: "a.example"},
+			{ServiceID: 2, Name: "b.example"},
+			{ServiceID: 3, Name: "c.example"},
+		},
+	}
+	primaryUsage := cdn.WindowedUsage{Bytes: 100, Requests: 10}
+	primaryUsage.AddRegion("US", 60, 6)
+	backupUsage := cdn.WindowedUsage{Bytes: 30, Requests: 3}
+	backupUsage.AddRegion("US", 20, 2)
+	selector, err := cdn.NewSelector(cdn.SelectorConfig{Providers: []cdn.Provider{
+		fakeHostProvider{name: "fastly", usage: map[string]cdn.WindowedUsage{
+			"a.example": primaryUsage,
+			"b.example": {Bytes: 50, Requests: 5},
+			"c.example": {Bytes: 70, Requests: 7},
+		}},
+		fakeHostProvider{name: "cloudflare", usage: map[string]cdn.WindowedUsage{
+			"a.example": backupUsage,
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("selector: %v", err)
+	}
+	engine := newEngine(store, selector, logging.New("test"), time.Hour, time.Hour)
+	start := time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC)
+
+	result, err := engine.IngestRange(context.Background(), start, start.Add(time.Hour), nil)
+	if err != nil {
+		t.Fatalf("IngestRange: %v", err)
+	}
+
+	want := map[WindowKey]db.UpsertUsageSnapshotParams{
+		{ServiceID: 1, WindowStart: start}: {
+			ServiceID: 1, WindowStart: start, WindowEnd: start.Add(time.Hour),
+			PrimaryBytes: 100, PrimaryRequests: 10, BackupBytes: 30, BackupRequests: 3,
+			Regions: db.UsageRegions{"US": {PrimaryBytes: 60, PrimaryRequests: 6, BackupBytes: 20, BackupRequests: 2}},
+		},
+		{ServiceID: 3, WindowStart: start}: {
+			ServiceID: 3, WindowStart: start, WindowEnd: start.Add(time.Hour),
+			PrimaryBytes: 70, PrimaryRequests: 7,
+		},
+	}
+	if !reflect.DeepEqual(store.snapshots, want) {
+		t.Fatalf("got snapshots %+v, want %+v", store.snapshots, want)
+	}
+	if _, ok := result.Unmeasured[2]; !ok || len(result.Unmeasured) != 1 || len(result.Failed) != 0 {
+		t.Fatalf("expected only service 2 unmeasured, got unmeasured %v and failed %v", result.Unmeasured, result.Failed)
+	}
+	if !reflect.DeepEqual(store.covered, []int64{1, 3}) {
+		t.Fatalf("expected coverage recorded for services 1 and 3, got %v", store.covered)
+	}
+}
@@ -0,0 +1,350 @@
+package usageingestor
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tranche/internal/cdn"
+	"tranche/internal/db"
+	"tranche/internal/logging"
+	"tranche/internal/usagelogs"
+)
+
+const (
+	// pathsPerFile caps how many of each host's paths a file contributes to service_path_hits.
+	pathsPerFile = 200
+	// pathHitsRetention is how long path hit counts are kept for the cache pre-warmer.
+	pathHitsRetention = 30 * 24 * time.Hour
+)
+
+// LogEngine ingests usage from raw CDN access logs. Every file is parsed whole, aggregated
+// into per-host windows and added to usage_snapshots in the same transaction that records
+// the file as processed, so re-runs and crashes never count a file twice. A file rewritten
+// in place (new size or ETag) is processed again, and only the difference from the counts
+// the previous version added is applied.
+//
+// Log ingestion adds to snapshots rather than replacing them, so a CDN must not also be
+// ingested through the analytics APIs. It records no regional breakdown, so region rates
+// never apply to log-ingested usage.
+type LogEngine struct {
+	queries  *db.Queries
+	selector *cdn.Selector
+	source   usagelogs.Source
+	parse    usagelogs.Parser
+	cdnName  string
+	window   time.Duration
+	logger   *logging.Logger
+}
+
+// NewLogEngine builds a log engine for one source. cdnName is the CDN that wrote the logs,
+// as referenced by services' primary_cdn/backup_cdn.
+func NewLogEngine(queries *db.Queries, selector *cdn.Selector, source usagelogs.Source, format, cdnName string, window time.Duration, logger *logging.Logger) (*LogEngine, error) {
+	parse, err := usagelogs.ParserFor(format)
+	if err != nil {
+		return nil, err
+	}
+	if cdnName == "" {
+		return nil, errors.New("log cdn name is required")
+	}
+	if window <= 0 {
+		window = time.Hour
+	}
+	return &LogEngine{
+		queries:  queries,
+		selector: selector,
+		source:   source,
+		parse:    parse,
+		cdnName:  cdnName,
+		window:   window,
+		logger:   logger,
+	}, nil
+}
+
+// RunOnce processes every file in the source that has not been processed yet, or has changed
+// since. A file that fails is logged and retried on the next run; the others still go ahead.
+func (e *LogEngine) RunOnce(ctx context.Context) error {
+	objects, err := e.source.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		routes    map[string]hostRoute
+		processed int
+		failed    int
+		firstErr  error
+	)
+	for _, obj := range objects {
+		if file, err := e.queries.GetUsageLogFile(ctx, db.GetUsageLogFileParams{Source: e.source.Name(), ObjectKey: obj.Key}); err == nil && sameVersion(file, obj) {
+			continue
+		} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("check log file %s: %w", obj.Key, err)
+		}
+
+		if routes == nil {
+			if routes, err = e.loadRoutes(ctx); err != nil {
+				return err
+			}
+		}
+		if err := e.processFile(ctx, obj, routes); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			e.logger.Error("log file not processed; retrying next run", "source", e.source.Name(), "key", obj.Key, "error", err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("process log file %s: %w", obj.Key, err)
+			}
+			failed++
+			continue
+		}
+		processed++
+	}
+	if processed > 0 {
+		e.logger.Printf("processed %d log file(s) from %s", processed, e.source.Name())
+		cutoff := time.Now().Add(-pathHitsRetention).UTC().Truncate(24 * time.Hour)
+		if _, err := e.queries.DeleteServicePathHitsBefore(ctx, cutoff); err != nil {
+			return fmt.Errorf("prune path hits: %w", err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d log file(s) failed: %w", failed, firstErr)
+	}
+	return nil
+}
+
+// sameVersion reports whether a listed object is the version that was processed.
+func sameVersion(file db.UsageLogFile, obj usagelogs.Object) bool {
+	return file.SizeBytes == obj.Size && file.Etag == obj.ETag
+}
+
+func (e *LogEngine) processFile(ctx context.Context, obj usagelogs.Object, routes map[string]hostRoute) error {
+	rc, err := usagelogs.OpenRecords(ctx, e.source, obj.Key)
+	if err != nil {
+		return err
+	}
+	agg := usagelogs.NewAggregator(e.window)
+	paths := usagelogs.NewPathCounter()
+	var records int64
+	skipped, err := e.parse(rc, func(rec usagelogs.Record) {
+		records++
+		agg.Add(rec)
+		paths.Add(rec)
+	})
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	usage, unrouted := routeUsage(agg.Usage(), routes)
+
+	qtx, tx, err := e.queries.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var previous db.LogFileUsage
+	switch file, err := qtx.LockUsageLogFile(ctx, db.LockUsageLogFileParams{Source: e.source.Name(), ObjectKey: obj.Key}); {
+	case errors.Is(err, sql.ErrNoRows):
+		inserted, err := qtx.InsertUsageLogFile(ctx, db.InsertUsageLogFileParams{
+			Source:    e.source.Name(),
+			ObjectKey: obj.Key,
+			SizeBytes: obj.Size,
+			Etag:      obj.ETag,
+			Records:   records,
+			Skipped:   int64(skipped),
+			Usage:     usage,
+		})
+		if err != nil {
+			return fmt.Errorf("record log file: %w", err)
+		}
+		if inserted == 0 {
+			// Another ingestor committed this file first.
+			return nil
+		}
+	case err != nil:
+		return fmt.Errorf("lock log file: %w", err)
+	case sameVersion(file, obj):
+		// Another ingestor committed this version first.
+		return nil
+	default:
+		if len(file.Usage) == 0 && file.Records > 0 {
+			e.logger.Warn("log file rewritten but its previous counts were not recorded; both versions are counted", "source", e.source.Name(), "key", obj.Key)
+		}
+		previous = file.Usage
+		if err := qtx.UpdateUsageLogFile(ctx, db.UpdateUsageLogFileParams{
+			Source:    e.source.Name(),
+			ObjectKey: obj.Key,
+			SizeBytes: obj.Size,
+			Etag:      obj.ETag,
+			Records:   records,
+			Skipped:   int64(skipped),
+			Usage:     usage,
+		}); err != nil {
+			return fmt.Errorf("record log file: %w", err)
+		}
+	}
+
+	for _, w := range usageDelta(previous, usage) {
+		params := db.AddUsageSnapshotBytesParams{
+			ServiceID:       w.ServiceID,
+			WindowStart:     w.WindowStart,
+			WindowEnd:       w.WindowEnd,
+			PrimaryBytes:    w.PrimaryBytes,
+			BackupBytes:     w.BackupBytes,
+			PrimaryRequests: w.PrimaryRequests,
+			BackupRequests:  w.BackupRequests,
+		}
+		added, err := qtx.AddUsageSnapshotBytes(ctx, params)
+		if err != nil {
+			return fmt.Errorf("add usage for service %d window %s: %w", w.ServiceID, w.WindowStart.Format(time.RFC3339), err)
+		}
+		if added > 0 {
+			continue
+		}
+		// The window is already invoiced; record the late bytes as a revision instead.
+		if err := qtx.AddUsageRevisionBytes(ctx, db.AddUsageRevisionBytesParams{
+			PrimaryBytes:    params.PrimaryBytes,
+			BackupBytes:     params.BackupBytes,
+			PrimaryRequests: params.PrimaryRequests,
+			BackupRequests:  params.BackupRequests,
+			ServiceID:       params.ServiceID,
+			WindowStart:     params.WindowStart,
+			WindowEnd:       params.WindowEnd,
+		}); err != nil {
+			return fmt.Errorf("add usage revision for service %d window %s: %w", w.ServiceID, w.WindowStart.Format(time.RFC3339), err)
+		}
+	}
+
+	// Path hits are counted against the day the file is processed, which is close enough
+	// for ranking recently hot paths.
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	for _, host := range paths.Hosts() {
+		route, ok := routes[host]
+		if !ok {
+			continue
+		}
+		for _, ph := range paths.Top(host, pathsPerFile) {
+			if err := qtx.AddServicePathHits(ctx, db.AddServicePathHitsParams{
+				ServiceID: route.serviceID,
+				Day:       day,
+				Path:      ph.Path,
+				Hits:      ph.Hits,
+			}); err != nil {
+				return fmt.Errorf("add path hits for service %d: %w", route.serviceID, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	if skipped > 0 || unrouted > 0 {
+		e.logger.Printf("log file %s: %d unparseable line(s), %d byte(s) for hosts not served by %s", obj.Key, skipped, unrouted, e.cdnName)
+	}
+	return nil
+}
+
+// logWindowKey identifies a service window in a file's recorded usage, which round-trips
+// through JSON and so cannot be keyed on time.Time.
+type logWindowKey struct {
+	serviceID   int64
+	windowStart int64
+}
+
+// routeUsage sums a file's per-host usage into the service windows and columns it bills to,
+// returning the bytes of hosts no service routes here separately.
+func routeUsage(hosts []usagelogs.Usage, routes map[string]hostRoute) (db.LogFileUsage, int64) {
+	usage := db.LogFileUsage{}
+	index := make(map[logWindowKey]int)
+	var unrouted int64
+	for _, u := range hosts {
+		route, ok := routes[u.Host]
+		if !ok {
+			unrouted += u.Bytes
+			continue
+		}
+		key := logWindowKey{serviceID: route.serviceID, windowStart: u.WindowStart.Unix()}
+		i, ok := index[key]
+		if !ok {
+			i = len(usage)
+			index[key] = i
+			usage = append(usage, db.LogFileWindow{ServiceID: route.serviceID, WindowStart: u.WindowStart, WindowEnd: u.WindowEnd})
+		}
+		if route.role == cdn.RoleBackup {
+			usage[i].BackupBytes += u.Bytes
+			usage[i].BackupRequests += u.Requests
+		} else {
+			usage[i].PrimaryBytes += u.Bytes
+			usage[i].PrimaryRequests += u.Requests
+		}
+	}
+	return usage, unrouted
+}
+
+// usageDelta returns what has to be added to the snapshots to replace the counts of a file's
+// previous version with the current ones. Windows whose counts did not change are left out.
+func usageDelta(previous, current db.LogFileUsage) db.LogFileUsage {
+	delta := db.LogFileUsage{}
+	index := make(map[logWindowKey]int)
+	add := func(w db.LogFileWindow, sign int64) {
+		key := logWindowKey{serviceID: w.ServiceID, windowStart: w.WindowStart.Unix()}
+		i, ok := index[key]
+		if !ok {
+			i = len(delta)
+			index[key] = i
+			delta = append(delta, db.LogFileWindow{ServiceID: w.ServiceID, WindowStart: w.WindowStart, WindowEnd: w.WindowEnd})
+		}
+		delta[i].PrimaryBytes += sign * w.PrimaryBytes
+		delta[i].BackupBytes += sign * w.BackupBytes
+		delta[i].PrimaryRequests += sign * w.PrimaryRequests
+		delta[i].BackupRequests += sign * w.BackupRequests
+	}
+	for _, w := range previous {
+		add(w, -1)
+	}
+	for _, w := range current {
+		add(w, 1)
+	}
+	changed := delta[:0]
+	for _, w := range delta {
+		if w.PrimaryBytes != 0 || w.BackupBytes != 0 || w.PrimaryRequests != 0 || w.BackupRequests != 0 {
+			changed = append(changed, w)
+		}
+	}
+	return changed
+}
+
+// loadRoutes maps every hostname of an active service that uses this CDN to the column its
+// bytes belong to.
+func (e *LogEngine) loadRoutes(ctx context.Context) (map[string]hostRoute, error) {
+	services, err := e.queries.GetActiveServices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch services: %w", err)
+	}
+	domains, err := loadDomains(ctx, e.queries, services)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make(map[string]hostRoute)
+	for _, svc := range services {
+		var role cdn.Role
+		switch {
+		case e.selector.NameFor(svc, cdn.RolePrimary) == e.cdnName:
+			role = cdn.RolePrimary
+		case svc.BackupCdn == e.cdnName:
+			role = cdn.RoleBackup
+		default:
+			continue
+		}
+		for _, d := range domains[svc.ID] {
+			routes[strings.ToLower(d.Name)] = hostRoute{serviceID: svc.ID, role: role}
+		}
+	}
+	return routes, nil
+}
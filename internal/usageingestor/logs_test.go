@@ -0,0 +1,78 @@
+package usageingestor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"tranche/internal/cdn"
+	"tranche/internal/db"
+	"tranche/internal/usagelogs"
+)
+
+func TestRouteUsageSumsHostsPerServiceWindow(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	routes := map[string]hostRoute{
+		"a.example.com": {serviceID: 1, role: cdn.RolePrimary},
+		"b.example.com": {serviceID: 1, role: cdn.RoleBackup},
+		"c.example.com": {serviceID: 1, role: cdn.RolePrimary},
+	}
+	usage, unrouted := routeUsage([]usagelogs.Usage{
+		{Host: "a.example.com", WindowStart: start, WindowEnd: end, Bytes: 100, Requests: 2},
+		{Host: "b.example.com", WindowStart: start, WindowEnd: end, Bytes: 40, Requests: 1},
+		{Host: "c.example.com", WindowStart: start, WindowEnd: end, Bytes: 10, Requests: 1},
+		{Host: "other.example.com", WindowStart: start, WindowEnd: end, Bytes: 7, Requests: 1},
+	}, routes)
+
+	want := db.LogFileUsage{{ServiceID: 1, WindowStart: start, WindowEnd: end, PrimaryBytes: 110, BackupBytes: 40, PrimaryRequests: 3, BackupRequests: 1}}
+	if !reflect.DeepEqual(usage, want) {
+		t.Fatalf("expected %+v, got %+v", want, usage)
+	}
+	if unrouted != 7 {
+		t.Fatalf("expected 7 unrouted bytes, got %d", unrouted)
+	}
+}
+
+func TestUsageDelta(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	w := func(offset time.Duration, primary, backup int64) db.LogFileWindow {
+		return db.LogFileWindow{ServiceID: 1, WindowStart: start.Add(offset), WindowEnd: start.Add(offset + time.Hour), PrimaryBytes: primary, BackupBytes: backup}
+	}
+	tests := []struct {
+		name              string
+		previous, current db.LogFileUsage
+		want              db.LogFileUsage
+	}{
+		{
+			name:    "first version",
+			current: db.LogFileUsage{w(0, 100, 0)},
+			want:    db.LogFileUsage{w(0, 100, 0)},
+		},
+		{
+			name:     "appended to",
+			previous: db.LogFileUsage{w(0, 100, 0)},
+			current:  db.LogFileUsage{w(0, 150, 5), w(time.Hour, 20, 0)},
+			want:     db.LogFileUsage{w(0, 50, 5), w(time.Hour, 20, 0)},
+		},
+		{
+			name:     "window dropped",
+			previous: db.LogFileUsage{w(0, 100, 0), w(time.Hour, 20, 0)},
+			current:  db.LogFileUsage{w(time.Hour, 20, 0)},
+			want:     db.LogFileUsage{w(0, -100, 0)},
+		},
+		{
+			name:     "unchanged",
+			previous: db.LogFileUsage{w(0, 100, 0)},
+			current:  db.LogFileUsage{w(0, 100, 0)},
+			want:     db.LogFileUsage{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := usageDelta(tt.previous, tt.current); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
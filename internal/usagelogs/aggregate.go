@@ -0,0 +1,117 @@
+package usagelogs
+
+import (
+	"sort"
+	"time"
+)
+
+// Usage is the traffic for one host within one window.
+type Usage struct {
+	Host        string
+	WindowStart time.Time
+	WindowEnd   time.Time
+	Bytes       int64
+	Requests    int64
+}
+
+// Aggregator sums records into per-host windows.
+type Aggregator struct {
+	window time.Duration
+	totals map[usageKey]*Usage
+}
+
+type usageKey struct {
+	host        string
+	windowStart time.Time
+}
+
+func NewAggregator(window time.Duration) *Aggregator {
+	if window <= 0 {
+		window = time.Hour
+	}
+	return &Aggregator{window: window, totals: make(map[usageKey]*Usage)}
+}
+
+// Add counts one request.
+func (a *Aggregator) Add(rec Record) {
+	start := rec.Timestamp.UTC().Truncate(a.window)
+	key := usageKey{host: rec.Host, windowStart: start}
+	u := a.totals[key]
+	if u == nil {
+		u = &Usage{Host: rec.Host, WindowStart: start, WindowEnd: start.Add(a.window)}
+		a.totals[key] = u
+	}
+	u.Bytes += rec.Bytes
+	u.Requests++
+}
+
+// Usage returns the aggregated windows ordered by window start, then host.
+func (a *Aggregator) Usage() []Usage {
+	out := make([]Usage, 0, len(a.totals))
+	for _, u := range a.totals {
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].WindowStart.Equal(out[j].WindowStart) {
+			return out[i].WindowStart.Before(out[j].WindowStart)
+		}
+		return out[i].Host < out[j].Host
+	})
+	return out
+}
+
+// PathCounter counts requests per host and path, for finding each host's hottest paths.
+type PathCounter struct {
+	hits map[string]map[string]int64
+}
+
+func NewPathCounter() *PathCounter {
+	return &PathCounter{hits: make(map[string]map[string]int64)}
+}
+
+// Add counts one request; records without a path are ignored.
+func (c *PathCounter) Add(rec Record) {
+	if rec.Path == "" {
+		return
+	}
+	paths := c.hits[rec.Host]
+	if paths == nil {
+		paths = make(map[string]int64)
+		c.hits[rec.Host] = paths
+	}
+	paths[rec.Path]++
+}
+
+// PathHits is one path's request count.
+type PathHits struct {
+	Path string
+	Hits int64
+}
+
+// Hosts returns the hosts with at least one counted path, sorted.
+func (c *PathCounter) Hosts() []string {
+	hosts := make([]string, 0, len(c.hits))
+	for host := range c.hits {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Top returns up to n of a host's paths, busiest first and then by path.
+func (c *PathCounter) Top(host string, n int) []PathHits {
+	out := make([]PathHits, 0, len(c.hits[host]))
+	for path, hits := range c.hits[host] {
+		out = append(out, PathHits{Path: path, Hits: hits})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Hits != out[j].Hits {
+			return out[i].Hits > out[j].Hits
+		}
+		return out[i].Path < out[j].Path
+	})
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
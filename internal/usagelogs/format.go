@@ -0,0 +1,265 @@
+// Package usagelogs reads raw CDN access logs and aggregates them into per-host usage
+// windows, as an alternative to the sampled and rate-limited analytics APIs.
+package usagelogs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported log formats.
+const (
+	// FormatCloudflare is Cloudflare Logpush http_requests NDJSON.
+	FormatCloudflare = "cloudflare"
+	// FormatFastly is Fastly real-time logging with a JSON log format.
+	FormatFastly = "fastly"
+	// FormatW3C is the W3C extended log file format, e.g. CloudFront standard logs.
+	FormatW3C = "w3c"
+)
+
+// Record is a single request read from an access log. Path is the request path without the
+// query string, when the log carries one.
+type Record struct {
+	Host      string
+	Path      string
+	Timestamp time.Time
+	Bytes     int64
+}
+
+// Parser reads every record from r, calling emit for each. Lines that cannot be parsed are
+// skipped and counted rather than failing the whole file.
+type Parser func(r io.Reader, emit func(Record)) (skipped int, err error)
+
+// ParserFor returns the parser for a log format.
+func ParserFor(format string) (Parser, error) {
+	switch format {
+	case FormatCloudflare:
+		return ParseCloudflare, nil
+	case FormatFastly:
+		return ParseFastly, nil
+	case FormatW3C:
+		return ParseW3C, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q (want %s, %s or %s)", format, FormatCloudflare, FormatFastly, FormatW3C)
+	}
+}
+
+// ParseCloudflare reads Logpush NDJSON using the ClientRequestHost, EdgeResponseBytes and
+// EdgeStartTimestamp fields, plus ClientRequestPath or ClientRequestURI when present.
+// Timestamps may be RFC3339, unix seconds or unix nanoseconds.
+func ParseCloudflare(r io.Reader, emit func(Record)) (int, error) {
+	return parseNDJSON(r, emit, func(fields map[string]json.RawMessage) (Record, bool) {
+		host, ok := stringField(fields, "ClientRequestHost")
+		if !ok {
+			return Record{}, false
+		}
+		bytes, ok := intField(fields, "EdgeResponseBytes")
+		if !ok {
+			return Record{}, false
+		}
+		ts, ok := timeField(fields, "EdgeStartTimestamp")
+		if !ok {
+			return Record{}, false
+		}
+		path, _ := stringField(fields, "ClientRequestPath", "ClientRequestURI")
+		return Record{Host: host, Path: cleanPath(path), Timestamp: ts, Bytes: bytes}, true
+	})
+}
+
+// ParseFastly reads JSON lines with a timestamp, host and response size. The first present
+// field of each group is used: timestamp/time_start, host/request_host,
+// resp_bytes/response_bytes/bytes and the optional url/path.
+func ParseFastly(r io.Reader, emit func(Record)) (int, error) {
+	return parseNDJSON(r, emit, func(fields map[string]json.RawMessage) (Record, bool) {
+		host, ok := stringField(fields, "host", "request_host")
+		if !ok {
+			return Record{}, false
+		}
+		bytes, ok := intField(fields, "resp_bytes", "response_bytes", "bytes")
+		if !ok {
+			return Record{}, false
+		}
+		ts, ok := timeField(fields, "timestamp", "time_start")
+		if !ok {
+			return Record{}, false
+		}
+		path, _ := stringField(fields, "url", "path")
+		return Record{Host: host, Path: cleanPath(path), Timestamp: ts, Bytes: bytes}, true
+	})
+}
+
+// ParseW3C reads W3C extended logs. The #Fields directive must name date, time, sc-bytes and
+// one of cs-host, cs(Host) or x-host-header; a "-" value counts as missing. cs-uri-stem is
+// read as the path when present.
+func ParseW3C(r io.Reader, emit func(Record)) (int, error) {
+	scanner := newScanner(r)
+	var (
+		skipped                   int
+		dateIdx, timeIdx, byteIdx = -1, -1, -1
+		hostIdx, pathIdx          = -1, -1
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if rest, ok := strings.CutPrefix(line, "#Fields:"); ok {
+				dateIdx, timeIdx, byteIdx, hostIdx, pathIdx = -1, -1, -1, -1, -1
+				for i, name := range strings.Fields(rest) {
+					switch strings.ToLower(name) {
+					case "date":
+						dateIdx = i
+					case "time":
+						timeIdx = i
+					case "sc-bytes":
+						byteIdx = i
+					case "cs-host", "cs(host)", "x-host-header":
+						if hostIdx < 0 {
+							hostIdx = i
+						}
+					case "cs-uri-stem":
+						pathIdx = i
+					}
+				}
+			}
+			continue
+		}
+		if dateIdx < 0 || timeIdx < 0 || byteIdx < 0 || hostIdx < 0 {
+			skipped++
+			continue
+		}
+		values := strings.Fields(line)
+		if len(values) <= max(dateIdx, timeIdx, byteIdx, hostIdx) {
+			skipped++
+			continue
+		}
+		ts, err := time.Parse("2006-01-02 15:04:05", values[dateIdx]+" "+values[timeIdx])
+		if err != nil {
+			skipped++
+			continue
+		}
+		bytes, err := strconv.ParseInt(values[byteIdx], 10, 64)
+		host := values[hostIdx]
+		if err != nil || host == "-" {
+			skipped++
+			continue
+		}
+		rec := Record{Host: strings.ToLower(host), Timestamp: ts.UTC(), Bytes: bytes}
+		if pathIdx >= 0 && pathIdx < len(values) {
+			rec.Path = cleanPath(values[pathIdx])
+		}
+		emit(rec)
+	}
+	return skipped, scanner.Err()
+}
+
+func parseNDJSON(r io.Reader, emit func(Record), decode func(map[string]json.RawMessage) (Record, bool)) (int, error) {
+	scanner := newScanner(r)
+	skipped := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			skipped++
+			continue
+		}
+		rec, ok := decode(fields)
+		if !ok || rec.Host == "" {
+			skipped++
+			continue
+		}
+		rec.Host = strings.ToLower(rec.Host)
+		emit(rec)
+	}
+	return skipped, scanner.Err()
+}
+
+// cleanPath strips the query string and rejects values that are not absolute paths.
+func cleanPath(raw string) string {
+	path, _, _ := strings.Cut(raw, "?")
+	if !strings.HasPrefix(path, "/") {
+		return ""
+	}
+	return path
+}
+
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+func stringField(fields map[string]json.RawMessage, names ...string) (string, bool) {
+	for _, name := range names {
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil && s != "" {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+func intField(fields map[string]json.RawMessage, names ...string) (int64, bool) {
+	for _, name := range names {
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		var n int64
+		if err := json.Unmarshal(raw, &n); err == nil {
+			return n, true
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// timeField accepts RFC3339 strings, strftime-style "%Y-%m-%dT%H:%M:%S%z" strings and
+// numeric unix timestamps in seconds, milliseconds or nanoseconds.
+func timeField(fields map[string]json.RawMessage, names ...string) (time.Time, bool) {
+	for _, name := range names {
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05-0700"} {
+				if ts, err := time.Parse(layout, s); err == nil {
+					return ts.UTC(), true
+				}
+			}
+			continue
+		}
+		var n int64
+		if err := json.Unmarshal(raw, &n); err == nil {
+			switch {
+			case n > 1e17:
+				return time.Unix(0, n).UTC(), true
+			case n > 1e11:
+				return time.UnixMilli(n).UTC(), true
+			default:
+				return time.Unix(n, 0).UTC(), true
+			}
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,196 @@
+package usagelogs
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Object is a log file available from a Source.
+type Object struct {
+	Key  string
+	Size int64
+	ETag string
+}
+
+// Source lists and opens log files. Keys are stable identifiers used to record which files
+// have been processed; a key listed with a different size or ETag is a new version.
+type Source interface {
+	// Name identifies the source, e.g. "dir:///var/log/cdn" or "s3://bucket/prefix".
+	Name() string
+	List(ctx context.Context) ([]Object, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// OpenSource builds a Source from a URI: a plain path or file:// URI for a local directory,
+// or s3://bucket/prefix for an S3-compatible bucket read through client.
+func OpenSource(uri string, client S3API) (Source, error) {
+	if uri == "" {
+		return nil, fmt.Errorf("log source is required")
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" {
+		return NewDirSource(uri), nil
+	}
+	switch u.Scheme {
+	case "file":
+		return NewDirSource(u.Path), nil
+	case "s3":
+		if client == nil {
+			return nil, fmt.Errorf("s3 log source requires AWS configuration")
+		}
+		return NewS3Source(client, u.Host, strings.TrimPrefix(u.Path, "/")), nil
+	default:
+		return nil, fmt.Errorf("unsupported log source scheme %q", u.Scheme)
+	}
+}
+
+// OpenRecords opens a log file, transparently decompressing gzip files (*.gz).
+func OpenRecords(ctx context.Context, src Source, key string) (io.ReadCloser, error) {
+	rc, err := src.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(key, ".gz") {
+		return rc, nil
+	}
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("gunzip %s: %w", key, err)
+	}
+	return gzipReadCloser{Reader: gz, underlying: rc}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	underlying io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	err := g.Reader.Close()
+	if cerr := g.underlying.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// DirSource reads log files from a local directory tree. Hidden files are ignored so
+// partially written files (e.g. ".tmp-") are not picked up.
+type DirSource struct {
+	root string
+}
+
+func NewDirSource(root string) *DirSource {
+	return &DirSource{root: root}
+}
+
+func (d *DirSource) Name() string {
+	return "dir://" + d.root
+}
+
+func (d *DirSource) List(ctx context.Context) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(d.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != d.root {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: filepath.ToSlash(rel), Size: info.Size()})
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", d.root, err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (d *DirSource) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.root, filepath.FromSlash(key)))
+}
+
+// S3API captures the subset of the S3 client used by S3Source.
+type S3API interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// S3Source reads log files below a prefix of an S3-compatible bucket.
+type S3Source struct {
+	client S3API
+	bucket string
+	prefix string
+}
+
+func NewS3Source(client S3API, bucket, prefix string) *S3Source {
+	return &S3Source{client: client, bucket: bucket, prefix: prefix}
+}
+
+func (s *S3Source) Name() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+func (s *S3Source) List(ctx context.Context) ([]Object, error) {
+	var (
+		objects []Object
+		token   *string
+	)
+	for {
+		out, err := s.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(s.bucket),
+			Prefix:            aws.String(s.prefix),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list s3://%s/%s: %w", s.bucket, s.prefix, err)
+		}
+		for _, obj := range out.Contents {
+			key := aws.ToString(obj.Key)
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			objects = append(objects, Object{Key: key, Size: aws.ToInt64(obj.Size), ETag: strings.Trim(aws.ToString(obj.ETag), `"`)})
+		}
+		if !aws.ToBool(out.IsTruncated) || out.NextContinuationToken == nil {
+			break
+		}
+		token = out.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *S3Source) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, fmt.Errorf("get s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return out.Body, nil
+}
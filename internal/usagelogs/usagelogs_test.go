@@ -0,0 +1,203 @@
+package usagelogs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var hour = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+func aggregateFixture(t *testing.T, src Source, key, format string) ([]Usage, int) {
+	t.Helper()
+	parse, err := ParserFor(format)
+	if err != nil {
+		t.Fatalf("ParserFor(%s): %v", format, err)
+	}
+	rc, err := OpenRecords(context.Background(), src, key)
+	if err != nil {
+		t.Fatalf("open %s: %v", key, err)
+	}
+	defer rc.Close()
+	agg := NewAggregator(time.Hour)
+	skipped, err := parse(rc, agg.Add)
+	if err != nil {
+		t.Fatalf("parse %s: %v", key, err)
+	}
+	return agg.Usage(), skipped
+}
+
+func assertUsage(t *testing.T, got []Usage, want []Usage) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d windows, got %d: %+v", len(want), len(got), got)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Host != w.Host || !g.WindowStart.Equal(w.WindowStart) || !g.WindowEnd.Equal(w.WindowStart.Add(time.Hour)) || g.Bytes != w.Bytes || g.Requests != w.Requests {
+			t.Fatalf("window %d: expected %+v, got %+v", i, w, g)
+		}
+	}
+}
+
+func TestParseFixtures(t *testing.T) {
+	src := NewDirSource("testdata")
+	cases := []struct {
+		key     string
+		format  string
+		skipped int
+		want    []Usage
+	}{
+		{
+			key: "cloudflare.ndjson", format: FormatCloudflare, skipped: 2,
+			want: []Usage{
+				{Host: "app.example.com", WindowStart: hour, Bytes: 1500, Requests: 2},
+				{Host: "www.example.com", WindowStart: hour.Add(time.Hour), Bytes: 250, Requests: 1},
+			},
+		},
+		{
+			key: "fastly.json", format: FormatFastly, skipped: 1,
+			want: []Usage{
+				{Host: "app.example.com", WindowStart: hour, Bytes: 2048, Requests: 1},
+				{Host: "app.example.com", WindowStart: hour.Add(time.Hour), Bytes: 1024, Requests: 1},
+			},
+		},
+		{
+			key: "w3c.log", format: FormatW3C, skipped: 1,
+			want: []Usage{
+				{Host: "app.example.com", WindowStart: hour, Bytes: 3000, Requests: 1},
+				{Host: "www.example.com", WindowStart: hour.Add(2 * time.Hour), Bytes: 700, Requests: 1},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.format, func(t *testing.T) {
+			got, skipped := aggregateFixture(t, src, tc.key, tc.format)
+			if skipped != tc.skipped {
+				t.Fatalf("expected %d skipped lines, got %d", tc.skipped, skipped)
+			}
+			assertUsage(t, got, tc.want)
+		})
+	}
+}
+
+func TestDirSourceListsAndDecompresses(t *testing.T) {
+	dir := t.TempDir()
+	fixture, err := os.ReadFile(filepath.Join("testdata", "cloudflare.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(fixture)
+	gz.Close()
+	if err := os.MkdirAll(filepath.Join(dir, "20240301"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "20240301", "batch.ndjson.gz"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".partial.ndjson"), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := NewDirSource(dir)
+	objects, err := src.List(context.Background())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(objects) != 1 || objects[0].Key != "20240301/batch.ndjson.gz" {
+		t.Fatalf("expected only the gzip batch, got %+v", objects)
+	}
+
+	got, _ := aggregateFixture(t, src, objects[0].Key, FormatCloudflare)
+	if len(got) != 2 || got[0].Bytes != 1500 {
+		t.Fatalf("unexpected usage from gzip file: %+v", got)
+	}
+}
+
+type mockS3 struct {
+	pages   []*s3.ListObjectsV2Output
+	objects map[string]string
+	calls   int
+}
+
+func (m *mockS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	page := m.pages[m.calls]
+	m.calls++
+	return page, nil
+}
+
+func (m *mockS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(m.objects[aws.ToString(params.Key)]))}, nil
+}
+
+func TestS3SourcePaginates(t *testing.T) {
+	mock := &mockS3{
+		pages: []*s3.ListObjectsV2Output{
+			{
+				Contents:              []s3types.Object{{Key: aws.String("logs/b.json"), Size: aws.Int64(10), ETag: aws.String(`"etag-b"`)}, {Key: aws.String("logs/")}},
+				IsTruncated:           aws.Bool(true),
+				NextContinuationToken: aws.String("next"),
+			},
+			{Contents: []s3types.Object{{Key: aws.String("logs/a.json"), Size: aws.Int64(5)}}},
+		},
+		objects: map[string]string{"logs/a.json": `{"timestamp":"2024-03-01T10:00:00Z","host":"app.example.com","resp_bytes":42}`},
+	}
+
+	src, err := OpenSource("s3://bucket/logs", mock)
+	if err != nil {
+		t.Fatalf("OpenSource: %v", err)
+	}
+	objects, err := src.List(context.Background())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if mock.calls != 2 || len(objects) != 2 || objects[0].Key != "logs/a.json" || objects[1].ETag != "etag-b" {
+		t.Fatalf("unexpected listing after %d calls: %+v", mock.calls, objects)
+	}
+
+	got, _ := aggregateFixture(t, src, "logs/a.json", FormatFastly)
+	assertUsage(t, got, []Usage{{Host: "app.example.com", WindowStart: hour, Bytes: 42, Requests: 1}})
+}
+
+func TestPathCounterTop(t *testing.T) {
+	src := NewDirSource("testdata")
+	counter := NewPathCounter()
+	for _, fixture := range []struct{ key, format string }{
+		{"cloudflare.ndjson", FormatCloudflare},
+		{"fastly.json", FormatFastly},
+		{"w3c.log", FormatW3C},
+	} {
+		parse, _ := ParserFor(fixture.format)
+		rc, err := OpenRecords(context.Background(), src, fixture.key)
+		if err != nil {
+			t.Fatalf("open %s: %v", fixture.key, err)
+		}
+		if _, err := parse(rc, counter.Add); err != nil {
+			t.Fatalf("parse %s: %v", fixture.key, err)
+		}
+		rc.Close()
+	}
+
+	if hosts := counter.Hosts(); len(hosts) != 2 || hosts[0] != "app.example.com" || hosts[1] != "www.example.com" {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+	top := counter.Top("app.example.com", 2)
+	if len(top) != 2 || top[0] != (PathHits{Path: "/index.html", Hits: 3}) || top[1] != (PathHits{Path: "/app.js", Hits: 1}) {
+		t.Fatalf("unexpected top paths %+v", top)
+	}
+	if top := counter.Top("www.example.com", 10); len(top) != 1 || top[0].Path != "/a.css" {
+		t.Fatalf("unexpected www paths %+v", top)
+	}
+}
@@ -0,0 +1,11 @@
+-- Per-service DNS TTL settings applied by the dns-operator
+
+CREATE TABLE service_dns_settings (
+    service_id        BIGINT PRIMARY KEY REFERENCES services(id) ON DELETE CASCADE,
+    ttl_seconds       INTEGER NOT NULL DEFAULT 300,
+    storm_ttl_seconds INTEGER NOT NULL DEFAULT 30,
+    prestorm_margin   DOUBLE PRECISION NOT NULL DEFAULT 0.05,
+    updated_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT service_dns_settings_ttl CHECK (ttl_seconds > 0 AND storm_ttl_seconds > 0),
+    CONSTRAINT service_dns_settings_margin CHECK (prestorm_margin >= 0 AND prestorm_margin < 1)
+);
@@ -0,0 +1,8 @@
+-- Per-domain DNS routing strategy (weighted records or Route53 failover records)
+
+ALTER TABLE service_domains
+    ADD COLUMN routing_strategy TEXT NOT NULL DEFAULT 'weighted';
+
+ALTER TABLE service_domains
+    ADD CONSTRAINT service_domains_routing_strategy
+    CHECK (routing_strategy IN ('weighted', 'failover'));
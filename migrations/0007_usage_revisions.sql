@@ -0,0 +1,23 @@
+-- Late usage for already-invoiced windows is recorded as a revision and billed as an
+-- adjustment line item on a later invoice, so issued invoices are never rewritten.
+
+CREATE TABLE usage_revisions (
+    id            BIGSERIAL PRIMARY KEY,
+    snapshot_id   BIGINT NOT NULL REFERENCES usage_snapshots(id) ON DELETE CASCADE,
+    primary_bytes BIGINT NOT NULL,
+    backup_bytes  BIGINT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    settled_at    TIMESTAMPTZ,
+    invoice_id    BIGINT REFERENCES invoices(id)
+);
+
+CREATE INDEX idx_usage_revisions_snapshot ON usage_revisions (snapshot_id, id DESC);
+
+CREATE INDEX idx_usage_revisions_unsettled
+    ON usage_revisions (snapshot_id)
+    WHERE settled_at IS NULL;
+
+ALTER TABLE invoice_line_items
+    ADD COLUMN kind TEXT NOT NULL DEFAULT 'usage',
+    ADD COLUMN adjusts_invoice_id BIGINT REFERENCES invoices(id),
+    ADD CONSTRAINT invoice_line_items_kind CHECK (kind IN ('usage', 'adjustment'));
@@ -0,0 +1,13 @@
+-- Log files already folded into usage_snapshots by log-based ingestion. A file's row is
+-- written in the same transaction as its byte counts, so each file is counted exactly once.
+
+CREATE TABLE usage_log_files (
+    source       TEXT NOT NULL,
+    object_key   TEXT NOT NULL,
+    size_bytes   BIGINT NOT NULL,
+    etag         TEXT NOT NULL DEFAULT '',
+    records      BIGINT NOT NULL,
+    skipped      BIGINT NOT NULL,
+    processed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (source, object_key)
+);
@@ -0,0 +1,17 @@
+-- Request counts and an optional per-region breakdown for usage. regions maps a region or
+-- price zone (as reported by the CDN) to its share of the totals; traffic not attributed to
+-- any region is billed at the base rates.
+
+ALTER TABLE usage_snapshots
+    ADD COLUMN primary_requests BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN backup_requests  BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN regions          JSONB NOT NULL DEFAULT '{}';
+
+ALTER TABLE usage_revisions
+    ADD COLUMN primary_requests BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN backup_requests  BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN regions          JSONB NOT NULL DEFAULT '{}';
+
+ALTER TABLE invoice_line_items
+    ADD COLUMN primary_requests BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN backup_requests  BIGINT NOT NULL DEFAULT 0;
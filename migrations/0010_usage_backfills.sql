@@ -0,0 +1,17 @@
+-- Progress of usage backfill jobs. job_key encodes the range, window and service filter, so
+-- re-running the same backfill resumes from cursor_at.
+
+CREATE TABLE usage_backfills (
+    job_key      TEXT PRIMARY KEY,
+    range_start  TIMESTAMPTZ NOT NULL,
+    range_end    TIMESTAMPTZ NOT NULL,
+    services     TEXT NOT NULL DEFAULT '',
+    cursor_at    TIMESTAMPTZ NOT NULL,
+    filled       BIGINT NOT NULL DEFAULT 0,
+    present      BIGINT NOT NULL DEFAULT 0,
+    empty        BIGINT NOT NULL DEFAULT 0,
+    started_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ,
+    CONSTRAINT usage_backfill_range CHECK (range_end > range_start)
+);
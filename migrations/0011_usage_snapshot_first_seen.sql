@@ -0,0 +1,10 @@
+-- When each usage window was first recorded. created_at moves forward on every re-fetch, so
+-- ingestion lateness is measured against first_seen_at instead.
+
+ALTER TABLE usage_snapshots ADD COLUMN first_seen_at TIMESTAMPTZ;
+
+UPDATE usage_snapshots SET first_seen_at = created_at;
+
+ALTER TABLE usage_snapshots
+    ALTER COLUMN first_seen_at SET NOT NULL,
+    ALTER COLUMN first_seen_at SET DEFAULT NOW();
@@ -0,0 +1,10 @@
+-- Requests per service path and day, counted from ingested access logs. The cache pre-warmer
+-- reads each service's busiest recent paths from here.
+
+CREATE TABLE service_path_hits (
+    service_id  BIGINT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+    day         DATE NOT NULL,
+    path        TEXT NOT NULL,
+    hits        BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (service_id, day, path)
+);
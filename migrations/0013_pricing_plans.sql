@@ -0,0 +1,36 @@
+-- Per-customer pricing. A plan prices primary and backup bytes separately; tiers lower
+-- those rates once a customer's monthly volume passes from_gb. customer_plans assigns a
+-- plan from effective_from until the customer's next assignment; customers without one are
+-- billed at the global rates.
+
+CREATE TABLE pricing_plans (
+    id                        BIGSERIAL PRIMARY KEY,
+    name                      TEXT NOT NULL UNIQUE,
+    primary_rate_cents_per_gb BIGINT NOT NULL,
+    backup_rate_cents_per_gb  BIGINT NOT NULL,
+    tiers                     JSONB NOT NULL DEFAULT '[]',
+    minimum_monthly_cents     BIGINT NOT NULL DEFAULT 0,
+    storm_discount_rate       DOUBLE PRECISION NOT NULL DEFAULT 0,
+    created_at                TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at                TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT pricing_plans_rates CHECK (primary_rate_cents_per_gb >= 0 AND backup_rate_cents_per_gb >= 0),
+    CONSTRAINT pricing_plans_minimum CHECK (minimum_monthly_cents >= 0),
+    CONSTRAINT pricing_plans_discount CHECK (storm_discount_rate >= 0 AND storm_discount_rate <= 1)
+);
+
+CREATE TABLE customer_plans (
+    id             BIGSERIAL PRIMARY KEY,
+    customer_id    BIGINT NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    plan_id        BIGINT NOT NULL REFERENCES pricing_plans(id),
+    effective_from TIMESTAMPTZ NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT customer_plans_effective UNIQUE (customer_id, effective_from)
+);
+
+-- A month's shortfall against the plan minimum is billed as a minimum_commit line item,
+-- which belongs to the customer rather than a service.
+ALTER TABLE invoice_line_items
+    ALTER COLUMN service_id DROP NOT NULL,
+    DROP CONSTRAINT invoice_line_items_kind,
+    ADD CONSTRAINT invoice_line_items_kind CHECK (kind IN ('usage', 'adjustment', 'minimum_commit')),
+    ADD CONSTRAINT invoice_line_items_service CHECK (service_id IS NOT NULL OR kind = 'minimum_commit');
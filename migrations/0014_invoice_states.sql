@@ -0,0 +1,82 @@
+-- Monthly invoicing. Usage accumulates on one draft invoice per customer and billing
+-- period, which starts on the customer's anchor day in their timezone. Drafts are finalized
+-- after the period closes; from then on an invoice can only be voided or marked paid.
+
+ALTER TABLE customers
+    ADD COLUMN billing_timezone   TEXT NOT NULL DEFAULT 'UTC',
+    ADD COLUMN billing_anchor_day SMALLINT NOT NULL DEFAULT 1,
+    ADD CONSTRAINT customers_billing_anchor_day CHECK (billing_anchor_day BETWEEN 1 AND 28);
+
+-- Invoices issued before this migration were final the moment they were created.
+ALTER TABLE invoices
+    ADD COLUMN status       TEXT NOT NULL DEFAULT 'finalized',
+    ADD COLUMN finalized_at TIMESTAMPTZ,
+    ADD COLUMN paid_at      TIMESTAMPTZ,
+    ADD CONSTRAINT invoices_status CHECK (status IN ('draft', 'finalized', 'void', 'paid'));
+
+UPDATE invoices SET finalized_at = created_at;
+
+ALTER TABLE invoices ALTER COLUMN status SET DEFAULT 'draft';
+
+CREATE UNIQUE INDEX idx_invoices_open_draft
+    ON invoices (customer_id, period_start)
+    WHERE status = 'draft';
+
+CREATE INDEX idx_invoices_draft_period_end
+    ON invoices (period_end)
+    WHERE status = 'draft';
+
+CREATE FUNCTION guard_invoice_change() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    IF OLD.status = 'draft' THEN
+        IF TG_OP = 'DELETE' THEN
+            RETURN OLD;
+        END IF;
+        RETURN NEW;
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RAISE EXCEPTION 'invoice % is %; only drafts can be deleted', OLD.id, OLD.status;
+    END IF;
+    IF NEW.customer_id <> OLD.customer_id
+        OR NEW.period_start <> OLD.period_start
+        OR NEW.period_end <> OLD.period_end
+        OR NEW.subtotal_cents <> OLD.subtotal_cents
+        OR NEW.discount_cents <> OLD.discount_cents
+        OR NEW.total_cents <> OLD.total_cents
+        OR NEW.finalized_at IS DISTINCT FROM OLD.finalized_at THEN
+        RAISE EXCEPTION 'invoice % is %; only drafts can change', OLD.id, OLD.status;
+    END IF;
+    IF NEW.status <> OLD.status AND NOT (OLD.status = 'finalized' AND NEW.status IN ('void', 'paid')) THEN
+        RAISE EXCEPTION 'invoice % cannot move from % to %', OLD.id, OLD.status, NEW.status;
+    END IF;
+    RETURN NEW;
+END;
+$$;
+
+CREATE TRIGGER invoices_guard
+    BEFORE UPDATE OR DELETE ON invoices
+    FOR EACH ROW EXECUTE FUNCTION guard_invoice_change();
+
+-- Line items can only change while their invoice is a draft. Cascaded deletes of a draft
+-- no longer see the invoice row.
+CREATE FUNCTION guard_invoice_line_item_change() RETURNS trigger LANGUAGE plpgsql AS $$
+DECLARE
+    invoice_status TEXT;
+BEGIN
+    SELECT status INTO invoice_status
+    FROM invoices
+    WHERE id = CASE WHEN TG_OP = 'DELETE' THEN OLD.invoice_id ELSE NEW.invoice_id END;
+    IF invoice_status IS NOT NULL AND invoice_status <> 'draft' THEN
+        RAISE EXCEPTION 'invoice % is %; its line items cannot change',
+            CASE WHEN TG_OP = 'DELETE' THEN OLD.invoice_id ELSE NEW.invoice_id END, invoice_status;
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$;
+
+CREATE TRIGGER invoice_line_items_guard
+    BEFORE INSERT OR UPDATE OR DELETE ON invoice_line_items
+    FOR EACH ROW EXECUTE FUNCTION guard_invoice_line_item_change();
@@ -0,0 +1,37 @@
+-- SLA credits. A pricing plan can carry an SLA whose tiers credit a share of a service's
+-- charges for a billing period when its measured availability falls below the tier.
+-- sla_results records each service's measured availability and credit when its invoice is
+-- finalized.
+
+CREATE TABLE sla_definitions (
+    id         BIGSERIAL PRIMARY KEY,
+    name       TEXT NOT NULL UNIQUE,
+    tiers      JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE pricing_plans
+    ADD COLUMN sla_definition_id BIGINT REFERENCES sla_definitions(id);
+
+CREATE TABLE sla_results (
+    id                   BIGSERIAL PRIMARY KEY,
+    invoice_id           BIGINT NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    service_id           BIGINT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+    sla_definition_id    BIGINT NOT NULL REFERENCES sla_definitions(id),
+    period_start         TIMESTAMPTZ NOT NULL,
+    period_end           TIMESTAMPTZ NOT NULL,
+    availability_percent DOUBLE PRECISION NOT NULL,
+    down_minutes         BIGINT NOT NULL,
+    total_minutes        BIGINT NOT NULL,
+    credit_percent       DOUBLE PRECISION NOT NULL,
+    credit_cents         BIGINT NOT NULL,
+    created_at           TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT sla_results_invoice_service UNIQUE (invoice_id, service_id)
+);
+
+CREATE INDEX idx_sla_results_service ON sla_results (service_id, period_start DESC);
+
+ALTER TABLE invoice_line_items
+    DROP CONSTRAINT invoice_line_items_kind,
+    ADD CONSTRAINT invoice_line_items_kind CHECK (kind IN ('usage', 'adjustment', 'minimum_commit', 'sla_credit'));
@@ -0,0 +1,31 @@
+-- Export of finalized invoices to a payment processor. Invoices track their sync status
+-- and the processor's invoice ID; each line item pushed is recorded as soon as the
+-- processor accepts it, so a retried export never creates it twice.
+
+ALTER TABLE customers
+    ADD COLUMN external_customer_id TEXT;
+
+ALTER TABLE invoices
+    ADD COLUMN export_status          TEXT NOT NULL DEFAULT 'pending',
+    ADD COLUMN external_id            TEXT,
+    ADD COLUMN export_attempts        INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN export_error           TEXT,
+    ADD COLUMN export_next_attempt_at TIMESTAMPTZ,
+    ADD COLUMN exported_at            TIMESTAMPTZ,
+    ADD CONSTRAINT invoices_export_status CHECK (export_status IN ('pending', 'synced', 'failed', 'skipped'));
+
+-- Invoices issued before exports existed were keyed into the processor by hand.
+UPDATE invoices SET export_status = 'skipped' WHERE status <> 'draft';
+
+CREATE INDEX idx_invoices_export_due
+    ON invoices (export_next_attempt_at NULLS FIRST, id)
+    WHERE export_status = 'pending' AND status IN ('finalized', 'paid');
+
+CREATE TABLE invoice_line_item_exports (
+    line_item_id BIGINT PRIMARY KEY REFERENCES invoice_line_items(id) ON DELETE CASCADE,
+    invoice_id   BIGINT NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    external_id  TEXT NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_invoice_line_item_exports_invoice ON invoice_line_item_exports (invoice_id);
@@ -0,0 +1,64 @@
+-- Exact money. Line items and invoices keep their amounts in millionths of a cent
+-- (micros) so sub-cent charges add up; the *_cents columns hold the amounts rounded for
+-- display. Pricing plans and invoices carry a currency, and each customer has one draft per
+-- billing period and currency.
+
+ALTER TABLE pricing_plans
+    ADD COLUMN currency TEXT NOT NULL DEFAULT 'usd',
+    ADD CONSTRAINT pricing_plans_currency CHECK (currency ~ '^[a-z]{3}$');
+
+ALTER TABLE invoices
+    ADD COLUMN currency        TEXT NOT NULL DEFAULT 'usd',
+    ADD COLUMN subtotal_micros BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN discount_micros BIGINT NOT NULL DEFAULT 0,
+    ADD CONSTRAINT invoices_currency CHECK (currency ~ '^[a-z]{3}$');
+
+UPDATE invoices
+SET subtotal_micros = subtotal_cents * 1000000,
+    discount_micros = discount_cents * 1000000;
+
+ALTER TABLE invoice_line_items
+    ADD COLUMN amount_micros   BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN discount_micros BIGINT NOT NULL DEFAULT 0;
+
+-- Backfilling finalized invoices' line items is the one change the guard must let through.
+ALTER TABLE invoice_line_items DISABLE TRIGGER invoice_line_items_guard;
+UPDATE invoice_line_items
+SET amount_micros = amount_cents * 1000000,
+    discount_micros = discount_cents * 1000000;
+ALTER TABLE invoice_line_items ENABLE TRIGGER invoice_line_items_guard;
+
+DROP INDEX idx_invoices_open_draft;
+CREATE UNIQUE INDEX idx_invoices_open_draft
+    ON invoices (customer_id, period_start, currency)
+    WHERE status = 'draft';
+
+CREATE OR REPLACE FUNCTION guard_invoice_change() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    IF OLD.status = 'draft' THEN
+        IF TG_OP = 'DELETE' THEN
+            RETURN OLD;
+        END IF;
+        RETURN NEW;
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RAISE EXCEPTION 'invoice % is %; only drafts can be deleted', OLD.id, OLD.status;
+    END IF;
+    IF NEW.customer_id <> OLD.customer_id
+        OR NEW.period_start <> OLD.period_start
+        OR NEW.period_end <> OLD.period_end
+        OR NEW.currency <> OLD.currency
+        OR NEW.subtotal_cents <> OLD.subtotal_cents
+        OR NEW.discount_cents <> OLD.discount_cents
+        OR NEW.total_cents <> OLD.total_cents
+        OR NEW.subtotal_micros <> OLD.subtotal_micros
+        OR NEW.discount_micros <> OLD.discount_micros
+        OR NEW.finalized_at IS DISTINCT FROM OLD.finalized_at THEN
+        RAISE EXCEPTION 'invoice % is %; only drafts can change', OLD.id, OLD.status;
+    END IF;
+    IF NEW.status <> OLD.status AND NOT (OLD.status = 'finalized' AND NEW.status IN ('void', 'paid')) THEN
+        RAISE EXCEPTION 'invoice % cannot move from % to %', OLD.id, OLD.status, NEW.status;
+    END IF;
+    RETURN NEW;
+END;
+$$;
@@ -0,0 +1,57 @@
+-- Voiding invoices. A voided invoice's usage is released and billed again at current
+-- pricing on a replacement invoice that points back at it; each void is recorded with its
+-- reason and the totals before and after.
+
+ALTER TABLE invoices
+    ADD COLUMN replaces_invoice_id BIGINT REFERENCES invoices(id);
+
+CREATE TABLE invoice_voids (
+    id                     BIGSERIAL PRIMARY KEY,
+    invoice_id             BIGINT NOT NULL UNIQUE REFERENCES invoices(id),
+    replacement_invoice_id BIGINT NOT NULL REFERENCES invoices(id),
+    reason                 TEXT NOT NULL CHECK (reason <> ''),
+    previous_status        TEXT NOT NULL,
+    released_snapshots     INTEGER NOT NULL,
+    released_revisions     INTEGER NOT NULL,
+    old_subtotal_cents     BIGINT NOT NULL,
+    old_discount_cents     BIGINT NOT NULL,
+    old_total_cents        BIGINT NOT NULL,
+    new_subtotal_cents     BIGINT NOT NULL,
+    new_discount_cents     BIGINT NOT NULL,
+    new_total_cents        BIGINT NOT NULL,
+    created_at             TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_invoices_replaces ON invoices (replaces_invoice_id) WHERE replaces_invoice_id IS NOT NULL;
+
+-- An issued replacement keeps pointing at the invoice it replaces.
+CREATE OR REPLACE FUNCTION guard_invoice_change() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    IF OLD.status = 'draft' THEN
+        IF TG_OP = 'DELETE' THEN
+            RETURN OLD;
+        END IF;
+        RETURN NEW;
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RAISE EXCEPTION 'invoice % is %; only drafts can be deleted', OLD.id, OLD.status;
+    END IF;
+    IF NEW.customer_id <> OLD.customer_id
+        OR NEW.period_start <> OLD.period_start
+        OR NEW.period_end <> OLD.period_end
+        OR NEW.currency <> OLD.currency
+        OR NEW.subtotal_cents <> OLD.subtotal_cents
+        OR NEW.discount_cents <> OLD.discount_cents
+        OR NEW.total_cents <> OLD.total_cents
+        OR NEW.subtotal_micros <> OLD.subtotal_micros
+        OR NEW.discount_micros <> OLD.discount_micros
+        OR NEW.replaces_invoice_id IS DISTINCT FROM OLD.replaces_invoice_id
+        OR NEW.finalized_at IS DISTINCT FROM OLD.finalized_at THEN
+        RAISE EXCEPTION 'invoice % is %; only drafts can change', OLD.id, OLD.status;
+    END IF;
+    IF NEW.status <> OLD.status AND NOT (OLD.status = 'finalized' AND NEW.status IN ('void', 'paid')) THEN
+        RAISE EXCEPTION 'invoice % cannot move from % to %', OLD.id, OLD.status, NEW.status;
+    END IF;
+    RETURN NEW;
+END;
+$$;
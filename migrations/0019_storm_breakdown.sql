@@ -0,0 +1,19 @@
+-- Storm discounts priced from traffic that actually moved. The dns-operator records every
+-- change of the weights it applies to a domain, and each line item keeps how its discount
+-- splits across the storms that moved its backup traffic.
+
+CREATE TABLE dns_weight_changes (
+    id             BIGSERIAL PRIMARY KEY,
+    service_id     BIGINT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+    domain         TEXT NOT NULL,
+    primary_weight INTEGER NOT NULL CHECK (primary_weight >= 0),
+    backup_weight  INTEGER NOT NULL CHECK (backup_weight >= 0),
+    applied_at     TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_dns_weight_changes_service ON dns_weight_changes (service_id, applied_at);
+CREATE INDEX idx_dns_weight_changes_domain ON dns_weight_changes (service_id, domain, applied_at DESC);
+
+-- Line items billed before this have no breakdown.
+ALTER TABLE invoice_line_items
+    ADD COLUMN storm_breakdown JSONB NOT NULL DEFAULT '[]';
@@ -0,0 +1,7 @@
+-- Log objects rewritten in place. Each processed file keeps what it added to usage_snapshots,
+-- so a new version (different etag or size) can replace the old one's counts instead of
+-- adding to them.
+
+-- Files processed before this have no record of their counts.
+ALTER TABLE usage_log_files
+    ADD COLUMN usage JSONB NOT NULL DEFAULT '[]';
@@ -0,0 +1,11 @@
+-- The range of windows the API ingestor has fetched for each service without a failure. A
+-- window in it without a snapshot had no traffic, rather than being missing. Ranges only
+-- grow by fetches that overlap or touch them, so a gap left by an outage stays visible
+-- until it is backfilled.
+
+CREATE TABLE usage_ingest_coverage (
+    service_id      BIGINT PRIMARY KEY REFERENCES services(id) ON DELETE CASCADE,
+    covered_from    TIMESTAMPTZ NOT NULL,
+    covered_through TIMESTAMPTZ NOT NULL,
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
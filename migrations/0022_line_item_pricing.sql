@@ -0,0 +1,7 @@
+-- Revisions of an invoiced window are priced at the rates the window was first billed at,
+-- not at whatever the rates are by the time the revision arrives. Each line item keeps the
+-- currency, rates, plan and volume offset it was priced with.
+
+-- Line items billed before this have no pricing; revisions of them use the current rates.
+ALTER TABLE invoice_line_items
+    ADD COLUMN pricing JSONB;
@@ -0,0 +1,19 @@
+-- Voided finalized invoices are voided at the payment processor as well, through the same
+-- export queue. Invoices voided before this were left open there if they had been pushed.
+
+DROP INDEX idx_invoices_export_due;
+
+CREATE INDEX idx_invoices_export_due
+    ON invoices (export_next_attempt_at NULLS FIRST, id)
+    WHERE export_status = 'pending'
+      AND (status IN ('finalized', 'paid') OR (status = 'void' AND finalized_at IS NOT NULL));
+
+UPDATE invoices
+SET export_status = 'pending',
+    export_attempts = 0,
+    export_error = NULL,
+    export_next_attempt_at = NULL
+WHERE status = 'void'
+  AND finalized_at IS NOT NULL
+  AND external_id IS NOT NULL
+  AND export_status IN ('synced', 'failed');